@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jakebailey/twitchmqtt/pkg/bridge"
+	flags "github.com/jessevdk/go-flags"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var errConfigExists = errors.New("config already exists, use --force to overwrite")
+
+func addCommands(parser *flags.Parser) {
+	commands := []struct {
+		name, short, long string
+		data              interface{}
+	}{
+		{"run", "Run the bridge", "Run the bridge. This is the default if no command is given.", &runCommand{}},
+		{"validate", "Validate the config", "Parse and validate the config without connecting to anything.", &validateCommand{}},
+		{"setup", "Write a config", "Write a config file for the connection given by --nick, --pass, --channels, --pub-topic, and --sub-topic.", &setupCommand{}},
+		{"send", "Send a chat message", "Publish a chat message to a connection's subscribe topic.", &sendCommand{}},
+		{"tail", "Print messages on a topic", "Subscribe to a topic and print each payload on its own line.", &tailCommand{}},
+		{"replay", "Publish recorded messages", "Publish payloads, one per line, as printed by tail.", &replayCommand{}},
+		{"selftest", "Test the config against fakes", "Run each connection against an in-memory IRC server and MQTT broker, checking that chat is published and sent, and exit nonzero if any check fails.", &selfTestCommand{}},
+		{"version", "Print the version", "Print the version.", &versionCommand{}},
+	}
+
+	for _, c := range commands {
+		if _, err := parser.AddCommand(c.name, c.short, c.long, c.data); err != nil {
+			panic(err)
+		}
+	}
+}
+
+type runCommand struct{}
+
+func (*runCommand) Execute([]string) error {
+	if args.ErrorWindow <= 0 {
+		return errors.New("error window must be positive")
+	}
+
+	if args.ReadOnly && args.WriteOnly {
+		return errors.New("read-only and write-only are mutually exclusive")
+	}
+
+	if args.MQTTStoreDir != "" && args.MQTT5 {
+		return errors.New("the MQTT store directory is not supported with MQTT 5")
+	}
+
+	if args.Connection.set() && args.WatchConfig {
+		return errors.New("there is no config file to watch when the connection is given by flags")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	commit, _ := buildInfo()
+	logger.Info().Str("version", bridge.Version).Str("commit", commit).Msg("starting")
+
+	opts := append(mqttOptions(),
+		bridge.WithClientID(clientID(config)),
+		bridge.WithStoreDir(args.MQTTStoreDir),
+		bridge.WithAvailabilityTopic(args.AvailabilityTopic),
+		bridge.WithDrainTimeout(args.DrainTimeout),
+		bridge.WithConfigFormat(args.ConfigFormat),
+		bridge.WithDryRun(args.DryRun),
+		bridge.WithReadOnly(args.ReadOnly),
+		bridge.WithWriteOnly(args.WriteOnly),
+	)
+
+	mqttCtx, cancelMQTT := context.WithCancel(context.Background())
+	defer cancelMQTT()
+
+	client, err := bridge.Connect(mqttCtx, config.Brokers, opts...)
+	if err != nil {
+		return err
+	}
+	// Let in-flight publishes finish once the connections have drained.
+	defer client.Disconnect(250)
+
+	stop := make(chan struct{})
+
+	if args.Buffer.Dir != "" {
+		if client, err = bridge.Buffer(client, args.Buffer.Dir, args.Buffer.MaxBytes, args.Buffer.MaxAge, stop); err != nil {
+			return err
+		}
+	}
+
+	go bridge.AggregateErrors(args.ErrorWindow, stop)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer cancel()
+
+	b := bridge.New(ctx, client, opts...)
+	b.Apply(config)
+
+	if args.HTTPAddr != "" {
+		if err := serveHTTP(args.HTTPAddr, client, b); err != nil {
+			return err
+		}
+	}
+
+	go notifySystemd(client, b, stop)
+
+	var changed <-chan struct{}
+	if args.WatchConfig {
+		if changed, err = watchConfig(args.ConfigPath, stop); err != nil {
+			return err
+		}
+	}
+
+	// Notifying of no signals would notify of all of them.
+	hup := make(chan os.Signal, 1)
+	if len(reloadSignals) > 0 {
+		signal.Notify(hup, reloadSignals...)
+	}
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-hup:
+			if args.Connection.set() {
+				logger.Warn().Msg("not reloading, the connection is given by flags")
+				continue
+			}
+			b.Reload(args.ConfigPath)
+		case <-changed:
+			b.Reload(args.ConfigPath)
+		}
+	}
+
+	signal.Stop(hup)
+
+	logger.Info().Dur("drain_timeout", args.DrainTimeout).Msg("shutting down")
+	if err := sdNotify("STOPPING=1"); err != nil {
+		logger.Error().Err(err).Msg("notifying systemd")
+	}
+	b.Stop()
+	close(stop)
+
+	return nil
+}
+
+// connectionFlags describe a single connection, to run without a config
+// file.
+type connectionFlags struct {
+	Nick     string   `long:"nick" env:"TWITCH_NICK" description:"Twitch username"`
+	Pass     string   `long:"pass" env:"TWITCH_PASS" description:"Twitch OAuth token, starting with oauth:, or empty to read anonymously"`
+	Channels []string `long:"channels" env:"TWITCH_CHANNELS" env-delim:"," description:"channels to join and publish, comma separated or repeated"`
+	PubTopic string   `long:"pub-topic" env:"PUB_TOPIC" description:"topic to publish chat to"`
+	SubTopic string   `long:"sub-topic" env:"SUB_TOPIC" description:"topic to read outgoing messages from"`
+}
+
+// set reports whether a connection was given, replacing the config file.
+func (f *connectionFlags) set() bool {
+	return f.Nick != "" || f.Pass != "" || len(f.Channels) > 0 || f.PubTopic != "" || f.SubTopic != ""
+}
+
+// config returns a validated config running the connection.
+func (f *connectionFlags) config() (*bridge.Config, error) {
+	c := &bridge.Connection{
+		Nick: f.Nick,
+		Pass: f.Pass,
+	}
+	c.Publish.Topic = f.PubTopic
+	c.Subscribe.Topic = f.SubTopic
+
+	for _, ch := range f.Channels {
+		for _, ch := range strings.Split(ch, ",") {
+			if ch = strings.TrimSpace(ch); ch != "" {
+				c.Publish.Channels = append(c.Publish.Channels, ch)
+			}
+		}
+	}
+
+	config := &bridge.Config{Connections: []*bridge.Connection{c}}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// loadConfig returns the connection given by flags if there is one, and
+// otherwise loads the config file.
+func loadConfig() (*bridge.Config, error) {
+	if args.Connection.set() {
+		return args.Connection.config()
+	}
+	return bridge.LoadConfigFormat(args.ConfigPath, args.ConfigFormat)
+}
+
+// mqttOptions returns the options for connecting to MQTT given by the
+// flags.
+func mqttOptions() []bridge.Option {
+	return []bridge.Option{
+		bridge.WithBroker(&bridge.Broker{
+			URL:   args.MQTTBroker,
+			TLS:   bridge.BrokerTLS(args.MQTTTLS),
+			Proxy: args.MQTTProxy,
+		}),
+		bridge.WithMQTT5(args.MQTT5),
+		bridge.WithCleanSession(args.MQTTCleanSession),
+		bridge.WithFailoverAfter(args.FailoverAfter),
+	}
+}
+
+// clientID returns the client ID the bridge connects with, so its session
+// survives restarts. It is taken from the flags, then the config, and
+// otherwise derived from the host name and the config's path (or the nick,
+// without a config file), so that bridges running different configs on one
+// host don't share a session.
+func clientID(config *bridge.Config) string {
+	if args.MQTTClientID != "" {
+		return args.MQTTClientID
+	}
+	if config.ClientID != "" {
+		return config.ClientID
+	}
+
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+
+	path := args.ConfigPath
+	if args.Connection.set() {
+		path = "nick:" + args.Connection.Nick
+	} else if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	sum := sha256.Sum256([]byte(path))
+
+	return "twitchmqtt-" + host + "-" + hex.EncodeToString(sum[:4])
+}
+
+type validateCommand struct{}
+
+func (*validateCommand) Execute([]string) error {
+	if _, err := loadConfig(); err != nil {
+		return err
+	}
+
+	fmt.Println("config OK")
+	return nil
+}
+
+type selfTestCommand struct {
+	Timeout time.Duration `long:"timeout" default:"10s" description:"how long to wait for each check"`
+}
+
+func (s *selfTestCommand) Execute([]string) error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if err := bridge.SelfTest(config, s.Timeout); err != nil {
+		return err
+	}
+
+	fmt.Println("self-test OK")
+	return nil
+}
+
+type setupCommand struct {
+	Force bool `long:"force" description:"overwrite an existing config"`
+}
+
+// Execute writes the connection given by the single connection flags to
+// the config file.
+func (s *setupCommand) Execute([]string) error {
+	if args.Connection.Nick == "" {
+		return errors.New("--nick is required")
+	}
+
+	if !s.Force {
+		if _, err := os.Stat(args.ConfigPath); err == nil {
+			return errConfigExists
+		}
+	}
+
+	config, err := args.Connection.config()
+	if err != nil {
+		return err
+	}
+
+	b, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(args.ConfigPath, b, 0600); err != nil {
+		return err
+	}
+
+	fmt.Println("wrote", args.ConfigPath)
+	return nil
+}
+
+type sendCommand struct {
+	Topic   string `long:"topic" required:"true" description:"subscribe topic of the connection to send with"`
+	Channel string `long:"channel" required:"true" description:"channel to send to"`
+	QOS     byte   `long:"qos" description:"QOS to publish at"`
+	ReplyTo string `long:"reply-to" description:"ID of a message to reply to"`
+	Action  bool   `long:"action" description:"send the message as a /me action"`
+
+	Args struct {
+		Message []string `positional-arg-name:"message" required:"1"`
+	} `positional-args:"true"`
+}
+
+func (s *sendCommand) Execute([]string) error {
+	b, err := json.Marshal(struct {
+		Channel          string
+		Message          string
+		ReplyParentMsgID string `json:"reply_parent_msg_id,omitempty"`
+		Action           bool   `json:",omitempty"`
+	}{
+		Channel:          s.Channel,
+		Message:          strings.Join(s.Args.Message, " "),
+		ReplyParentMsgID: s.ReplyTo,
+		Action:           s.Action,
+	})
+	if err != nil {
+		return err
+	}
+
+	client, err := bridge.Connect(context.Background(), nil, mqttOptions()...)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(250)
+
+	t := client.Publish(s.Topic, s.QOS, false, b)
+	t.Wait()
+	return t.Error()
+}
+
+type tailCommand struct {
+	Topic string `long:"topic" required:"true" description:"topic filter to subscribe to"`
+	QOS   byte   `long:"qos" description:"QOS to subscribe at"`
+}
+
+func (tc *tailCommand) Execute([]string) error {
+	client, err := bridge.Connect(context.Background(), nil, mqttOptions()...)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(250)
+
+	var mu sync.Mutex
+
+	if t := client.Subscribe(tc.Topic, tc.QOS, func(_ mqtt.Client, mq mqtt.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Printf("%s\n", mq.Payload())
+	}); t.Wait() && t.Error() != nil {
+		return t.Error()
+	}
+
+	waitForInterrupt()
+	return nil
+}
+
+type replayCommand struct {
+	Topic string        `long:"topic" required:"true" description:"topic to publish to"`
+	QOS   byte          `long:"qos" description:"QOS to publish at"`
+	Delay time.Duration `long:"delay" description:"delay between messages"`
+
+	Args struct {
+		File string `positional-arg-name:"file" description:"file to read, defaults to stdin"`
+	} `positional-args:"true"`
+}
+
+func (r *replayCommand) Execute([]string) error {
+	var in io.Reader = os.Stdin
+
+	if r.Args.File != "" && r.Args.File != "-" {
+		f, err := os.Open(r.Args.File)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	client, err := bridge.Connect(context.Background(), nil, mqttOptions()...)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(250)
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		t := client.Publish(r.Topic, r.QOS, false, append([]byte(nil), line...))
+		if t.Wait() && t.Error() != nil {
+			return t.Error()
+		}
+
+		if r.Delay > 0 {
+			time.Sleep(r.Delay)
+		}
+	}
+
+	return scanner.Err()
+}
+
+type versionCommand struct{}
+
+func (*versionCommand) Execute([]string) error {
+	commit, date := buildInfo()
+	fmt.Println(bridge.Version)
+	if commit != "" {
+		fmt.Println("commit:", commit)
+	}
+	if date != "" {
+		fmt.Println("built:", date)
+	}
+	fmt.Println("go:", runtime.Version())
+	return nil
+}
+
+// buildInfo returns the commit and build date set at build time, falling
+// back to the VCS information recorded by the Go toolchain.
+func buildInfo() (commit, date string) {
+	commit, date = bridge.Commit, bridge.BuildDate
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && commit == "":
+				commit = s.Value
+			case s.Key == "vcs.time" && date == "":
+				date = s.Value
+			}
+		}
+	}
+
+	return commit, date
+}
@@ -1,16 +1,30 @@
 module github.com/jakebailey/twitchmqtt
 
-go 1.12
+go 1.22
 
 require (
-	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/BurntSushi/toml v1.4.0
+	github.com/eclipse/paho.golang v0.12.0
 	github.com/eclipse/paho.mqtt.golang v1.2.0
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/jakebailey/irc v0.0.0-20190407213833-8d2a5d226230
-	github.com/jessevdk/go-flags v1.4.0
+	github.com/jessevdk/go-flags v1.5.0
 	github.com/joho/godotenv v1.3.0
+	github.com/klauspost/compress v1.18.0
+	github.com/rs/zerolog v1.31.0
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	golang.org/x/net v0.17.0
+	google.golang.org/protobuf v1.34.2
+	gopkg.in/yaml.v2 v2.2.2
+)
+
+require (
 	github.com/kr/pretty v0.1.0 // indirect
-	github.com/stretchr/testify v1.3.0 // indirect
-	golang.org/x/net v0.0.0-20190424112056-4829fb13d2c6 // indirect
+	github.com/mattn/go-colorable v0.1.13 // indirect
+	github.com/mattn/go-isatty v0.0.19 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	golang.org/x/sync v0.4.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
-	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,60 @@
+package main
+
+import (
+	_ "expvar" // Serve /debug/vars.
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/jakebailey/twitchmqtt/pkg/bridge"
+)
+
+// serveHTTP serves health checks and metrics on addr.
+//
+// /healthz reports that the process is alive. /readyz additionally reports
+// whether the broker is connected and every connection is connected to IRC
+// and has joined its channels.
+func serveHTTP(addr string, client bridge.BrokerClient, b *bridge.Bridge) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if problems := notReady(client, b); len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+
+	go func() {
+		if err := http.Serve(ln, nil); err != nil {
+			logger.Error().Err(err).Msg("HTTP server")
+		}
+	}()
+
+	return nil
+}
+
+// notReady describes what is keeping the bridge from being ready, if
+// anything.
+func notReady(client bridge.BrokerClient, b *bridge.Bridge) []string {
+	var problems []string
+
+	if !client.IsConnected() {
+		problems = append(problems, "MQTT broker not connected")
+	}
+
+	for _, name := range b.NotReady() {
+		problems = append(problems, "connection "+name+" not ready")
+	}
+
+	return problems
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jakebailey/twitchmqtt/pkg/bridge"
+	"github.com/rs/zerolog"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+var errBadLogFormat = errors.New("log format must be text or json")
+
+// logger is the process-wide logger, shared with the bridge.
+var logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).With().Timestamp().Logger()
+
+// setupLogging configures logger from the logging flags, and sends the
+// bridge's and the standard library's log output through it.
+func setupLogging() error {
+	level := zerolog.InfoLevel
+	if args.LogLevel != "" {
+		var err error
+		if level, err = zerolog.ParseLevel(strings.ToLower(args.LogLevel)); err != nil {
+			return err
+		}
+	}
+
+	if args.Debug {
+		level = zerolog.DebugLevel
+	}
+
+	switch args.LogFormat {
+	case "", logFormatText:
+		logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr})
+	case logFormatJSON:
+		logger = zerolog.New(os.Stderr)
+	default:
+		return errBadLogFormat
+	}
+
+	logger = logger.Level(level).With().Timestamp().Logger()
+	bridge.SetLogger(logger)
+
+	log.SetFlags(0)
+	log.SetOutput(logger)
+
+	return nil
+}
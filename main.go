@@ -1,367 +1,105 @@
 package main
 
 import (
-	"crypto/tls"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
-	"math/rand"
 	"os"
 	"os/signal"
-	"strings"
-	"sync"
-	"syscall"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/jakebailey/irc"
 	flags "github.com/jessevdk/go-flags"
 	"github.com/joho/godotenv"
-	yaml "gopkg.in/yaml.v2"
-)
-
-const twitchIRC = "irc.chat.twitch.tv:6697"
-
-var (
-	errEmptyNick       = errors.New("empty nick")
-	errEmptyPass       = errors.New("empty pass")
-	errNonOauthPass    = errors.New("pass did not start with oauth")
-	errBadTopics       = errors.New("pub and sub topics are the same or empty")
-	errBadQOS          = errors.New("invalid QOS")
-	errChannelsNoTopic = errors.New("channels provided without publish topic")
-	errEmptyChannel    = errors.New("empty channel name")
 )
 
 var args = struct {
-	MQTTBroker string `long:"mqtt-broker" env:"MQTT_BROKER" required:"true"`
-	ConfigPath string `long:"config" env:"CONFIG"`
-	Debug      bool   `long:"debug" env:"DEBUG" description:"enables debug logging"`
-}{
-	ConfigPath: "config.yaml",
-}
-
-type Config struct {
-	Connections []*Connection
-}
+	Version bool `long:"version" description:"print the version and exit"`
 
-func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-
-	if err := godotenv.Load(); err != nil {
-		if !os.IsNotExist(err) {
-			log.Fatal(err)
-		}
-	}
+	MQTTBroker string `long:"mqtt-broker" env:"MQTT_BROKER"`
+	MQTT5      bool   `long:"mqtt5" env:"MQTT5" description:"use MQTT 5, adding user properties to publishes"`
+	MQTTProxy  string `long:"mqtt-proxy" env:"MQTT_PROXY" description:"socks5, socks5h, http, or https URL of a proxy to reach the broker through"`
 
-	if _, err := flags.Parse(&args); err != nil {
-		os.Exit(1)
-	}
+	MQTTClientID     string `long:"mqtt-client-id" env:"MQTT_CLIENT_ID" description:"client ID the bridge connects with, defaulting to one derived from the host name and config path"`
+	MQTTCleanSession bool   `long:"mqtt-clean-session" env:"MQTT_CLEAN_SESSION" description:"start a new MQTT session on every connection instead of resuming the last one"`
+	MQTTStoreDir     string `long:"mqtt-store-dir" env:"MQTT_STORE_DIR" description:"directory to keep in-flight QoS 1 and 2 messages in across restarts, instead of memory (MQTT 3.1.1 only)"`
 
-	b, err := ioutil.ReadFile(args.ConfigPath)
-	if err != nil {
-		log.Fatal(err)
-	}
+	ConfigPath   string `long:"config" env:"CONFIG"`
+	ConfigFormat string `long:"config-format" env:"CONFIG_FORMAT" choice:"yaml" choice:"json" choice:"toml" description:"config format, chosen by extension by default"`
+	WatchConfig  bool   `long:"watch-config" env:"WATCH_CONFIG" description:"reload the config automatically when it changes"`
+	Debug        bool   `long:"debug" env:"DEBUG" description:"enables debug logging"`
 
-	var config Config
-	if err := yaml.Unmarshal(b, &config); err != nil {
-		log.Fatal(err)
-	}
+	LogLevel  string `long:"log-level" env:"LOG_LEVEL" description:"minimum level to log: debug, info, warn, or error"`
+	LogFormat string `long:"log-format" env:"LOG_FORMAT" description:"log format: text or json"`
 
-	exit := false
-	for i, c := range config.Connections {
-		if err := c.validate(); err != nil {
-			log.Println(i, err)
-			exit = true
-		}
-	}
+	HTTPAddr string `long:"http-addr" env:"HTTP_ADDR" description:"address to serve /healthz, /readyz, and /debug/vars on"`
 
-	if exit {
-		os.Exit(1)
-	}
+	AvailabilityTopic string `long:"availability-topic" env:"AVAILABILITY_TOPIC" description:"topic to publish bridge availability to, with an offline will"`
 
-	cOpts := mqtt.NewClientOptions()
-	cOpts.SetClientID(fmt.Sprintf("%d%d", time.Now().UnixNano(), rand.Intn(10)))
-	cOpts.SetCleanSession(false)
-	cOpts.AddBroker(args.MQTTBroker)
-	client := mqtt.NewClient(cOpts)
+	ErrorWindow time.Duration `long:"error-window" env:"ERROR_WINDOW" description:"window over which repeated errors are aggregated"`
 
-	if t := client.Connect(); t.Wait() && t.Error() != nil {
-		log.Fatal(t.Error())
-	}
-	defer client.Disconnect(0)
+	DrainTimeout time.Duration `long:"drain-timeout" env:"DRAIN_TIMEOUT" description:"how long to keep publishing queued messages when shutting down"`
 
-	stop := make(chan struct{})
-	wg := &sync.WaitGroup{}
-	wg.Add(len(config.Connections))
+	DryRun    bool `long:"dry-run" env:"DRY_RUN" description:"log what would be published and sent instead of doing so"`
+	ReadOnly  bool `long:"read-only" env:"READ_ONLY" description:"never send to IRC, regardless of each connection's mode"`
+	WriteOnly bool `long:"write-only" env:"WRITE_ONLY" description:"never publish from IRC, regardless of each connection's mode"`
 
-	for _, c := range config.Connections {
-		go c.run(wg, stop, client)
-	}
+	MQTTTLS struct {
+		CA         string `long:"mqtt-ca" env:"MQTT_CA" description:"CA bundle used to verify the broker"`
+		Cert       string `long:"mqtt-cert" env:"MQTT_CERT" description:"client certificate"`
+		Key        string `long:"mqtt-key" env:"MQTT_KEY" description:"client certificate key"`
+		ServerName string `long:"mqtt-server-name" env:"MQTT_SERVER_NAME" description:"server name to verify the broker's certificate against"`
+		MinVersion string `long:"mqtt-tls-min-version" env:"MQTT_TLS_MIN_VERSION" description:"lowest TLS version to accept, like 1.2"`
+		Insecure   bool   `long:"mqtt-insecure" env:"MQTT_INSECURE" description:"skip verification of the broker's certificate"`
+	} `group:"MQTT TLS"`
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	<-c
+	FailoverAfter time.Duration `long:"mqtt-failover-after" env:"MQTT_FAILOVER_AFTER" description:"how long the broker may be unreachable before failing over to the next configured broker"`
 
-	close(stop)
-	wg.Wait()
-}
+	Connection connectionFlags `group:"Single connection (instead of a config file)"`
 
-type Connection struct {
-	Nick string
-	Pass string
-
-	Publish struct {
-		Topic    string
-		QOS      byte
-		Channels []string
-	}
-
-	Subscribe struct {
-		Topic string
-		QOS   byte
-	}
-}
-
-func (c *Connection) validate() error {
-	if c.Nick == "" {
-		return errEmptyNick
-	}
-
-	if c.Pass == "" {
-		return errEmptyPass
-	}
-
-	if !strings.HasPrefix(c.Pass, "oauth:") {
-		return errNonOauthPass
-	}
-
-	if c.Publish.Topic == c.Subscribe.Topic {
-		return errBadTopics
-	}
-
-	if len(c.Publish.Channels) > 0 && c.Publish.Topic == "" {
-		return errChannelsNoTopic
-	}
-
-	if c.Publish.QOS > 2 || c.Subscribe.QOS > 2 {
-		return errBadQOS
-	}
-
-	for _, s := range c.Publish.Channels {
-		if s == "" {
-			return errEmptyChannel
-		}
-	}
-
-	return nil
+	Buffer struct {
+		Dir      string        `long:"buffer-dir" env:"BUFFER_DIR" description:"directory to buffer publishes in while the broker is unreachable"`
+		MaxBytes int64         `long:"buffer-max-bytes" env:"BUFFER_MAX_BYTES" description:"maximum size of the buffer, 0 for unlimited"`
+		MaxAge   time.Duration `long:"buffer-max-age" env:"BUFFER_MAX_AGE" description:"discard buffered messages older than this, 0 to keep them all"`
+	} `group:"Broker outage buffer"`
+}{
+	ConfigPath:    "config.yaml",
+	ErrorWindow:   time.Minute,
+	DrainTimeout:  5 * time.Second,
+	FailoverAfter: 10 * time.Second,
 }
 
-func (c *Connection) run(wg *sync.WaitGroup, stop <-chan struct{}, client mqtt.Client) {
-	defer wg.Done()
-	var mu sync.Mutex
-
-	conn, err := createIRCConn(c.Nick, c.Pass)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	defer conn.Close()
-
-	if err := join(conn, c.Publish.Channels...); err != nil {
-		log.Fatal(err)
-	}
-
-	go func() {
-		<-stop
-		mu.Lock()
-		defer mu.Unlock()
-		if err := quit(conn); err != nil {
-			log.Fatal(err)
-		}
-	}()
-
-	if c.Subscribe.Topic != "" {
-		log.Printf("subscribing to %s at QOS %d", c.Subscribe.Topic, c.Subscribe.QOS)
-
-		if t := client.Subscribe(c.Subscribe.Topic, c.Subscribe.QOS, func(c mqtt.Client, mq mqtt.Message) {
-			var msg struct {
-				Channel string
-				Message string
-			}
-
-			if err := json.Unmarshal(mq.Payload(), &msg); err != nil {
-				log.Println(err)
-				return
-			}
-
-			if msg.Channel == "" {
-				log.Println("empty channel")
-				return
-			}
-
-			if msg.Channel[0] != '#' {
-				msg.Channel = "#" + msg.Channel
-			}
-
-			if msg.Message == "" {
-				log.Println("empty message")
-				return
-			}
-
-			m := &irc.Message{
-				Command:  "PRIVMSG",
-				Params:   []string{msg.Channel},
-				Trailing: msg.Message,
-			}
-
-			if args.Debug {
-				log.Println("<", m.String())
-			}
-
-			mu.Lock()
-			defer mu.Unlock()
-
-			if err := conn.Encode(m); err != nil {
-				log.Println(err)
-			}
-		}); t.Wait() && t.Error() != nil {
-			log.Fatal(t.Error())
+func main() {
+	if err := godotenv.Load(); err != nil {
+		if !os.IsNotExist(err) {
+			logger.Fatal().Err(err).Msg("loading .env")
 		}
 	}
 
-	if c.Publish.Topic != "" {
-		log.Printf("publishing to %s at QOS %d", c.Publish.Topic, c.Publish.QOS)
-	}
-
-	for {
-		var m irc.Message
-		if err := conn.Decode(&m); err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Fatal(err)
-		}
-
-		if args.Debug {
-			log.Println(">", m.Raw)
-		} else {
-			switch m.Command {
-			case "PRIVMSG", "NOTICE", "USERNOTICE", "PING", "CLEARCHAT", "HOSTTARGET":
-				// Do nothing.
-			default:
-				log.Println(">", m.Raw)
-			}
-		}
-
-		if m.Command == "PING" {
-			m.Command = "PONG"
-			if err := conn.Encode(&m); err != nil {
-				log.Println(err)
-			}
-			continue
+	parser := flags.NewParser(&args, flags.Default)
+	parser.SubcommandsOptional = true
+	parser.CommandHandler = func(cmd flags.Commander, a []string) error {
+		if err := setupLogging(); err != nil {
+			return err
 		}
 
-		if c.Publish.Topic != "" {
-			b, err := json.Marshal(m)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-
-			t := client.Publish(c.Publish.Topic, c.Publish.QOS, false, b)
-			if err := t.Error(); err != nil {
-				log.Println(err)
-			}
+		if args.Version {
+			cmd = &versionCommand{}
 		}
 
-		if m.Command == "RECONNECT" {
-			log.Println("server sent RECONNECT, restarting process")
-			time.Sleep(time.Second)
-			restartProcess()
+		// Running the bridge is the default when no command is given.
+		if cmd == nil {
+			cmd = &runCommand{}
 		}
-	}
-}
 
-func createIRCConn(nick, pass string) (irc.Conn, error) {
-	tconn, err := tls.Dial("tcp", twitchIRC, nil)
-	if err != nil {
-		return nil, err
+		return cmd.Execute(a)
 	}
-	conn := irc.NewBaseConn(tconn)
+	addCommands(parser)
 
-	if err := login(conn, nick, pass); err != nil {
-		return nil, err
-	}
-
-	if err := capReq(conn,
-		"twitch.tv/tags",
-		"twitch.tv/commands",
-	); err != nil {
-		return nil, err
-	}
-
-	return conn, nil
-}
-
-func login(conn irc.Encoder, nick, pass string) error {
-	err := conn.Encode(&irc.Message{
-		Command: "PASS",
-		Params:  []string{pass},
-	})
-	if err != nil {
-		return err
-	}
-
-	return conn.Encode(&irc.Message{
-		Command: "NICK",
-		Params:  []string{nick},
-	})
-}
-
-func capReq(conn irc.Encoder, caps ...string) error {
-	if len(caps) == 0 {
-		return nil
-	}
-
-	return conn.Encode(&irc.Message{
-		Command:  "CAP",
-		Params:   []string{"REQ"},
-		Trailing: strings.Join(caps, " "),
-	})
-}
-
-func join(conn irc.Encoder, channels ...string) error {
-	if len(channels) == 0 {
-		return nil
-	}
-
-	for i, s := range channels {
-		if s[0] != '#' {
-			channels[i] = "#" + s
-		}
+	if _, err := parser.Parse(); err != nil {
+		os.Exit(1)
 	}
-
-	return conn.Encode(&irc.Message{
-		Command: "JOIN",
-		Params:  []string{strings.Join(channels, ",")},
-	})
 }
 
-func quit(conn irc.Encoder) error {
-	return conn.Encode(&irc.Message{
-		Command: "QUIT",
-	})
-}
-
-var (
-	argv0 = os.Args[0]
-	argv  = os.Args
-	envv  = os.Environ()
-)
-
-func restartProcess() {
-	log.Fatal(syscall.Exec(argv0, argv, envv))
+func waitForInterrupt() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, shutdownSignals...)
+	<-c
+	signal.Stop(c)
 }
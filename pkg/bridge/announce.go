@@ -0,0 +1,144 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jakebailey/irc"
+)
+
+// The types of payload on the subscribe topic. Announcements and shoutouts
+// can't be sent over IRC, so are always sent through Helix.
+const (
+	payloadMessage  = "message"
+	payloadAnnounce = "announce"
+	payloadShoutout = "shoutout"
+)
+
+var (
+	errBadPayloadType    = errors.New("payload type must be message, announce, or shoutout")
+	errBadAnnounceColor  = errors.New("announcement color must be blue, green, orange, purple, or primary")
+	errShoutoutNoTarget  = errors.New("shoutout requires a target")
+	errAnnounceNoMessage = errors.New("announcement requires a message")
+)
+
+var announceColors = map[string]bool{
+	"blue":    true,
+	"green":   true,
+	"orange":  true,
+	"purple":  true,
+	"primary": true,
+}
+
+// helixAction is an announcement or shoutout to make in Channel, which
+// has no leading #.
+type helixAction struct {
+	Type    string
+	Channel string
+	Message string
+	Color   string
+	Target  string
+}
+
+// newHelixAction checks an announcement or shoutout from the subscribe
+// topic, returning it along with a chat command standing in for it in logs
+// and rate limiting.
+func newHelixAction(typ, channel, message, color, target string) (*helixAction, *irc.Message, error) {
+	a := &helixAction{Type: typ, Channel: strings.TrimPrefix(channel, "#")}
+	var text string
+
+	switch typ {
+	case payloadAnnounce:
+		a.Message = sanitizeMessage(message)
+		if a.Message == "" {
+			return nil, nil, errAnnounceNoMessage
+		}
+		if utf8.RuneCountInString(a.Message) > maxMessageLength {
+			return nil, nil, errMessageTooLong
+		}
+
+		a.Color = strings.ToLower(color)
+		if a.Color != "" && !announceColors[a.Color] {
+			return nil, nil, errBadAnnounceColor
+		}
+
+		text = "/announce " + a.Message
+		if a.Color != "" && a.Color != "primary" {
+			text = "/announce" + a.Color + " " + a.Message
+		}
+
+	case payloadShoutout:
+		a.Target = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(target)), "@")
+		if a.Target == "" {
+			return nil, nil, errShoutoutNoTarget
+		}
+		if err := checkChannelName(a.Target); err != nil {
+			return nil, nil, err
+		}
+		text = "/shoutout " + a.Target
+
+	default:
+		return nil, nil, fmt.Errorf("%w: %q", errBadPayloadType, typ)
+	}
+
+	m := &irc.Message{
+		Command:  "PRIVMSG",
+		Params:   []string{"#" + a.Channel},
+		Trailing: text,
+	}
+	return a, m, nil
+}
+
+// sendAction makes the item's announcement or shoutout through Helix,
+// publishing the result to the result topic if one is configured.
+func (c *Connection) sendAction(h *helixClient, client MQTTClient, it sendItem) error {
+	a := it.action
+	result := &sendResult{Channel: a.Channel, Message: it.m.Trailing}
+
+	err := func() error {
+		if err := c.checkHelix(); err != nil {
+			return err
+		}
+
+		broadcasterID, err := h.userID(a.Channel)
+		if err != nil {
+			return err
+		}
+
+		moderatorID, err := h.userID(c.Nick)
+		if err != nil {
+			return err
+		}
+
+		if a.Type == payloadAnnounce {
+			return h.sendAnnouncement(broadcasterID, moderatorID, a.Message, a.Color)
+		}
+
+		targetID, err := h.userID(a.Target)
+		if err != nil {
+			return err
+		}
+
+		return h.sendShoutout(broadcasterID, targetID, moderatorID)
+	}()
+
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Sent = true
+	}
+
+	if c.Subscribe.ResultTopic != "" {
+		b, merr := json.Marshal(result)
+		if merr != nil {
+			c.elog.Println(merr)
+		} else if t := client.Publish(c.Subscribe.ResultTopic, it.qos, it.retain, b); t.Error() != nil {
+			c.elog.Printf("send result publish failed: %v", t.Error())
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,62 @@
+package bridge
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultMinDelay = time.Second
+	defaultMaxDelay = 2 * time.Minute
+)
+
+// backoff produces exponentially increasing delays with jitter.
+type backoff struct {
+	min, max time.Duration
+	attempt  uint
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	if min <= 0 {
+		min = defaultMinDelay
+	}
+	if max <= 0 {
+		max = defaultMaxDelay
+	}
+	if max < min {
+		max = min
+	}
+	return &backoff{min: min, max: max}
+}
+
+// next returns the delay before the next attempt, chosen uniformly from
+// the upper half of the current exponential step.
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempt < 32 {
+		if step := b.min << b.attempt; step > 0 && step < b.max {
+			d = step
+		}
+	}
+	b.attempt++
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// sleep waits for d, returning false if stop was closed first.
+func sleep(d time.Duration, stop <-chan struct{}) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
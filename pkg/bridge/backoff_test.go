@@ -0,0 +1,80 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jakebailey/irc"
+)
+
+func TestBackoffGrowsWithJitter(t *testing.T) {
+	b := newBackoff(10*time.Millisecond, 100*time.Millisecond)
+
+	steps := []time.Duration{10, 20, 40, 80, 100, 100}
+	for i, step := range steps {
+		step *= time.Millisecond
+		if d := b.next(); d < step/2 || d > step {
+			t.Errorf("attempt %d: delay %s, want between %s and %s", i, d, step/2, step)
+		}
+	}
+
+	b.reset()
+	if d := b.next(); d < 5*time.Millisecond || d > 10*time.Millisecond {
+		t.Errorf("delay after reset %s, want between 5ms and 10ms", d)
+	}
+}
+
+func TestBackoffDefaults(t *testing.T) {
+	b := newBackoff(0, 0)
+	if b.min != defaultMinDelay || b.max != defaultMaxDelay {
+		t.Errorf("backoff between %s and %s, want %s and %s", b.min, b.max, defaultMinDelay, defaultMaxDelay)
+	}
+
+	b = newBackoff(time.Minute, time.Second)
+	if b.max != time.Minute {
+		t.Errorf("max %s below min, want it raised to %s", b.max, time.Minute)
+	}
+}
+
+func TestDialRetryGivesUp(t *testing.T) {
+	c := newTestConnection()
+	c.Reconnect.MaxAttempts = 3
+	if _, err := newHarness(c); err != nil {
+		t.Fatal(err)
+	}
+
+	errDial := errors.New("dial failed")
+	attempts := 0
+	dial := func(context.Context, string, string) (irc.Conn, error) {
+		attempts++
+		return nil, errDial
+	}
+
+	if _, err := c.dialRetry(context.Background(), dial); err != errDial {
+		t.Errorf("err = %v, want %v", err, errDial)
+	}
+	if attempts != 3 {
+		t.Errorf("dialed %d times, want 3", attempts)
+	}
+}
+
+func TestDialRetryStops(t *testing.T) {
+	c := newTestConnection()
+	c.Reconnect.MinDelay = time.Hour
+	c.Reconnect.MaxDelay = time.Hour
+	if _, err := newHarness(c); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dial := func(context.Context, string, string) (irc.Conn, error) {
+		cancel()
+		return nil, errors.New("dial failed")
+	}
+
+	if _, err := c.dialRetry(ctx, dial); err != errStopped {
+		t.Errorf("err = %v, want %v", err, errStopped)
+	}
+}
@@ -0,0 +1,164 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBatchSize     = 100
+	defaultBatchInterval = time.Second
+)
+
+var (
+	errBadBatch     = errors.New("negative batch size or interval")
+	errBatchNotJSON = errors.New("batching requires the json encoding")
+)
+
+func (c *Connection) validateBatch() error {
+	bt := &c.Publish.Batch
+
+	if bt.Size < 0 || bt.Interval < 0 {
+		return errBadBatch
+	}
+
+	if bt.Size == 0 && bt.Interval == 0 {
+		return nil
+	}
+
+	if bt.Size == 0 {
+		bt.Size = defaultBatchSize
+	}
+	if bt.Interval == 0 {
+		bt.Interval = defaultBatchInterval
+	}
+
+	if !isJSONEncoding(c.Publish.Encoding) {
+		return errBatchNotJSON
+	}
+	for i, t := range c.Publish.Targets {
+		if !isJSONEncoding(t.Encoding) {
+			return fieldErr(fmt.Sprintf("targets[%d].encoding", i), errBatchNotJSON)
+		}
+	}
+
+	return nil
+}
+
+func isJSONEncoding(encoding string) bool {
+	return encoding == "" || encoding == encodingJSON
+}
+
+// batches reports whether the connection publishes in batches.
+func (c *Connection) batches() bool {
+	return c.Publish.Batch.Size > 0
+}
+
+// batchKey identifies the messages which may be published together.
+type batchKey struct {
+	topic  string
+	qos    byte
+	retain bool
+}
+
+// batcher collects published payloads into a JSON array per topic,
+// publishing it once it holds the batch size or the batch interval has
+// passed since its first payload.
+type batcher struct {
+	c      *Connection
+	client MQTTClient
+
+	mu      sync.Mutex
+	batches map[batchKey]*batch
+	closed  bool
+}
+
+type batch struct {
+	payloads []json.RawMessage
+	timer    *time.Timer
+}
+
+func (c *Connection) newBatcher(client MQTTClient) *batcher {
+	return &batcher{c: c, client: client, batches: make(map[batchKey]*batch)}
+}
+
+// add adds a payload, which must be valid JSON, to its topic's batch.
+func (b *batcher) add(key batchKey, payload json.RawMessage) {
+	b.mu.Lock()
+
+	bt := b.batches[key]
+	if bt == nil {
+		bt = &batch{}
+		b.batches[key] = bt
+		bt.timer = time.AfterFunc(b.c.Publish.Batch.Interval, func() { b.flushKey(key, bt) })
+	}
+	bt.payloads = append(bt.payloads, payload)
+
+	if !b.closed && len(bt.payloads) < b.c.Publish.Batch.Size {
+		b.mu.Unlock()
+		return
+	}
+
+	bt.timer.Stop()
+	delete(b.batches, key)
+	b.mu.Unlock()
+
+	b.publish(key, bt.payloads)
+}
+
+// flushKey publishes the batch bt for key when its interval is up, unless
+// it has already been published.
+func (b *batcher) flushKey(key batchKey, bt *batch) {
+	b.mu.Lock()
+	if b.batches[key] != bt {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.batches, key)
+	b.mu.Unlock()
+
+	b.publish(key, bt.payloads)
+}
+
+// close publishes every pending batch, once nothing more will be added.
+func (b *batcher) close() {
+	b.mu.Lock()
+	batches := b.batches
+	b.batches = make(map[batchKey]*batch)
+	b.closed = true
+	b.mu.Unlock()
+
+	for key, bt := range batches {
+		bt.timer.Stop()
+		b.publish(key, bt.payloads)
+	}
+}
+
+func (b *batcher) publish(key batchKey, payloads []json.RawMessage) {
+	c := b.c
+
+	p, err := json.Marshal(payloads)
+	if err != nil {
+		c.elog.Println(err)
+		return
+	}
+
+	c.count("batches")
+	c.publishPayload(b.client, key.topic, key.qos, key.retain, p, [][2]string{
+		{"connection", c.name()},
+		{"count", strconv.Itoa(len(payloads))},
+	}, len(payloads), nil)
+}
+
+// batchPayload returns the item's payload as JSON for a batch. Raw lines
+// aren't JSON, so they are batched as strings.
+func batchPayload(format string, it publishItem, b []byte) (json.RawMessage, error) {
+	if format == formatRaw || !it.caps.has(capTags) {
+		return json.Marshal(string(b))
+	}
+	return b, nil
+}
@@ -0,0 +1,115 @@
+package bridge
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// blockedMessage is published to the blocklist topic when an outbound
+// message is rejected. Channel is empty for whispers, and User is empty
+// for chat messages.
+type blockedMessage struct {
+	Channel string `json:"channel,omitempty"`
+	User    string `json:"user,omitempty"`
+	Message string `json:"message"`
+	Match   string `json:"match"`
+}
+
+// blocklist is the compiled blocklist of a connection.
+type blocklist struct {
+	phrases  []string // lowercased
+	patterns []*regexp.Regexp
+}
+
+func (c *Connection) validateBlocklist() error {
+	bl := &c.Blocklist
+	c.blocklist = nil
+
+	// Rejections look enough like messages to be sent again.
+	for _, topic := range []string{c.Subscribe.Topic, c.Whisper.SendTopic} {
+		if bl.Topic != "" && topic != "" && topicsOverlap(bl.Topic, topic) {
+			return fieldErr("topic", errBadTopics)
+		}
+	}
+
+	if len(bl.Phrases) == 0 && len(bl.Patterns) == 0 {
+		return nil
+	}
+
+	b := &blocklist{}
+
+	for _, p := range bl.Phrases {
+		if p = strings.ToLower(strings.TrimSpace(p)); p != "" {
+			b.phrases = append(b.phrases, p)
+		}
+	}
+
+	var err error
+	if b.patterns, err = compileFilters("patterns", "", bl.Patterns); err != nil {
+		return err
+	}
+
+	c.blocklist = b
+	return nil
+}
+
+// match returns the phrase or pattern text matches, or "" if it matches
+// none.
+func (b *blocklist) match(text string) string {
+	if b == nil {
+		return ""
+	}
+
+	lower := strings.ToLower(text)
+	for _, p := range b.phrases {
+		if strings.Contains(lower, p) {
+			return p
+		}
+	}
+
+	for _, re := range b.patterns {
+		if re.MatchString(text) {
+			return re.String()
+		}
+	}
+
+	return ""
+}
+
+// blocked reports whether the outbound message text, to channel or
+// whispered to user, matches the blocklist, logging and publishing the
+// rejection if so.
+func (c *Connection) blocked(client MQTTClient, channel, user, text string) bool {
+	match := c.blocklist.match(text)
+	if match == "" {
+		return false
+	}
+
+	target := channel
+	if target == "" {
+		target = "@" + user
+	}
+	c.elog.Printf("rejected message to %s: matches blocklist entry %q", target, match)
+	c.count("send_blocked")
+
+	if c.Blocklist.Topic == "" {
+		return true
+	}
+
+	b, err := json.Marshal(&blockedMessage{
+		Channel: strings.TrimPrefix(channel, "#"),
+		User:    user,
+		Message: text,
+		Match:   match,
+	})
+	if err != nil {
+		c.elog.Println(err)
+		return true
+	}
+
+	if t := client.Publish(c.Blocklist.Topic, c.Blocklist.QOS, false, b); t.Wait() && t.Error() != nil {
+		c.elog.Printf("publish failed: %v", t.Error())
+	}
+	return true
+}
@@ -0,0 +1,247 @@
+// Package bridge bridges Twitch chat to MQTT. A Bridge runs the connections
+// of a Config, publishing chat to and sending chat from an MQTT client.
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Bridge runs a set of connections, which can be replaced by reloading the
+// config without dropping the MQTT session.
+type Bridge struct {
+	ctx    context.Context
+	client MQTTClient
+	opts   *options
+
+	// applyMu serializes Apply and Stop, which release mu while waiting for
+	// connections to stop.
+	applyMu sync.Mutex
+
+	mu      sync.Mutex // guards running and brokers
+	running map[string]*runningConn
+	brokers []*Broker
+	tenants map[string]*Tenant
+}
+
+type runningConn struct {
+	c      *Connection
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New returns a bridge which publishes and subscribes with client, and
+// whose connections stop when ctx is canceled. Connections with dedicated
+// clients connect with the bridge's client ID and their name or nick. If an
+// availability topic is given, the bridge is reported online there until
+// it is stopped. In a dry run, nothing is published.
+func New(ctx context.Context, client MQTTClient, opts ...Option) *Bridge {
+	o := newOptions(opts)
+	if o.dryRun {
+		client = dryRunClient{MQTTClient: client, log: logger}
+	}
+
+	b := &Bridge{
+		ctx:     ctx,
+		client:  client,
+		opts:    o,
+		running: make(map[string]*runningConn),
+		tenants: make(map[string]*Tenant),
+	}
+
+	if topic := b.opts.availabilityTopic; topic != "" {
+		publishAvailability(client, topic, 1, true)
+	}
+
+	return b
+}
+
+// Apply starts, stops, and updates connections to match config, which must
+// already be validated. Connections whose settings are unchanged other than
+// their channels keep running, and join or part channels as needed.
+func (b *Bridge) Apply(config *Config) {
+	b.applyMu.Lock()
+	defer b.applyMu.Unlock()
+
+	next := make(map[string]*Connection, len(config.Connections))
+	for _, c := range config.Connections {
+		key := c.key
+		for i := 2; next[key] != nil; i++ {
+			key = fmt.Sprintf("%s#%d", c.key, i)
+		}
+		next[key] = c
+	}
+
+	// Stop removed connections first, so their subscriptions are gone
+	// before any replacements subscribe to the same topics. They drain
+	// without holding mu, so health checks aren't held up meanwhile.
+	b.mu.Lock()
+	var stopping []*runningConn
+	for key, r := range b.running {
+		if _, ok := next[key]; !ok {
+			r.c.log.Info().Msg("stopping connection")
+			r.cancel()
+			stopping = append(stopping, r)
+			delete(b.running, key)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, r := range stopping {
+		r.wg.Wait()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Unchanged tenants keep their rate limiters.
+	tenants := make(map[string]*Tenant)
+	for _, c := range config.Connections {
+		if old := b.tenants[c.tenant.Name]; old != nil && old.key == c.tenant.key {
+			c.tenant = old
+		}
+		tenants[c.tenant.Name] = c.tenant
+	}
+	b.tenants = tenants
+	b.brokers = config.Brokers
+
+	for key, c := range next {
+		if r, ok := b.running[key]; ok {
+			r.c.setChannels(c.Publish.Channels)
+			continue
+		}
+
+		c.log.Info().Msg("starting connection")
+		c.opts = b.opts
+
+		ctx, cancel := context.WithCancel(b.ctx)
+		r := &runningConn{c: c, cancel: cancel}
+		r.wg.Add(1)
+		brokers := b.brokers
+		go func() {
+			defer r.wg.Done()
+			b.run(ctx, c, brokers)
+		}()
+		b.running[key] = r
+	}
+}
+
+// run runs c until ctx is canceled, with its own MQTT client if it has a
+// dedicated one, connected to its own brokers or else the config's.
+func (b *Bridge) run(ctx context.Context, c *Connection, brokers []*Broker) {
+	if c.Client != clientDedicated {
+		c.supervise(ctx, b.client)
+		return
+	}
+
+	if len(c.Brokers) > 0 {
+		brokers = c.Brokers
+	}
+
+	clientID := ""
+	if b.opts.clientID != "" {
+		clientID = b.opts.clientID + "-" + c.name()
+	}
+
+	client, err := c.connectMQTT(ctx, clientID, brokers)
+	if err != nil {
+		return
+	}
+	defer client.Disconnect(250)
+
+	if f, ok := client.(*failoverClient); ok {
+		go f.run(ctx.Done())
+	}
+
+	c.supervise(ctx, client)
+}
+
+// connectMQTT connects the connection's dedicated client to brokers,
+// retrying until it succeeds or ctx is canceled. Its will reports the
+// connection offline on its availability topic, if it has one.
+func (c *Connection) connectMQTT(ctx context.Context, clientID string, brokers []*Broker) (BrokerClient, error) {
+	retry := newBackoff(c.Reconnect.MinDelay, c.Reconnect.MaxDelay)
+
+	for {
+		client, err := c.options().connect(clientID, c.Availability.Topic, brokers)
+		if err == nil {
+			return client, nil
+		}
+
+		d := retry.next()
+		c.log.Warn().Err(err).Dur("delay", d).Msg("MQTT connection failed, retrying")
+
+		if !sleep(d, ctx.Done()) {
+			return nil, errStopped
+		}
+	}
+}
+
+// Reload loads the config at path and applies it, keeping the current
+// connections if it is invalid.
+func (b *Bridge) Reload(path string) {
+	config, err := LoadConfigFormat(path, b.opts.configFormat)
+	if err != nil {
+		logger.Error().Err(err).Msg("not reloading config")
+		return
+	}
+
+	logger.Info().Msg("reloading config")
+	b.Apply(config)
+}
+
+// Stop stops every connection and waits for them to exit, then reports
+// the bridge offline if it has an availability topic.
+func (b *Bridge) Stop() {
+	b.applyMu.Lock()
+	defer b.applyMu.Unlock()
+
+	b.mu.Lock()
+	running := b.running
+	b.running = make(map[string]*runningConn)
+	b.mu.Unlock()
+
+	for _, r := range running {
+		r.cancel()
+	}
+
+	for _, r := range running {
+		r.wg.Wait()
+	}
+
+	if topic := b.opts.availabilityTopic; topic != "" {
+		publishAvailability(b.client, topic, 1, false)
+	}
+}
+
+// NotReady returns the names, or else nicks, of the running connections
+// which are not connected and joined.
+func (b *Bridge) NotReady() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var names []string
+	for _, r := range b.running {
+		if !r.c.isReady() {
+			names = append(names, r.c.name())
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// reloadKey identifies the connection's settings other than its channels.
+// It is computed before validation fills in defaults.
+func (c *Connection) reloadKey() (string, error) {
+	channels := c.Publish.Channels
+	c.Publish.Channels = nil
+	b, err := yaml.Marshal(c)
+	c.Publish.Channels = channels
+
+	return string(b), err
+}
@@ -0,0 +1,110 @@
+package bridge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// heldBroker holds every publish until released.
+type heldBroker struct {
+	*fakeMQTT
+	held    chan struct{}
+	release chan struct{}
+}
+
+func (b *heldBroker) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	select {
+	case b.held <- struct{}{}:
+	default:
+	}
+	<-b.release
+	return b.fakeMQTT.Publish(topic, qos, retained, payload)
+}
+
+func TestApplyDoesNotBlockWhileDraining(t *testing.T) {
+	c := newTestConnection()
+	config := &Config{Connections: []*Connection{c}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	d := newFakeDialer()
+	c.dial = d.dial
+
+	broker := &heldBroker{fakeMQTT: newFakeMQTT(), held: make(chan struct{}, 1), release: make(chan struct{})}
+	mq := broker.fakeMQTT
+	mq.lossy = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := New(ctx, broker)
+	b.Apply(config)
+
+	var f *fakeIRC
+	select {
+	case f = <-d.Conns:
+	case <-time.After(testTimeout):
+		t.Fatal("connection did not dial")
+	}
+	if _, err := f.NextCommand("JOIN", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the connection's publish, so it can't finish draining.
+	m := chatMessage("alice", "#foo", "held")
+	m.Raw = m.String()
+	if err := f.Send(m); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-broker.held:
+	case <-time.After(testTimeout):
+		t.Fatal("message was not published")
+	}
+
+	applied := make(chan struct{})
+	go func() {
+		defer close(applied)
+		b.Apply(&Config{})
+	}()
+
+	// Once the connection is removed, the bridge answers while it drains.
+	deadline := time.Now().Add(testTimeout)
+	for {
+		answered := make(chan int, 1)
+		go func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			answered <- len(b.running)
+		}()
+
+		select {
+		case n := <-answered:
+			if n != 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("connection was not stopped")
+				}
+				time.Sleep(time.Millisecond)
+				continue
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("bridge was locked while a connection was draining")
+		}
+		break
+	}
+
+	select {
+	case <-applied:
+		t.Fatal("Apply returned before the connection drained")
+	default:
+	}
+
+	close(broker.release)
+	select {
+	case <-applied:
+	case <-time.After(testTimeout):
+		t.Fatal("Apply did not return")
+	}
+}
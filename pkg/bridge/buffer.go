@@ -0,0 +1,363 @@
+package bridge
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	bufferFile       = "buffer.jsonl"
+	bufferReplayFile = "buffer.replay.jsonl"
+
+	// bufferReplayInterval is how often the buffer is checked for messages
+	// to replay.
+	bufferReplayInterval = time.Second
+)
+
+var errBufferFull = errors.New("outage buffer is full")
+
+// bufferedMessage is a publish kept on disk while the broker is
+// unreachable.
+type bufferedMessage struct {
+	Time    time.Time
+	Topic   string
+	QOS     byte
+	Retain  bool
+	Payload []byte
+	Props   *publishProperties `json:",omitempty"`
+}
+
+// bufferedClient stores publishes on disk while the broker is unreachable,
+// and replays them in order once it reconnects. Messages are published
+// directly only when the broker is connected and nothing is waiting to be
+// replayed, so order is kept, and are stored if that publish fails.
+type bufferedClient struct {
+	BrokerClient
+
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu        sync.Mutex
+	file      *os.File // bufferFile open for appending, or nil
+	size      int64    // of bufferFile
+	replaying bool
+}
+
+var _ propertyPublisher = (*bufferedClient)(nil)
+
+// Buffer returns a client which stores publishes in dir while client's
+// broker is unreachable, and replays them once it reconnects until stop is
+// closed. The buffer is limited to maxBytes and messages older than maxAge
+// are dropped, unless they are 0.
+func Buffer(client BrokerClient, dir string, maxBytes int64, maxAge time.Duration, stop <-chan struct{}) (BrokerClient, error) {
+	b, err := newBufferedClient(client, dir, maxBytes, maxAge)
+	if err != nil {
+		return nil, err
+	}
+	go b.run(stop)
+	return b, nil
+}
+
+func newBufferedClient(client BrokerClient, dir string, maxBytes int64, maxAge time.Duration) (*bufferedClient, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	b := &bufferedClient{
+		BrokerClient: client,
+		dir:          dir,
+		maxBytes:     maxBytes,
+		maxAge:       maxAge,
+	}
+
+	// Messages left from a previous run are replayed first.
+	if err := b.requeue(); err != nil {
+		return nil, err
+	}
+
+	if fi, err := os.Stat(b.path(bufferFile)); err == nil {
+		b.size = fi.Size()
+	}
+
+	return b, nil
+}
+
+func (b *bufferedClient) path(name string) string {
+	return filepath.Join(b.dir, name)
+}
+
+func (b *bufferedClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return b.PublishWithProperties(topic, qos, retained, payload, nil)
+}
+
+func (b *bufferedClient) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props *publishProperties) mqtt.Token {
+	b.mu.Lock()
+	direct := b.IsConnected() && !b.replaying && b.size == 0
+	b.mu.Unlock()
+
+	var p []byte
+	switch v := payload.(type) {
+	case []byte:
+		p = v
+	case string:
+		p = []byte(v)
+	}
+
+	msg := &bufferedMessage{
+		Time:    time.Now(),
+		Topic:   topic,
+		QOS:     qos,
+		Retain:  retained,
+		Payload: p,
+		Props:   props,
+	}
+
+	if !direct {
+		return doneToken(b.store(msg))
+	}
+
+	// The broker may go away while the message is in flight, in which
+	// case it is kept for the replay like any other.
+	t := b.publish(topic, qos, retained, payload, props)
+	return asyncToken(func() error {
+		if t.Wait(); t.Error() == nil {
+			return nil
+		}
+		return b.store(msg)
+	})
+}
+
+func (b *bufferedClient) publish(topic string, qos byte, retained bool, payload interface{}, props *publishProperties) mqtt.Token {
+	if pp, ok := b.BrokerClient.(propertyPublisher); ok && props != nil {
+		return pp.PublishWithProperties(topic, qos, retained, payload, props)
+	}
+	return b.BrokerClient.Publish(topic, qos, retained, payload)
+}
+
+// store appends msg to the buffer file.
+func (b *bufferedClient) store(msg *bufferedMessage) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.maxBytes > 0 && b.size+int64(len(line)) > b.maxBytes {
+		return errBufferFull
+	}
+
+	if b.file == nil {
+		f, err := os.OpenFile(b.path(bufferFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		b.file = f
+	}
+
+	n, err := b.file.Write(line)
+	b.size += int64(n)
+	return err
+}
+
+// closeFile closes the buffer file, before it is moved or replaced. b.mu
+// must be held.
+func (b *bufferedClient) closeFile() error {
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	b.file = nil
+	return err
+}
+
+// requeue puts an unfinished replay back in front of the buffer. b.mu must
+// be held once the client is in use.
+func (b *bufferedClient) requeue() error {
+	replay, err := os.ReadFile(b.path(bufferReplayFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := b.closeFile(); err != nil {
+		return err
+	}
+
+	rest, err := os.ReadFile(b.path(bufferFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp := b.path(bufferFile + ".tmp")
+	if err := os.WriteFile(tmp, append(replay, rest...), 0o600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, b.path(bufferFile)); err != nil {
+		return err
+	}
+
+	b.size = int64(len(replay) + len(rest))
+	return os.Remove(b.path(bufferReplayFile))
+}
+
+// run replays buffered messages whenever the broker is connected, until
+// stop is closed.
+func (b *bufferedClient) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(bufferReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			b.mu.Lock()
+			if err := b.closeFile(); err != nil {
+				elog.Printf("closing outage buffer: %v", err)
+			}
+			b.mu.Unlock()
+			return
+		case <-ticker.C:
+		}
+
+		if !b.IsConnected() {
+			continue
+		}
+
+		if err := b.replay(stop); err != nil {
+			elog.Printf("replaying buffered messages: %v", err)
+		}
+	}
+}
+
+// replay publishes the buffered messages in order. New messages are
+// buffered behind them until the replay finishes. If a publish fails, the
+// rest are kept for the next attempt.
+func (b *bufferedClient) replay(stop <-chan struct{}) error {
+	b.mu.Lock()
+	if b.size == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+
+	if err := b.closeFile(); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+
+	if err := os.Rename(b.path(bufferFile), b.path(bufferReplayFile)); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	b.size = 0
+	b.replaying = true
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.replaying = false
+		b.mu.Unlock()
+	}()
+
+	f, err := os.Open(b.path(bufferReplayFile))
+	if err != nil {
+		return err
+	}
+
+	count, err := b.publishAll(f, stop)
+	f.Close()
+
+	if count > 0 {
+		logger.Info().Int("messages", count).Msg("replayed buffered messages")
+	}
+
+	if err != nil {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return errors.Join(err, b.requeueReplayed(count))
+	}
+
+	return os.Remove(b.path(bufferReplayFile))
+}
+
+// publishAll publishes the messages in r, returning how many were
+// published. Lines are read whole, however long, so no message can block
+// the ones behind it.
+func (b *bufferedClient) publishAll(r io.Reader, stop <-chan struct{}) (int, error) {
+	br := bufio.NewReader(r)
+
+	count := 0
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return count, nil
+		}
+		if err != nil && err != io.EOF {
+			return count, err
+		}
+
+		select {
+		case <-stop:
+			return count, errStopped
+		default:
+		}
+
+		var msg bufferedMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			elog.Printf("skipping corrupt buffered message: %v", err)
+			count++
+			continue
+		}
+
+		if b.maxAge > 0 && time.Since(msg.Time) > b.maxAge {
+			count++
+			continue
+		}
+
+		t := b.publish(msg.Topic, msg.QOS, msg.Retain, msg.Payload, msg.Props)
+		if t.Wait(); t.Error() != nil {
+			return count, t.Error()
+		}
+
+		count++
+	}
+}
+
+// requeueReplayed drops the first done messages of the replay file and
+// puts the rest back in front of the buffer. b.mu must be held.
+func (b *bufferedClient) requeueReplayed(done int) error {
+	replay, err := os.ReadFile(b.path(bufferReplayFile))
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < done && len(replay) > 0; i++ {
+		n := 0
+		for n < len(replay) && replay[n] != '\n' {
+			n++
+		}
+		if n < len(replay) {
+			n++
+		}
+		replay = replay[n:]
+	}
+
+	if err := os.WriteFile(b.path(bufferReplayFile), replay, 0o600); err != nil {
+		return err
+	}
+
+	return b.requeue()
+}
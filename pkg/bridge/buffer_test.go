@@ -0,0 +1,90 @@
+package bridge
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// failingBroker is connected, but fails every publish.
+type failingBroker struct {
+	*fakeMQTT
+}
+
+func (failingBroker) IsConnected() bool { return true }
+func (failingBroker) Disconnect(uint)   {}
+
+func (failingBroker) Publish(string, byte, bool, interface{}) mqtt.Token {
+	return doneToken(errors.New("connection lost"))
+}
+
+func TestBufferStoresFailedPublishes(t *testing.T) {
+	dir := t.TempDir()
+	b, err := newBufferedClient(failingBroker{newFakeMQTT()}, dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"first", "second"} {
+		if tok := b.Publish("twitch/chat", 1, false, p); tok.Wait() && tok.Error() != nil {
+			t.Fatalf("publish of %s: %v", p, tok.Error())
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.closeFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := os.ReadFile(b.path(bufferFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(buf), "\n"); lines != 2 {
+		t.Errorf("buffered %d messages, want 2", lines)
+	}
+}
+
+// offlineBroker is disconnected until connect is called, and then
+// publishes to the fake broker.
+type offlineBroker struct {
+	*fakeMQTT
+	connected bool
+}
+
+func (b *offlineBroker) IsConnected() bool { return b.connected }
+func (b *offlineBroker) Disconnect(uint)   {}
+
+func TestBufferReplaysLargeMessages(t *testing.T) {
+	broker := &offlineBroker{fakeMQTT: newFakeMQTT()}
+	b, err := newBufferedClient(broker, t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := strings.Repeat("x", 2<<20)
+	for _, p := range []string{large, "after"} {
+		if tok := b.Publish("twitch/chat", 1, false, p); tok.Wait() && tok.Error() != nil {
+			t.Fatal(tok.Error())
+		}
+	}
+
+	broker.connected = true
+	if err := b.replay(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{large, "after"} {
+		m, err := broker.Next(testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m.payload) != want {
+			t.Errorf("replayed %d bytes, want %d", len(m.payload), len(want))
+		}
+	}
+}
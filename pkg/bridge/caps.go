@@ -0,0 +1,95 @@
+package bridge
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jakebailey/irc"
+)
+
+const (
+	capTags     = "twitch.tv/tags"
+	capCommands = "twitch.tv/commands"
+)
+
+var requestedCaps = []string{capTags, capCommands}
+
+// capSet tracks the capabilities the server has acknowledged. Until the
+// server ACKs twitch.tv/tags, messages carry no tags and the connection
+// runs in a degraded, raw-only mode.
+type capSet struct {
+	mu   sync.Mutex
+	caps map[string]bool
+}
+
+func newCapSet() *capSet {
+	return &capSet{caps: make(map[string]bool)}
+}
+
+// handle updates the set from a CAP message, returning true if it changed.
+func (s *capSet) handle(m *irc.Message) bool {
+	if m.Command != "CAP" || len(m.Params) < 2 {
+		return false
+	}
+
+	ack := false
+	switch m.Params[1] {
+	case "ACK":
+		ack = true
+	case "NAK":
+	default:
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for _, c := range strings.Fields(m.Trailing) {
+		if s.caps[c] != ack {
+			changed = true
+		}
+
+		if ack {
+			s.caps[c] = true
+		} else {
+			delete(s.caps, c)
+		}
+	}
+
+	return changed
+}
+
+func (s *capSet) has(c string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.caps[c]
+}
+
+// degraded reports whether any requested capability is missing.
+func (s *capSet) degraded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range requestedCaps {
+		if !s.caps[c] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *capSet) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	caps := make([]string, 0, len(s.caps))
+	for c := range s.caps {
+		caps = append(caps, c)
+	}
+	sort.Strings(caps)
+
+	return caps
+}
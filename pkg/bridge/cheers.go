@@ -0,0 +1,68 @@
+package bridge
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jakebailey/irc"
+)
+
+// cheer is a cheermote in a message, like Cheer100.
+type cheer struct {
+	Prefix string `json:"prefix"`
+	Amount int    `json:"amount"`
+}
+
+var cheerRe = regexp.MustCompile(`^([A-Za-z]+)([1-9][0-9]*)$`)
+
+// parseCheers returns the cheermotes in the text of a message with the
+// given number of bits. Twitch does not tag which words are cheermotes, so
+// words are matched by shape, stopping once they account for all bits.
+func parseCheers(text string, bits int) []cheer {
+	if bits <= 0 {
+		return nil
+	}
+
+	var cheers []cheer
+	total := 0
+
+	for _, word := range strings.Fields(text) {
+		match := cheerRe.FindStringSubmatch(word)
+		if match == nil {
+			continue
+		}
+
+		n, err := strconv.Atoi(match[2])
+		if err != nil || total+n > bits {
+			continue
+		}
+
+		cheers = append(cheers, cheer{Prefix: match[1], Amount: n})
+
+		if total += n; total == bits {
+			break
+		}
+	}
+
+	return cheers
+}
+
+// publishCheer publishes m, a PRIVMSG with bits, in the parsed format to
+// the cheers topic.
+func (c *Connection) publishCheer(client MQTTClient, m *irc.Message) {
+	b, err := marshalPayload(c.Publish.Encoding, parseMessage(m))
+	if err != nil {
+		c.elog.Println(err)
+		return
+	}
+
+	topic := c.expandTopic(c.Cheers.Topic, m)
+
+	if t := client.Publish(topic, c.Cheers.QOS, false, b); t.Error() != nil {
+		c.elog.Printf("cheer publish failed: %v", t.Error())
+		c.count("publish_errors")
+	} else {
+		c.count("cheers")
+	}
+}
@@ -0,0 +1,129 @@
+package bridge
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+
+	defaultCompressionThreshold = 1024
+)
+
+var (
+	errBadCompression          = errors.New("compression algorithm must be gzip or zstd")
+	errBadCompressionThreshold = errors.New("negative compression threshold")
+)
+
+// compressedPayload wraps a compressed payload published over MQTT 3, which
+// has no properties to mark it with. Being JSON, the envelope carries the
+// compressed bytes base64 encoded, a third larger than they are over MQTT 5.
+type compressedPayload struct {
+	ContentEncoding string `json:"content_encoding"`
+	Payload         []byte `json:"payload"`
+}
+
+func (c *Connection) validateCompression() error {
+	cp := &c.Publish.Compression
+
+	switch cp.Algorithm {
+	case "", compressionGzip, compressionZstd:
+	default:
+		return fieldErr("algorithm", errBadCompression)
+	}
+
+	if cp.Threshold < 0 {
+		return fieldErr("threshold", errBadCompressionThreshold)
+	}
+
+	if cp.Threshold == 0 {
+		cp.Threshold = defaultCompressionThreshold
+	}
+
+	return nil
+}
+
+// compress compresses the payload b if the connection compresses payloads
+// of its size. Over MQTT 5, the compressed payload is returned along with
+// its content encoding; otherwise it is wrapped in an envelope, and the
+// content encoding is empty as for an uncompressed payload.
+func (c *Connection) compress(b []byte) ([]byte, string, error) {
+	cp := &c.Publish.Compression
+	if cp.Algorithm == "" || len(b) < cp.Threshold {
+		return b, "", nil
+	}
+
+	z, err := compressWith(cp.Algorithm, b)
+	if err != nil {
+		return nil, "", err
+	}
+
+	c.count("compressed")
+
+	if c.options().mqtt5 {
+		return z, cp.Algorithm, nil
+	}
+
+	env, err := json.Marshal(&compressedPayload{ContentEncoding: cp.Algorithm, Payload: z})
+	if err != nil {
+		return nil, "", err
+	}
+	return env, "", nil
+}
+
+// compressWith compresses b with the given algorithm.
+func compressWith(algorithm string, b []byte) ([]byte, error) {
+	if algorithm == compressionZstd {
+		w, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+		return w.EncodeAll(b, nil), nil
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// uncompress returns the payload wrapped in b if it is a compressed
+// payload envelope, and otherwise b itself.
+func uncompress(b []byte) ([]byte, error) {
+	var env compressedPayload
+	if err := json.Unmarshal(b, &env); err != nil {
+		return b, nil
+	}
+
+	switch env.ContentEncoding {
+	case compressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(env.Payload))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case compressionZstd:
+		r, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return r.DecodeAll(env.Payload, nil)
+	default:
+		return b, nil
+	}
+}
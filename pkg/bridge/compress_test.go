@@ -0,0 +1,85 @@
+package bridge
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func newCompressConnection(t *testing.T, name, algorithm string) *Connection {
+	t.Helper()
+
+	c := newTestConnection()
+	c.Name = name
+	c.Publish.Compression.Algorithm = algorithm
+	if _, err := newHarness(c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	payload := []byte(strings.Repeat("hello there ", 200))
+
+	for _, algorithm := range []string{compressionGzip, compressionZstd} {
+		t.Run(algorithm, func(t *testing.T) {
+			c := newCompressConnection(t, "compress-"+algorithm, algorithm)
+
+			env, encoding, err := c.compress(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encoding != "" {
+				t.Errorf("content encoding over MQTT 3 = %q, want none", encoding)
+			}
+
+			got, err := uncompress(env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("uncompressed payload does not match the original")
+			}
+		})
+	}
+}
+
+func TestCompressMQTT5(t *testing.T) {
+	payload := []byte(strings.Repeat("hello there ", 200))
+
+	c := newCompressConnection(t, "compress-mqtt5", compressionZstd)
+	c.opts = newOptions([]Option{WithMQTT5(true)})
+
+	z, encoding, err := c.compress(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoding != compressionZstd {
+		t.Errorf("content encoding = %q, want %q", encoding, compressionZstd)
+	}
+	if len(z) >= len(payload) {
+		t.Errorf("compressed payload is %d bytes, want fewer than %d", len(z), len(payload))
+	}
+}
+
+func TestCompressBelowThreshold(t *testing.T) {
+	c := newCompressConnection(t, "compress-threshold", compressionGzip)
+
+	payload := []byte("hello")
+	got, encoding, err := c.compress(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoding != "" || !bytes.Equal(got, payload) {
+		t.Errorf("payload below the threshold was compressed: %q, %q", got, encoding)
+	}
+}
+
+func TestValidateCompressionAlgorithm(t *testing.T) {
+	c := newTestConnection()
+	c.Publish.Compression.Algorithm = "brotli"
+	want := "algorithm: " + errBadCompression.Error()
+	if err := c.validateCompression(); err == nil || err.Error() != want {
+		t.Errorf("err = %v, want %s", err, want)
+	}
+}
@@ -0,0 +1,398 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	errEmptyNick       = errors.New("empty nick")
+	errNonOauthPass    = errors.New("pass did not start with oauth")
+	errBadTopics       = errors.New("pub and sub topics are the same or empty")
+	errBadQOS          = errors.New("invalid QOS")
+	errChannelsNoTopic = errors.New("channels provided without publish topic")
+	errEmptyChannel    = errors.New("empty channel name")
+	errInvalidConfig   = errors.New("invalid config")
+	errNoBroker        = errors.New("no MQTT broker specified")
+	errBadMode         = errors.New("mode must be read, write, or readwrite")
+	errNotConnected    = errors.New("not connected to IRC")
+	errStopped         = errors.New("stopped")
+	errReconnect       = errors.New("server requested reconnect")
+	errBadReconnect    = errors.New("invalid reconnect delays or attempts")
+	errBadExpiry       = errors.New("negative message expiry")
+	errBadDedupe       = errors.New("negative dedupe window")
+	errBadFormat       = errors.New("unknown payload format")
+	errBadEncoding     = errors.New("unknown payload encoding")
+	errAnonymousWrite  = errors.New("connections without a pass must be read-only")
+	errBadControlTopic = errors.New("control topic contains wildcards")
+	errBadConfigFormat = errors.New("config format must be yaml, json, or toml")
+	errBadLogLevel     = errors.New("log level must be debug, info, warn, or error")
+	errBadClient       = errors.New("client must be shared or dedicated")
+	errDuplicateName   = errors.New("duplicate connection name")
+	errSharedBrokers   = errors.New("connections with their own brokers need a dedicated client")
+	errUnknownField    = errors.New("unknown field")
+)
+
+// Config is the set of connections a Bridge runs, and where their MQTT
+// clients connect.
+type Config struct {
+	// Brokers, if set, replaces the broker given by WithBroker. With more
+	// than one, the bridge fails over between them in order.
+	Brokers []*Broker `yaml:",omitempty"`
+
+	// ClientID is the bridge's MQTT client ID, to be given to New and
+	// Connect with WithClientID. Connections with their own brokers add
+	// their nick to it.
+	ClientID string `yaml:"client_id,omitempty"`
+
+	// Defaults are inherited by connections which don't override them.
+	Defaults Defaults `yaml:",omitempty"`
+
+	Tenants     []*Tenant `yaml:",omitempty"`
+	Connections []*Connection
+}
+
+// Config file formats, given to LoadConfigFormat.
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+	FormatTOML = "toml"
+)
+
+// LoadConfig reads, resolves the secrets of, and validates the config at
+// path, in the format given by its extension (YAML unless it ends in .json
+// or .toml).
+func LoadConfig(path string) (*Config, error) {
+	return LoadConfigFormat(path, "")
+}
+
+// LoadConfigFormat is like LoadConfig, but reads the config in the given
+// format, or by its extension if format is empty. All formats use the same
+// field names.
+func LoadConfigFormat(path, format string) (*Config, error) {
+	if format == "" {
+		format = configFormat(path)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := decodeConfig(b, format, &config); err != nil {
+		return nil, err
+	}
+
+	if err := expandEnv(&config); err != nil {
+		return nil, err
+	}
+
+	if err := config.resolveSecrets(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// configFormat returns the format of the config at path by its extension.
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON
+	case ".toml":
+		return FormatTOML
+	default:
+		return FormatYAML
+	}
+}
+
+// decodeConfig decodes b into config, rejecting unknown fields, and applies
+// the config's defaults to its connections. JSON and TOML are decoded
+// generically and then re-encoded as YAML, so every format shares the YAML
+// field names and decoding rules, like durations written as "10s".
+func decodeConfig(b []byte, format string, config *Config) error {
+	reencoded := format != FormatYAML
+	if reencoded {
+		var err error
+		if b, err = reencodeYAML(b, format); err != nil {
+			return err
+		}
+	}
+
+	// The generic form tells where any unknown fields are, and which
+	// fields were set, and so not defaulted.
+	var raw interface{}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	if errs := unknownFields("", raw, reflect.TypeOf(config)); len(errs) > 0 {
+		return errors.Join(append([]error{errInvalidConfig}, errs...)...)
+	}
+
+	if err := yaml.UnmarshalStrict(b, config); err != nil {
+		// Line numbers refer to the re-encoded YAML, so would only mislead.
+		if te, ok := err.(*yaml.TypeError); ok && reencoded {
+			for i, e := range te.Errors {
+				if strings.HasPrefix(e, "line ") {
+					if j := strings.Index(e, ": "); j >= 0 {
+						te.Errors[i] = e[j+2:]
+					}
+				}
+			}
+		}
+		return err
+	}
+
+	config.applyDefaults(raw)
+
+	return nil
+}
+
+var yamlUnmarshaler = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// unknownFields returns an error for each key in the generically decoded
+// value raw, found at path, which no field of t decodes. Errors name the
+// full path of the key, like connections[0].publish.chanels.
+func unknownFields(path string, raw interface{}, t reflect.Type) []error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if reflect.PointerTo(t).Implements(yamlUnmarshaler) {
+		return nil
+	}
+
+	var errs []error
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := raw.(map[interface{}]interface{})
+		if !ok {
+			return nil
+		}
+
+		fields := yamlFields(t)
+		for _, k := range sortedKeys(m) {
+			key := joinPath(path, k)
+			ft, ok := fields[k]
+			if !ok {
+				errs = append(errs, fieldErr(key, errUnknownField))
+				continue
+			}
+			errs = append(errs, unknownFields(key, m[k], ft)...)
+		}
+
+	case reflect.Map:
+		m, ok := raw.(map[interface{}]interface{})
+		if !ok {
+			return nil
+		}
+		for _, k := range sortedKeys(m) {
+			errs = append(errs, unknownFields(joinPath(path, k), m[k], t.Elem())...)
+		}
+
+	case reflect.Slice, reflect.Array:
+		s, ok := raw.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, v := range s {
+			errs = append(errs, unknownFields(fmt.Sprintf("%s[%d]", path, i), v, t.Elem())...)
+		}
+	}
+
+	return errs
+}
+
+// yamlFields returns the types of the fields of the struct t by the keys
+// YAML decodes them from.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type, t.NumField())
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+
+		if f.Type.Kind() == reflect.Struct && strings.Contains(opts, "inline") {
+			for k, v := range yamlFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+
+		fields[name] = f.Type
+	}
+
+	return fields
+}
+
+func sortedKeys(m map[interface{}]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, fmt.Sprint(k))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// reencodeYAML decodes a JSON or TOML config generically and re-encodes it
+// as YAML.
+func reencodeYAML(b []byte, format string) ([]byte, error) {
+	var v interface{}
+
+	switch format {
+	case FormatJSON:
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+	case FormatTOML:
+		if err := toml.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errBadConfigFormat
+	}
+
+	return yaml.Marshal(v)
+}
+
+// fieldError is a validation error for a single config field. Nested field
+// errors are joined into a path, like connections[0].publish.topic.
+type fieldError struct {
+	field string
+	err   error
+}
+
+// fieldErr returns err for the given field. Each of a joined set of errors
+// is given the field separately.
+func fieldErr(field string, err error) error {
+	if j, ok := err.(interface{ Unwrap() []error }); ok {
+		errs := j.Unwrap()
+		for i, err := range errs {
+			errs[i] = fieldErr(field, err)
+		}
+		return errors.Join(errs...)
+	}
+	return &fieldError{field: field, err: err}
+}
+
+func (e *fieldError) Error() string {
+	if fe, ok := e.err.(*fieldError); ok {
+		return e.field + "." + fe.Error()
+	}
+	return e.field + ": " + e.err.Error()
+}
+
+// Validate checks the config, returning every error found, one per line.
+// A valid config has its defaults filled in and is readied to run; an
+// invalid one is left as it was.
+func (c *Config) Validate() error {
+	// Check a copy first, since validating fills in the config as it goes.
+	check, err := c.clone()
+	if err != nil {
+		return err
+	}
+	if err := check.validate(); err != nil {
+		return err
+	}
+
+	if err := c.validate(); err != nil {
+		return err
+	}
+	c.ready()
+	return nil
+}
+
+// clone returns a deep copy of the config's settings.
+func (c *Config) clone() (*Config, error) {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var cp Config
+	if err := yaml.Unmarshal(b, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// validate checks the config and fills in defaults, returning every error
+// found.
+func (c *Config) validate() error {
+	var errs []error
+
+	if err := validateBrokers(c.Brokers); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Connections can't be checked against invalid tenants.
+	tenants, err := c.tenants()
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		names := make(map[string]bool, len(c.Connections))
+		for i, conn := range c.Connections {
+			if conn.Name != "" {
+				if names[conn.Name] {
+					errs = append(errs, fieldErr(fmt.Sprintf("connections[%d].name", i), errDuplicateName))
+				}
+				names[conn.Name] = true
+			}
+
+			if err := conn.validate(tenants); err != nil {
+				errs = append(errs, fieldErr(fmt.Sprintf("connections[%d]", i), err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(append([]error{errInvalidConfig}, errs...)...)
+	}
+
+	return nil
+}
+
+// ready readies the validated config's tenants and connections to run,
+// giving them their rate limiters, metrics, token sources, and loggers.
+func (c *Config) ready() {
+	tenants := make(map[*Tenant]bool)
+	for i, conn := range c.Connections {
+		if !tenants[conn.tenant] {
+			conn.tenant.init()
+			tenants[conn.tenant] = true
+		}
+		conn.ready(i)
+	}
+}
@@ -0,0 +1,295 @@
+package bridge
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigTOML(t *testing.T) {
+	path := writeConfig(t, "config.toml", `
+# A comment.
+client_id = "bridge"
+
+[[connections]]
+nick = "bot"
+pass = "oauth:abc"
+
+  [connections.publish]
+  topic = "twitch/chat"
+  qos = 1
+  channels = ["foo", "bar"]
+  sample = { rate = 0.5 }
+
+  [connections.reconnect]
+  min_delay = "10s"
+  max_attempts = 3
+
+[[connections]]
+nick = "other"
+mode = 'read'
+publish.topic = "twitch/other"
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.ClientID != "bridge" {
+		t.Errorf("client_id = %q", config.ClientID)
+	}
+	if len(config.Connections) != 2 {
+		t.Fatalf("%d connections, want 2", len(config.Connections))
+	}
+
+	c := config.Connections[0]
+	if c.Nick != "bot" || c.Pass != "oauth:abc" {
+		t.Errorf("nick, pass = %q, %q", c.Nick, c.Pass)
+	}
+	if c.Publish.Topic != "twitch/chat" || c.Publish.QOS != 1 || len(c.Publish.Channels) != 2 {
+		t.Errorf("publish = %q, %d, %q", c.Publish.Topic, c.Publish.QOS, c.Publish.Channels)
+	}
+	if c.Publish.Sample.Rate != 0.5 {
+		t.Errorf("sample rate = %v", c.Publish.Sample.Rate)
+	}
+	if c.Reconnect.MinDelay != 10*time.Second || c.Reconnect.MaxAttempts != 3 {
+		t.Errorf("reconnect = %s, %d", c.Reconnect.MinDelay, c.Reconnect.MaxAttempts)
+	}
+
+	if c := config.Connections[1]; c.Nick != "other" || c.Mode != "read" {
+		t.Errorf("second connection = %q, %q", c.Nick, c.Mode)
+	}
+}
+
+func TestLoadConfigTOMLSyntaxError(t *testing.T) {
+	path := writeConfig(t, "config.toml", "[[connections]]\nnick = \n")
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("loaded a config with a syntax error")
+	}
+}
+
+func TestLoadConfigUnknownFields(t *testing.T) {
+	tests := []struct {
+		name, content string
+	}{
+		{"config.yaml", `
+connections:
+- nick: bot
+  publish:
+    topic: twitch/chat
+- nick: other
+  publish:
+    topic: twitch/other
+    chanels: [foo]
+    sample:
+      rat: 0.5
+    overrides:
+      foo:
+        topc: twitch/foo
+tenants:
+- name: t
+  rate_limit:
+    message: 1
+`},
+		{"config.json", `{
+  "connections": [
+    {"nick": "bot", "publish": {"topic": "twitch/chat"}},
+    {"nick": "other", "publish": {
+      "topic": "twitch/other",
+      "chanels": ["foo"],
+      "sample": {"rat": 0.5},
+      "overrides": {"foo": {"topc": "twitch/foo"}}
+    }}
+  ],
+  "tenants": [{"name": "t", "rate_limit": {"message": 1}}]
+}`},
+		{"config.toml", `
+[[connections]]
+nick = "bot"
+publish.topic = "twitch/chat"
+
+[[connections]]
+nick = "other"
+publish.topic = "twitch/other"
+publish.chanels = ["foo"]
+publish.sample.rat = 0.5
+publish.overrides.foo.topc = "twitch/foo"
+
+[[tenants]]
+name = "t"
+rate_limit.message = 1
+`},
+	}
+
+	want := []string{
+		"connections[1].publish.chanels: unknown field",
+		"connections[1].publish.overrides.foo.topc: unknown field",
+		"connections[1].publish.sample.rat: unknown field",
+		"tenants[0].rate_limit.message: unknown field",
+	}
+
+	for _, test := range tests {
+		_, err := LoadConfig(writeConfig(t, test.name, test.content))
+		if !errors.Is(err, errInvalidConfig) {
+			t.Errorf("%s: got error %v, want unknown fields", test.name, err)
+			continue
+		}
+
+		if got := strings.Join(strings.Split(err.Error(), "\n")[1:], "\n"); got != strings.Join(want, "\n") {
+			t.Errorf("%s: got errors\n%s\nwant\n%s", test.name, got, strings.Join(want, "\n"))
+		}
+	}
+}
+
+func TestLoadConfigNormalizesChannels(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+connections:
+- nick: bot
+  publish:
+    topic: twitch/chat
+    channels: [Foo, " #Bar "]
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Channels joined by control messages are normalized the same way, so
+	// must compare equal.
+	c := config.Connections[0]
+	for _, ch := range []string{"foo", "#BAR"} {
+		if !c.hasChannel(normalizeChannel(ch)) {
+			t.Errorf("channels %q do not include %q", c.Publish.Channels, ch)
+		}
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+defaults:
+  qos: 1
+  retain: true
+  format: parsed
+  topic_prefix: twitch
+  rate_limit:
+    messages: 100
+    period: 30s
+    queue: 50
+connections:
+- nick: inherits
+  pass: oauth:abc
+  publish:
+    topic: chat
+  subscribe:
+    topic: send
+- nick: overrides
+  pass: oauth:def
+  topic_prefix: ""
+  rate_limit:
+    messages: 20
+    period: 1m
+  publish:
+    topic: chat
+    qos: 0
+    retain: false
+    format: raw
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inherits, overrides := config.Connections[0], config.Connections[1]
+
+	if p := inherits.Publish; p.QOS != 1 || !p.Retain || p.Format != formatParsed || p.Topic != "twitch/chat" {
+		t.Errorf("inheriting connection publishes with qos %d, retain %v, format %q to %q", p.QOS, p.Retain, p.Format, p.Topic)
+	}
+	if s := inherits.Subscribe; s.QOS != 1 || s.Topic != "twitch/send" {
+		t.Errorf("inheriting connection subscribes with qos %d to %q", s.QOS, s.Topic)
+	}
+
+	if r := inherits.RateLimit; r.Messages != 100 || r.Period != 30*time.Second {
+		t.Errorf("inheriting connection is limited to %d messages per %s", r.Messages, r.Period)
+	}
+
+	if p := overrides.Publish; p.QOS != 0 || p.Retain || p.Format != formatRaw || p.Topic != "chat" {
+		t.Errorf("overriding connection publishes with qos %d, retain %v, format %q to %q", p.QOS, p.Retain, p.Format, p.Topic)
+	}
+	// The connection's rate limit replaces the default as a whole.
+	if r := overrides.RateLimit; r.Messages != 20 || r.Period != time.Minute || r.Queue != 0 {
+		t.Errorf("overriding connection is limited to %d messages per %s, queueing %d", r.Messages, r.Period, r.Queue)
+	}
+}
+
+func TestLoadConfigTopicPrefixWithTenant(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+defaults:
+  topic_prefix: twitch
+tenants:
+- name: acme
+  topic_prefix: acme/
+connections:
+- nick: bot
+  pass: oauth:abc
+  tenant: acme
+  publish:
+    topic: acme/chat
+    routes:
+      CLEARCHAT: acme/clears
+  subscribe:
+    topic: acme/send/+
+  control:
+    topic: bot
+- nick: other
+  pass: oauth:def
+  publish:
+    topic: chat
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := config.Connections[0]
+	for _, got := range [][2]string{
+		{c.Publish.Topic, "acme/twitch/chat"},
+		{c.Publish.Routes["CLEARCHAT"], "acme/twitch/clears"},
+		{c.Subscribe.Topic, "acme/twitch/send/+"},
+		{c.controlTopic(), "acme/control/bot"},
+		{config.Connections[1].Publish.Topic, "twitch/chat"},
+	} {
+		if got[0] != got[1] {
+			t.Errorf("got topic %q, want %q", got[0], got[1])
+		}
+	}
+}
+
+func TestValidateLeavesRejectedConfig(t *testing.T) {
+	good := &Connection{Nick: "bot", Pass: "oauth:abc", Tenant: "rejected"}
+	good.Publish.Topic = "rejected/chat"
+	bad := &Connection{Nick: "other", Pass: "oauth:def", Mode: "sideways"}
+	bad.Publish.Topic = "twitch/other"
+
+	config := &Config{
+		Tenants:     []*Tenant{{Name: "rejected", TopicPrefix: "rejected/"}},
+		Connections: []*Connection{good, bad},
+	}
+	if err := config.Validate(); !errors.Is(err, errInvalidConfig) {
+		t.Fatalf("got error %v, want invalid config", err)
+	}
+
+	if good.Mode != "" || good.Client != "" || good.tenant != nil {
+		t.Errorf("rejected connection was filled in: mode %q, client %q", good.Mode, good.Client)
+	}
+	if config.Tenants[0].TopicPrefix != "rejected/" {
+		t.Errorf("rejected tenant's prefix changed to %q", config.Tenants[0].TopicPrefix)
+	}
+	if tenantMetrics.Get("rejected") != nil {
+		t.Error("rejected tenant has metrics")
+	}
+}
@@ -0,0 +1,77 @@
+package bridge
+
+import (
+	"errors"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	defaultConfirmTimeout = 10 * time.Second
+	defaultConfirmBackoff = time.Second
+	maxConfirmBackoff     = 30 * time.Second
+)
+
+var (
+	errBadConfirm     = errors.New("confirm timeout, retries, and backoff must not be negative")
+	errConfirmTimeout = errors.New("timed out waiting for the broker to acknowledge")
+)
+
+func (c *Connection) validateConfirm() error {
+	cf := &c.Publish.Confirm
+
+	if cf.Timeout < 0 || cf.Retries < 0 || cf.Backoff < 0 {
+		return errBadConfirm
+	}
+
+	if cf.Timeout == 0 {
+		cf.Timeout = defaultConfirmTimeout
+	}
+
+	if cf.Backoff == 0 {
+		cf.Backoff = defaultConfirmBackoff
+	}
+
+	return nil
+}
+
+// confirm waits for the broker to acknowledge each attempt of publish,
+// which completes once the message is sent at QoS 0, or acknowledged at
+// QoS 1 and 2. Failed attempts are retried with exponential backoff, up to
+// the configured number of retries, or until stop is closed.
+func (c *Connection) confirm(publish func() mqtt.Token, stop <-chan struct{}) error {
+	cf := &c.Publish.Confirm
+	backoff := cf.Backoff
+
+	for attempt := 0; ; attempt++ {
+		t := publish()
+
+		err := errConfirmTimeout
+		if t.WaitTimeout(cf.Timeout) {
+			err = t.Error()
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= cf.Retries {
+			return err
+		}
+
+		c.log.Warn().Err(err).Dur("backoff", backoff).Msg("publish failed, retrying")
+		c.count("publish_retries")
+
+		select {
+		case <-stop:
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxConfirmBackoff {
+			backoff = maxConfirmBackoff
+		}
+	}
+}
@@ -0,0 +1,1930 @@
+package bridge
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jakebailey/irc"
+	"github.com/rs/zerolog"
+)
+
+// MQTTClient is the subset of mqtt.Client used by connections.
+type MQTTClient interface {
+	Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token
+	Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token
+	Unsubscribe(topics ...string) mqtt.Token
+}
+
+// dialFunc connects and logs in to IRC.
+type dialFunc func(ctx context.Context, nick, pass string) (irc.Conn, error)
+
+// stableSession is how long an IRC connection must last for its loss to
+// no longer count towards the reconnect backoff.
+const stableSession = time.Minute
+
+type Connection struct {
+	// Name, if set, identifies the connection in logs, metrics, readiness
+	// checks, status and stats payloads, and Home Assistant and Homie
+	// devices, and is the {connection} topic placeholder, all of which
+	// otherwise use its nick. Names must be unique.
+	Name string `yaml:",omitempty"`
+
+	Nick string
+	Pass string
+
+	// NickFile and PassFile, if set, name files to read the nick and pass
+	// from, so they need not be kept in the config.
+	NickFile string `yaml:"nick_file,omitempty"`
+	PassFile string `yaml:"pass_file,omitempty"`
+
+	Tenant string `yaml:",omitempty"`
+
+	// Mode is "read" to only publish chat, "write" to only send it, or
+	// "readwrite" (the default, or "read" for anonymous connections).
+	// DryRun reads from IRC and MQTT as usual, but logs what would be
+	// published and sent instead.
+	Mode   string `yaml:",omitempty"`
+	DryRun bool   `yaml:"dry_run,omitempty"`
+
+	// Client is "shared" (the default) to use the bridge's MQTT client, or
+	// "dedicated" to give the connection its own, with its own client ID,
+	// session, and will on its availability topic. Brokers, if set, are
+	// what a dedicated client connects to, failing over between them in
+	// order, instead of the bridge's brokers, and imply a dedicated client.
+	Client  string    `yaml:",omitempty"`
+	Brokers []*Broker `yaml:",omitempty"`
+
+	// ClientID is the Twitch application client ID used for Helix API
+	// calls. It defaults to the OAuth client ID.
+	ClientID string `yaml:"client_id,omitempty"`
+
+	// IRC configures the connection to Twitch chat. Transport is "tcp"
+	// (the default) for IRC over TLS, or "websocket" for IRC over a secure
+	// WebSocket on port 443, for networks which allow only HTTPS.
+	//
+	// Server replaces Twitch's server, for testing against something like
+	// fdgt: a host and port for tcp, or a ws:// or wss:// URL for
+	// websocket. TLS takes the same settings as a broker's, and Plaintext
+	// connects to a tcp server without TLS.
+	IRC IRCConfig `yaml:"irc,omitempty"`
+
+	// Proxy is a socks5, socks5h, http, or https URL of a proxy to connect
+	// to IRC, Helix, and EventSub through. Without it, HTTPS_PROXY or
+	// ALL_PROXY is used, unless NO_PROXY excludes the host.
+	Proxy string `yaml:",omitempty"`
+
+	// Log overrides logging for the connection. Level is the minimum level
+	// it logs at (debug, info, warn, or error), regardless of the bridge's
+	// level, and Label, if set, is added to its log lines to tell them
+	// apart.
+	Log LogConfig `yaml:",omitempty"`
+
+	// Middleware passes messages through middlewares in order, in both
+	// directions. Built in are "filter", which drops chat whose text
+	// matches any of the drop patterns or none of the keep patterns, and
+	// "redact", which replaces text matching any of patterns. Both take a
+	// direction option of inbound, outbound, or both (the default). Others
+	// can be added with RegisterMiddleware.
+	Middleware []MiddlewareConfig `yaml:",omitempty"`
+
+	// TopicPrefix is prepended to each of the connection's topics, after
+	// its tenant's prefix and other than the control topic, replacing the
+	// config's default prefix.
+	TopicPrefix string `yaml:"topic_prefix,omitempty"`
+
+	Publish PublishConfig
+
+	// Subscribe is a topic where chat messages to send are read. If it ends
+	// in a + wildcard, like twitch/send/+, that level names the channel and
+	// payloads are plain text rather than JSON. Messages are sent over
+	// IRC, or with Transport "helix" through the Helix Send Chat Message
+	// API, which reports whether each message was delivered; those results
+	// are published to ResultTopic, if set. A JSON message may carry its
+	// own qos and retain flag for its result, which otherwise uses QOS and
+	// is not retained. Line breaks and control characters are stripped
+	// from messages, and those over Twitch's 500 character limit are
+	// rejected, or with Split, sent as several messages split between
+	// words. Twitch drops a message identical to the last one sent to the
+	// channel within 30 seconds; Duplicates chooses whether such messages
+	// are skipped, delayed until they would be accepted, or suffixed with
+	// an invisible character ("skip", "delay", or "suffix"); messages too
+	// long for the suffix are delayed instead. JSON payloads
+	// like {"type":"announce","channel":"foo","message":"hi","color":"purple"}
+	// and {"type":"shoutout","channel":"foo","target":"bar"} make
+	// announcements and shoutouts through Helix, whatever the transport.
+	Subscribe SubscribeConfig
+
+	Status StatusConfig `yaml:",omitempty"`
+
+	// Availability is published with "online" while the connection is up
+	// and "offline" once it is down. Since connections share an MQTT
+	// client, a process crash is reported only on the bridge's own
+	// availability topic, so consumers should watch both.
+	Availability AvailabilityConfig `yaml:",omitempty"`
+
+	// RateLimit limits outbound messages. Class selects Twitch's limit
+	// for the account (regular, known, or verified), or Messages and
+	// Period may be set explicitly. Messages beyond the limit wait in a
+	// queue of the given size; when it is full, Overflow chooses whether
+	// the newest or oldest message is dropped. Without explicit limits,
+	// messages to channels where USERSTATE shows the account is the
+	// broadcaster or a moderator get Twitch's higher moderator limit.
+	RateLimit RateLimit `yaml:"rate_limit,omitempty"`
+
+	// Join paces joining channels to stay within Twitch's limits: at most
+	// Limit channels are joined per Period, in JOIN commands of up to
+	// Batch channels. Joins which Twitch rejects or does not confirm are
+	// retried with backoff, and if Topic is set, each channel's join state
+	// is published retained to Topic/<channel>.
+	Join JoinConfig `yaml:",omitempty"`
+
+	// Shard, if Channels is set, spreads the connection's channels evenly
+	// across as many IRC connections as needed to keep at most Channels in
+	// each. Channels joined at runtime go to the connection in the fewest,
+	// or to a new one once every connection is full. When a connection
+	// reconnects, or parts leave it with two channels fewer than another,
+	// channels are moved between them to even them out again.
+	Shard ShardConfig `yaml:",omitempty"`
+
+	// Reconnect controls the backoff between attempts to reconnect to IRC.
+	// A connection which has been silent for PingInterval (1m by default)
+	// is sent a PING, and is reconnected if nothing arrives within
+	// PingTimeout (15s by default).
+	Reconnect ReconnectConfig `yaml:",omitempty"`
+
+	// FirstChats, if Topic is set, is where users' first messages in each
+	// channel are also published, in the publish format and encoding,
+	// for greeting bots. Topic may be a template, like Publish.Topic.
+	FirstChats FirstChatsConfig `yaml:"first_chats,omitempty"`
+
+	// Blocklist rejects outbound chat messages, announcements, and
+	// whispers containing any of Phrases, ignoring case, or matching any
+	// of Patterns, which are regular expressions. Each rejection is
+	// published to Topic, if set, like
+	// {"channel":"foo","message":"...","match":"..."}.
+	Blocklist BlocklistConfig `yaml:",omitempty"`
+
+	// Restart controls restarting the connection when it fails or panics.
+	// With the on-failure policy, the default, it is restarted only then;
+	// with always, also when it gives up on reconnecting to IRC; and with
+	// never, not at all. If MaxRestarts is set, the connection stays
+	// stopped after that many restarts within Window (10m by default).
+	// Restarts are published, not retained, to the status topic's events
+	// subtopic.
+	Restart RestartConfig `yaml:",omitempty"`
+
+	// Control is a topic, within the tenant's control namespace, where
+	// {"action":"join","channel":"foo"} or {"action":"part","channel":"foo"}
+	// change the connection's channels at runtime.
+	Control ControlConfig `yaml:",omitempty"`
+
+	// Whisper publishes incoming whispers to Topic, and sends whispers
+	// like {"user":"foo","message":"hi"} from SendTopic via the Helix API.
+	// Incoming whispers are published like any other route; QOS applies to
+	// the SendTopic subscription.
+	Whisper WhisperConfig `yaml:",omitempty"`
+
+	// Moderation is a topic where ban, timeout, unban, and delete requests
+	// are made through the Helix API, with results published to
+	// ReplyTopic. If EventsTopic is set, CLEARCHAT and CLEARMSG are
+	// published there as structured moderation events instead of through
+	// the publish topics. EventsTopic may contain placeholders.
+	Moderation ModerationConfig `yaml:",omitempty"`
+
+	// Query is a topic where {"query":"status"} is answered on ReplyTopic
+	// with the connection's state: its shards and joined channels, queue
+	// depths, rate limit budgets, counters, and uptime.
+	Query QueryConfig `yaml:",omitempty"`
+
+	// Replay, if Topic is set, keeps the last Size (100 by default) chat
+	// messages published from each channel, and answers requests on Topic
+	// like {"channel":"foo","count":50} by publishing those messages to
+	// ReplyTopic, for consumers which connect late.
+	Replay ReplayConfig `yaml:",omitempty"`
+
+	// RoomSettings is a topic where requests like
+	// {"channel":"foo","setting":"slow","value":30} change chat room
+	// settings through the Helix API.
+	RoomSettings RoomSettingsConfig `yaml:"room_settings,omitempty"`
+
+	// RoomState, if Topic is set, publishes each channel's chat settings,
+	// retained, to Topic/<channel> whenever they change.
+	RoomState RoomStateConfig `yaml:"room_state,omitempty"`
+
+	// UserState, if Topic is set, publishes the connection's own badges
+	// and whether it moderates each channel, retained, to
+	// Topic/<channel> whenever they change.
+	UserState UserStateConfig `yaml:"user_state,omitempty"`
+
+	// Events, if Topic is set, publishes USERNOTICEs (subs, gifts, raids,
+	// and so on) decoded into structured events. Topic may contain
+	// placeholders, including {event} for the event type.
+	Events EventsConfig `yaml:",omitempty"`
+
+	// HomeAssistant, if Discovery is set, publishes Home Assistant MQTT
+	// discovery configs under Prefix ("homeassistant" by default) when the
+	// connection starts: sensors for the last message and event in each
+	// configured channel, and a binary sensor for the availability topic.
+	HomeAssistant HomeAssistantConfig `yaml:"home_assistant,omitempty"`
+
+	// EventSub, if Topic is set, subscribes to the listed EventSub Types
+	// (like stream.online or channel.follow) over a WebSocket for each of
+	// Channels, which default to the connection's channels, publishing
+	// notifications to Topic. The connection's token needs the scopes each
+	// type requires. Topic may contain placeholders, where {event} is the
+	// subscription type.
+	EventSub EventSubConfig `yaml:"eventsub,omitempty"`
+
+	// Homie, if Enabled, publishes the connection as a device following
+	// the Homie convention under Prefix ("homie" by default), with a node
+	// for each configured channel holding its last message, message rate,
+	// and room state.
+	Homie HomieConfig `yaml:",omitempty"`
+
+	// Cheers, if Topic is set, also publishes chat messages with bits in
+	// the parsed format, for alerting. Topic may contain placeholders.
+	Cheers CheersConfig `yaml:",omitempty"`
+
+	// Stats is a topic where a retained JSON document of the connection's
+	// activity is published every Interval.
+	Stats StatsConfig `yaml:",omitempty"`
+
+	// OAuth, if set, is used to refresh the access token instead of
+	// using a static pass.
+	OAuth OAuthConfig `yaml:"oauth,omitempty"`
+
+	tenant *Tenant
+	dial   dialFunc
+	ircTLS *tls.Config
+	token  *tokenSource
+	opts   *options // set by the bridge running the connection
+
+	commands        map[string]bool
+	excludeCommands map[string]bool
+	filters         messageFilters
+	middleware      []Middleware
+	scripts         *connScripts
+	enricher        *enricher
+	emoteSets       *emoteSets
+	allowUsers      map[string]bool
+	denyUsers       map[string]bool
+	sampleRates     map[string]float64
+	overrides       map[string]*ChannelOverride
+	blocklist       *blocklist
+
+	key string // identifies the connection across reloads
+
+	mu          sync.Mutex // guards Publish.Channels once running, and the fields below
+	shards      []*shard
+	joinLimiter *limiter
+	sendLim     *limiter
+	modLim      *limiter
+	joins       *joinTracker
+	stop        <-chan struct{}
+	guard       *panicGuard
+	startShard  func(*shard) // runs a shard added while running
+
+	rooms roomStates
+	users userStates
+	homie *homieDevice
+
+	replay  *replayBuffer
+	batcher *batcher // set by run before publishing starts
+
+	log     zerolog.Logger
+	elog    *errorLog
+	stats   connStats
+	metrics *expvar.Map // nil for unnamed connections
+}
+
+// IRCConfig is how a connection connects to Twitch chat.
+type IRCConfig struct {
+	Transport string    `yaml:",omitempty"`
+	Server    string    `yaml:",omitempty"`
+	TLS       BrokerTLS `yaml:",omitempty"`
+	Plaintext bool      `yaml:",omitempty"`
+}
+
+// LogConfig overrides logging for a connection.
+type LogConfig struct {
+	Level string `yaml:",omitempty"`
+	Label string `yaml:",omitempty"`
+}
+
+// PublishConfig is how a connection publishes the messages it reads
+// from IRC.
+type PublishConfig struct {
+	Topic    string
+	QOS      byte
+	Channels []string
+
+	// Expiry is the MQTT 5 message expiry of published messages.
+	Expiry time.Duration `yaml:",omitempty"`
+
+	// Retain sets the retain flag on published messages.
+	// RetainCommands overrides it for specific IRC commands.
+	Retain         bool            `yaml:",omitempty"`
+	RetainCommands map[string]bool `yaml:"retain_commands,omitempty"`
+
+	// Routes maps IRC commands to their own topics, falling back to
+	// Topic. Routing a command to an empty topic drops it.
+	Routes map[string]string `yaml:",omitempty"`
+
+	// Commands, if set, limits publishing to the listed IRC commands.
+	// ExcludeCommands are never published.
+	Commands        []string `yaml:",omitempty"`
+	ExcludeCommands []string `yaml:"exclude_commands,omitempty"`
+
+	// Filter drops chat messages by their text and sender.
+	Filter MessageFilter `yaml:",omitempty"`
+
+	// AllowUsers, if set, limits publishing chat messages to the listed
+	// users. DenyUsers are never published. Both are matched against
+	// the sender's login and display name, ignoring case.
+	AllowUsers []string `yaml:"allow_users,omitempty"`
+	DenyUsers  []string `yaml:"deny_users,omitempty"`
+
+	// Sample publishes only a fraction of the chat messages (PRIVMSG)
+	// of busy channels, between 0 and 1: Channels maps channels to
+	// their own rates, and Rate applies to the others, which are all
+	// published if it is unset. Other commands, like USERNOTICE and
+	// CLEARCHAT, are always published.
+	Sample SampleConfig `yaml:",omitempty"`
+
+	// Dedupe, if set, is how long to remember published message IDs,
+	// dropping messages already published to the same topic by any
+	// connection.
+	Dedupe time.Duration `yaml:",omitempty"`
+
+	// Queue buffers messages between reading IRC and publishing them,
+	// with Workers publishing concurrently (possibly out of order). When
+	// full, Overflow is "drop-newest" (the default), "drop-oldest", or
+	// "block", which stalls reading IRC.
+	Queue QueueConfig `yaml:",omitempty"`
+
+	// Confirm, if enabled, waits for the broker to acknowledge each
+	// publish, retrying failures up to Retries times with exponential
+	// backoff starting at Backoff (1s by default). An attempt fails if
+	// it is not acknowledged within Timeout (10s by default). Workers
+	// wait for each message, so more workers may be needed to keep up.
+	Confirm ConfirmConfig `yaml:",omitempty"`
+
+	// Enrich, if Enabled, adds the sender's profile image and
+	// broadcaster type and the channel's game and title to parsed
+	// payloads, looked up through the Helix API and cached for TTL
+	// (10m by default).
+	Enrich EnrichConfig `yaml:",omitempty"`
+
+	// ThirdPartyEmotes, if Enabled, adds the BTTV, FFZ, and 7TV emotes
+	// used in each message to parsed payloads. The global and channel
+	// emote sets of each of Providers (all of them by default, earlier
+	// ones taking precedence) are fetched and cached for TTL (1h by
+	// default).
+	ThirdPartyEmotes ThirdPartyEmotesConfig `yaml:"third_party_emotes,omitempty"`
+
+	// Script customizes publishing with expressions in Go syntax,
+	// evaluated against each message after filtering. Drop discards
+	// messages for which it is true, Topic returns the topic to publish
+	// to (which must be within the tenant's prefix), and Fields adds
+	// the named values to json and parsed payloads. Scripts may use
+	// the variables command, channel, user, display_name, user_id,
+	// room_id, message, bits, mod, subscriber, vip, is_action,
+	// first_msg, returning_chatter, nick, topic, and tags (like
+	// tags["color"]), and the functions contains, hasPrefix,
+	// hasSuffix, lower, upper, trim, replace, len, matches, oneOf,
+	// cond, and str. A script which fails is logged and ignored.
+	Script ScriptConfig `yaml:",omitempty"`
+
+	// Self chooses what happens to messages the bridge sent when they
+	// are read back by other connections: "suppress" drops them, and
+	// "tag" marks them with "self": true in json and parsed payloads.
+	// By default they are published like any other message.
+	Self string `yaml:",omitempty"`
+
+	// Overrides change the topic, QoS, filters, and sample rate of
+	// the listed channels (see ChannelOverride).
+	Overrides map[string]*ChannelOverride `yaml:",omitempty"`
+
+	// Targets are further topics to publish each message to, each
+	// with its own payload format and filters, applied on top of the
+	// connection's.
+	Targets []*PublishTarget `yaml:",omitempty"`
+
+	// Format is the payload format: "json" (the default) for the IRC
+	// message as JSON, "parsed" for typed tag fields, or "raw" for the
+	// untouched IRC line. Both json and parsed payloads include
+	// received_at, when the bridge read the message, and sent_at, when
+	// Twitch says it was sent. Parsed payloads also repeat sent_at as
+	// timestamp, which is deprecated.
+	Format string `yaml:",omitempty"`
+
+	// Encoding is how json and parsed payloads are serialized: "json"
+	// (the default), "msgpack", or "protobuf" (see twitchmqtt.proto).
+	Encoding string `yaml:",omitempty"`
+
+	// Compression, if Algorithm is "gzip" or "zstd", compresses payloads
+	// of at least Threshold bytes (1024 by default). Over MQTT 5 they are
+	// marked with a content-encoding user property, and otherwise
+	// wrapped in a JSON envelope like
+	// {"content_encoding":"gzip","payload":"<base64>"}, whose base64
+	// makes the compressed bytes a third larger.
+	Compression CompressionConfig `yaml:",omitempty"`
+
+	// Batch, if Size or Interval is set, publishes messages to each
+	// topic together as a JSON array of their payloads, once Size
+	// messages (100 by default) are waiting or Interval (1s by
+	// default) has passed since the first. Raw lines are batched as
+	// strings. Batching requires the json encoding.
+	Batch BatchConfig `yaml:",omitempty"`
+}
+
+// SampleConfig is the fraction of chat messages a connection publishes.
+type SampleConfig struct {
+	Rate     float64            `yaml:",omitempty"`
+	Channels map[string]float64 `yaml:",omitempty"`
+}
+
+// QueueConfig buffers messages between reading IRC and publishing them.
+type QueueConfig struct {
+	Size     int    `yaml:",omitempty"`
+	Workers  int    `yaml:",omitempty"`
+	Overflow string `yaml:",omitempty"`
+}
+
+// ConfirmConfig controls waiting for the broker to acknowledge publishes.
+type ConfirmConfig struct {
+	Enabled bool          `yaml:",omitempty"`
+	Timeout time.Duration `yaml:",omitempty"`
+	Retries int           `yaml:",omitempty"`
+	Backoff time.Duration `yaml:",omitempty"`
+}
+
+// EnrichConfig adds user and channel details to parsed payloads.
+type EnrichConfig struct {
+	Enabled bool          `yaml:",omitempty"`
+	TTL     time.Duration `yaml:",omitempty"`
+}
+
+// ThirdPartyEmotesConfig adds third party emotes to parsed payloads.
+type ThirdPartyEmotesConfig struct {
+	Enabled   bool          `yaml:",omitempty"`
+	Providers []string      `yaml:",omitempty"`
+	TTL       time.Duration `yaml:",omitempty"`
+}
+
+// ScriptConfig customizes publishing with script expressions.
+type ScriptConfig struct {
+	Drop   string            `yaml:",omitempty"`
+	Topic  string            `yaml:",omitempty"`
+	Fields map[string]string `yaml:",omitempty"`
+}
+
+// CompressionConfig compresses published payloads.
+type CompressionConfig struct {
+	Algorithm string `yaml:",omitempty"`
+	Threshold int    `yaml:",omitempty"`
+}
+
+// BatchConfig publishes messages together in batches.
+type BatchConfig struct {
+	Size     int           `yaml:",omitempty"`
+	Interval time.Duration `yaml:",omitempty"`
+}
+
+// SubscribeConfig is where a connection reads the chat messages it
+// sends.
+type SubscribeConfig struct {
+	Topic       string
+	QOS         byte
+	Transport   string `yaml:",omitempty"`
+	ResultTopic string `yaml:"result_topic,omitempty"`
+	Split       bool   `yaml:",omitempty"`
+	Duplicates  string `yaml:",omitempty"`
+}
+
+// StatusConfig is where a connection publishes its status.
+type StatusConfig struct {
+	Topic string
+	QOS   byte
+}
+
+// AvailabilityConfig is where a connection publishes whether it is up.
+type AvailabilityConfig struct {
+	Topic string
+	QOS   byte
+}
+
+// JoinConfig paces joining channels.
+type JoinConfig struct {
+	Batch  int           `yaml:",omitempty"`
+	Limit  int           `yaml:",omitempty"`
+	Period time.Duration `yaml:",omitempty"`
+	Topic  string        `yaml:",omitempty"`
+	QOS    byte          `yaml:",omitempty"`
+}
+
+// ShardConfig spreads a connection's channels across IRC connections.
+type ShardConfig struct {
+	Channels int `yaml:",omitempty"`
+}
+
+// ReconnectConfig controls reconnecting to IRC.
+type ReconnectConfig struct {
+	MinDelay     time.Duration `yaml:"min_delay"`
+	MaxDelay     time.Duration `yaml:"max_delay"`
+	MaxAttempts  int           `yaml:"max_attempts"`
+	PingInterval time.Duration `yaml:"ping_interval,omitempty"`
+	PingTimeout  time.Duration `yaml:"ping_timeout,omitempty"`
+}
+
+// FirstChatsConfig is where users' first messages are also published.
+type FirstChatsConfig struct {
+	Topic string
+	QOS   byte
+}
+
+// BlocklistConfig rejects outbound messages.
+type BlocklistConfig struct {
+	Phrases  []string `yaml:",omitempty"`
+	Patterns []string `yaml:",omitempty"`
+	Topic    string   `yaml:",omitempty"`
+	QOS      byte     `yaml:",omitempty"`
+}
+
+// RestartConfig controls restarting a connection.
+type RestartConfig struct {
+	Policy      string        `yaml:",omitempty"`
+	MaxRestarts int           `yaml:"max_restarts,omitempty"`
+	Window      time.Duration `yaml:",omitempty"`
+}
+
+// ControlConfig is where a connection's channels are changed at
+// runtime.
+type ControlConfig struct {
+	Topic string
+	QOS   byte
+}
+
+// WhisperConfig is where whispers are published and sent from.
+type WhisperConfig struct {
+	Topic     string
+	SendTopic string `yaml:"send_topic"`
+	QOS       byte
+}
+
+// ModerationConfig is where moderation requests are made.
+type ModerationConfig struct {
+	Topic       string
+	ReplyTopic  string `yaml:"reply_topic"`
+	EventsTopic string `yaml:"events_topic,omitempty"`
+	QOS         byte
+}
+
+// QueryConfig is where a connection answers queries about its state.
+type QueryConfig struct {
+	Topic      string
+	ReplyTopic string `yaml:"reply_topic"`
+	QOS        byte
+}
+
+// ReplayConfig replays recent chat messages on request.
+type ReplayConfig struct {
+	Topic      string
+	ReplyTopic string `yaml:"reply_topic"`
+	QOS        byte
+	Size       int `yaml:",omitempty"`
+}
+
+// RoomSettingsConfig is where chat room settings are changed.
+type RoomSettingsConfig struct {
+	Topic string
+	QOS   byte
+}
+
+// RoomStateConfig is where each channel's chat settings are published.
+type RoomStateConfig struct {
+	Topic string
+	QOS   byte
+}
+
+// UserStateConfig is where a connection's own state in each channel
+// is published.
+type UserStateConfig struct {
+	Topic string
+	QOS   byte
+}
+
+// EventsConfig is where USERNOTICEs are published as structured events.
+type EventsConfig struct {
+	Topic string
+	QOS   byte
+}
+
+// HomeAssistantConfig publishes Home Assistant MQTT discovery configs.
+type HomeAssistantConfig struct {
+	Discovery bool   `yaml:",omitempty"`
+	Prefix    string `yaml:",omitempty"`
+	QOS       byte   `yaml:",omitempty"`
+}
+
+// EventSubConfig bridges EventSub notifications.
+type EventSubConfig struct {
+	Topic    string
+	QOS      byte
+	Types    []string
+	Channels []string `yaml:",omitempty"`
+}
+
+// HomieConfig publishes a connection as a Homie device.
+type HomieConfig struct {
+	Enabled bool   `yaml:",omitempty"`
+	Prefix  string `yaml:",omitempty"`
+}
+
+// CheersConfig is where chat messages with bits are also published.
+type CheersConfig struct {
+	Topic string
+	QOS   byte
+}
+
+// StatsConfig is where a connection's activity is published.
+type StatsConfig struct {
+	Topic    string
+	QOS      byte
+	Interval time.Duration
+}
+
+// OAuthConfig refreshes a connection's access token.
+type OAuthConfig struct {
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RefreshToken string `yaml:"refresh_token"`
+
+	ClientSecretFile string `yaml:"client_secret_file,omitempty"`
+	RefreshTokenFile string `yaml:"refresh_token_file,omitempty"`
+}
+
+// options returns the options of the bridge running the connection.
+func (c *Connection) options() *options {
+	if c.opts == nil {
+		return newOptions(nil)
+	}
+	return c.opts
+}
+
+const (
+	formatJSON   = "json"
+	formatParsed = "parsed"
+	formatRaw    = "raw"
+)
+
+const (
+	clientShared    = "shared"
+	clientDedicated = "dedicated"
+)
+
+const (
+	modeRead      = "read"
+	modeWrite     = "write"
+	modeReadWrite = "readwrite"
+)
+
+func (c *Connection) validate(tenants map[string]*Tenant) error {
+	key, err := c.reloadKey()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	fail := func(field string, err error) {
+		errs = append(errs, fieldErr(field, err))
+	}
+
+	refresh := c.OAuth != (Connection{}).OAuth
+
+	if refresh {
+		if c.OAuth.ClientID == "" || c.OAuth.ClientSecret == "" || c.OAuth.RefreshToken == "" || c.Pass != "" {
+			fail("oauth", errBadOAuth)
+		}
+	}
+
+	// Connections without a pass log in anonymously, which only allows
+	// reading chat.
+	anonymous := c.Pass == "" && !refresh
+
+	switch c.Mode {
+	case "":
+		if anonymous {
+			c.Mode = modeRead
+		} else {
+			c.Mode = modeReadWrite
+		}
+	case modeRead, modeWrite, modeReadWrite:
+	default:
+		fail("mode", errBadMode)
+	}
+
+	if anonymous {
+		if c.Mode == modeWrite || c.Mode == modeReadWrite {
+			fail("mode", errAnonymousWrite)
+		}
+
+		if c.Nick == "" {
+			c.Nick = anonymousNick()
+		}
+	} else {
+		if c.Nick == "" {
+			fail("nick", errEmptyNick)
+		}
+
+		if !refresh && !strings.HasPrefix(c.Pass, "oauth:") {
+			fail("pass", errNonOauthPass)
+		}
+	}
+
+	if c.Log.Level != "" {
+		if _, err := zerolog.ParseLevel(strings.ToLower(c.Log.Level)); err != nil {
+			fail("log.level", errBadLogLevel)
+		}
+	}
+
+	if err := c.validateWhisper(); err != nil {
+		fail("whisper", err)
+	}
+
+	if err := c.validateModeration(); err != nil {
+		fail("moderation", err)
+	}
+
+	if err := c.validateQuery(); err != nil {
+		fail("query", err)
+	}
+
+	if err := c.validateReplay(); err != nil {
+		fail("replay", err)
+	}
+
+	if err := c.validateRoomSettings(); err != nil {
+		fail("room_settings", err)
+	}
+
+	if err := c.validateHomeAssistant(); err != nil {
+		fail("home_assistant", err)
+	}
+
+	if err := c.validateEventSub(); err != nil {
+		fail("eventsub", err)
+	}
+
+	if err := c.validateHomie(); err != nil {
+		fail("homie", err)
+	}
+
+	if err := c.validateRoomState(); err != nil {
+		fail("room_state", err)
+	}
+
+	if err := c.validateUserState(); err != nil {
+		fail("user_state", err)
+	}
+
+	if err := c.validateFilters(); err != nil {
+		fail("publish", err)
+	}
+
+	if err := c.validateSample(); err != nil {
+		fail("publish.sample", err)
+	}
+
+	if err := c.validateOverrides(); err != nil {
+		fail("publish", err)
+	}
+
+	if err := c.validateTargets(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.validateMiddleware(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.validateScript(); err != nil {
+		fail("publish.script", err)
+	}
+
+	if err := c.validateSelf(); err != nil {
+		fail("publish.self", err)
+	}
+
+	if err := c.validatePublishQueue(); err != nil {
+		fail("publish.queue", err)
+	}
+
+	if err := c.validateTransport(); err != nil {
+		fail("subscribe", err)
+	}
+
+	if err := c.validateDuplicates(); err != nil {
+		fail("subscribe", err)
+	}
+
+	if err := c.validateEnrich(); err != nil {
+		fail("publish.enrich", err)
+	}
+
+	if err := c.validateThirdPartyEmotes(); err != nil {
+		fail("publish.third_party_emotes", err)
+	}
+
+	if err := c.validateCompression(); err != nil {
+		fail("publish.compression", err)
+	}
+
+	if err := c.validateBatch(); err != nil {
+		fail("publish.batch", err)
+	}
+
+	if err := c.validateConfirm(); err != nil {
+		fail("publish.confirm", err)
+	}
+
+	if err := c.validateShard(); err != nil {
+		fail("shard", err)
+	}
+
+	if err := c.validateStats(); err != nil {
+		fail("stats", err)
+	}
+
+	if !c.publishes() && c.Subscribe.Topic == "" {
+		fail("subscribe.topic", errBadTopics)
+	}
+
+	if c.Publish.Topic != "" && c.Publish.Topic == c.Subscribe.Topic {
+		fail("subscribe.topic", errBadTopics)
+	}
+
+	if len(c.Publish.Channels) > 0 && !c.publishes() {
+		fail("publish.channels", errChannelsNoTopic)
+	}
+
+	if len(c.Publish.Routes) > 0 {
+		routes := make(map[string]string, len(c.Publish.Routes))
+		for cmd, topic := range c.Publish.Routes {
+			if topic != "" && topic == c.Subscribe.Topic {
+				fail("publish.routes."+cmd, errBadTopics)
+			}
+			routes[strings.ToUpper(cmd)] = topic
+		}
+		c.Publish.Routes = routes
+	}
+
+	if len(c.Publish.RetainCommands) > 0 {
+		retain := make(map[string]bool, len(c.Publish.RetainCommands))
+		for cmd, r := range c.Publish.RetainCommands {
+			retain[strings.ToUpper(cmd)] = r
+		}
+		c.Publish.RetainCommands = retain
+	}
+
+	switch c.Publish.Format {
+	case "", formatJSON, formatParsed, formatRaw:
+	default:
+		fail("publish.format", errBadFormat)
+	}
+
+	switch c.Publish.Encoding {
+	case "", encodingJSON, encodingMsgpack, encodingProtobuf:
+	default:
+		fail("publish.encoding", errBadEncoding)
+	}
+
+	if c.Publish.Dedupe < 0 {
+		fail("publish.dedupe", errBadDedupe)
+	}
+
+	if c.Publish.Expiry < 0 {
+		fail("publish.expiry", errBadExpiry)
+	}
+
+	if err := c.validateIRC(); err != nil {
+		fail("irc", err)
+	}
+
+	if c.Proxy != "" {
+		if _, err := parseProxy(c.Proxy); err != nil {
+			fail("proxy", err)
+		}
+	}
+
+	switch c.Client {
+	case "":
+		c.Client = clientShared
+		if len(c.Brokers) > 0 {
+			c.Client = clientDedicated
+		}
+	case clientShared:
+		if len(c.Brokers) > 0 {
+			fail("client", errSharedBrokers)
+		}
+	case clientDedicated:
+	default:
+		fail("client", errBadClient)
+	}
+
+	if err := validateBrokers(c.Brokers); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.validateRateLimit(); err != nil {
+		fail("rate_limit", err)
+	}
+
+	if err := c.validateJoin(); err != nil {
+		fail("join", err)
+	}
+
+	if c.Reconnect.MinDelay < 0 || c.Reconnect.MaxDelay < 0 || c.Reconnect.MaxAttempts < 0 ||
+		c.Reconnect.PingInterval < 0 || c.Reconnect.PingTimeout < 0 {
+		fail("reconnect", errBadReconnect)
+	}
+
+	if c.Reconnect.MaxDelay != 0 && c.Reconnect.MaxDelay < c.Reconnect.MinDelay {
+		fail("reconnect.max_delay", errBadReconnect)
+	}
+
+	if err := c.validateRestart(); err != nil {
+		fail("restart", err)
+	}
+
+	if err := c.validateBlocklist(); err != nil {
+		fail("blocklist", err)
+	}
+
+	if err := c.validateFirstChats(); err != nil {
+		fail("first_chats", err)
+	}
+
+	qos := []struct {
+		field string
+		qos   byte
+	}{
+		{"publish.qos", c.Publish.QOS},
+		{"subscribe.qos", c.Subscribe.QOS},
+		{"status.qos", c.Status.QOS},
+		{"blocklist.qos", c.Blocklist.QOS},
+		{"first_chats.qos", c.FirstChats.QOS},
+		{"availability.qos", c.Availability.QOS},
+		{"control.qos", c.Control.QOS},
+		{"whisper.qos", c.Whisper.QOS},
+		{"moderation.qos", c.Moderation.QOS},
+		{"room_settings.qos", c.RoomSettings.QOS},
+		{"stats.qos", c.Stats.QOS},
+		{"join.qos", c.Join.QOS},
+		{"room_state.qos", c.RoomState.QOS},
+		{"user_state.qos", c.UserState.QOS},
+		{"events.qos", c.Events.QOS},
+		{"cheers.qos", c.Cheers.QOS},
+		{"eventsub.qos", c.EventSub.QOS},
+		{"home_assistant.qos", c.HomeAssistant.QOS},
+	}
+
+	for _, q := range qos {
+		if q.qos > 2 {
+			fail(q.field, errBadQOS)
+		}
+	}
+
+	for i, s := range c.Publish.Channels {
+		s = normalizeChannel(s)
+		if s == "" {
+			fail(fmt.Sprintf("publish.channels[%d]", i), errEmptyChannel)
+			continue
+		}
+		c.Publish.Channels[i] = s
+	}
+
+	if strings.ContainsAny(c.Control.Topic, "+#") {
+		fail("control.topic", errBadControlTopic)
+	}
+
+	name := c.Tenant
+	if name == "" {
+		name = defaultTenantName
+	}
+
+	t, ok := tenants[name]
+	if !ok {
+		fail("tenant", errUnknownTenant)
+	} else if err := c.validateTopics(t, tenants); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	c.tenant = t
+	c.key = key + t.key
+	return nil
+}
+
+// ready readies the validated connection, the index'th of its config, to
+// run.
+func (c *Connection) ready(index int) {
+	c.metrics = namedMetrics(c.Name)
+
+	if c.OAuth != (Connection{}).OAuth {
+		c.token = newTokenSource(c.OAuth.ClientID, c.OAuth.ClientSecret, c.OAuth.RefreshToken)
+	}
+
+	c.setLogger(index)
+}
+
+// validateTopics checks that the connection's topics belong to its tenant,
+// returning every error found.
+func (c *Connection) validateTopics(t *Tenant, tenants map[string]*Tenant) error {
+	var errs []error
+	fail := func(field string, err error) {
+		errs = append(errs, fieldErr(field, err))
+	}
+
+	if err := checkTopicTemplate(c.Publish.Topic); err != nil {
+		fail("publish.topic", err)
+	}
+
+	if err := t.checkTopic(tenants, topicTemplateFilter(c.Publish.Topic)); err != nil {
+		fail("publish.topic", err)
+	}
+
+	for cmd, topic := range c.Publish.Routes {
+		if err := checkTopicTemplate(topic); err != nil {
+			fail("publish.routes."+cmd, err)
+		}
+
+		if err := t.checkTopic(tenants, topicTemplateFilter(topic)); err != nil {
+			fail("publish.routes."+cmd, err)
+		}
+	}
+
+	if err := t.checkTopic(tenants, c.Subscribe.Topic); err != nil {
+		fail("subscribe.topic", err)
+	}
+
+	if err := t.checkTopic(tenants, c.Subscribe.ResultTopic); err != nil {
+		fail("subscribe.result_topic", err)
+	}
+
+	if err := t.checkTopic(tenants, c.Whisper.SendTopic); err != nil {
+		fail("whisper.send_topic", err)
+	}
+
+	if err := t.checkTopic(tenants, c.Moderation.Topic); err != nil {
+		fail("moderation.topic", err)
+	}
+
+	if err := t.checkTopic(tenants, c.Moderation.ReplyTopic); err != nil {
+		fail("moderation.reply_topic", err)
+	}
+
+	if err := checkTopicTemplate(c.Moderation.EventsTopic); err != nil {
+		fail("moderation.events_topic", err)
+	}
+
+	if err := t.checkTopic(tenants, topicTemplateFilter(c.Moderation.EventsTopic)); err != nil {
+		fail("moderation.events_topic", err)
+	}
+
+	if err := t.checkTopic(tenants, c.Query.Topic); err != nil {
+		fail("query.topic", err)
+	}
+
+	if err := t.checkTopic(tenants, c.Query.ReplyTopic); err != nil {
+		fail("query.reply_topic", err)
+	}
+
+	if err := t.checkTopic(tenants, c.Replay.Topic); err != nil {
+		fail("replay.topic", err)
+	}
+
+	if err := t.checkTopic(tenants, c.Replay.ReplyTopic); err != nil {
+		fail("replay.reply_topic", err)
+	}
+
+	if err := t.checkTopic(tenants, c.RoomSettings.Topic); err != nil {
+		fail("room_settings.topic", err)
+	}
+
+	if err := t.checkTopic(tenants, c.Stats.Topic); err != nil {
+		fail("stats.topic", err)
+	}
+
+	if err := t.checkTopic(tenants, c.Blocklist.Topic); err != nil {
+		fail("blocklist.topic", err)
+	}
+
+	if err := t.checkTopic(tenants, topicTemplateFilter(c.FirstChats.Topic)); err != nil {
+		fail("first_chats.topic", err)
+	}
+
+	if err := t.checkTopic(tenants, c.Status.Topic); err != nil {
+		fail("status.topic", err)
+	}
+
+	if err := t.checkTopic(tenants, c.Availability.Topic); err != nil {
+		fail("availability.topic", err)
+	}
+
+	if c.Join.Topic != "" {
+		if err := t.checkTopic(tenants, c.Join.Topic+"/+"); err != nil {
+			fail("join.topic", err)
+		}
+	}
+
+	if err := checkTopicTemplate(c.Events.Topic); err != nil {
+		fail("events.topic", err)
+	}
+
+	if err := t.checkTopic(tenants, topicTemplateFilter(c.Events.Topic)); err != nil {
+		fail("events.topic", err)
+	}
+
+	if c.HomeAssistant.Discovery {
+		if err := t.checkTopic(tenants, c.HomeAssistant.Prefix+"/#"); err != nil {
+			fail("home_assistant.prefix", err)
+		}
+	}
+
+	if c.Homie.Enabled {
+		if err := t.checkTopic(tenants, c.Homie.Prefix+"/#"); err != nil {
+			fail("homie.prefix", err)
+		}
+	}
+
+	if err := checkTopicTemplate(c.EventSub.Topic); err != nil {
+		fail("eventsub.topic", err)
+	}
+
+	if err := t.checkTopic(tenants, topicTemplateFilter(c.EventSub.Topic)); err != nil {
+		fail("eventsub.topic", err)
+	}
+
+	if err := checkTopicTemplate(c.Cheers.Topic); err != nil {
+		fail("cheers.topic", err)
+	}
+
+	if err := t.checkTopic(tenants, topicTemplateFilter(c.Cheers.Topic)); err != nil {
+		fail("cheers.topic", err)
+	}
+
+	if c.RoomState.Topic != "" {
+		if err := t.checkTopic(tenants, c.RoomState.Topic+"/+"); err != nil {
+			fail("room_state.topic", err)
+		}
+	}
+
+	if c.UserState.Topic != "" {
+		if err := t.checkTopic(tenants, c.UserState.Topic+"/+"); err != nil {
+			fail("user_state.topic", err)
+		}
+	}
+
+	for i, target := range c.Publish.Targets {
+		if err := t.checkTopic(tenants, topicTemplateFilter(target.Topic)); err != nil {
+			fail(fmt.Sprintf("publish.targets[%d].topic", i), err)
+		}
+	}
+
+	for ch, o := range c.Publish.Overrides {
+		if o == nil || o.Topic == "" {
+			continue
+		}
+		if err := t.checkTopic(tenants, topicTemplateFilter(o.Topic)); err != nil {
+			fail("publish.overrides."+ch+".topic", err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// canRead reports whether messages read from IRC may be published.
+func (c *Connection) canRead() bool {
+	return c.Mode != modeWrite && !c.options().writeOnly
+}
+
+// canWrite reports whether messages may be sent to IRC.
+func (c *Connection) canWrite() bool {
+	return c.Mode != modeRead && !c.options().readOnly
+}
+
+// run runs the connection until ctx is canceled or it gives up on
+// connecting to IRC, returning an error if it fails to start or one of its
+// goroutines panics.
+func (c *Connection) run(ctx context.Context, client MQTTClient) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := ctx.Done()
+
+	// A panic in any of the run's goroutines stops the run.
+	g := &panicGuard{c: c, cancel: cancel}
+
+	if c.dryRun() {
+		c.log.Warn().Msg("dry run, nothing will be published or sent")
+		if _, ok := client.(dryRunClient); !ok {
+			client = dryRunClient{MQTTClient: client, log: c.log}
+		}
+	}
+
+	dial := c.dial
+	if dial == nil {
+		dial = c.ircDialer()
+	}
+
+	shards := c.newShards()
+	queue := c.newSendQueue()
+
+	joins := newJoinTracker(c, client)
+
+	c.mu.Lock()
+	c.shards, c.joinLimiter, c.joins, c.stop, c.guard = shards, c.newJoinLimiter(), joins, stop, g
+	c.mu.Unlock()
+
+	g.goSafe(func() { c.rejoinLoop(joins, stop) })
+
+	if len(shards) > 1 {
+		c.log.Info().Int("shards", len(shards)).Msg("sharding channels")
+	}
+
+	var topics []string
+	defer func() {
+		if len(topics) > 0 {
+			client.Unsubscribe(topics...)
+		}
+	}()
+
+	subscribe := func(topic string, qos byte, h mqtt.MessageHandler) error {
+		if t := client.Subscribe(topic, qos, g.handler(h)); t.Wait() && t.Error() != nil {
+			return fmt.Errorf("subscribe to %s failed: %w", topic, t.Error())
+		}
+		topics = append(topics, topic)
+		return nil
+	}
+
+	// Part and quit when stopped, which ends reading; publishing continues
+	// until the publish queue is drained.
+	g.goSafe(func() {
+		<-stop
+		for _, s := range c.runningShards() {
+			if err := part(s.conn, s.channels()...); err != nil && err != errNotConnected {
+				c.log.Error().Err(err).Msg("part failed")
+			}
+			if err := quit(s.conn); err != nil && err != errNotConnected {
+				c.log.Error().Err(err).Msg("quit failed")
+			}
+
+			// Stop reading if the server does not close the connection.
+			s.conn.setReadDeadline(time.Now().Add(quitTimeout))
+		}
+	})
+
+	if c.Subscribe.Topic != "" && !c.canWrite() {
+		c.log.Warn().Str("topic", c.Subscribe.Topic).Msg("connection is read-only, ignoring subscribe topic")
+	}
+
+	if topic := c.Subscribe.Topic; topic != "" && c.canWrite() {
+		c.log.Info().Str("topic", topic).Uint8("qos", c.Subscribe.QOS).Msg("subscribing")
+
+		// Messages can be sent to any channel over any connection.
+		g.goSafe(func() { c.sendLoop(queue, shards[0].conn, client, stop) })
+
+		if err := subscribe(topic, c.Subscribe.QOS, c.sendHandler(queue)); err != nil {
+			return err
+		}
+	}
+
+	if topic := c.Whisper.SendTopic; topic != "" {
+		c.log.Info().Str("topic", topic).Uint8("qos", c.Whisper.QOS).Msg("sending whispers")
+
+		whispers := make(chan whisper, defaultSendQueue)
+		g.goSafe(func() { c.whisperLoop(whispers, client, stop) })
+
+		if err := subscribe(topic, c.Whisper.QOS, c.whisperHandler(whispers)); err != nil {
+			return err
+		}
+	}
+
+	if topic := c.Moderation.Topic; topic != "" {
+		c.log.Info().Str("topic", topic).Uint8("qos", c.Moderation.QOS).Msg("accepting moderation requests")
+
+		requests := make(chan modRequest, defaultSendQueue)
+		g.goSafe(func() { c.moderationLoop(requests, client, stop) })
+
+		if err := subscribe(topic, c.Moderation.QOS, c.moderationHandler(requests)); err != nil {
+			return err
+		}
+	}
+
+	if topic := c.Replay.Topic; topic != "" && c.canRead() {
+		c.log.Info().Str("topic", topic).Uint8("qos", c.Replay.QOS).Msg("accepting replay requests")
+
+		requests := make(chan replayRequest, defaultSendQueue)
+		g.goSafe(func() { c.replayLoop(requests, client, stop) })
+
+		if err := subscribe(topic, c.Replay.QOS, c.replayHandler(requests)); err != nil {
+			return err
+		}
+	}
+
+	if topic := c.RoomSettings.Topic; topic != "" {
+		c.log.Info().Str("topic", topic).Uint8("qos", c.RoomSettings.QOS).Msg("accepting room settings")
+
+		settings := make(chan roomSetting, defaultSendQueue)
+		g.goSafe(func() { c.roomSettingsLoop(settings, stop) })
+
+		if err := subscribe(topic, c.RoomSettings.QOS, c.roomSettingsHandler(settings)); err != nil {
+			return err
+		}
+	}
+
+	if topic := c.controlTopic(); topic != "" {
+		c.log.Info().Str("topic", topic).Uint8("qos", c.Control.QOS).Msg("accepting control messages")
+
+		if err := subscribe(topic, c.Control.QOS, c.controlHandler()); err != nil {
+			return err
+		}
+	}
+
+	if c.publishes() && !c.canRead() {
+		c.log.Warn().Msg("connection is write-only, ignoring publish topics")
+	}
+
+	if c.publishes() && c.canRead() {
+		if c.Publish.Topic != "" {
+			c.log.Info().Str("topic", c.Publish.Topic).Uint8("qos", c.Publish.QOS).Msg("publishing")
+		}
+		for cmd, topic := range c.Publish.Routes {
+			if topic != "" {
+				c.log.Info().Str("command", cmd).Str("topic", topic).Uint8("qos", c.Publish.QOS).Msg("publishing")
+			}
+		}
+		for _, t := range c.Publish.Targets {
+			c.log.Info().Str("topic", t.Topic).Uint8("qos", t.QOS).Str("format", t.Format).Msg("publishing")
+		}
+	}
+
+	if c.HomeAssistant.Discovery {
+		c.log.Info().Str("prefix", c.HomeAssistant.Prefix).Msg("publishing Home Assistant discovery")
+		c.publishDiscovery(client)
+	}
+
+	if c.Homie.Enabled && c.canRead() {
+		c.log.Info().Str("prefix", c.Homie.Prefix).Msg("publishing Homie device")
+
+		h := c.newHomieDevice(client)
+		h.start()
+		defer h.stop()
+		g.goSafe(func() { h.rateLoop(stop) })
+
+		c.mu.Lock()
+		c.homie = h
+		c.mu.Unlock()
+	}
+
+	if c.EventSub.Topic != "" {
+		c.log.Info().Str("topic", c.EventSub.Topic).Strs("types", c.EventSub.Types).Msg("publishing EventSub notifications")
+		g.goSafe(func() { c.eventSubLoop(client, stop) })
+	}
+
+	var pq *publishQueue
+	var pwg sync.WaitGroup
+	c.batcher = nil
+	if c.publishes() && c.canRead() {
+		if c.batches() {
+			c.batcher = c.newBatcher(client)
+		}
+		pq = c.newPublishQueue()
+		c.publishLoops(pq, client, &pwg, g, stop)
+	}
+	// Publishing stops only once stopped, even if the connection fails,
+	// and the queue is drained once the shards have stopped reading into
+	// it. Whatever is left in batches is published after that.
+	defer func() {
+		cancel()
+		if pq != nil {
+			pq.close()
+		}
+		pwg.Wait()
+		if c.batcher != nil {
+			c.batcher.close()
+		}
+	}()
+
+	if c.Stats.Topic != "" {
+		c.log.Info().Str("topic", c.Stats.Topic).Dur("interval", c.Stats.Interval).Msg("publishing stats")
+		g.goSafe(func() { c.statsLoop(client, queue, pq, stop) })
+	}
+
+	if topic := c.Query.Topic; topic != "" {
+		c.log.Info().Str("topic", topic).Uint8("qos", c.Query.QOS).Msg("accepting queries")
+
+		queries := make(chan queryRequest, defaultSendQueue)
+		g.goSafe(func() { c.queryLoop(queries, client, queue, pq, stop) })
+
+		if err := subscribe(topic, c.Query.QOS, c.queryHandler(queries)); err != nil {
+			return err
+		}
+	}
+
+	var swg sync.WaitGroup
+	startShard := func(s *shard) {
+		swg.Add(1)
+		g.goSafe(func() {
+			defer swg.Done()
+			c.session(ctx, s, dial, pq, client, g)
+		})
+	}
+
+	c.mu.Lock()
+	for _, s := range shards[1:] {
+		startShard(s)
+	}
+	c.startShard = startShard
+	c.mu.Unlock()
+
+	c.session(ctx, shards[0], dial, pq, client, g)
+
+	// No more shards may be started once waiting for them.
+	c.mu.Lock()
+	c.startShard = nil
+	c.mu.Unlock()
+
+	swg.Wait()
+	return g.error()
+}
+
+// session keeps the shard connected to IRC, reconnecting until stop is
+// closed. Only the first shard publishes status and availability.
+func (c *Connection) session(ctx context.Context, s *shard, dial dialFunc, pq *publishQueue, client MQTTClient, g *panicGuard) {
+	stop := ctx.Done()
+	first := s.index == 0
+	log := c.log
+	if c.Shard.Channels > 0 {
+		log = c.log.With().Int("shard", s.index).Logger()
+	}
+
+	retry := newBackoff(c.Reconnect.MinDelay, c.Reconnect.MaxDelay)
+
+	for {
+		ic, err := c.dialRetry(ctx, dial)
+		if err != nil {
+			if err != errStopped {
+				log.Error().Err(err).Msg("giving up on connection")
+			}
+			return
+		}
+
+		caps := newCapSet()
+		if first {
+			c.publishStatus(client, caps)
+		}
+
+		// The shard takes or hands off channels while it has joined none,
+		// so it joins its share below.
+		c.rebalance(s)
+
+		if !s.conn.set(ic, stop) {
+			ic.Close()
+			return
+		}
+
+		done := make(chan struct{})
+		channels := s.assignedChannels()
+		g.goSafe(func() { c.joinChannels(s, c.joinLimiter, channels, done) })
+
+		s.touch()
+		g.goSafe(func() { c.keepalive(ic, s, done) })
+
+		// Log in again with the new access token once it is refreshed.
+		rotated := make(chan struct{})
+		if c.token != nil {
+			g.goSafe(func() {
+				if c.token.wait(done) {
+					close(rotated)
+					ic.Close()
+				}
+			})
+		}
+
+		if first && c.Availability.Topic != "" {
+			publishAvailability(client, c.Availability.Topic, c.Availability.QOS, true)
+		}
+
+		start := time.Now()
+		err = c.read(ic, s, caps, pq, client, first, stop)
+
+		close(done)
+		s.reset()
+		s.conn.set(nil, nil)
+		ic.Close()
+
+		if first && c.Availability.Topic != "" {
+			publishAvailability(client, c.Availability.Topic, c.Availability.QOS, false)
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		c.stats.reconnects.Add(1)
+
+		if err == errReconnect {
+			log.Info().Msg("server sent RECONNECT, reconnecting")
+			continue
+		}
+
+		select {
+		case <-rotated:
+			log.Info().Msg("access token refreshed, reconnecting")
+			continue
+		default:
+		}
+
+		// Avoid reconnecting in a tight loop if the server keeps
+		// dropping the connection right after it is established.
+		if time.Since(start) >= stableSession {
+			retry.reset()
+		}
+
+		d := retry.next()
+		log.Warn().Err(err).Dur("delay", d).Msg("connection lost, reconnecting")
+
+		if !sleep(d, stop) {
+			return
+		}
+	}
+}
+
+// dialRetry dials IRC until it succeeds, ctx is canceled, or the configured
+// number of attempts is exhausted.
+func (c *Connection) dialRetry(ctx context.Context, dial dialFunc) (irc.Conn, error) {
+	b := newBackoff(c.Reconnect.MinDelay, c.Reconnect.MaxDelay)
+
+	for attempt := 1; ; attempt++ {
+		var ic irc.Conn
+		var err error
+
+		pass := c.Pass
+		if c.token != nil {
+			pass, err = c.token.pass()
+		}
+
+		if err == nil {
+			ic, err = dial(ctx, c.Nick, pass)
+		}
+
+		if err == nil {
+			return ic, nil
+		}
+
+		if max := c.Reconnect.MaxAttempts; max > 0 && attempt >= max {
+			return nil, err
+		}
+
+		d := b.next()
+		c.log.Warn().Err(err).Int("attempt", attempt).Dur("delay", d).Msg("dial failed, retrying")
+
+		if !sleep(d, ctx.Done()) {
+			return nil, errStopped
+		}
+	}
+}
+
+// read handles messages from ic until it fails, returning errReconnect if
+// the server asked the client to reconnect. All errors are treated as the
+// connection being lost.
+func (c *Connection) read(ic irc.Conn, s *shard, caps *capSet, pq *publishQueue, client MQTTClient, first bool, stop <-chan struct{}) error {
+	joins := c.joinTracker()
+
+	c.mu.Lock()
+	homie := c.homie
+	c.mu.Unlock()
+
+	for {
+		var m irc.Message
+		if err := ic.Decode(&m); err != nil {
+			return err
+		}
+		received := time.Now()
+		c.stats.received.Add(1)
+		s.touch()
+
+		switch m.Command {
+		case "PRIVMSG", "NOTICE", "USERNOTICE", "PING", "CLEARCHAT", "HOSTTARGET":
+			c.log.Debug().Str("raw", m.Raw).Msg("received")
+		default:
+			c.log.Info().Str("raw", m.Raw).Msg("received")
+		}
+
+		if caps.handle(&m) {
+			if caps.degraded() {
+				c.log.Warn().Strs("capabilities", requestedCaps).Msg("capabilities not all acknowledged, publishing raw messages only")
+			}
+			if first {
+				c.publishStatus(client, caps)
+			}
+		}
+
+		if m.Command == "PING" {
+			m.Command = "PONG"
+			if err := s.conn.Encode(&m); err != nil {
+				c.elog.Println(err)
+			}
+			continue
+		}
+
+		switch m.Command {
+		case "JOIN":
+			if strings.EqualFold(m.Prefix.Name, c.Nick) {
+				joins.confirmed(messageChannel(&m))
+			}
+		case "NOTICE":
+			if id := m.Tags["msg-id"]; joinFailures[id] {
+				joins.failed(messageChannel(&m), id)
+			}
+		case "ROOMSTATE":
+			if st, changed := c.rooms.update(&m); changed && st.Channel != "" {
+				if c.RoomState.Topic != "" && c.canRead() {
+					c.publishRoomState(client, st)
+				}
+				if homie != nil {
+					homie.roomState(st)
+				}
+			}
+		case "USERSTATE":
+			if st, changed := c.users.update(&m); changed && st.Channel != "" && c.UserState.Topic != "" && c.canRead() {
+				c.publishUserState(client, st)
+			}
+		case "USERNOTICE":
+			if c.Events.Topic != "" && c.canRead() {
+				c.publishEvent(client, &m)
+			}
+		case "PRIVMSG":
+			if homie != nil {
+				homie.message(&m)
+			}
+			if c.Cheers.Topic != "" && c.canRead() && m.Tags["bits"] != "" {
+				c.publishCheer(client, &m)
+			}
+		case "CLEARCHAT", "CLEARMSG":
+			if c.Moderation.EventsTopic != "" && c.canRead() {
+				c.publishModEvent(client, &m)
+				continue
+			}
+		}
+
+		// A message left unqueued because the connection is stopping
+		// isn't dropped for lack of room, so isn't counted.
+		if pq != nil {
+			if err := pq.push(publishItem{m: &m, caps: caps, received: received}, stop); err == errPublishQueueFull {
+				c.elog.Printf("publish queue full, dropped a message")
+				c.count("publish_dropped")
+			}
+		}
+
+		if m.Command == "RECONNECT" {
+			return errReconnect
+		}
+	}
+}
+
+func (c *Connection) publish(client MQTTClient, it publishItem, stop <-chan struct{}) {
+	m := it.m
+	if !c.filter(m) || !c.runMiddleware(Inbound, m) {
+		return
+	}
+
+	if !c.sampled(m) {
+		c.count("sampled_out")
+		return
+	}
+
+	channel := messageChannel(m)
+	topic := c.routeTopic(m.Command, channel)
+	if topic == "" && len(c.Publish.Targets) == 0 && c.FirstChats.Topic == "" {
+		return
+	}
+	if topic != "" {
+		topic = c.expandTopic(topic, m)
+	}
+
+	topic, fields, ok := c.runScripts(m, topic)
+	if !ok {
+		return
+	}
+
+	self := c.Publish.Self != "" && sentByBridge(m)
+	if self && c.Publish.Self == selfSuppress {
+		c.count("self_suppressed")
+		return
+	}
+
+	c.recordReplay(it)
+
+	if topic != "" {
+		c.publishTo(client, it, topic, c.publishQOS(channel), c.retain(m.Command), c.Publish.Format, c.Publish.Encoding, fields, self, stop)
+	}
+
+	for _, t := range c.Publish.Targets {
+		if t.filter(m) {
+			c.publishTo(client, it, c.expandTopic(t.Topic, m), t.QOS, t.Retain, t.Format, t.Encoding, fields, self, stop)
+		}
+	}
+
+	if c.FirstChats.Topic != "" && isFirstMessage(m) {
+		c.publishTo(client, it, c.expandTopic(c.FirstChats.Topic, m), c.FirstChats.QOS, false, c.Publish.Format, c.Publish.Encoding, fields, self, stop)
+		c.count("first_chats")
+	}
+}
+
+// publishTo publishes the item to topic in the given format.
+func (c *Connection) publishTo(client MQTTClient, it publishItem, topic string, qos byte, retain bool, format, encoding string, fields map[string]interface{}, self bool, stop <-chan struct{}) {
+	m := it.m
+
+	if c.duplicate(topic, m) {
+		c.count("deduplicated")
+		return
+	}
+
+	b, err := c.payload(format, encoding, it, fields, self)
+	if err != nil {
+		c.elog.Println(err)
+		return
+	}
+
+	if c.batcher != nil {
+		p, err := batchPayload(format, it, b)
+		if err != nil {
+			c.elog.Println(err)
+			return
+		}
+		c.batcher.add(batchKey{topic: topic, qos: qos, retain: retain}, p)
+		return
+	}
+
+	c.publishPayload(client, topic, qos, retain, b, [][2]string{
+		{"channel", messageChannel(m)},
+		{"command", m.Command},
+		{"connection", c.name()},
+	}, 1, stop)
+}
+
+// publishPayload publishes the payload of n messages to topic, compressing
+// it if configured, with the given MQTT 5 user properties.
+func (c *Connection) publishPayload(client MQTTClient, topic string, qos byte, retain bool, b []byte, user [][2]string, n int, stop <-chan struct{}) {
+	b, contentEncoding, err := c.compress(b)
+	if err != nil {
+		c.elog.Println(err)
+		return
+	}
+
+	if contentEncoding != "" {
+		user = append(user, [2]string{"content-encoding", contentEncoding})
+	}
+
+	send := func() mqtt.Token {
+		if pp, ok := client.(propertyPublisher); ok {
+			return pp.PublishWithProperties(topic, qos, retain, b, &publishProperties{
+				User:   user,
+				Expiry: c.Publish.Expiry,
+			})
+		}
+		return client.Publish(topic, qos, retain, b)
+	}
+
+	if c.Publish.Confirm.Enabled {
+		err = c.confirm(send, stop)
+	} else {
+		err = send().Error()
+	}
+
+	if err != nil {
+		c.elog.Printf("publish failed: %v", err)
+		c.count("publish_errors")
+	} else {
+		for i := 0; i < n; i++ {
+			c.count("published")
+		}
+		c.stats.published.Add(int64(n))
+	}
+}
+
+// payload encodes the item's message, with any fields added by scripts,
+// in the given format and encoding, marking it if the bridge sent it.
+// Without tags, the raw line is published regardless of format.
+func (c *Connection) payload(format, encoding string, it publishItem, fields map[string]interface{}, self bool) ([]byte, error) {
+	m, received := it.m, it.received
+
+	if format == formatRaw || !it.caps.has(capTags) {
+		return []byte(m.Raw), nil
+	}
+
+	var v interface{} = &timedMessage{Message: m, ReceivedAt: received.UTC(), SentAt: sentAt(m), Fields: fields, Self: self}
+	if format == formatParsed {
+		p := parseMessage(m)
+		p.ReceivedAt = received.UTC()
+		p.Fields = fields
+		p.Self = self
+		c.enrich(p)
+		c.addThirdPartyEmotes(p)
+		v = p
+	}
+
+	return marshalPayload(encoding, v)
+}
+
+// publishes reports whether the connection has any publish topics.
+func (c *Connection) publishes() bool {
+	return c.Publish.Topic != "" || len(c.Publish.Routes) > 0 || len(c.Publish.Targets) > 0 || c.overrideTopics() ||
+		c.FirstChats.Topic != ""
+}
+
+// routeTopic returns the topic template for messages with the given command
+// in the given channel.
+func (c *Connection) routeTopic(command, channel string) string {
+	if topic, ok := c.Publish.Routes[command]; ok {
+		return topic
+	}
+	if o := c.override(channel); o != nil && o.Topic != "" {
+		return o.Topic
+	}
+	return c.Publish.Topic
+}
+
+// retain reports whether messages with the given command are published
+// with the retain flag.
+func (c *Connection) retain(command string) bool {
+	if r, ok := c.Publish.RetainCommands[command]; ok {
+		return r
+	}
+	return c.Publish.Retain
+}
+
+// sharedConn guards the current IRC connection, which changes when the
+// connection is reestablished.
+type sharedConn struct {
+	mu   sync.Mutex
+	conn irc.Conn
+}
+
+// set replaces the current connection. It returns false without replacing
+// the connection if stop has been closed.
+func (s *sharedConn) set(conn irc.Conn, stop <-chan struct{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+
+	s.conn = conn
+	return true
+}
+
+// setReadDeadline interrupts reading from the current connection at t, if
+// the connection supports it.
+func (s *sharedConn) setReadDeadline(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d, ok := s.conn.(interface{ SetReadDeadline(time.Time) error }); ok {
+		d.SetReadDeadline(t)
+	}
+}
+
+func (s *sharedConn) connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn != nil
+}
+
+func (s *sharedConn) Encode(m *irc.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return errNotConnected
+	}
+
+	return s.conn.Encode(m)
+}
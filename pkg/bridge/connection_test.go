@@ -0,0 +1,192 @@
+package bridge
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakebailey/irc"
+)
+
+const testTimeout = 5 * time.Second
+
+func newTestConnection() *Connection {
+	c := &Connection{Nick: "bot", Pass: "oauth:token"}
+	c.Publish.Topic = "twitch/chat"
+	c.Publish.Channels = []string{"foo"}
+	c.Subscribe.Topic = "twitch/send"
+	c.Reconnect.MinDelay = time.Millisecond
+	c.Reconnect.MaxDelay = 10 * time.Millisecond
+	return c
+}
+
+func startHarness(t *testing.T, c *Connection) (*harness, *fakeIRC) {
+	t.Helper()
+
+	h, err := newHarness(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := h.Start(testTimeout)
+	t.Cleanup(h.Stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return h, f
+}
+
+func chatMessage(user, channel, text string) *irc.Message {
+	return &irc.Message{
+		Tags:     map[string]string{"display-name": user},
+		Prefix:   irc.Prefix{Name: user, User: user, Host: user + ".tmi.twitch.tv"},
+		Command:  "PRIVMSG",
+		Params:   []string{channel},
+		Trailing: text,
+	}
+}
+
+func TestConnectionLogsInAndJoins(t *testing.T) {
+	_, f := startHarness(t, newTestConnection())
+
+	nick, err := f.NextCommand("NICK", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nick.Params[0] != "bot" {
+		t.Errorf("NICK %v, want bot", nick.Params)
+	}
+
+	join, err := f.NextCommand("JOIN", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if join.Params[0] != "#foo" {
+		t.Errorf("JOIN %v, want #foo", join.Params)
+	}
+}
+
+func TestConnectionPublishesChat(t *testing.T) {
+	h, f := startHarness(t, newTestConnection())
+
+	if err := f.Send(chatMessage("alice", "#foo", "hello there")); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := h.MQTT.NextOn("twitch/chat", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(m.payload), "hello there") {
+		t.Errorf("payload %s does not contain the message", m.payload)
+	}
+}
+
+func TestConnectionFiltersChat(t *testing.T) {
+	c := newTestConnection()
+	c.Publish.DenyUsers = []string{"spammer"}
+	h, f := startHarness(t, c)
+
+	if err := f.Send(chatMessage("spammer", "#foo", "buy followers")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Send(chatMessage("alice", "#foo", "hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := h.MQTT.NextOn("twitch/chat", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(m.payload), "buy followers") {
+		t.Errorf("denied user's message was published: %s", m.payload)
+	}
+}
+
+func TestConnectionSendsChat(t *testing.T) {
+	h, f := startHarness(t, newTestConnection())
+
+	err := h.MQTT.DeliverWhenSubscribed("twitch/send", []byte(`{"channel":"foo","message":"hi chat"}`), testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := f.NextCommand("PRIVMSG", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Params[0] != "#foo" || m.Trailing != "hi chat" {
+		t.Errorf("sent %q, want PRIVMSG #foo :hi chat", m.String())
+	}
+}
+
+func TestConnectionReconnectsOnRequest(t *testing.T) {
+	h, f := startHarness(t, newTestConnection())
+
+	if err := f.Send(&irc.Message{Command: "RECONNECT"}); err != nil {
+		t.Fatal(err)
+	}
+
+	f2, err := h.NextConn(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	join, err := f2.NextCommand("JOIN", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if join.Params[0] != "#foo" {
+		t.Errorf("rejoined %v, want #foo", join.Params)
+	}
+}
+
+func TestConnectionReconnectsOnEOF(t *testing.T) {
+	h, f := startHarness(t, newTestConnection())
+
+	if _, err := f.NextCommand("JOIN", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server hanging up ends the read loop with io.EOF.
+	f.Close()
+
+	f2, err := h.NextConn(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	join, err := f2.NextCommand("JOIN", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if join.Params[0] != "#foo" {
+		t.Errorf("rejoined %v, want #foo", join.Params)
+	}
+
+	if err := f2.Send(chatMessage("alice", "#foo", "still here")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := h.MQTT.NextOn("twitch/chat", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(m.payload), "still here") {
+		t.Errorf("payload %s does not contain the message", m.payload)
+	}
+}
+
+func TestConnectionRetriesDial(t *testing.T) {
+	h, err := newHarness(newTestConnection())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Dialer.FailNext(2)
+
+	_, err = h.Start(testTimeout)
+	t.Cleanup(h.Stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,208 @@
+package bridge
+
+import (
+	"encoding/json"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jakebailey/irc"
+)
+
+// controlTopic returns the connection's full control topic, which is kept
+// within its tenant's control namespace.
+func (c *Connection) controlTopic() string {
+	if c.Control.Topic == "" {
+		return ""
+	}
+	return c.tenant.controlTopic(c.Control.Topic)
+}
+
+// channels returns a copy of the channels the connection should be in.
+func (c *Connection) channels() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.Publish.Channels...)
+}
+
+// hasChannel reports whether channel is one of the connection's channels.
+func (c *Connection) hasChannel(channel string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ch := range c.Publish.Channels {
+		if ch == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// addChannel adds channel to the connection's channels, returning false if
+// it was already present.
+func (c *Connection) addChannel(channel string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ch := range c.Publish.Channels {
+		if ch == channel {
+			return false
+		}
+	}
+
+	c.Publish.Channels = append(c.Publish.Channels, channel)
+	return true
+}
+
+// removeChannel removes channel from the connection's channels, returning
+// false if it was not present.
+func (c *Connection) removeChannel(channel string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, ch := range c.Publish.Channels {
+		if ch == channel {
+			c.Publish.Channels = append(c.Publish.Channels[:i], c.Publish.Channels[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// joinChannel adds channel to the connection's channels, joining it if the
+// connection is running.
+func (c *Connection) joinChannel(channel string) {
+	if !c.addChannel(channel) {
+		return
+	}
+
+	c.joinOnShard(c.assignShard(channel), channel)
+}
+
+// joinOnShard joins channel on s in the background. A shard which isn't
+// connected joins the channel once it is.
+func (c *Connection) joinOnShard(s *shard, channel string) {
+	if s == nil || !s.conn.connected() {
+		return
+	}
+
+	c.mu.Lock()
+	lim, stop, g := c.joinLimiter, c.stop, c.guard
+	c.mu.Unlock()
+
+	c.log.Info().Str("channel", channel).Int("shard", s.index).Msg("joining")
+
+	g.goSafe(func() {
+		if !lim.Wait(stop) {
+			return
+		}
+
+		if err := join(s.conn, channel); err != nil {
+			if err != errNotConnected {
+				c.elog.Printf("join failed: %v", err)
+			}
+			return
+		}
+
+		s.setJoined(channel, true)
+		c.joinTracker().sent(s, channel)
+	})
+}
+
+// partChannel removes channel from the connection's channels, parting it
+// if the connection is running, and rebalances the shards it was parted
+// from.
+func (c *Connection) partChannel(channel string) {
+	if !c.removeChannel(channel) {
+		return
+	}
+
+	c.joinTracker().parted(channel)
+
+	var from *shard
+	for _, s := range c.runningShards() {
+		if s.isAssigned(channel) {
+			s.unassign(channel)
+			from = s
+		}
+		if !s.hasJoined(channel) {
+			continue
+		}
+
+		c.log.Info().Str("channel", channel).Int("shard", s.index).Msg("parting")
+
+		if err := part(s.conn, channel); err != nil && err != errNotConnected {
+			c.elog.Printf("part failed: %v", err)
+		}
+
+		s.setJoined(channel, false)
+	}
+
+	if from != nil {
+		c.rebalance(from)
+	}
+}
+
+// setChannels joins and parts channels so that the connection is in
+// exactly the given channels.
+func (c *Connection) setChannels(channels []string) {
+	want := make(map[string]bool, len(channels))
+	for _, ch := range channels {
+		want[ch] = true
+	}
+
+	for _, ch := range c.channels() {
+		if !want[ch] {
+			c.partChannel(ch)
+		}
+		delete(want, ch)
+	}
+
+	for _, ch := range channels {
+		if want[ch] {
+			c.joinChannel(ch)
+		}
+	}
+}
+
+// controlHandler returns an MQTT message handler which joins and parts
+// channels at runtime. Changes are kept for future reconnects.
+func (c *Connection) controlHandler() mqtt.MessageHandler {
+	return func(_ mqtt.Client, mq mqtt.Message) {
+		var msg struct {
+			Action  string
+			Channel string
+		}
+
+		if err := json.Unmarshal(mq.Payload(), &msg); err != nil {
+			c.elog.Printf("bad payload on %s: %v", mq.Topic(), err)
+			return
+		}
+
+		channel := normalizeChannel(msg.Channel)
+		if channel == "" {
+			c.elog.Printf("empty channel")
+			return
+		}
+
+		switch strings.ToLower(msg.Action) {
+		case "join":
+			c.joinChannel(channel)
+		case "part":
+			c.partChannel(channel)
+		default:
+			c.elog.Printf("unknown control action %q", msg.Action)
+		}
+	}
+}
+
+func part(conn irc.Encoder, channels ...string) error {
+	if len(channels) == 0 {
+		return nil
+	}
+
+	return conn.Encode(&irc.Message{
+		Command: "PART",
+		Params:  []string{strings.Join(channels, ",")},
+	})
+}
@@ -0,0 +1,72 @@
+package bridge
+
+import "testing"
+
+func TestControlJoinsAndParts(t *testing.T) {
+	c := newTestConnection()
+	c.Control.Topic = "twitch"
+	h, f := startHarness(t, c)
+
+	if _, err := f.NextCommand("JOIN", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	err := h.MQTT.DeliverWhenSubscribed("control/twitch", []byte(`{"action":"JOIN","channel":" Bar "}`), testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	join, err := f.NextCommand("JOIN", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if join.Params[0] != "#bar" {
+		t.Errorf("joined %v, want #bar", join.Params)
+	}
+
+	h.MQTT.Deliver("control/twitch", []byte(`{"action":"part","channel":"#foo"}`))
+	part, err := f.NextCommand("PART", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.Params[0] != "#foo" {
+		t.Errorf("parted %v, want #foo", part.Params)
+	}
+
+	// The changes are kept across reconnects.
+	f.Close()
+	f2, err := h.NextConn(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	join, err = f2.NextCommand("JOIN", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if join.Params[0] != "#bar" {
+		t.Errorf("rejoined %v, want #bar", join.Params)
+	}
+}
+
+func TestControlIgnoresBadRequests(t *testing.T) {
+	c := newTestConnection()
+	c.Control.Topic = "twitch"
+	h, f := startHarness(t, c)
+
+	if _, err := f.NextCommand("JOIN", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, payload := range []string{
+		`not json`,
+		`{"action":"join","channel":"#"}`,
+		`{"action":"leave","channel":"bar"}`,
+	} {
+		if err := h.MQTT.DeliverWhenSubscribed("control/twitch", []byte(payload), testTimeout); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := c.channels(); len(got) != 1 || got[0] != "#foo" {
+		t.Errorf("channels %v, want only #foo", got)
+	}
+}
@@ -0,0 +1,70 @@
+package bridge
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jakebailey/irc"
+)
+
+// dedupeSweepInterval is how often expired entries are removed.
+const dedupeSweepInterval = time.Minute
+
+// dedupeCache remembers published messages for a while, so connections
+// joined to the same channel do not publish the same message twice. It is
+// shared by every connection and survives config reloads.
+type dedupeCache struct {
+	mu        sync.Mutex
+	expires   map[string]time.Time
+	nextSweep time.Time
+}
+
+var publishDedupe = &dedupeCache{expires: make(map[string]time.Time)}
+
+// seen records key for ttl, reporting whether it was already recorded.
+func (d *dedupeCache) seen(key string, ttl time.Duration) bool {
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.After(d.nextSweep) {
+		for k, exp := range d.expires {
+			if now.After(exp) {
+				delete(d.expires, k)
+			}
+		}
+		d.nextSweep = now.Add(dedupeSweepInterval)
+	}
+
+	if exp, ok := d.expires[key]; ok && now.Before(exp) {
+		return true
+	}
+
+	d.expires[key] = now.Add(ttl)
+	return false
+}
+
+// has reports whether key is recorded, without recording it.
+func (d *dedupeCache) has(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	exp, ok := d.expires[key]
+	return ok && time.Now().Before(exp)
+}
+
+// duplicate reports whether m was already published to topic, by this or
+// any other connection, within the dedupe window.
+func (c *Connection) duplicate(topic string, m *irc.Message) bool {
+	if c.Publish.Dedupe <= 0 {
+		return false
+	}
+
+	id := tag(m, "id")
+	if id == "" {
+		return false
+	}
+
+	return publishDedupe.seen(topic+"\x00"+id, c.Publish.Dedupe)
+}
@@ -0,0 +1,72 @@
+package bridge
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakebailey/irc"
+)
+
+func TestConnectionsDedupe(t *testing.T) {
+	newConn := func(name string) *Connection {
+		c := newTestConnection()
+		c.Name = name
+		c.Publish.Dedupe = time.Minute
+		return c
+	}
+	h1, f1 := startHarness(t, newConn("dedupe-1"))
+	h2, f2 := startHarness(t, newConn("dedupe-2"))
+
+	// The cache is shared by every connection in the process, so the IDs
+	// must not repeat across runs.
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	m := chatMessage("alice", "#foo", "seen twice")
+	m.Tags["id"] = id + "-1"
+	if err := f1.Send(m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h1.MQTT.NextOn("twitch/chat", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second connection reads the same message, and then a new one.
+	dup := chatMessage("alice", "#foo", "seen twice")
+	dup.Tags["id"] = id + "-1"
+	next := chatMessage("alice", "#foo", "seen once")
+	next.Tags["id"] = id + "-2"
+	for _, m := range []*irc.Message{dup, next} {
+		if err := f2.Send(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := h2.MQTT.NextOn("twitch/chat", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got.payload), "seen once") {
+		t.Errorf("second connection published %s, want only the new message", got.payload)
+	}
+}
+
+func TestDedupeCacheExpires(t *testing.T) {
+	d := &dedupeCache{expires: make(map[string]time.Time)}
+
+	if d.seen("a", 10*time.Millisecond) {
+		t.Error("new key was already seen")
+	}
+	if !d.seen("a", 10*time.Millisecond) {
+		t.Error("key was not seen the second time")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if d.has("a") {
+		t.Error("key was still recorded after it expired")
+	}
+	if d.seen("a", 10*time.Millisecond) {
+		t.Error("expired key was seen")
+	}
+}
@@ -0,0 +1,159 @@
+package bridge
+
+import "strings"
+
+// Defaults are settings connections inherit unless they set their own.
+// QOS, Retain, Format, and Encoding are those of publish (QOS also of
+// subscribe), RateLimit replaces the connection's rate_limit as a whole,
+// and TopicPrefix is prepended to every topic of connections without
+// their own topic_prefix, other than the control topic. In a tenant's
+// topics, it goes after the tenant's prefix, keeping them in the tenant's
+// namespace.
+type Defaults struct {
+	QOS         byte       `yaml:",omitempty"`
+	Retain      bool       `yaml:",omitempty"`
+	Format      string     `yaml:",omitempty"`
+	Encoding    string     `yaml:",omitempty"`
+	TopicPrefix string     `yaml:"topic_prefix,omitempty"`
+	RateLimit   *RateLimit `yaml:"rate_limit,omitempty"`
+}
+
+// applyDefaults fills in the defaults of each connection, using the
+// generically decoded config raw to tell which fields were set explicitly,
+// since a zero value may be an override.
+func (c *Config) applyDefaults(raw interface{}) {
+	conns, _ := rawField(raw, "connections").([]interface{})
+
+	for i, conn := range c.Connections {
+		var r interface{}
+		if i < len(conns) {
+			r = conns[i]
+		}
+		conn.applyDefaults(&c.Defaults, c.tenantPrefix(conn.Tenant), r)
+	}
+}
+
+// tenantPrefix returns the topic prefix of the named tenant, or an empty
+// string if it has none, which validation reports.
+func (c *Config) tenantPrefix(name string) string {
+	for _, t := range c.Tenants {
+		if t != nil && t.Name == name {
+			return strings.TrimSuffix(t.TopicPrefix, "/")
+		}
+	}
+	return ""
+}
+
+func (c *Connection) applyDefaults(d *Defaults, tenantPrefix string, raw interface{}) {
+	publish := rawField(raw, "publish")
+	subscribe := rawField(raw, "subscribe")
+
+	if !rawHas(publish, "qos") {
+		c.Publish.QOS = d.QOS
+	}
+	if !rawHas(subscribe, "qos") {
+		c.Subscribe.QOS = d.QOS
+	}
+	if !rawHas(publish, "retain") {
+		c.Publish.Retain = d.Retain
+	}
+	if !rawHas(publish, "format") {
+		c.Publish.Format = d.Format
+	}
+	if !rawHas(publish, "encoding") {
+		c.Publish.Encoding = d.Encoding
+	}
+	if d.RateLimit != nil && !rawHas(raw, "rate_limit") {
+		c.RateLimit = *d.RateLimit
+	}
+
+	prefix := d.TopicPrefix
+	if rawHas(raw, "topic_prefix") {
+		prefix = c.TopicPrefix
+	}
+	if prefix == "" {
+		return
+	}
+
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	addPrefix := func(topic string) string {
+		if tenantPrefix != "" && strings.HasPrefix(topic, tenantPrefix+"/") {
+			return tenantPrefix + "/" + prefix + strings.TrimPrefix(topic, tenantPrefix+"/")
+		}
+		return prefix + topic
+	}
+
+	for _, t := range c.topics() {
+		if *t != "" {
+			*t = addPrefix(*t)
+		}
+	}
+	for cmd, topic := range c.Publish.Routes {
+		if topic != "" {
+			c.Publish.Routes[cmd] = addPrefix(topic)
+		}
+	}
+}
+
+// topics returns the connection's topics, other than its routes and its
+// control topic, which names one in its tenant's control namespace, to be
+// modified in place.
+func (c *Connection) topics() []*string {
+	topics := []*string{
+		&c.Publish.Topic,
+		&c.Subscribe.Topic,
+		&c.Subscribe.ResultTopic,
+		&c.Status.Topic,
+		&c.Availability.Topic,
+		&c.Join.Topic,
+		&c.Whisper.Topic,
+		&c.Whisper.SendTopic,
+		&c.Moderation.Topic,
+		&c.Moderation.ReplyTopic,
+		&c.Moderation.EventsTopic,
+		&c.Query.Topic,
+		&c.Query.ReplyTopic,
+		&c.Replay.Topic,
+		&c.Replay.ReplyTopic,
+		&c.RoomSettings.Topic,
+		&c.RoomState.Topic,
+		&c.UserState.Topic,
+		&c.Events.Topic,
+		&c.EventSub.Topic,
+		&c.Cheers.Topic,
+		&c.Stats.Topic,
+		&c.Blocklist.Topic,
+		&c.FirstChats.Topic,
+	}
+	for _, t := range c.Publish.Targets {
+		topics = append(topics, &t.Topic)
+	}
+	for _, o := range c.Publish.Overrides {
+		if o != nil {
+			topics = append(topics, &o.Topic)
+		}
+	}
+	return topics
+}
+
+// rawField returns the value of key in the generically decoded map m, or
+// nil if m is not a map or lacks it.
+func rawField(m interface{}, key string) interface{} {
+	v, _ := rawLookup(m, key)
+	return v
+}
+
+// rawHas reports whether the generically decoded map m sets key.
+func rawHas(m interface{}, key string) bool {
+	_, ok := rawLookup(m, key)
+	return ok
+}
+
+func rawLookup(m interface{}, key string) (interface{}, bool) {
+	mm, ok := m.(map[interface{}]interface{})
+	if !ok {
+		return nil, false
+	}
+	v, ok := mm[key]
+	return v, ok
+}
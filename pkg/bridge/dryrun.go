@@ -0,0 +1,42 @@
+package bridge
+
+import (
+	"fmt"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+)
+
+// dryRun reports whether the connection logs what it would publish and
+// send rather than doing so.
+func (c *Connection) dryRun() bool {
+	return c.DryRun || c.options().dryRun
+}
+
+// dryRunClient logs publishes instead of making them. Subscriptions are
+// passed through, so messages to send are still read.
+type dryRunClient struct {
+	MQTTClient
+	log zerolog.Logger
+}
+
+func (d dryRunClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var s string
+	switch p := payload.(type) {
+	case []byte:
+		s = string(p)
+	case string:
+		s = p
+	default:
+		s = fmt.Sprint(p)
+	}
+
+	d.log.Info().
+		Str("topic", topic).
+		Uint8("qos", qos).
+		Bool("retained", retained).
+		Str("payload", s).
+		Msg("dry run: not publishing")
+
+	return doneToken(nil)
+}
@@ -0,0 +1,99 @@
+package bridge
+
+import (
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jakebailey/irc"
+)
+
+const (
+	duplicatesSkip   = "skip"
+	duplicatesDelay  = "delay"
+	duplicatesSuffix = "suffix"
+)
+
+// duplicateWindow is how long Twitch rejects a message identical to the
+// previous one sent to the same channel.
+const duplicateWindow = 30 * time.Second
+
+// duplicateSuffix is appended to make a repeated message differ. It is an
+// unassigned tag character, which Twitch clients do not display.
+const duplicateSuffix = " \U000E0000"
+
+var errBadDuplicates = errors.New("duplicates must be skip, delay, or suffix")
+
+func (c *Connection) validateDuplicates() error {
+	switch c.Subscribe.Duplicates {
+	case "", duplicatesSkip, duplicatesDelay, duplicatesSuffix:
+		return nil
+	default:
+		return fieldErr("duplicates", errBadDuplicates)
+	}
+}
+
+type sentMessage struct {
+	text string
+	at   time.Time
+}
+
+// duplicates remembers the last message sent to each channel, to work
+// around Twitch silently dropping repeated messages.
+type duplicates struct {
+	strategy string
+	last     map[string]sentMessage
+}
+
+func (c *Connection) newDuplicates() *duplicates {
+	if c.Subscribe.Duplicates == "" {
+		return nil
+	}
+
+	return &duplicates{
+		strategy: c.Subscribe.Duplicates,
+		last:     make(map[string]sentMessage),
+	}
+}
+
+// check applies the strategy to m if it repeats the last message sent to
+// its channel within the window, returning how long to wait before sending
+// it and whether it should be sent at all.
+func (d *duplicates) check(m *irc.Message) (time.Duration, bool) {
+	last, ok := d.last[messageChannel(m)]
+	if !ok || last.text != m.Trailing {
+		return 0, true
+	}
+
+	wait := duplicateWindow - time.Since(last.at)
+	if wait <= 0 {
+		return 0, true
+	}
+
+	switch d.strategy {
+	case duplicatesSkip:
+		return 0, false
+	case duplicatesDelay:
+		return wait, true
+	}
+
+	text, action := unwrapAction(m.Trailing)
+
+	// A message already at the length limit can't take the suffix, so is
+	// delayed instead.
+	text += duplicateSuffix
+	if utf8.RuneCountInString(text) > maxMessageLength {
+		return wait, true
+	}
+
+	if action {
+		text = wrapAction(text)
+	}
+	m.Trailing = text
+	return 0, true
+}
+
+// sent records m as the last message sent to its channel.
+func (d *duplicates) sent(m *irc.Message) {
+	d.last[messageChannel(m)] = sentMessage{text: m.Trailing, at: time.Now()}
+}
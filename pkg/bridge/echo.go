@@ -0,0 +1,65 @@
+package bridge
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/jakebailey/irc"
+)
+
+const (
+	selfSuppress = "suppress"
+	selfTag      = "tag"
+)
+
+// echoWindow is how long sent messages are remembered, to recognize them
+// when other connections read them back from chat.
+const echoWindow = 5 * time.Minute
+
+var errBadSelf = errors.New("self must be suppress or tag")
+
+// sentMessages remembers the client nonces of messages sent over IRC and
+// the IDs of those sent through Helix. It is shared by every connection.
+var sentMessages = &dedupeCache{expires: make(map[string]time.Time)}
+
+func (c *Connection) validateSelf() error {
+	switch c.Publish.Self {
+	case "", selfSuppress, selfTag:
+		return nil
+	default:
+		return errBadSelf
+	}
+}
+
+// tagNonce gives m a random client-nonce tag, which Twitch repeats on the
+// copy of the message other connections read, and remembers it.
+func tagNonce(m *irc.Message) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return
+	}
+	nonce := hex.EncodeToString(b[:])
+
+	if m.Tags == nil {
+		m.Tags = make(map[string]string)
+	}
+	m.Tags["client-nonce"] = nonce
+
+	sentMessages.seen("nonce\x00"+nonce, echoWindow)
+}
+
+// sentByBridge reports whether m is a message the bridge sent.
+func sentByBridge(m *irc.Message) bool {
+	if m.Command != "PRIVMSG" {
+		return false
+	}
+	if nonce := tag(m, "client-nonce"); nonce != "" && sentMessages.has("nonce\x00"+nonce) {
+		return true
+	}
+	if id := tag(m, "id"); id != "" && sentMessages.has("id\x00"+id) {
+		return true
+	}
+	return false
+}
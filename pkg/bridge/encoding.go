@@ -0,0 +1,235 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jakebailey/irc"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	encodingJSON     = "json"
+	encodingMsgpack  = "msgpack"
+	encodingProtobuf = "protobuf"
+)
+
+// marshalPayload encodes v, which is an *irc.Message, *timedMessage, or
+// *parsedMessage. Protobuf payloads follow twitchmqtt.proto.
+func marshalPayload(encoding string, v interface{}) ([]byte, error) {
+	switch encoding {
+	case encodingMsgpack:
+		var buf bytes.Buffer
+		enc := msgpack.NewEncoder(&buf)
+		enc.SetCustomStructTag("json")
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	case encodingProtobuf:
+		switch v := v.(type) {
+		case *irc.Message:
+			return protoIRCMessage(nil, v), nil
+		case *timedMessage:
+			b := protoIRCMessage(nil, v.Message)
+			b = protoMessage(b, 7, protoTimestamp(nil, v.ReceivedAt))
+			if v.SentAt != nil {
+				b = protoMessage(b, 8, protoTimestamp(nil, *v.SentAt))
+			}
+			b = protoFields(b, 9, v.Fields)
+			return protoBool(b, 10, v.Self), nil
+		case *parsedMessage:
+			return protoParsedMessage(nil, v), nil
+		default:
+			return nil, fmt.Errorf("cannot encode %T as protobuf", v)
+		}
+
+	default:
+		return json.Marshal(v)
+	}
+}
+
+func protoString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func protoBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+func protoInt(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func protoMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+func protoIRCMessage(b []byte, m *irc.Message) []byte {
+	b = protoString(b, 1, m.Raw)
+
+	keys := make([]string, 0, len(m.Tags))
+	for k := range m.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, m.Tags[k])
+		b = protoMessage(b, 2, entry)
+	}
+
+	if p := m.Prefix; p.Name != "" {
+		var prefix []byte
+		prefix = protoString(prefix, 1, p.Name)
+		prefix = protoString(prefix, 2, p.User)
+		prefix = protoString(prefix, 3, p.Host)
+		b = protoMessage(b, 3, prefix)
+	}
+
+	b = protoString(b, 4, m.Command)
+	for _, p := range m.Params {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendString(b, p)
+	}
+	b = protoString(b, 6, m.Trailing)
+
+	return b
+}
+
+func protoParsedMessage(b []byte, p *parsedMessage) []byte {
+	b = protoString(b, 1, p.Command)
+	b = protoString(b, 2, p.Channel)
+	b = protoString(b, 3, p.User)
+	b = protoString(b, 4, p.Message)
+	b = protoString(b, 5, p.ID)
+	b = protoString(b, 6, p.DisplayName)
+	b = protoString(b, 7, p.UserID)
+	b = protoString(b, 8, p.RoomID)
+	b = protoString(b, 9, p.Color)
+
+	for _, badge := range p.Badges {
+		var m []byte
+		m = protoString(m, 1, badge.Name)
+		m = protoString(m, 2, badge.Version)
+		b = protoMessage(b, 10, m)
+	}
+
+	for _, e := range p.Emotes {
+		var m []byte
+		m = protoString(m, 1, e.ID)
+		m = protoInt(m, 2, int64(e.Start))
+		m = protoInt(m, 3, int64(e.End))
+		m = protoString(m, 4, e.Name)
+
+		m = protoMessage(m, 5, protoEmoteURLs(nil, e.URLs))
+
+		b = protoMessage(b, 11, m)
+	}
+
+	b = protoInt(b, 12, int64(p.Bits))
+	b = protoBool(b, 13, p.Mod)
+	b = protoBool(b, 14, p.Subscriber)
+	b = protoBool(b, 15, p.VIP)
+
+	if p.Timestamp != nil {
+		b = protoMessage(b, 16, protoTimestamp(nil, *p.Timestamp))
+	}
+
+	b = protoBool(b, 17, p.IsAction)
+
+	for _, ch := range p.Cheers {
+		var m []byte
+		m = protoString(m, 1, ch.Prefix)
+		m = protoInt(m, 2, int64(ch.Amount))
+		b = protoMessage(b, 18, m)
+	}
+
+	if pr := p.Profile; pr != nil {
+		var m []byte
+		m = protoString(m, 1, pr.ProfileImageURL)
+		m = protoString(m, 2, pr.BroadcasterType)
+		b = protoMessage(b, 19, m)
+	}
+
+	if s := p.Stream; s != nil {
+		var m []byte
+		m = protoString(m, 1, s.Game)
+		m = protoString(m, 2, s.Title)
+		b = protoMessage(b, 20, m)
+	}
+
+	for _, e := range p.ThirdPartyEmotes {
+		var m []byte
+		m = protoString(m, 1, e.Provider)
+		m = protoString(m, 2, e.ID)
+		m = protoString(m, 3, e.Name)
+		m = protoInt(m, 4, int64(e.Start))
+		m = protoInt(m, 5, int64(e.End))
+		m = protoMessage(m, 6, protoEmoteURLs(nil, e.URLs))
+		b = protoMessage(b, 21, m)
+	}
+
+	b = protoMessage(b, 22, protoTimestamp(nil, p.ReceivedAt))
+	if p.SentAt != nil {
+		b = protoMessage(b, 23, protoTimestamp(nil, *p.SentAt))
+	}
+
+	b = protoFields(b, 24, p.Fields)
+	b = protoBool(b, 25, p.Self)
+	b = protoBool(b, 26, p.FirstMessage)
+	return protoBool(b, 27, p.ReturningChatter)
+}
+
+// protoFields encodes script fields as a map<string, string>, formatting
+// their values as text.
+func protoFields(b []byte, num protowire.Number, fields map[string]interface{}) []byte {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var entry []byte
+		entry = protoString(entry, 1, k)
+		entry = protoString(entry, 2, fmt.Sprint(fields[k]))
+		b = protoMessage(b, num, entry)
+	}
+
+	return b
+}
+
+func protoEmoteURLs(b []byte, urls emoteURLs) []byte {
+	b = protoString(b, 1, urls.X1)
+	b = protoString(b, 2, urls.X2)
+	return protoString(b, 3, urls.X3)
+}
+
+// protoTimestamp encodes t as a google.protobuf.Timestamp.
+func protoTimestamp(b []byte, t time.Time) []byte {
+	b = protoInt(b, 1, t.Unix())
+	return protoInt(b, 2, int64(t.Nanosecond()))
+}
@@ -0,0 +1,186 @@
+package bridge
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const defaultEnrichTTL = 10 * time.Minute
+
+var (
+	errEnrichFormat = errors.New("enrichment requires the parsed format")
+	errBadEnrichTTL = errors.New("negative enrichment cache TTL")
+)
+
+// userProfile is Helix information about a message's sender.
+type userProfile struct {
+	ProfileImageURL string `json:"profile_image_url,omitempty"`
+	BroadcasterType string `json:"broadcaster_type,omitempty"`
+}
+
+// streamInfo is Helix information about a message's channel.
+type streamInfo struct {
+	Game  string `json:"game,omitempty"`
+	Title string `json:"title,omitempty"`
+}
+
+type enrichEntry struct {
+	v       interface{}
+	expires time.Time
+}
+
+// enricher looks up users and channels through Helix, caching the results
+// to stay within rate limits.
+type enricher struct {
+	h   *helixClient
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]enrichEntry
+}
+
+func (c *Connection) validateEnrich() error {
+	e := &c.Publish.Enrich
+	if !e.Enabled {
+		return nil
+	}
+
+	if c.Publish.Format != formatParsed {
+		return errEnrichFormat
+	}
+
+	if err := c.checkHelix(); err != nil {
+		return err
+	}
+
+	if e.TTL < 0 {
+		return errBadEnrichTTL
+	}
+
+	if e.TTL == 0 {
+		e.TTL = defaultEnrichTTL
+	}
+
+	c.enricher = &enricher{
+		h:       c.helix(),
+		ttl:     e.TTL,
+		entries: make(map[string]enrichEntry),
+	}
+
+	return nil
+}
+
+// cached returns the cached value for key, calling fetch if it is missing
+// or expired.
+func (e *enricher) cached(key string, fetch func() (interface{}, error)) (interface{}, error) {
+	now := time.Now()
+
+	e.mu.Lock()
+	entry, ok := e.entries[key]
+	e.mu.Unlock()
+
+	if ok && now.Before(entry.expires) {
+		return entry.v, nil
+	}
+
+	v, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Drop expired entries as the cache is refilled.
+	for k, old := range e.entries {
+		if now.After(old.expires) {
+			delete(e.entries, k)
+		}
+	}
+	e.entries[key] = enrichEntry{v: v, expires: now.Add(e.ttl)}
+
+	return v, nil
+}
+
+func (e *enricher) profile(userID string) (*userProfile, error) {
+	v, err := e.cached("user:"+userID, func() (interface{}, error) {
+		var resp struct {
+			Data []struct {
+				ProfileImageURL string `json:"profile_image_url"`
+				BroadcasterType string `json:"broadcaster_type"`
+			}
+		}
+
+		if err := e.h.do("GET", "/users", url.Values{"id": {userID}}, nil, &resp); err != nil {
+			return nil, err
+		}
+
+		if len(resp.Data) == 0 {
+			return (*userProfile)(nil), nil
+		}
+
+		return &userProfile{
+			ProfileImageURL: resp.Data[0].ProfileImageURL,
+			BroadcasterType: resp.Data[0].BroadcasterType,
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*userProfile), nil
+}
+
+func (e *enricher) stream(roomID string) (*streamInfo, error) {
+	v, err := e.cached("channel:"+roomID, func() (interface{}, error) {
+		var resp struct {
+			Data []struct {
+				GameName string `json:"game_name"`
+				Title    string
+			}
+		}
+
+		if err := e.h.do("GET", "/channels", url.Values{"broadcaster_id": {roomID}}, nil, &resp); err != nil {
+			return nil, err
+		}
+
+		if len(resp.Data) == 0 {
+			return (*streamInfo)(nil), nil
+		}
+
+		return &streamInfo{
+			Game:  resp.Data[0].GameName,
+			Title: resp.Data[0].Title,
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*streamInfo), nil
+}
+
+// enrich adds the sender's profile and the channel's game and title to p.
+// Lookup failures are logged and leave the fields empty.
+func (c *Connection) enrich(p *parsedMessage) {
+	e := c.enricher
+	if e == nil {
+		return
+	}
+
+	if p.UserID != "" {
+		profile, err := e.profile(p.UserID)
+		if err != nil {
+			c.elog.Printf("enriching user: %v", err)
+		}
+		p.Profile = profile
+	}
+
+	if p.RoomID != "" {
+		stream, err := e.stream(p.RoomID)
+		if err != nil {
+			c.elog.Printf("enriching channel: %v", err)
+		}
+		p.Stream = stream
+	}
+}
@@ -0,0 +1,144 @@
+package bridge
+
+import (
+	"expvar"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const maxErrorLogEntries = 1000
+
+var errorMetrics = expvar.NewMap("errors")
+
+// errorLog aggregates repeated error lines. The first occurrence of a line
+// in each window is logged immediately; repeats are counted and summarized
+// once the window ends. Lines beyond the first maxErrorLogEntries in a
+// window are not logged, but their number is. Every occurrence is counted
+// in errorMetrics, keyed by format string, or for Println by the calling
+// function, to keep the number of keys bounded.
+//
+// Error logs returned by with share their counts, but log through their own
+// logger.
+type errorLog struct {
+	*errorCounts
+	log *zerolog.Logger
+}
+
+type errorCounts struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[errorKey]int
+	dropped int
+}
+
+type errorKey struct {
+	log *zerolog.Logger
+	s   string
+}
+
+var elog = &errorLog{
+	errorCounts: &errorCounts{
+		window:  time.Minute,
+		entries: make(map[errorKey]int),
+	},
+	log: &logger,
+}
+
+// with returns an error log which logs through l.
+func (e *errorLog) with(l *zerolog.Logger) *errorLog {
+	return &errorLog{errorCounts: e.errorCounts, log: l}
+}
+
+func (e *errorLog) Printf(format string, v ...interface{}) {
+	e.output(format, fmt.Sprintf(format, v...))
+}
+
+func (e *errorLog) Println(err error) {
+	e.output(callerName(2), err.Error())
+}
+
+// callerName returns the name of the function skip frames up the stack,
+// without its package path.
+func callerName(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip)
+	f := runtime.FuncForPC(pc)
+	if !ok || f == nil {
+		return "unknown"
+	}
+
+	name := f.Name()
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+func (e *errorLog) output(metric, s string) {
+	errorMetrics.Add(metric, 1)
+
+	key := errorKey{log: e.log, s: s}
+
+	e.mu.Lock()
+	count, seen := e.entries[key]
+	if seen {
+		e.entries[key] = count + 1
+		e.mu.Unlock()
+		return
+	}
+	if len(e.entries) >= maxErrorLogEntries {
+		e.dropped++
+		e.mu.Unlock()
+		return
+	}
+	e.entries[key] = 0
+	e.mu.Unlock()
+
+	e.log.Error().Msg(s)
+}
+
+// AggregateErrors summarizes repeated errors once per window until stop is
+// closed. Without it, repeats are counted but never logged.
+func AggregateErrors(window time.Duration, stop <-chan struct{}) {
+	elog.mu.Lock()
+	elog.window = window
+	elog.mu.Unlock()
+
+	elog.run(window, stop)
+}
+
+func (e *errorLog) run(window time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			e.flush()
+			return
+		case <-ticker.C:
+			e.flush()
+		}
+	}
+}
+
+func (e *errorLog) flush() {
+	e.mu.Lock()
+	entries, dropped, window := e.entries, e.dropped, e.window
+	e.entries, e.dropped = make(map[errorKey]int, len(entries)), 0
+	e.mu.Unlock()
+
+	for key, count := range entries {
+		if count > 0 {
+			key.log.Error().Int("repeats", count).Dur("window", window).Msg(key.s)
+		}
+	}
+
+	if dropped > 0 {
+		e.log.Error().Int("dropped", dropped).Dur("window", window).Msg("too many distinct errors, some were not logged")
+	}
+}
@@ -0,0 +1,58 @@
+package bridge
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func newTestErrorLog() (*errorLog, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l := zerolog.New(&buf)
+	return &errorLog{
+		errorCounts: &errorCounts{window: time.Minute, entries: make(map[errorKey]int)},
+		log:         &l,
+	}, &buf
+}
+
+func TestErrorLogMetricKeys(t *testing.T) {
+	// Both are counted under this function, not the type of the errors.
+	const key = "bridge.TestErrorLogMetricKeys"
+	count := func() int64 {
+		if v, ok := errorMetrics.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := count()
+
+	e, _ := newTestErrorLog()
+	e.Println(errors.New("first"))
+	e.Println(errors.New("second"))
+
+	if got := count() - before; got != 2 {
+		t.Errorf("errors[%q] grew by %d, want 2", key, got)
+	}
+}
+
+func TestErrorLogDropped(t *testing.T) {
+	e, buf := newTestErrorLog()
+	for i := 0; i < maxErrorLogEntries+3; i++ {
+		e.Printf("error %d", i)
+	}
+
+	if got := strings.Count(buf.String(), "\n"); got != maxErrorLogEntries {
+		t.Errorf("logged %d lines, want %d", got, maxErrorLogEntries)
+	}
+
+	buf.Reset()
+	e.flush()
+	if !strings.Contains(buf.String(), `"dropped":3`) {
+		t.Errorf("flush logged %q, want 3 dropped", buf.String())
+	}
+}
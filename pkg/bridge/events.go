@@ -0,0 +1,130 @@
+package bridge
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jakebailey/irc"
+)
+
+// eventUser identifies a user involved in an event.
+type eventUser struct {
+	Login       string `json:"login,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	ID          string `json:"id,omitempty"`
+}
+
+// userEvent is a USERNOTICE decoded from its msg-id and msg-param-* tags.
+// Fields which do not apply to the event's type are omitted; Params keeps
+// every msg-param-* tag, without the prefix, for types not decoded here.
+type userEvent struct {
+	Type          string            `json:"type"`
+	Channel       string            `json:"channel"`
+	ID            string            `json:"id,omitempty"`
+	User          eventUser         `json:"user"`
+	Message       string            `json:"message,omitempty"`
+	SystemMessage string            `json:"system_message,omitempty"`
+	Timestamp     *time.Time        `json:"timestamp,omitempty"`
+	Tier          string            `json:"tier,omitempty"`
+	PlanName      string            `json:"plan_name,omitempty"`
+	Months        int               `json:"months,omitempty"`
+	StreakMonths  int               `json:"streak_months,omitempty"`
+	GiftMonths    int               `json:"gift_months,omitempty"`
+	Recipient     *eventUser        `json:"recipient,omitempty"`
+	GiftCount     int               `json:"gift_count,omitempty"`
+	SenderTotal   int               `json:"sender_total,omitempty"`
+	Viewers       int               `json:"viewers,omitempty"`
+	Params        map[string]string `json:"params,omitempty"`
+}
+
+const msgParamPrefix = "msg-param-"
+
+func parseUserEvent(m *irc.Message) *userEvent {
+	e := &userEvent{
+		Type:          tag(m, "msg-id"),
+		Channel:       strings.TrimPrefix(messageChannel(m), "#"),
+		ID:            tag(m, "id"),
+		Message:       m.Trailing,
+		SystemMessage: tag(m, "system-msg"),
+		User: eventUser{
+			Login:       tag(m, "login"),
+			DisplayName: tag(m, "display-name"),
+			ID:          tag(m, "user-id"),
+		},
+	}
+
+	if ts, err := strconv.ParseInt(tag(m, "tmi-sent-ts"), 10, 64); err == nil {
+		t := time.Unix(0, ts*int64(time.Millisecond)).UTC()
+		e.Timestamp = &t
+	}
+
+	for k, v := range m.Tags {
+		if name := strings.TrimPrefix(k, msgParamPrefix); name != k {
+			if e.Params == nil {
+				e.Params = make(map[string]string)
+			}
+			e.Params[name] = v
+		}
+	}
+
+	param := func(name string) string {
+		return e.Params[name]
+	}
+	intParam := func(name string) int {
+		n, _ := strconv.Atoi(param(name))
+		return n
+	}
+
+	switch e.Type {
+	case "sub", "resub":
+		e.Tier = param("sub-plan")
+		e.PlanName = param("sub-plan-name")
+		e.Months = intParam("cumulative-months")
+		if param("should-share-streak") == "1" {
+			e.StreakMonths = intParam("streak-months")
+		}
+
+	case "subgift", "anonsubgift":
+		e.Tier = param("sub-plan")
+		e.PlanName = param("sub-plan-name")
+		e.Months = intParam("months")
+		e.GiftMonths = intParam("gift-months")
+		e.SenderTotal = intParam("sender-count")
+		e.Recipient = &eventUser{
+			Login:       param("recipient-user-name"),
+			DisplayName: param("recipient-display-name"),
+			ID:          param("recipient-id"),
+		}
+
+	case "submysterygift", "anonsubmysterygift":
+		e.Tier = param("sub-plan")
+		e.GiftCount = intParam("mass-gift-count")
+		e.SenderTotal = intParam("sender-count")
+
+	case "raid":
+		e.Viewers = intParam("viewerCount")
+	}
+
+	return e
+}
+
+// publishEvent publishes m, a USERNOTICE, as a userEvent to the events
+// topic.
+func (c *Connection) publishEvent(client MQTTClient, m *irc.Message) {
+	b, err := json.Marshal(parseUserEvent(m))
+	if err != nil {
+		c.elog.Println(err)
+		return
+	}
+
+	topic := c.expandTopic(c.Events.Topic, m)
+
+	if t := client.Publish(topic, c.Events.QOS, false, b); t.Error() != nil {
+		c.elog.Printf("event publish failed: %v", t.Error())
+		c.count("publish_errors")
+	} else {
+		c.count("events")
+	}
+}
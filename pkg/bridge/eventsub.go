@@ -0,0 +1,409 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jakebailey/irc"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	eventSubURL = "wss://eventsub.wss.twitch.tv/ws"
+
+	// eventSubSlack is added to the session's keepalive timeout before the
+	// connection is considered dead.
+	eventSubSlack = 10 * time.Second
+
+	defaultEventSubKeepalive = 10 * time.Second
+
+	// eventSubDedupe is how long notification IDs are remembered, as
+	// Twitch may deliver a notification more than once.
+	eventSubDedupe = 10 * time.Minute
+)
+
+var (
+	errBadEventSubType   = errors.New("unknown EventSub subscription type")
+	errNoEventSubTypes   = errors.New("no EventSub subscription types")
+	errNoEventSubWelcome = errors.New("EventSub session did not start with a welcome message")
+)
+
+// Conditions of EventSub subscriptions, which name the users they apply
+// to.
+const (
+	conditionBroadcaster = iota
+	conditionModerator
+	conditionToBroadcaster
+)
+
+type eventSubType struct {
+	version   string
+	condition int
+}
+
+// eventSubTypes are the supported EventSub subscription types.
+var eventSubTypes = map[string]eventSubType{
+	"channel.update":               {"2", conditionBroadcaster},
+	"channel.follow":               {"2", conditionModerator},
+	"channel.subscribe":            {"1", conditionBroadcaster},
+	"channel.subscription.end":     {"1", conditionBroadcaster},
+	"channel.subscription.gift":    {"1", conditionBroadcaster},
+	"channel.subscription.message": {"1", conditionBroadcaster},
+	"channel.cheer":                {"1", conditionBroadcaster},
+	"channel.raid":                 {"1", conditionToBroadcaster},
+	"channel.ban":                  {"1", conditionBroadcaster},
+	"channel.unban":                {"1", conditionBroadcaster},
+	"channel.channel_points_custom_reward_redemption.add":    {"1", conditionBroadcaster},
+	"channel.channel_points_custom_reward_redemption.update": {"1", conditionBroadcaster},
+	"channel.poll.begin":          {"1", conditionBroadcaster},
+	"channel.poll.progress":       {"1", conditionBroadcaster},
+	"channel.poll.end":            {"1", conditionBroadcaster},
+	"channel.prediction.begin":    {"1", conditionBroadcaster},
+	"channel.prediction.progress": {"1", conditionBroadcaster},
+	"channel.prediction.lock":     {"1", conditionBroadcaster},
+	"channel.prediction.end":      {"1", conditionBroadcaster},
+	"channel.hype_train.begin":    {"1", conditionBroadcaster},
+	"channel.hype_train.progress": {"1", conditionBroadcaster},
+	"channel.hype_train.end":      {"1", conditionBroadcaster},
+	"channel.shoutout.create":     {"1", conditionModerator},
+	"channel.shoutout.receive":    {"1", conditionModerator},
+	"stream.online":               {"1", conditionBroadcaster},
+	"stream.offline":              {"1", conditionBroadcaster},
+}
+
+// eventSubMessage is a message received over an EventSub WebSocket.
+type eventSubMessage struct {
+	Metadata struct {
+		MessageID           string `json:"message_id"`
+		MessageType         string `json:"message_type"`
+		SubscriptionType    string `json:"subscription_type"`
+		SubscriptionVersion string `json:"subscription_version"`
+	} `json:"metadata"`
+
+	Payload struct {
+		Session *struct {
+			ID                      string `json:"id"`
+			KeepaliveTimeoutSeconds int    `json:"keepalive_timeout_seconds"`
+			ReconnectURL            string `json:"reconnect_url"`
+		} `json:"session"`
+
+		Subscription *struct {
+			ID        string            `json:"id"`
+			Type      string            `json:"type"`
+			Version   string            `json:"version"`
+			Status    string            `json:"status"`
+			Condition map[string]string `json:"condition"`
+		} `json:"subscription"`
+
+		Event json.RawMessage `json:"event"`
+	} `json:"payload"`
+}
+
+// eventSubEvent is published for each EventSub notification.
+type eventSubEvent struct {
+	Type    string          `json:"type"`
+	Version string          `json:"version"`
+	Channel string          `json:"channel"`
+	Event   json.RawMessage `json:"event"`
+}
+
+func (c *Connection) validateEventSub() error {
+	es := &c.EventSub
+	if es.Topic == "" {
+		return nil
+	}
+
+	if err := c.checkHelix(); err != nil {
+		return fieldErr("topic", err)
+	}
+
+	if len(es.Types) == 0 {
+		return fieldErr("types", errNoEventSubTypes)
+	}
+
+	for i, typ := range es.Types {
+		if _, ok := eventSubTypes[typ]; !ok {
+			return fieldErr(fmt.Sprintf("types[%d]", i), fmt.Errorf("%w: %q", errBadEventSubType, typ))
+		}
+	}
+
+	for i, ch := range es.Channels {
+		if ch = channelName(ch); ch == "" {
+			return fieldErr(fmt.Sprintf("channels[%d]", i), errEmptyChannel)
+		}
+		es.Channels[i] = ch
+	}
+
+	return nil
+}
+
+// eventSubChannels returns the logins of the broadcasters to subscribe to,
+// defaulting to the connection's channels.
+func (c *Connection) eventSubChannels() []string {
+	if len(c.EventSub.Channels) > 0 {
+		return c.EventSub.Channels
+	}
+
+	var channels []string
+	for _, ch := range c.channels() {
+		channels = append(channels, strings.TrimPrefix(ch, "#"))
+	}
+	return channels
+}
+
+// eventSubSocket is the current WebSocket of an EventSub session, which
+// changes when Twitch asks the client to reconnect.
+type eventSubSocket struct {
+	mu     sync.Mutex
+	ws     *websocket.Conn
+	closed bool
+}
+
+func (s *eventSubSocket) set(ws *websocket.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		ws.Close()
+		return false
+	}
+
+	s.ws = ws
+	return true
+}
+
+func (s *eventSubSocket) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.ws != nil {
+		s.ws.Close()
+	}
+}
+
+// eventSubLoop keeps an EventSub session open, reconnecting with backoff,
+// until stop is closed.
+func (c *Connection) eventSubLoop(client MQTTClient, stop <-chan struct{}) {
+	h := c.helix()
+	retry := newBackoff(c.Reconnect.MinDelay, c.Reconnect.MaxDelay)
+
+	for {
+		err := c.eventSubSession(h, client, retry, stop)
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		d := retry.next()
+		c.log.Warn().Err(err).Dur("delay", d).Msg("EventSub session ended, reconnecting")
+
+		if !sleep(d, stop) {
+			return
+		}
+	}
+}
+
+// eventSubSession runs a single EventSub session, subscribing once it is
+// welcomed and publishing notifications until it fails or stop is closed.
+func (c *Connection) eventSubSession(h *helixClient, client MQTTClient, retry *backoff, stop <-chan struct{}) error {
+	sock := &eventSubSocket{}
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		sock.close()
+	}()
+
+	ws, keepalive, sessionID, err := c.dialEventSub(eventSubURL)
+	if err != nil {
+		return err
+	}
+	if !sock.set(ws) {
+		return errStopped
+	}
+
+	if err := c.eventSubscribe(h, sessionID); err != nil {
+		return err
+	}
+
+	c.log.Info().Strs("types", c.EventSub.Types).Msg("EventSub session started")
+	retry.reset()
+
+	for {
+		var msg eventSubMessage
+		ws.SetReadDeadline(time.Now().Add(keepalive + eventSubSlack))
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return err
+		}
+
+		switch msg.Metadata.MessageType {
+		case "session_keepalive":
+
+		case "notification":
+			if publishDedupe.seen("eventsub\x00"+msg.Metadata.MessageID, eventSubDedupe) {
+				continue
+			}
+			c.publishEventSub(client, &msg)
+
+		case "session_reconnect":
+			if msg.Payload.Session == nil {
+				continue
+			}
+
+			c.log.Info().Msg("EventSub reconnecting")
+
+			// Subscriptions carry over to the new connection.
+			next, ka, _, err := c.dialEventSub(msg.Payload.Session.ReconnectURL)
+			if err != nil {
+				return err
+			}
+
+			old := ws
+			if !sock.set(next) {
+				return errStopped
+			}
+			old.Close()
+			ws, keepalive = next, ka
+
+		case "revocation":
+			if sub := msg.Payload.Subscription; sub != nil {
+				c.log.Warn().Str("type", sub.Type).Str("status", sub.Status).Msg("EventSub subscription revoked")
+				c.count("eventsub_revocations")
+			}
+		}
+	}
+}
+
+// dialEventSub connects to an EventSub WebSocket and waits for its welcome
+// message, returning the session's keepalive timeout and ID.
+func (c *Connection) dialEventSub(url string) (*websocket.Conn, time.Duration, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), proxyTimeout)
+	defer cancel()
+
+	ws, err := dialWebSocket(ctx, c.proxyDial(), url, nil)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	var msg eventSubMessage
+	ws.SetReadDeadline(time.Now().Add(defaultEventSubKeepalive + eventSubSlack))
+	if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		ws.Close()
+		return nil, 0, "", err
+	}
+
+	if msg.Metadata.MessageType != "session_welcome" || msg.Payload.Session == nil {
+		ws.Close()
+		return nil, 0, "", errNoEventSubWelcome
+	}
+
+	keepalive := time.Duration(msg.Payload.Session.KeepaliveTimeoutSeconds) * time.Second
+	if keepalive <= 0 {
+		keepalive = defaultEventSubKeepalive
+	}
+
+	return ws, keepalive, msg.Payload.Session.ID, nil
+}
+
+// eventSubscribe creates the configured subscriptions for the session.
+func (c *Connection) eventSubscribe(h *helixClient, sessionID string) error {
+	userID, err := h.userID(c.Nick)
+	if err != nil {
+		return err
+	}
+
+	for _, ch := range c.eventSubChannels() {
+		broadcasterID, err := h.userID(ch)
+		if err != nil {
+			return err
+		}
+
+		for _, typ := range c.EventSub.Types {
+			t := eventSubTypes[typ]
+
+			condition := map[string]string{}
+			switch t.condition {
+			case conditionBroadcaster:
+				condition["broadcaster_user_id"] = broadcasterID
+			case conditionModerator:
+				condition["broadcaster_user_id"] = broadcasterID
+				condition["moderator_user_id"] = userID
+			case conditionToBroadcaster:
+				condition["to_broadcaster_user_id"] = broadcasterID
+			}
+
+			body := map[string]interface{}{
+				"type":      typ,
+				"version":   t.version,
+				"condition": condition,
+				"transport": map[string]string{
+					"method":     "websocket",
+					"session_id": sessionID,
+				},
+			}
+
+			// A failed subscription, usually for a missing scope, should
+			// not prevent the others.
+			if err := h.do("POST", "/eventsub/subscriptions", nil, body, nil); err != nil {
+				c.elog.Printf("EventSub subscribe to %s for %s failed: %v", typ, ch, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// publishEventSub publishes a notification to the EventSub topic.
+func (c *Connection) publishEventSub(client MQTTClient, msg *eventSubMessage) {
+	sub := msg.Payload.Subscription
+	if sub == nil {
+		return
+	}
+
+	var event struct {
+		BroadcasterLogin   string `json:"broadcaster_user_login"`
+		ToBroadcasterLogin string `json:"to_broadcaster_user_login"`
+	}
+	json.Unmarshal(msg.Payload.Event, &event)
+
+	channel := event.BroadcasterLogin
+	if channel == "" {
+		channel = event.ToBroadcasterLogin
+	}
+
+	b, err := json.Marshal(&eventSubEvent{
+		Type:    sub.Type,
+		Version: sub.Version,
+		Channel: channel,
+		Event:   msg.Payload.Event,
+	})
+	if err != nil {
+		c.elog.Println(err)
+		return
+	}
+
+	topic := c.expandTopic(c.EventSub.Topic, &irc.Message{
+		Command: sub.Type,
+		Params:  []string{"#" + channel},
+		Tags:    map[string]string{"msg-id": sub.Type},
+	})
+
+	if t := client.Publish(topic, c.EventSub.QOS, false, b); t.Error() != nil {
+		c.elog.Printf("EventSub publish failed: %v", t.Error())
+		c.count("publish_errors")
+	} else {
+		c.count("eventsub_notifications")
+	}
+}
@@ -0,0 +1,220 @@
+package bridge
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// failbackInterval is how often a client failed over to a later broker
+// tries to return to an earlier one.
+const failbackInterval = time.Minute
+
+var (
+	errNoBrokerConnected = errors.New("not connected to any MQTT broker")
+	errAllBrokersFailed  = errors.New("could not connect to any MQTT broker")
+)
+
+type failoverSub struct {
+	qos     byte
+	handler mqtt.MessageHandler
+}
+
+// failoverClient is connected to one of several brokers, preferring them
+// in order. When its broker is unreachable for too long, it connects to
+// the first broker that accepts it and restores its subscriptions there.
+type failoverClient struct {
+	opts      *options
+	brokers   []*Broker
+	clientID  string
+	willTopic string
+	dial      func(b *Broker, clientID, willTopic string) (BrokerClient, error)
+
+	mu      sync.Mutex
+	current BrokerClient
+	index   int
+	subs    map[string]failoverSub
+	closed  bool
+}
+
+var (
+	_ BrokerClient      = (*failoverClient)(nil)
+	_ propertyPublisher = (*failoverClient)(nil)
+)
+
+func (o *options) connectFailover(brokers []*Broker, clientID, willTopic string) (*failoverClient, error) {
+	f := &failoverClient{
+		opts:      o,
+		brokers:   brokers,
+		clientID:  clientID,
+		willTopic: willTopic,
+		subs:      make(map[string]failoverSub),
+	}
+
+	if !f.connect(len(brokers)) {
+		return nil, errAllBrokersFailed
+	}
+
+	return f, nil
+}
+
+// connect connects to the first of the first n brokers which accepts the
+// connection, switching to it, and reports whether one did.
+func (f *failoverClient) connect(n int) bool {
+	dial := f.dial
+	if dial == nil {
+		dial = f.opts.connectBroker
+	}
+
+	for i, b := range f.brokers[:n] {
+		client, err := dial(b, f.clientID, f.willTopic)
+		if err != nil {
+			logger.Warn().Err(err).Str("broker", b.URL).Msg("MQTT broker connection failed")
+			continue
+		}
+
+		f.use(client, i)
+		return true
+	}
+
+	return false
+}
+
+// use switches to client, the broker at index, restoring subscriptions.
+func (f *failoverClient) use(client BrokerClient, index int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		client.Disconnect(0)
+		return
+	}
+
+	if f.current != nil {
+		f.current.Disconnect(250)
+	}
+
+	f.current, f.index = client, index
+	logger.Info().Str("broker", f.brokers[index].URL).Msg("connected to MQTT broker")
+
+	for topic, s := range f.subs {
+		if t := client.Subscribe(topic, s.qos, s.handler); t.Wait() && t.Error() != nil {
+			elog.Printf("resubscribing to %s failed: %v", topic, t.Error())
+		}
+	}
+
+	// The will may have been published when the last broker was lost.
+	if f.willTopic != "" {
+		client.Publish(f.willTopic, 1, true, availabilityOnline)
+	}
+}
+
+func (f *failoverClient) client() BrokerClient {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.current
+}
+
+// run fails over when the broker has been unreachable for the failover
+// delay, and periodically tries to fail back to earlier brokers, until
+// stop is closed.
+func (f *failoverClient) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var down time.Time
+	lastFailback := time.Now()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if f.IsConnected() {
+			down = time.Time{}
+
+			f.mu.Lock()
+			index := f.index
+			f.mu.Unlock()
+
+			if index > 0 && time.Since(lastFailback) >= failbackInterval {
+				lastFailback = time.Now()
+				f.connect(index)
+			}
+			continue
+		}
+
+		if down.IsZero() {
+			down = time.Now()
+			continue
+		}
+
+		if time.Since(down) < f.opts.failoverAfter {
+			continue
+		}
+
+		logger.Warn().Dur("down", time.Since(down)).Msg("MQTT broker unreachable, failing over")
+
+		if f.connect(len(f.brokers)) {
+			down = time.Time{}
+		}
+	}
+}
+
+func (f *failoverClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c := f.client()
+	if c == nil {
+		return doneToken(errNoBrokerConnected)
+	}
+	return c.Publish(topic, qos, retained, payload)
+}
+
+func (f *failoverClient) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props *publishProperties) mqtt.Token {
+	c := f.client()
+	if c == nil {
+		return doneToken(errNoBrokerConnected)
+	}
+	if pp, ok := c.(propertyPublisher); ok {
+		return pp.PublishWithProperties(topic, qos, retained, payload, props)
+	}
+	return c.Publish(topic, qos, retained, payload)
+}
+
+func (f *failoverClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	f.mu.Lock()
+	f.subs[topic] = failoverSub{qos: qos, handler: callback}
+	c := f.current
+	f.mu.Unlock()
+
+	return c.Subscribe(topic, qos, callback)
+}
+
+func (f *failoverClient) Unsubscribe(topics ...string) mqtt.Token {
+	f.mu.Lock()
+	for _, topic := range topics {
+		delete(f.subs, topic)
+	}
+	c := f.current
+	f.mu.Unlock()
+
+	return c.Unsubscribe(topics...)
+}
+
+func (f *failoverClient) IsConnected() bool {
+	c := f.client()
+	return c != nil && c.IsConnected()
+}
+
+func (f *failoverClient) Disconnect(quiesce uint) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	if f.current != nil {
+		f.current.Disconnect(quiesce)
+	}
+}
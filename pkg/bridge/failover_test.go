@@ -0,0 +1,118 @@
+package bridge
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeBroker is a broker which can be taken down, refusing connections and
+// reporting its client disconnected.
+type fakeBroker struct {
+	*fakeMQTT
+	up           atomic.Bool
+	disconnected atomic.Bool
+}
+
+func newFakeBroker(up bool) *fakeBroker {
+	b := &fakeBroker{fakeMQTT: newFakeMQTT()}
+	b.up.Store(up)
+	return b
+}
+
+func (b *fakeBroker) IsConnected() bool { return b.up.Load() }
+func (b *fakeBroker) Disconnect(uint)   { b.disconnected.Store(true) }
+
+// newTestFailover returns a failover client over brokers named by their
+// URLs, without connecting it.
+func newTestFailover(brokers map[string]*fakeBroker, urls ...string) *failoverClient {
+	f := &failoverClient{
+		opts:      newOptions([]Option{WithFailoverAfter(time.Millisecond)}),
+		willTopic: "twitch/status",
+		subs:      make(map[string]failoverSub),
+	}
+	for _, u := range urls {
+		f.brokers = append(f.brokers, &Broker{URL: u})
+	}
+
+	f.dial = func(b *Broker, _, _ string) (BrokerClient, error) {
+		if br := brokers[b.URL]; br.up.Load() {
+			return br, nil
+		}
+		return nil, errors.New("broker is down")
+	}
+	return f
+}
+
+func TestFailoverConnectsToFirstAvailable(t *testing.T) {
+	brokers := map[string]*fakeBroker{
+		"tcp://a": newFakeBroker(false),
+		"tcp://b": newFakeBroker(true),
+		"tcp://c": newFakeBroker(true),
+	}
+	f := newTestFailover(brokers, "tcp://a", "tcp://b", "tcp://c")
+
+	if !f.connect(len(f.brokers)) {
+		t.Fatal("no broker accepted the connection")
+	}
+	if f.index != 1 {
+		t.Errorf("connected to broker %d, want 1", f.index)
+	}
+
+	m, err := brokers["tcp://b"].NextOn("twitch/status", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.payload) != availabilityOnline || !m.retained {
+		t.Errorf("published %q (retained %v), want retained %q", m.payload, m.retained, availabilityOnline)
+	}
+
+	f.Publish("twitch/chat", 0, false, "hello")
+	if _, err := brokers["tcp://b"].NextOn("twitch/chat", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailoverRestoresSubscriptions(t *testing.T) {
+	brokers := map[string]*fakeBroker{
+		"tcp://a": newFakeBroker(true),
+		"tcp://b": newFakeBroker(true),
+	}
+	f := newTestFailover(brokers, "tcp://a", "tcp://b")
+	if !f.connect(len(f.brokers)) {
+		t.Fatal("no broker accepted the connection")
+	}
+
+	received := make(chan string, 1)
+	f.Subscribe("twitch/send", 1, func(_ mqtt.Client, m mqtt.Message) {
+		received <- string(m.Payload())
+	})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go f.run(stop)
+
+	brokers["tcp://a"].up.Store(false)
+
+	deadline := time.Now().Add(testTimeout)
+	for f.client() != BrokerClient(brokers["tcp://b"]) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for failover")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !brokers["tcp://a"].disconnected.Load() {
+		t.Error("lost broker was not disconnected")
+	}
+
+	if n := brokers["tcp://b"].Deliver("twitch/send", []byte("hi")); n != 1 {
+		t.Fatalf("delivered to %d subscriptions, want 1", n)
+	}
+	if got := <-received; got != "hi" {
+		t.Errorf("received %q, want hi", got)
+	}
+}
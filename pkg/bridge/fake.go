@@ -0,0 +1,302 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jakebailey/irc"
+)
+
+// This file contains in-memory fakes of IRC and MQTT, so the pipeline can
+// be exercised without Twitch or a broker, by the self-test and by tests.
+
+var errFakeClosed = errors.New("fake connection closed")
+
+// fakeIRC is an in-memory irc.Conn. Messages passed to Send are decoded by
+// the bridge, and messages the bridge encodes are available via Next.
+type fakeIRC struct {
+	in     chan *irc.Message
+	out    chan fakeLine
+	closed chan struct{}
+	once   sync.Once
+}
+
+var _ irc.Conn = (*fakeIRC)(nil)
+
+func newFakeIRC() *fakeIRC {
+	return &fakeIRC{
+		in:     make(chan *irc.Message),
+		out:    make(chan fakeLine, 256),
+		closed: make(chan struct{}),
+	}
+}
+
+func (f *fakeIRC) Decode(m *irc.Message) error {
+	select {
+	case in := <-f.in:
+		*m = *in
+		return nil
+	case <-f.closed:
+		return io.EOF
+	}
+}
+
+func (f *fakeIRC) Encode(m *irc.Message) error {
+	cp := *m
+
+	select {
+	case <-f.closed:
+		return errFakeClosed
+	case f.out <- fakeLine{m: &cp, at: time.Now()}:
+	}
+
+	// Like Twitch, hang up after a QUIT.
+	if m.Command == "QUIT" {
+		return f.Close()
+	}
+
+	return nil
+}
+
+func (f *fakeIRC) Close() error {
+	f.once.Do(func() { close(f.closed) })
+	return nil
+}
+
+// Send delivers m to the bridge, as if the server had sent it.
+func (f *fakeIRC) Send(m *irc.Message) error {
+	if m.Raw == "" {
+		m.Raw = m.String()
+	}
+
+	select {
+	case f.in <- m:
+		return nil
+	case <-f.closed:
+		return errFakeClosed
+	}
+}
+
+// Next returns the next message sent by the bridge.
+func (f *fakeIRC) Next(timeout time.Duration) (*irc.Message, error) {
+	m, _, err := f.nextAt(timeout)
+	return m, err
+}
+
+func (f *fakeIRC) nextAt(timeout time.Duration) (*irc.Message, time.Time, error) {
+	select {
+	case l := <-f.out:
+		return l.m, l.at, nil
+	case <-time.After(timeout):
+		return nil, time.Time{}, fmt.Errorf("timed out waiting for IRC message after %s", timeout)
+	}
+}
+
+// NextCommand returns the next message with the given command sent by the
+// bridge, skipping any others.
+func (f *fakeIRC) NextCommand(command string, timeout time.Duration) (*irc.Message, error) {
+	m, _, err := f.NextCommandAt(command, timeout)
+	return m, err
+}
+
+// NextCommandAt is like NextCommand, but also returns when the bridge sent
+// the message.
+func (f *fakeIRC) NextCommandAt(command string, timeout time.Duration) (*irc.Message, time.Time, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		m, at, err := f.nextAt(time.Until(deadline))
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if m.Command == command {
+			return m, at, nil
+		}
+	}
+}
+
+// fakeLine is a message sent by the bridge, and when it was sent.
+type fakeLine struct {
+	m  *irc.Message
+	at time.Time
+}
+
+// fakeDialer hands out a new fakeIRC for every dial, making each one
+// available on Conns so reconnects can be observed.
+type fakeDialer struct {
+	Conns chan *fakeIRC
+
+	mu   sync.Mutex
+	fail int
+}
+
+func newFakeDialer() *fakeDialer {
+	return &fakeDialer{Conns: make(chan *fakeIRC, 16)}
+}
+
+// FailNext makes the next n dials fail.
+func (d *fakeDialer) FailNext(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.fail = n
+}
+
+func (d *fakeDialer) dial(_ context.Context, nick, pass string) (irc.Conn, error) {
+	d.mu.Lock()
+	if d.fail > 0 {
+		d.fail--
+		d.mu.Unlock()
+		return nil, errors.New("fake dial failure")
+	}
+	d.mu.Unlock()
+
+	f := newFakeIRC()
+	if err := login(f, nick, pass); err != nil {
+		return nil, err
+	}
+	if err := capReq(f, requestedCaps...); err != nil {
+		return nil, err
+	}
+
+	d.Conns <- f
+	return f, nil
+}
+
+// fakeMQTT is an in-memory broker and client. Publishes made by the bridge
+// are available via Next, and Deliver sends messages to its subscriptions.
+// If lossy, publishes nobody is waiting for are dropped rather than block
+// the bridge.
+type fakeMQTT struct {
+	mu   sync.Mutex
+	subs map[string]mqtt.MessageHandler
+
+	published chan *fakeMessage
+	lossy     bool
+}
+
+var _ MQTTClient = (*fakeMQTT)(nil)
+
+func newFakeMQTT() *fakeMQTT {
+	return &fakeMQTT{
+		subs:      make(map[string]mqtt.MessageHandler),
+		published: make(chan *fakeMessage, 256),
+	}
+}
+
+func (f *fakeMQTT) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var b []byte
+	switch p := payload.(type) {
+	case []byte:
+		b = p
+	case string:
+		b = []byte(p)
+	default:
+		return doneToken(fmt.Errorf("unknown payload type %T", payload))
+	}
+
+	m := &fakeMessage{topic: topic, qos: qos, retained: retained, payload: b}
+	if !f.lossy {
+		f.published <- m
+		return doneToken(nil)
+	}
+
+	select {
+	case f.published <- m:
+	default:
+	}
+	return doneToken(nil)
+}
+
+func (f *fakeMQTT) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subs[topic] = callback
+	return doneToken(nil)
+}
+
+func (f *fakeMQTT) Unsubscribe(topics ...string) mqtt.Token {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, t := range topics {
+		delete(f.subs, t)
+	}
+	return doneToken(nil)
+}
+
+// Deliver calls every subscription matching topic with payload, returning
+// the number of subscriptions called.
+func (f *fakeMQTT) Deliver(topic string, payload []byte) int {
+	f.mu.Lock()
+	var handlers []mqtt.MessageHandler
+	for filter, h := range f.subs {
+		if topicsOverlap(filter, topic) {
+			handlers = append(handlers, h)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, h := range handlers {
+		h(nil, &fakeMessage{topic: topic, payload: payload})
+	}
+
+	return len(handlers)
+}
+
+// Next returns the next message published by the bridge.
+func (f *fakeMQTT) Next(timeout time.Duration) (*fakeMessage, error) {
+	select {
+	case m := <-f.published:
+		return m, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timed out waiting for MQTT publish after %s", timeout)
+	}
+}
+
+// NextOn returns the next message published by the bridge to topic,
+// skipping any others.
+func (f *fakeMQTT) NextOn(topic string, timeout time.Duration) (*fakeMessage, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		m, err := f.Next(time.Until(deadline))
+		if err != nil {
+			return nil, err
+		}
+		if m.topic == topic {
+			return m, nil
+		}
+	}
+}
+
+// DeliverWhenSubscribed is like Deliver, but first waits for something to
+// subscribe to topic.
+func (f *fakeMQTT) DeliverWhenSubscribed(topic string, payload []byte, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for f.Deliver(topic, payload) == 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for a subscription to %s after %s", topic, timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+type fakeMessage struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  []byte
+}
+
+var _ mqtt.Message = (*fakeMessage)(nil)
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return m.qos }
+func (m *fakeMessage) Retained() bool    { return m.retained }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return 0 }
+func (m *fakeMessage) Payload() []byte   { return m.payload }
+func (m *fakeMessage) Ack()              {}
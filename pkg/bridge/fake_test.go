@@ -0,0 +1,74 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// harness runs a single Connection against in-memory fakes.
+type harness struct {
+	Dialer *fakeDialer
+	MQTT   *fakeMQTT
+
+	// Client is what the connection publishes with, MQTT unless a test
+	// wraps it.
+	Client MQTTClient
+
+	conn   *Connection
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newHarness validates c as the only connection of a config with the given
+// tenants and prepares it to run against fakes.
+func newHarness(c *Connection, tenants ...*Tenant) (*harness, error) {
+	config := &Config{
+		Tenants:     tenants,
+		Connections: []*Connection{c},
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	h := &harness{
+		Dialer: newFakeDialer(),
+		MQTT:   newFakeMQTT(),
+		conn:   c,
+	}
+	h.Client = h.MQTT
+	c.dial = h.Dialer.dial
+
+	return h, nil
+}
+
+// Start runs the connection and returns its first IRC connection.
+func (h *harness) Start(timeout time.Duration) (*fakeIRC, error) {
+	var ctx context.Context
+	ctx, h.cancel = context.WithCancel(context.Background())
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.conn.run(ctx, h.Client)
+	}()
+	return h.NextConn(timeout)
+}
+
+// NextConn waits for the connection to dial IRC.
+func (h *harness) NextConn(timeout time.Duration) (*fakeIRC, error) {
+	select {
+	case f := <-h.Dialer.Conns:
+		return f, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timed out waiting for IRC dial after %s", timeout)
+	}
+}
+
+// Stop stops the connection and waits for it to exit.
+func (h *harness) Stop() {
+	h.cancel()
+	h.wg.Wait()
+}
@@ -0,0 +1,193 @@
+package bridge
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jakebailey/irc"
+)
+
+// MessageFilter drops chat messages by regular expressions on their text
+// and the sender's login. A message must match one of Messages and Users
+// (if set) and none of ExcludeMessages and ExcludeUsers. Messages without
+// text or a sender, like JOINs, are not filtered.
+type MessageFilter struct {
+	Messages        []string `yaml:",omitempty"`
+	ExcludeMessages []string `yaml:"exclude_messages,omitempty"`
+	Users           []string `yaml:",omitempty"`
+	ExcludeUsers    []string `yaml:"exclude_users,omitempty"`
+}
+
+// messageFilters are the compiled regular expressions of a MessageFilter.
+type messageFilters struct {
+	messages        []*regexp.Regexp
+	excludeMessages []*regexp.Regexp
+	users           []*regexp.Regexp
+	excludeUsers    []*regexp.Regexp
+}
+
+// upperSet returns the set of commands, uppercased.
+func upperSet(commands []string) map[string]bool {
+	if len(commands) == 0 {
+		return nil
+	}
+
+	set := make(map[string]bool, len(commands))
+	for _, cmd := range commands {
+		set[strings.ToUpper(cmd)] = true
+	}
+	return set
+}
+
+// lowerSet returns the set of names, lowercased.
+func lowerSet(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		if name = strings.ToLower(strings.TrimPrefix(name, "@")); name != "" {
+			set[name] = true
+		}
+	}
+	return set
+}
+
+// compileFilters compiles patterns, prefixing each with flags.
+func compileFilters(field, flags string, patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(patterns))
+
+	for i, p := range patterns {
+		re, err := regexp.Compile(flags + p)
+		if err != nil {
+			return nil, fieldErr(fmt.Sprintf("%s[%d]", field, i), err)
+		}
+		res[i] = re
+	}
+
+	return res, nil
+}
+
+func (c *Connection) validateFilters() error {
+	c.commands = upperSet(c.Publish.Commands)
+	c.excludeCommands = upperSet(c.Publish.ExcludeCommands)
+	c.allowUsers = lowerSet(c.Publish.AllowUsers)
+	c.denyUsers = lowerSet(c.Publish.DenyUsers)
+
+	var err error
+	c.filters, err = c.Publish.Filter.compile("filter")
+	return err
+}
+
+// compile compiles the filter, whose field in the config is given.
+func (f *MessageFilter) compile(field string) (messageFilters, error) {
+	var mf messageFilters
+
+	filters := []struct {
+		field    string
+		flags    string
+		patterns []string
+		res      *[]*regexp.Regexp
+	}{
+		{field + ".messages", "", f.Messages, &mf.messages},
+		{field + ".exclude_messages", "", f.ExcludeMessages, &mf.excludeMessages},
+		{field + ".users", "(?i)", f.Users, &mf.users},
+		{field + ".exclude_users", "(?i)", f.ExcludeUsers, &mf.excludeUsers},
+	}
+
+	for _, f := range filters {
+		res, err := compileFilters(f.field, f.flags, f.patterns)
+		if err != nil {
+			return messageFilters{}, err
+		}
+		*f.res = res
+	}
+
+	return mf, nil
+}
+
+// anyMatch reports whether any of res match s.
+func anyMatch(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter reports whether m should be published.
+func (c *Connection) filter(m *irc.Message) bool {
+	if c.commands != nil && !c.commands[m.Command] {
+		return false
+	}
+
+	if c.excludeCommands[m.Command] {
+		return false
+	}
+
+	if !isChat(m) {
+		return true
+	}
+
+	login := senderLogin(m)
+	display := strings.ToLower(tag(m, "display-name"))
+	lower := strings.ToLower(login)
+
+	if c.allowUsers != nil && !c.allowUsers[lower] && !c.allowUsers[display] {
+		return false
+	}
+
+	if c.denyUsers[lower] || c.denyUsers[display] {
+		return false
+	}
+
+	return c.filters.allows(m) && c.overrideAllows(m)
+}
+
+// allows reports whether the chat message m passes the filters.
+func (f *messageFilters) allows(m *irc.Message) bool {
+	if m.Trailing != "" {
+		text, _ := unwrapAction(m.Trailing)
+
+		if len(f.messages) > 0 && !anyMatch(f.messages, text) {
+			return false
+		}
+
+		if anyMatch(f.excludeMessages, text) {
+			return false
+		}
+	}
+
+	login := senderLogin(m)
+
+	if len(f.users) > 0 && !anyMatch(f.users, login) {
+		return false
+	}
+
+	if anyMatch(f.excludeUsers, login) {
+		return false
+	}
+
+	return true
+}
+
+// isChat reports whether m is a message sent by a user.
+func isChat(m *irc.Message) bool {
+	switch m.Command {
+	case "PRIVMSG", "USERNOTICE", "WHISPER":
+		return true
+	}
+	return false
+}
+
+// senderLogin returns the login of the user who sent m. USERNOTICEs come
+// from the server, with the user in the login tag.
+func senderLogin(m *irc.Message) string {
+	if login := tag(m, "login"); login != "" {
+		return login
+	}
+	return m.Prefix.Name
+}
@@ -0,0 +1,116 @@
+package bridge
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jakebailey/irc"
+)
+
+func userNotice(user, channel, text string) *irc.Message {
+	return &irc.Message{
+		Tags:     map[string]string{"login": user, "msg-id": "sub"},
+		Prefix:   irc.Prefix{Name: "tmi.twitch.tv"},
+		Command:  "USERNOTICE",
+		Params:   []string{channel},
+		Trailing: text,
+	}
+}
+
+// publishedTexts sends each message and returns the texts of those
+// published to topic, up to the last, which must be published.
+func publishedTexts(t *testing.T, h *harness, f *fakeIRC, topic string, ms ...*irc.Message) []string {
+	t.Helper()
+
+	for _, m := range ms {
+		if err := f.Send(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	last := ms[len(ms)-1].Trailing
+	var texts []string
+	for {
+		m, err := h.MQTT.NextOn(topic, testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, msg := range ms {
+			if strings.Contains(string(m.payload), msg.Trailing) {
+				texts = append(texts, msg.Trailing)
+				break
+			}
+		}
+		if strings.Contains(string(m.payload), last) {
+			return texts
+		}
+	}
+}
+
+func TestConnectionFiltersCommands(t *testing.T) {
+	notice := userNotice("alice", "#foo", "subscribed")
+	chat := chatMessage("alice", "#foo", "hello")
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		send    []*irc.Message
+		want    string
+	}{
+		{name: "include", include: []string{"privmsg"}, send: []*irc.Message{notice, chat}, want: "hello"},
+		{name: "exclude", exclude: []string{"USERNOTICE"}, send: []*irc.Message{notice, chat}, want: "hello"},
+		{
+			name:    "both",
+			include: []string{"PRIVMSG", "USERNOTICE"},
+			exclude: []string{"privmsg"},
+			send:    []*irc.Message{chat, notice},
+			want:    "subscribed",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestConnection()
+			c.Publish.Commands = test.include
+			c.Publish.ExcludeCommands = test.exclude
+			h, f := startHarness(t, c)
+
+			got := publishedTexts(t, h, f, "twitch/chat", test.send...)
+			if len(got) != 1 || got[0] != test.want {
+				t.Errorf("published %q, want only %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestConnectionFiltersByPattern(t *testing.T) {
+	c := newTestConnection()
+	c.Publish.Filter = MessageFilter{
+		ExcludeMessages: []string{`(?i)buy .*followers`},
+		Users:           []string{`^a`},
+		ExcludeUsers:    []string{`bot$`},
+	}
+	h, f := startHarness(t, c)
+
+	got := publishedTexts(t, h, f, "twitch/chat",
+		chatMessage("bob", "#foo", "not allowed"),
+		chatMessage("ALICE", "#foo", "BUY cheap followers"),
+		chatMessage("alicebot", "#foo", "beep"),
+		chatMessage("alice", "#foo", "hello"),
+	)
+	if len(got) != 1 || got[0] != "hello" {
+		t.Errorf("published %q, want only hello", got)
+	}
+}
+
+func TestValidateFilterBadPattern(t *testing.T) {
+	c := newTestConnection()
+	c.Publish.Filter.ExcludeUsers = []string{"ok", "("}
+
+	_, err := newHarness(c)
+	if err == nil || !strings.Contains(err.Error(), "publish.filter.exclude_users[1]") {
+		t.Errorf("err = %v, want an error for filter.exclude_users[1]", err)
+	}
+}
@@ -0,0 +1,25 @@
+package bridge
+
+import "github.com/jakebailey/irc"
+
+// isFirstMessage reports whether m is a user's first chat message in the
+// channel.
+func isFirstMessage(m *irc.Message) bool {
+	return m.Command == "PRIVMSG" && tag(m, "first-msg") == "1"
+}
+
+func (c *Connection) validateFirstChats() error {
+	if c.FirstChats.Topic == "" {
+		return nil
+	}
+
+	if c.FirstChats.Topic == c.Subscribe.Topic {
+		return fieldErr("topic", errBadTopics)
+	}
+
+	if err := checkTopicTemplate(c.FirstChats.Topic); err != nil {
+		return fieldErr("topic", err)
+	}
+
+	return nil
+}
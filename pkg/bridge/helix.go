@@ -0,0 +1,285 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// helixURL is the base URL of the Twitch Helix API.
+const helixURL = "https://api.twitch.tv/helix"
+
+var (
+	errNoClientID    = errors.New("a client ID is required to use the Helix API")
+	errHelixReadOnly = errors.New("Helix API calls require a writable connection with a pass")
+	errUnknownUser   = errors.New("unknown user")
+)
+
+// helixClient makes Helix API calls as a connection's user.
+type helixClient struct {
+	clientID string
+	token    func() (string, error)
+	http     *http.Client
+
+	// dryRun, if set, logs calls which change anything instead of making
+	// them.
+	dryRun *zerolog.Logger
+
+	mu  sync.Mutex
+	ids map[string]string // user IDs by login
+}
+
+// checkHelix verifies that the connection can make Helix API calls.
+func (c *Connection) checkHelix() error {
+	if !c.canWrite() || c.Pass == "" && c.OAuth.RefreshToken == "" {
+		return errHelixReadOnly
+	}
+
+	if c.ClientID == "" && c.OAuth.ClientID == "" {
+		return errNoClientID
+	}
+
+	return nil
+}
+
+// helix returns a Helix client authenticated with the connection's
+// credentials.
+func (c *Connection) helix() *helixClient {
+	clientID := c.ClientID
+	if clientID == "" {
+		clientID = c.OAuth.ClientID
+	}
+
+	var dryRun *zerolog.Logger
+	if c.dryRun() {
+		dryRun = &c.log
+	}
+
+	client := httpClient
+	if c.Proxy != "" {
+		client = &http.Client{
+			Timeout:   httpClient.Timeout,
+			Transport: &http.Transport{DialContext: c.proxyDial()},
+		}
+	}
+
+	return &helixClient{
+		clientID: clientID,
+		http:     client,
+		dryRun:   dryRun,
+		token: func() (string, error) {
+			pass := c.Pass
+			if c.token != nil {
+				var err error
+				if pass, err = c.token.pass(); err != nil {
+					return "", err
+				}
+			}
+			return strings.TrimPrefix(pass, "oauth:"), nil
+		},
+		ids: make(map[string]string),
+	}
+}
+
+// do calls the API, encoding body (if any) and decoding the response into
+// out (if any).
+func (h *helixClient) do(method, path string, query url.Values, body, out interface{}) error {
+	if h.dryRun != nil && method != "GET" {
+		h.dryRun.Info().Str("method", method).Str("path", path).Msg("dry run: not calling Helix")
+		return nil
+	}
+
+	token, err := h.token()
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	u := helixURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Client-Id", h.clientID)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := h.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Message string
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("helix %s %s: %s: %s", method, path, resp.Status, e.Message)
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// userID returns the ID of the user with the given login.
+func (h *helixClient) userID(login string) (string, error) {
+	login = strings.ToLower(login)
+
+	h.mu.Lock()
+	id, ok := h.ids[login]
+	h.mu.Unlock()
+
+	if ok {
+		return id, nil
+	}
+
+	var resp struct {
+		Data []struct {
+			ID string
+		}
+	}
+
+	if err := h.do("GET", "/users", url.Values{"login": {login}}, nil, &resp); err != nil {
+		return "", err
+	}
+
+	if len(resp.Data) == 0 {
+		return "", fmt.Errorf("%w: %s", errUnknownUser, login)
+	}
+
+	id = resp.Data[0].ID
+
+	h.mu.Lock()
+	h.ids[login] = id
+	h.mu.Unlock()
+
+	return id, nil
+}
+
+// whisper sends message from one user to another.
+func (h *helixClient) whisper(from, to, message string) error {
+	fromID, err := h.userID(from)
+	if err != nil {
+		return err
+	}
+
+	toID, err := h.userID(to)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{
+		"from_user_id": {fromID},
+		"to_user_id":   {toID},
+	}
+
+	return h.do("POST", "/whispers", query, map[string]string{"message": message}, nil)
+}
+
+// ban bans or, with a positive duration in seconds, times out a user in
+// the broadcaster's channel.
+func (h *helixClient) ban(broadcasterID, moderatorID, userID string, duration int, reason string) error {
+	query := url.Values{
+		"broadcaster_id": {broadcasterID},
+		"moderator_id":   {moderatorID},
+	}
+
+	type ban struct {
+		UserID   string `json:"user_id"`
+		Duration int    `json:"duration,omitempty"`
+		Reason   string `json:"reason,omitempty"`
+	}
+
+	body := map[string]ban{"data": {UserID: userID, Duration: duration, Reason: reason}}
+
+	return h.do("POST", "/moderation/bans", query, body, nil)
+}
+
+// unban removes a ban or timeout of a user in the broadcaster's channel.
+func (h *helixClient) unban(broadcasterID, moderatorID, userID string) error {
+	query := url.Values{
+		"broadcaster_id": {broadcasterID},
+		"moderator_id":   {moderatorID},
+		"user_id":        {userID},
+	}
+
+	return h.do("DELETE", "/moderation/bans", query, nil, nil)
+}
+
+// deleteMessage deletes a chat message in the broadcaster's channel.
+func (h *helixClient) deleteMessage(broadcasterID, moderatorID, messageID string) error {
+	query := url.Values{
+		"broadcaster_id": {broadcasterID},
+		"moderator_id":   {moderatorID},
+		"message_id":     {messageID},
+	}
+
+	return h.do("DELETE", "/moderation/chat", query, nil, nil)
+}
+
+// updateChatSettings changes the chat settings of the broadcaster's
+// channel. settings holds the fields to change, as named by the API.
+func (h *helixClient) updateChatSettings(broadcasterID, moderatorID string, settings map[string]interface{}) error {
+	query := url.Values{
+		"broadcaster_id": {broadcasterID},
+		"moderator_id":   {moderatorID},
+	}
+
+	return h.do("PATCH", "/chat/settings", query, settings, nil)
+}
+
+// sendAnnouncement announces message in the broadcaster's channel,
+// highlighted in color, or the channel's accent color if it is "primary"
+// or empty.
+func (h *helixClient) sendAnnouncement(broadcasterID, moderatorID, message, color string) error {
+	query := url.Values{
+		"broadcaster_id": {broadcasterID},
+		"moderator_id":   {moderatorID},
+	}
+
+	body := map[string]string{"message": message}
+	if color != "" {
+		body["color"] = color
+	}
+
+	return h.do("POST", "/chat/announcements", query, body, nil)
+}
+
+// sendShoutout gives a shoutout to another broadcaster in the
+// broadcaster's channel.
+func (h *helixClient) sendShoutout(fromID, toID, moderatorID string) error {
+	query := url.Values{
+		"from_broadcaster_id": {fromID},
+		"to_broadcaster_id":   {toID},
+		"moderator_id":        {moderatorID},
+	}
+
+	return h.do("POST", "/chat/shoutouts", query, nil, nil)
+}
@@ -0,0 +1,135 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+const (
+	transportIRC   = "irc"
+	transportHelix = "helix"
+)
+
+var errBadTransport = errors.New("transport must be irc or helix")
+
+// sendResult reports the outcome of a message sent through Helix.
+type sendResult struct {
+	Channel    string      `json:"channel"`
+	Message    string      `json:"message"`
+	MessageID  string      `json:"message_id,omitempty"`
+	Sent       bool        `json:"is_sent"`
+	DropReason *dropReason `json:"drop_reason,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+type dropReason struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (c *Connection) validateTransport() error {
+	switch c.Subscribe.Transport {
+	case "", transportIRC:
+		if c.Subscribe.ResultTopic != "" {
+			return fieldErr("result_topic", errBadTransport)
+		}
+	case transportHelix:
+		if err := c.checkHelix(); err != nil {
+			return fieldErr("transport", err)
+		}
+
+		// Results look enough like messages to be sent again.
+		if c.Subscribe.ResultTopic != "" && topicsOverlap(c.Subscribe.ResultTopic, c.Subscribe.Topic) {
+			return fieldErr("result_topic", errBadTopics)
+		}
+	default:
+		return fieldErr("transport", errBadTransport)
+	}
+	return nil
+}
+
+// sendChatMessage sends a chat message as the sender through the Helix
+// chat endpoint.
+func (h *helixClient) sendChatMessage(broadcasterID, senderID, message, replyTo string) (*sendResult, error) {
+	body := map[string]string{
+		"broadcaster_id": broadcasterID,
+		"sender_id":      senderID,
+		"message":        message,
+	}
+	if replyTo != "" {
+		body["reply_parent_message_id"] = replyTo
+	}
+
+	var resp struct {
+		Data []struct {
+			MessageID  string      `json:"message_id"`
+			IsSent     bool        `json:"is_sent"`
+			DropReason *dropReason `json:"drop_reason"`
+		}
+	}
+
+	if err := h.do("POST", "/chat/messages", nil, body, &resp); err != nil {
+		return nil, err
+	}
+
+	r := &sendResult{}
+	if len(resp.Data) > 0 {
+		r.MessageID = resp.Data[0].MessageID
+		r.Sent = resp.Data[0].IsSent
+		r.DropReason = resp.Data[0].DropReason
+	}
+	return r, nil
+}
+
+// sendHelix sends the item's PRIVMSG through Helix, publishing the result
+// to the result topic if one is configured. Helix has no /me, so actions
+// are sent as plain messages.
+func (c *Connection) sendHelix(h *helixClient, client MQTTClient, it sendItem) error {
+	m := it.m
+	channel := strings.TrimPrefix(messageChannel(m), "#")
+	text, _ := unwrapAction(m.Trailing)
+
+	result := &sendResult{Channel: channel, Message: text}
+
+	err := func() error {
+		broadcasterID, err := h.userID(channel)
+		if err != nil {
+			return err
+		}
+
+		senderID, err := h.userID(c.Nick)
+		if err != nil {
+			return err
+		}
+
+		r, err := h.sendChatMessage(broadcasterID, senderID, text, m.Tags["reply-parent-msg-id"])
+		if err != nil {
+			return err
+		}
+
+		result.MessageID, result.Sent, result.DropReason = r.MessageID, r.Sent, r.DropReason
+		if r.Sent && r.MessageID != "" {
+			sentMessages.seen("id\x00"+r.MessageID, echoWindow)
+		}
+		return nil
+	}()
+
+	if err != nil {
+		result.Error = err.Error()
+	} else if !result.Sent {
+		c.log.Warn().Str("channel", channel).Interface("drop_reason", result.DropReason).Msg("message dropped")
+		c.count("send_dropped")
+	}
+
+	if c.Subscribe.ResultTopic != "" {
+		b, merr := json.Marshal(result)
+		if merr != nil {
+			c.elog.Println(merr)
+		} else if t := client.Publish(c.Subscribe.ResultTopic, it.qos, it.retain, b); t.Error() != nil {
+			c.elog.Printf("send result publish failed: %v", t.Error())
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,157 @@
+package bridge
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jakebailey/irc"
+)
+
+const defaultDiscoveryPrefix = "homeassistant"
+
+var errDiscoveryEncoding = errors.New("Home Assistant discovery requires the json encoding")
+
+// haDevice groups a connection's entities in Home Assistant.
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	SWVersion    string   `json:"sw_version"`
+}
+
+// haEntity is a Home Assistant MQTT discovery config.
+type haEntity struct {
+	Name                string    `json:"name"`
+	UniqueID            string    `json:"unique_id"`
+	StateTopic          string    `json:"state_topic"`
+	ValueTemplate       string    `json:"value_template,omitempty"`
+	JSONAttributesTopic string    `json:"json_attributes_topic,omitempty"`
+	PayloadOn           string    `json:"payload_on,omitempty"`
+	PayloadOff          string    `json:"payload_off,omitempty"`
+	DeviceClass         string    `json:"device_class,omitempty"`
+	Icon                string    `json:"icon,omitempty"`
+	AvailabilityTopic   string    `json:"availability_topic,omitempty"`
+	Device              *haDevice `json:"device"`
+
+	component string
+	objectID  string
+}
+
+func (c *Connection) validateHomeAssistant() error {
+	ha := &c.HomeAssistant
+	if !ha.Discovery {
+		return nil
+	}
+
+	if ha.Prefix == "" {
+		ha.Prefix = defaultDiscoveryPrefix
+	}
+	ha.Prefix = strings.TrimSuffix(ha.Prefix, "/")
+
+	if c.Publish.Encoding != "" && c.Publish.Encoding != encodingJSON {
+		return errDiscoveryEncoding
+	}
+
+	return nil
+}
+
+// channelTopic expands the topic template for a message from channel,
+// returning false if the topic also depends on the sender and so has no
+// single state topic.
+func (c *Connection) channelTopic(topic, command, channel string) (string, bool) {
+	if topic == "" || strings.Contains(topic, "{user}") || strings.Contains(topic, "{event}") {
+		return "", false
+	}
+
+	return c.expandTopic(topic, &irc.Message{
+		Command: command,
+		Params:  []string{channel},
+	}), true
+}
+
+// discoveryEntities returns the Home Assistant entities for the connection:
+// the last message and event in each channel, and its availability.
+func (c *Connection) discoveryEntities() []*haEntity {
+	id := "twitchmqtt_" + topicLevel(strings.ToLower(c.name()))
+	device := &haDevice{
+		Identifiers:  []string{id},
+		Name:         "twitchmqtt " + c.name(),
+		Manufacturer: "twitchmqtt",
+		SWVersion:    Version,
+	}
+
+	messageTemplate := "{{ value_json.Trailing }}"
+	switch c.Publish.Format {
+	case formatParsed:
+		messageTemplate = "{{ value_json.message }}"
+	case formatRaw:
+		messageTemplate = ""
+	}
+
+	var entities []*haEntity
+	seen := make(map[string]bool)
+
+	for _, ch := range c.channels() {
+		name := strings.TrimPrefix(ch, "#")
+
+		if topic, ok := c.channelTopic(c.routeTopic("PRIVMSG", ch), "PRIVMSG", ch); ok && !seen[topic] {
+			seen[topic] = true
+			e := &haEntity{
+				Name:          "Last message in " + name,
+				StateTopic:    topic,
+				ValueTemplate: messageTemplate,
+				Icon:          "mdi:chat",
+				component:     "sensor",
+				objectID:      "last_message_" + topicLevel(name),
+			}
+			if c.Publish.Format != formatRaw {
+				e.JSONAttributesTopic = topic
+			}
+			entities = append(entities, e)
+		}
+
+		if topic, ok := c.channelTopic(c.Events.Topic, "USERNOTICE", ch); ok && !seen[topic] {
+			seen[topic] = true
+			entities = append(entities, &haEntity{
+				Name:                "Last event in " + name,
+				StateTopic:          topic,
+				ValueTemplate:       "{{ value_json.type }}",
+				JSONAttributesTopic: topic,
+				Icon:                "mdi:party-popper",
+				component:           "sensor",
+				objectID:            "last_event_" + topicLevel(name),
+			})
+		}
+	}
+
+	if topic := c.Availability.Topic; topic != "" {
+		entities = append(entities, &haEntity{
+			Name:        "Connected",
+			StateTopic:  topic,
+			PayloadOn:   availabilityOnline,
+			PayloadOff:  availabilityOffline,
+			DeviceClass: "connectivity",
+			component:   "binary_sensor",
+			objectID:    "connected",
+		})
+	}
+
+	for _, e := range entities {
+		e.UniqueID = id + "_" + e.objectID
+		e.AvailabilityTopic = c.options().availabilityTopic
+		e.Device = device
+	}
+
+	return entities
+}
+
+// publishDiscovery publishes retained Home Assistant discovery configs for
+// the connection's entities.
+func (c *Connection) publishDiscovery(client MQTTClient) {
+	id := "twitchmqtt_" + topicLevel(strings.ToLower(c.name()))
+
+	for _, e := range c.discoveryEntities() {
+		topic := c.HomeAssistant.Prefix + "/" + e.component + "/" + id + "/" + e.objectID + "/config"
+		c.publishJSON(client, "discovery", topic, c.HomeAssistant.QOS, true, e)
+	}
+}
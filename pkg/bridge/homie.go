@@ -0,0 +1,197 @@
+package bridge
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jakebailey/irc"
+)
+
+const (
+	defaultHomiePrefix = "homie"
+	homieVersion       = "4.0"
+
+	// homieRateInterval is how often message rates are published.
+	homieRateInterval = time.Minute
+)
+
+var homieIDRe = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// homieID converts s to a valid Homie topic ID: lowercase letters, digits,
+// and hyphens, not starting with a hyphen.
+func homieID(s string) string {
+	id := strings.Trim(homieIDRe.ReplaceAllString(strings.ToLower(s), "-"), "-")
+	if id == "" {
+		return "x"
+	}
+	return id
+}
+
+// homieProperty describes a property of every channel node.
+type homieProperty struct {
+	id, name, datatype, unit string
+}
+
+var homieProperties = []homieProperty{
+	{"last-message", "Last message", "string", ""},
+	{"last-user", "Last user", "string", ""},
+	{"message-rate", "Message rate", "float", "#/min"},
+	{"emote-only", "Emote-only mode", "boolean", ""},
+	{"followers-only", "Followers-only mode", "integer", "min"},
+	{"r9k", "Unique chat mode", "boolean", ""},
+	{"slow", "Slow mode", "integer", "s"},
+	{"subs-only", "Subscribers-only mode", "boolean", ""},
+}
+
+// homieDevice publishes a connection as a Homie device, with a node for
+// each of its configured channels.
+type homieDevice struct {
+	c      *Connection
+	client MQTTClient
+	topic  string
+
+	mu     sync.Mutex
+	nodes  map[string]string // channel to node ID
+	counts map[string]int    // messages per channel since the last rate
+}
+
+func (c *Connection) validateHomie() error {
+	if !c.Homie.Enabled {
+		return nil
+	}
+
+	if c.Homie.Prefix == "" {
+		c.Homie.Prefix = defaultHomiePrefix
+	}
+	c.Homie.Prefix = strings.TrimSuffix(c.Homie.Prefix, "/")
+
+	return nil
+}
+
+func (c *Connection) newHomieDevice(client MQTTClient) *homieDevice {
+	h := &homieDevice{
+		c:      c,
+		client: client,
+		topic:  c.Homie.Prefix + "/twitchmqtt-" + homieID(c.name()),
+		nodes:  make(map[string]string),
+		counts: make(map[string]int),
+	}
+
+	for _, ch := range c.channels() {
+		h.nodes[ch] = homieID(strings.TrimPrefix(ch, "#"))
+	}
+
+	return h
+}
+
+// publish publishes a retained value, as the Homie convention requires.
+func (h *homieDevice) publish(topic, value string) {
+	if t := h.client.Publish(h.topic+"/"+topic, 1, true, value); t.Error() != nil {
+		h.c.elog.Printf("homie publish failed: %v", t.Error())
+	}
+}
+
+// start publishes the device's attributes and marks it ready.
+func (h *homieDevice) start() {
+	h.publish("$state", "init")
+	h.publish("$homie", homieVersion)
+	h.publish("$name", "twitchmqtt "+h.c.name())
+	h.publish("$extensions", "")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ids := make([]string, 0, len(h.nodes))
+	for ch, id := range h.nodes {
+		ids = append(ids, id)
+
+		h.publish(id+"/$name", ch)
+		h.publish(id+"/$type", "channel")
+
+		props := make([]string, len(homieProperties))
+		for i, p := range homieProperties {
+			props[i] = p.id
+			h.publish(id+"/"+p.id+"/$name", p.name)
+			h.publish(id+"/"+p.id+"/$datatype", p.datatype)
+			if p.unit != "" {
+				h.publish(id+"/"+p.id+"/$unit", p.unit)
+			}
+		}
+		h.publish(id+"/$properties", strings.Join(props, ","))
+	}
+
+	h.publish("$nodes", strings.Join(ids, ","))
+	h.publish("$state", "ready")
+}
+
+// stop marks the device disconnected. Connections share an MQTT client,
+// so the "lost" state is never published.
+func (h *homieDevice) stop() {
+	h.publish("$state", "disconnected")
+}
+
+// message records a chat message.
+func (h *homieDevice) message(m *irc.Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := messageChannel(m)
+	id, ok := h.nodes[ch]
+	if !ok {
+		return
+	}
+
+	h.counts[ch]++
+
+	text := m.Trailing
+	if t, ok := unwrapAction(text); ok {
+		text = t
+	}
+	h.publish(id+"/last-message", text)
+
+	if m.Prefix.Name != "" {
+		h.publish(id+"/last-user", m.Prefix.Name)
+	}
+}
+
+// roomState publishes a channel's room settings.
+func (h *homieDevice) roomState(st roomState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id, ok := h.nodes[st.Channel]
+	if !ok {
+		return
+	}
+
+	h.publish(id+"/emote-only", strconv.FormatBool(st.EmoteOnly))
+	h.publish(id+"/followers-only", strconv.Itoa(st.FollowersOnly))
+	h.publish(id+"/r9k", strconv.FormatBool(st.R9K))
+	h.publish(id+"/slow", strconv.Itoa(st.Slow))
+	h.publish(id+"/subs-only", strconv.FormatBool(st.SubsOnly))
+}
+
+// rateLoop publishes each channel's message rate until stop is closed.
+func (h *homieDevice) rateLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(homieRateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		h.mu.Lock()
+		for ch, id := range h.nodes {
+			rate := float64(h.counts[ch]) / homieRateInterval.Minutes()
+			h.publish(id+"/message-rate", strconv.FormatFloat(rate, 'f', 2, 64))
+			h.counts[ch] = 0
+		}
+		h.mu.Unlock()
+	}
+}
@@ -0,0 +1,304 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jakebailey/irc"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	twitchIRC   = "irc.chat.twitch.tv:6697"
+	twitchIRCWS = "wss://irc-ws.chat.twitch.tv:443"
+
+	// Twitch doesn't check the origin of WebSockets, but the handshake
+	// needs one.
+	wsOrigin = "https://localhost/"
+)
+
+const (
+	transportTCP       = "tcp"
+	transportWebSocket = "websocket"
+)
+
+var (
+	errBadIRCTransport = errors.New("IRC transport must be tcp or websocket")
+	errBadIRCServer    = errors.New("IRC server must be a host and port, or a ws:// or wss:// URL for websocket")
+	errPlaintextTLS    = errors.New("plaintext IRC connections can't have TLS settings")
+)
+
+// quitTimeout is how long to wait for the server to close the connection
+// after quitting before giving up on reading from it.
+const quitTimeout = 5 * time.Second
+
+// netConn is an IRC connection whose reads can be interrupted by a
+// deadline.
+type netConn struct {
+	irc.Conn
+	nc net.Conn
+}
+
+func (c *netConn) SetReadDeadline(t time.Time) error {
+	return c.nc.SetReadDeadline(t)
+}
+
+// validateIRC checks the IRC server settings, filling in the default
+// server and loading the TLS settings.
+func (c *Connection) validateIRC() error {
+	var errs []error
+
+	switch c.IRC.Transport {
+	case "":
+		c.IRC.Transport = transportTCP
+	case transportTCP, transportWebSocket:
+	default:
+		errs = append(errs, fieldErr("transport", errBadIRCTransport))
+	}
+
+	switch {
+	case c.IRC.Server == "" && c.IRC.Transport == transportWebSocket:
+		c.IRC.Server = twitchIRCWS
+	case c.IRC.Server == "":
+		c.IRC.Server = twitchIRC
+	case c.IRC.Transport == transportWebSocket:
+		if u, err := url.Parse(c.IRC.Server); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			errs = append(errs, fieldErr("server", errBadIRCServer))
+		}
+	default:
+		if _, _, err := net.SplitHostPort(c.IRC.Server); err != nil {
+			errs = append(errs, fieldErr("server", errBadIRCServer))
+		}
+	}
+
+	config, err := c.IRC.TLS.config()
+	if err != nil {
+		errs = append(errs, fieldErr("tls", err))
+	} else if config != nil && c.IRC.Plaintext {
+		errs = append(errs, fieldErr("plaintext", errPlaintextTLS))
+	}
+	c.ircTLS = config
+
+	return errors.Join(errs...)
+}
+
+// ircDialer returns the dial function for the connection's IRC transport,
+// through its proxy if it has one.
+func (c *Connection) ircDialer() dialFunc {
+	dial := c.proxyDial()
+	return func(ctx context.Context, nick, pass string) (irc.Conn, error) {
+		if c.IRC.Transport == transportWebSocket {
+			return c.createWebSocketIRCConn(ctx, dial, nick, pass)
+		}
+		return c.createIRCConn(ctx, dial, nick, pass)
+	}
+}
+
+func (c *Connection) createIRCConn(ctx context.Context, dial dialContextFunc, nick, pass string) (irc.Conn, error) {
+	var nc net.Conn
+	var err error
+	if c.IRC.Plaintext {
+		nc, err = dial(ctx, "tcp", c.IRC.Server)
+	} else {
+		nc, err = dialTLS(ctx, dial, c.IRC.Server, c.ircTLS)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return startIRC(&netConn{Conn: irc.NewBaseConn(nc), nc: nc}, nick, pass)
+}
+
+// createWebSocketIRCConn connects to IRC over a WebSocket, for networks
+// which only allow HTTPS.
+func (c *Connection) createWebSocketIRCConn(ctx context.Context, dial dialContextFunc, nick, pass string) (irc.Conn, error) {
+	ws, err := dialWebSocket(ctx, dial, c.IRC.Server, c.ircTLS)
+	if err != nil {
+		return nil, err
+	}
+
+	return startIRC(&netConn{Conn: irc.NewBaseConn(&wsLines{Conn: ws}), nc: ws}, nick, pass)
+}
+
+// dialWebSocket opens a WebSocket, dialing with dial, and for wss:// URLs
+// starting TLS with config, which may be nil.
+func dialWebSocket(ctx context.Context, dial dialContextFunc, rawURL string, config *tls.Config) (*websocket.Conn, error) {
+	wsConfig, err := websocket.NewConfig(rawURL, wsOrigin)
+	if err != nil {
+		return nil, err
+	}
+
+	secure := wsConfig.Location.Scheme == "wss"
+
+	addr := wsConfig.Location.Host
+	if wsConfig.Location.Port() == "" {
+		port := "80"
+		if secure {
+			port = "443"
+		}
+		addr = net.JoinHostPort(addr, port)
+	}
+
+	var nc net.Conn
+	if secure {
+		nc, err = dialTLS(ctx, dial, addr, config)
+	} else {
+		nc, err = dial(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := websocket.NewClient(wsConfig, nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return ws, nil
+}
+
+// startIRC logs in and requests capabilities on a new connection.
+func startIRC(conn *netConn, nick, pass string) (irc.Conn, error) {
+	if err := login(conn, nick, pass); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := capReq(conn, requestedCaps...); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// wsLines sends what is written to it over a WebSocket a line at a time,
+// since Twitch expects each frame to hold whole IRC lines. Reads pass
+// through, as frames are a stream of lines.
+type wsLines struct {
+	*websocket.Conn
+	buf []byte
+}
+
+func (w *wsLines) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	if i := bytes.LastIndexByte(w.buf, '\n'); i >= 0 {
+		if _, err := w.Conn.Write(w.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[i+1:]...)
+	}
+
+	return len(p), nil
+}
+
+// anonymousNick returns a nick which Twitch accepts without a pass, for
+// read-only connections.
+func anonymousNick() string {
+	return fmt.Sprintf("justinfan%d", 10000+rand.Intn(90000))
+}
+
+// login logs in to IRC. An empty pass logs in anonymously.
+func login(conn irc.Encoder, nick, pass string) error {
+	if pass != "" {
+		err := conn.Encode(&irc.Message{
+			Command: "PASS",
+			Params:  []string{pass},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return conn.Encode(&irc.Message{
+		Command: "NICK",
+		Params:  []string{nick},
+	})
+}
+
+func capReq(conn irc.Encoder, caps ...string) error {
+	if len(caps) == 0 {
+		return nil
+	}
+
+	return conn.Encode(&irc.Message{
+		Command:  "CAP",
+		Params:   []string{"REQ"},
+		Trailing: strings.Join(caps, " "),
+	})
+}
+
+func join(conn irc.Encoder, channels ...string) error {
+	if len(channels) == 0 {
+		return nil
+	}
+
+	for i, s := range channels {
+		if s[0] != '#' {
+			channels[i] = "#" + s
+		}
+	}
+
+	return conn.Encode(&irc.Message{
+		Command: "JOIN",
+		Params:  []string{strings.Join(channels, ",")},
+	})
+}
+
+func quit(conn irc.Encoder) error {
+	return conn.Encode(&irc.Message{
+		Command: "QUIT",
+	})
+}
+
+const (
+	actionPrefix = "\x01ACTION "
+	actionSuffix = "\x01"
+)
+
+// wrapAction frames text as a CTCP ACTION, as sent by /me.
+func wrapAction(text string) string {
+	return actionPrefix + text + actionSuffix
+}
+
+// unwrapAction returns the text of a CTCP ACTION, and whether text was one.
+func unwrapAction(text string) (string, bool) {
+	if !strings.HasPrefix(text, actionPrefix) {
+		return text, false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(text, actionPrefix), actionSuffix), true
+}
+
+// messageChannel returns the channel m was sent to, or an empty string if
+// it was not sent to a channel.
+func messageChannel(m *irc.Message) string {
+	if len(m.Params) > 0 && strings.HasPrefix(m.Params[0], "#") {
+		return m.Params[0]
+	}
+	return ""
+}
+
+// normalizeChannel returns channel as Twitch names it, in lowercase with a
+// leading #, or an empty string if it has no name.
+func normalizeChannel(channel string) string {
+	if name := channelName(channel); name != "" {
+		return "#" + name
+	}
+	return ""
+}
+
+// channelName returns channel's name in lowercase without a leading #, or
+// an empty string if it has none.
+func channelName(channel string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(channel), "#"))
+}
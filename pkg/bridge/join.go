@@ -0,0 +1,77 @@
+package bridge
+
+import (
+	"errors"
+	"time"
+)
+
+// Twitch allows 20 channels to be joined per 10 seconds.
+const (
+	defaultJoinBatch  = 20
+	defaultJoinLimit  = 20
+	defaultJoinPeriod = 10 * time.Second
+)
+
+var errBadJoin = errors.New("invalid join batch or limit")
+
+func (c *Connection) validateJoin() error {
+	j := &c.Join
+
+	if j.Batch < 0 || j.Limit < 0 || j.Period < 0 {
+		return errBadJoin
+	}
+
+	if (j.Limit == 0) != (j.Period == 0) {
+		return errBadJoin
+	}
+
+	return c.validateJoinTopic()
+}
+
+func (c *Connection) newJoinLimiter() *limiter {
+	if c.Join.Limit > 0 {
+		return newLimiter(c.Join.Limit, c.Join.Period)
+	}
+	return newLimiter(defaultJoinLimit, defaultJoinPeriod)
+}
+
+// joinChannels joins channels on the shard in batches, paced by lim, until
+// all are joined, an error occurs, or done is closed.
+func (c *Connection) joinChannels(s *shard, lim *limiter, channels []string, done <-chan struct{}) {
+	batch := c.Join.Batch
+	if batch == 0 {
+		batch = defaultJoinBatch
+	}
+	if lim != nil && batch > lim.max {
+		batch = lim.max
+	}
+
+	joins := c.joinTracker()
+
+	for len(channels) > 0 {
+		n := batch
+		if n > len(channels) {
+			n = len(channels)
+		}
+
+		// Every channel counts towards the limit, not every command, and
+		// counts from when the command is sent.
+		if !lim.WaitN(n, done) {
+			return
+		}
+
+		if err := join(s.conn, channels[:n]...); err != nil {
+			c.elog.Printf("join failed: %v", err)
+			return
+		}
+
+		for _, ch := range channels[:n] {
+			s.setJoined(ch, true)
+			joins.sent(s, ch)
+		}
+
+		channels = channels[n:]
+	}
+
+	s.setReady()
+}
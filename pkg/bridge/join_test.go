@@ -0,0 +1,41 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJoinsStayWithinLimit(t *testing.T) {
+	const limit = 5
+	const period = 100 * time.Millisecond
+	const channels = 3 * limit
+
+	c := newTestConnection()
+	c.Publish.Channels = nil
+	for i := 0; i < channels; i++ {
+		c.Publish.Channels = append(c.Publish.Channels, fmt.Sprintf("chan%d", i))
+	}
+	c.Join.Batch = 2
+	c.Join.Limit = limit
+	c.Join.Period = period
+
+	_, f := startHarness(t, c)
+
+	// Record the time each channel was joined.
+	var times []time.Time
+	for len(times) < channels {
+		m, at, err := f.NextCommandAt("JOIN", testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range strings.Split(m.Params[0], ",") {
+			times = append(times, at)
+		}
+	}
+
+	// A join may be sent a little after the limiter allows it, so may
+	// appear closer to the next.
+	checkWindows(t, times, limit, period-period/10)
+}
@@ -0,0 +1,258 @@
+package bridge
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// joinTimeout is how long to wait for Twitch to confirm a JOIN before
+	// treating it as failed.
+	joinTimeout = time.Minute
+
+	joinCheckInterval = time.Second
+
+	minRejoinDelay = 10 * time.Second
+	maxRejoinDelay = 10 * time.Minute
+)
+
+const (
+	joinStateJoining = "joining"
+	joinStateJoined  = "joined"
+	joinStateFailed  = "failed"
+)
+
+var errBadStateTopic = errors.New("state topic must not contain wildcards")
+
+// joinFailures are the NOTICE msg-ids Twitch sends in response to a JOIN
+// which did not succeed.
+var joinFailures = map[string]bool{
+	"msg_banned":            true,
+	"msg_channel_blocked":   true,
+	"msg_channel_suspended": true,
+	"tos_ban":               true,
+}
+
+// joinState is the state of a channel, published retained to the join
+// state topic.
+type joinState struct {
+	Channel  string    `json:"channel"`
+	State    string    `json:"state"`
+	Reason   string    `json:"reason,omitempty"`
+	Attempts int       `json:"attempts"`
+	Since    time.Time `json:"since"`
+
+	shard   *shard
+	retryAt time.Time
+	backoff *backoff
+}
+
+// joinTracker follows JOINs until Twitch confirms or rejects them, so that
+// failed joins can be retried and reported.
+type joinTracker struct {
+	c      *Connection
+	client MQTTClient
+
+	mu     sync.Mutex
+	states map[string]*joinState
+}
+
+func newJoinTracker(c *Connection, client MQTTClient) *joinTracker {
+	return &joinTracker{
+		c:      c,
+		client: client,
+		states: make(map[string]*joinState),
+	}
+}
+
+func (c *Connection) validateJoinTopic() error {
+	if strings.ContainsAny(c.Join.Topic, "+#") {
+		return fieldErr("topic", errBadStateTopic)
+	}
+	return nil
+}
+
+// joinStateTopic returns the topic the state of channel is published to.
+func (c *Connection) joinStateTopic(channel string) string {
+	return c.Join.Topic + "/" + strings.TrimPrefix(channel, "#")
+}
+
+func (c *Connection) joinTracker() *joinTracker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.joins
+}
+
+// sent records that a JOIN for channel was sent on s.
+func (t *joinTracker) sent(s *shard, channel string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st := t.states[channel]
+	if st == nil {
+		st = &joinState{
+			Channel: channel,
+			backoff: newBackoff(minRejoinDelay, maxRejoinDelay),
+		}
+		t.states[channel] = st
+	}
+
+	st.shard = s
+	st.Attempts++
+	t.setLocked(st, joinStateJoining, "")
+}
+
+// confirmed records that Twitch confirmed joining channel.
+func (t *joinTracker) confirmed(channel string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st := t.states[channel]
+	if st == nil || st.State == joinStateJoined {
+		return
+	}
+
+	st.Attempts = 0
+	st.backoff.reset()
+	t.setLocked(st, joinStateJoined, "")
+}
+
+// failed records that joining channel failed, scheduling a retry.
+func (t *joinTracker) failed(channel, reason string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if st := t.states[channel]; st != nil && st.State == joinStateJoining {
+		t.failLocked(st, reason)
+	}
+}
+
+func (t *joinTracker) failLocked(st *joinState, reason string) {
+	st.shard.setJoined(st.Channel, false)
+	st.retryAt = time.Now().Add(st.backoff.next())
+
+	t.c.log.Warn().Str("channel", st.Channel).Str("reason", reason).Time("retry_at", st.retryAt).Msg("join failed")
+	t.c.count("join_failures")
+
+	t.setLocked(st, joinStateFailed, reason)
+}
+
+// parted forgets channel, clearing its retained state.
+func (t *joinTracker) parted(channel string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.states[channel]; !ok {
+		return
+	}
+	delete(t.states, channel)
+
+	if t.c.Join.Topic != "" {
+		t.client.Publish(t.c.joinStateTopic(channel), t.c.Join.QOS, true, []byte{})
+	}
+}
+
+func (t *joinTracker) setLocked(st *joinState, state, reason string) {
+	st.State = state
+	st.Reason = reason
+	st.Since = time.Now()
+
+	if t.c.Join.Topic == "" {
+		return
+	}
+
+	t.c.publishJSON(t.client, "join state", t.c.joinStateTopic(st.Channel), t.c.Join.QOS, true, st)
+}
+
+// due returns the channels whose failed joins should be retried, failing
+// joins which have not been confirmed in time.
+func (t *joinTracker) due() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var channels []string
+
+	for ch, st := range t.states {
+		switch st.State {
+		case joinStateJoining:
+			if now.Sub(st.Since) < joinTimeout {
+				continue
+			}
+
+			// The join is sent again when the shard reconnects.
+			if !st.shard.conn.connected() {
+				continue
+			}
+
+			t.failLocked(st, "timeout")
+
+		case joinStateFailed:
+			if now.After(st.retryAt) {
+				channels = append(channels, ch)
+			}
+		}
+	}
+
+	return channels
+}
+
+// rejoinLoop retries failed joins until stop is closed.
+func (c *Connection) rejoinLoop(t *joinTracker, stop <-chan struct{}) {
+	ticker := time.NewTicker(joinCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, ch := range t.due() {
+			if !c.hasChannel(ch) {
+				t.parted(ch)
+				continue
+			}
+
+			s := c.channelShard(ch)
+			if s == nil {
+				continue
+			}
+
+			if !c.joinLimiter.Wait(stop) {
+				return
+			}
+
+			c.log.Info().Str("channel", ch).Int("shard", s.index).Msg("rejoining")
+
+			if err := join(s.conn, ch); err != nil {
+				if err != errNotConnected {
+					c.elog.Printf("join failed: %v", err)
+				}
+				continue
+			}
+
+			s.setJoined(ch, true)
+			t.sent(s, ch)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package bridge
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/jakebailey/irc"
+)
+
+const (
+	defaultPingInterval = time.Minute
+	defaultPingTimeout  = 15 * time.Second
+)
+
+// keepalive sends a PING on ic every ping interval, and closes ic if
+// nothing has been read from it within the ping timeout of the last PING,
+// so that half-dead connections are reestablished. It runs until done is
+// closed.
+func (c *Connection) keepalive(ic irc.Conn, s *shard, done <-chan struct{}) {
+	interval := c.Reconnect.PingInterval
+	if interval == 0 {
+		interval = defaultPingInterval
+	}
+
+	timeout := c.Reconnect.PingTimeout
+	if timeout == 0 {
+		timeout = defaultPingTimeout
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		// Anything read since the last PING shows the connection is alive.
+		if time.Since(s.lastRead()) < interval {
+			continue
+		}
+
+		sent := time.Now()
+		if err := s.conn.Encode(&irc.Message{
+			Command:  "PING",
+			Trailing: strconv.FormatInt(sent.Unix(), 10),
+		}); err != nil {
+			c.elog.Printf("ping failed: %v", err)
+			ic.Close()
+			return
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(timeout):
+		}
+
+		if s.lastRead().Before(sent) {
+			c.log.Warn().Int("shard", s.index).Dur("timeout", timeout).Msg("no reply to ping, reconnecting")
+			c.count("ping_timeouts")
+			ic.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package bridge
+
+import (
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// logger is the process-wide logger. Connections log through children of
+// it carrying their own fields.
+var logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).With().Timestamp().Logger()
+
+// SetLogger sets the logger the bridge and its connections log through.
+// It must be called before any config is loaded.
+func SetLogger(l zerolog.Logger) {
+	logger = l
+}
+
+// setLogger gives the connection a logger and error log carrying its
+// index in the config, its name and nick, and its label, at its own level
+// if it has one.
+func (c *Connection) setLogger(index int) {
+	ctx := logger.With().Int("connection", index).Str("name", c.name()).Str("nick", c.Nick).Str("tenant", c.tenant.Name)
+	if c.Log.Label != "" {
+		ctx = ctx.Str("label", c.Log.Label)
+	}
+	c.log = ctx.Logger()
+
+	if level, err := zerolog.ParseLevel(strings.ToLower(c.Log.Level)); err == nil && c.Log.Level != "" {
+		c.log = c.log.Level(level)
+	}
+
+	c.elog = elog.with(&c.log)
+}
@@ -0,0 +1,248 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/jakebailey/irc"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Direction is the way a message passes through a connection.
+type Direction int
+
+const (
+	// Inbound messages are read from IRC to be published to MQTT.
+	Inbound Direction = iota
+	// Outbound messages are read from MQTT to be sent to IRC.
+	Outbound
+)
+
+func (d Direction) String() string {
+	if d == Outbound {
+		return "outbound"
+	}
+	return "inbound"
+}
+
+// Middleware inspects, modifies, or drops messages passing through a
+// connection. Handle may change m in place, and returns false to drop it.
+// It is called concurrently, so must be safe for concurrent use.
+type Middleware interface {
+	Handle(dir Direction, m *irc.Message) bool
+}
+
+// MiddlewareFunc adapts a function to a Middleware.
+type MiddlewareFunc func(dir Direction, m *irc.Message) bool
+
+// Handle calls f.
+func (f MiddlewareFunc) Handle(dir Direction, m *irc.Message) bool {
+	return f(dir, m)
+}
+
+// MiddlewareFactory builds a middleware from its config. decode unmarshals
+// the middleware's options into v, as yaml.Unmarshal would.
+type MiddlewareFactory func(decode func(v interface{}) error) (Middleware, error)
+
+// MiddlewareConfig selects a middleware by the name it was registered with,
+// and gives its options.
+type MiddlewareConfig struct {
+	Name    string
+	Options map[string]interface{} `yaml:",omitempty"`
+}
+
+var (
+	errUnknownMiddleware = errors.New("unknown middleware")
+	errBadDirection      = errors.New("direction must be inbound, outbound, or both")
+	errNoRedactPatterns  = errors.New("no patterns to redact")
+)
+
+var (
+	middlewaresMu sync.RWMutex
+	middlewares   = map[string]MiddlewareFactory{
+		"filter": newFilterMiddleware,
+		"redact": newRedactMiddleware,
+	}
+)
+
+// RegisterMiddleware makes a middleware available to configs by name,
+// replacing any registered with the same name. Middlewares must be
+// registered before the configs using them are loaded.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	middlewaresMu.Lock()
+	defer middlewaresMu.Unlock()
+	middlewares[name] = factory
+}
+
+func (c *Connection) validateMiddleware() error {
+	c.middleware = nil
+
+	for i, mc := range c.Middleware {
+		middlewaresMu.RLock()
+		factory := middlewares[mc.Name]
+		middlewaresMu.RUnlock()
+
+		field := fmt.Sprintf("middleware[%d]", i)
+
+		if factory == nil {
+			return fieldErr(field+".name", fmt.Errorf("%w: %q", errUnknownMiddleware, mc.Name))
+		}
+
+		options := mc.Options
+		mw, err := factory(func(v interface{}) error {
+			b, err := yaml.Marshal(options)
+			if err != nil {
+				return err
+			}
+			return yaml.UnmarshalStrict(b, v)
+		})
+		if err != nil {
+			return fieldErr(field+".options", err)
+		}
+
+		c.middleware = append(c.middleware, mw)
+	}
+
+	return nil
+}
+
+// runMiddleware passes m through the connection's middleware in order,
+// reporting whether it should continue on its way.
+func (c *Connection) runMiddleware(dir Direction, m *irc.Message) bool {
+	for _, mw := range c.middleware {
+		if !mw.Handle(dir, m) {
+			c.count("middleware_dropped")
+			return false
+		}
+	}
+	return true
+}
+
+// directions parses a built-in middleware's direction option.
+func directions(s string) (inbound, outbound bool, err error) {
+	switch s {
+	case "", "both":
+		return true, true, nil
+	case "inbound":
+		return true, false, nil
+	case "outbound":
+		return false, true, nil
+	default:
+		return false, false, errBadDirection
+	}
+}
+
+// filterMiddleware drops chat messages whose text matches any of drop, or
+// none of keep if it is set.
+type filterMiddleware struct {
+	inbound, outbound bool
+	drop, keep        []*regexp.Regexp
+}
+
+func newFilterMiddleware(decode func(v interface{}) error) (Middleware, error) {
+	var opts struct {
+		Direction string
+		Drop      []string
+		Keep      []string
+	}
+	if err := decode(&opts); err != nil {
+		return nil, err
+	}
+
+	f := &filterMiddleware{}
+
+	var err error
+	if f.inbound, f.outbound, err = directions(opts.Direction); err != nil {
+		return nil, fieldErr("direction", err)
+	}
+	if f.drop, err = compileFilters("drop", "", opts.Drop); err != nil {
+		return nil, err
+	}
+	if f.keep, err = compileFilters("keep", "", opts.Keep); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *filterMiddleware) Handle(dir Direction, m *irc.Message) bool {
+	if (dir == Inbound && !f.inbound) || (dir == Outbound && !f.outbound) || !isChat(m) {
+		return true
+	}
+
+	text, _ := unwrapAction(m.Trailing)
+
+	if len(f.keep) > 0 && !anyMatch(f.keep, text) {
+		return false
+	}
+
+	return !anyMatch(f.drop, text)
+}
+
+// redactMiddleware replaces text matching any of its patterns in chat
+// messages.
+type redactMiddleware struct {
+	inbound, outbound bool
+	patterns          []*regexp.Regexp
+	replacement       string
+}
+
+func newRedactMiddleware(decode func(v interface{}) error) (Middleware, error) {
+	var opts struct {
+		Direction   string
+		Patterns    []string
+		Replacement *string
+	}
+	if err := decode(&opts); err != nil {
+		return nil, err
+	}
+
+	if len(opts.Patterns) == 0 {
+		return nil, fieldErr("patterns", errNoRedactPatterns)
+	}
+
+	r := &redactMiddleware{replacement: "[redacted]"}
+	if opts.Replacement != nil {
+		r.replacement = *opts.Replacement
+	}
+
+	var err error
+	if r.inbound, r.outbound, err = directions(opts.Direction); err != nil {
+		return nil, fieldErr("direction", err)
+	}
+	if r.patterns, err = compileFilters("patterns", "", opts.Patterns); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *redactMiddleware) Handle(dir Direction, m *irc.Message) bool {
+	if (dir == Inbound && !r.inbound) || (dir == Outbound && !r.outbound) || !isChat(m) {
+		return true
+	}
+
+	text, action := unwrapAction(m.Trailing)
+	redacted := text
+	for _, re := range r.patterns {
+		redacted = re.ReplaceAllLiteralString(redacted, r.replacement)
+	}
+
+	if redacted == text {
+		return true
+	}
+
+	if action {
+		redacted = wrapAction(redacted)
+	}
+	m.Trailing = redacted
+
+	// Keep the raw line from leaking what was redacted.
+	if m.Raw != "" {
+		m.Raw = m.String()
+	}
+
+	return true
+}
@@ -0,0 +1,171 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	errBadModAction  = errors.New("unknown moderation action")
+	errModNoUser     = errors.New("moderation action requires a user")
+	errModNoMessage  = errors.New("delete requires a message ID")
+	errModBadTimeout = errors.New("timeout requires a positive duration")
+)
+
+// modRequest is a moderation request, like
+// {"channel":"foo","action":"timeout","user":"bar","duration":600,"reason":"spam"}.
+// ID is optional and echoed in the reply.
+type modRequest struct {
+	ID       string `json:"id,omitempty"`
+	Channel  string `json:"channel"`
+	Action   string `json:"action"`
+	User     string `json:"user,omitempty"`
+	Message  string `json:"message_id,omitempty"`
+	Duration int    `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// modReply is published to the reply topic for each request.
+type modReply struct {
+	modRequest
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func (c *Connection) validateModeration() error {
+	if c.Moderation.Topic == "" {
+		return nil
+	}
+
+	if c.Moderation.Topic == c.Moderation.ReplyTopic {
+		return fieldErr("reply_topic", errBadTopics)
+	}
+
+	if err := c.checkHelix(); err != nil {
+		return fieldErr("topic", err)
+	}
+
+	return nil
+}
+
+// moderationHandler returns an MQTT message handler which queues
+// moderation requests.
+func (c *Connection) moderationHandler(queue chan<- modRequest) mqtt.MessageHandler {
+	return func(_ mqtt.Client, mq mqtt.Message) {
+		var req modRequest
+
+		if err := json.Unmarshal(mq.Payload(), &req); err != nil {
+			c.elog.Printf("bad payload on %s: %v", mq.Topic(), err)
+			return
+		}
+
+		req.Channel = channelName(req.Channel)
+		req.Action = strings.ToLower(req.Action)
+
+		select {
+		case queue <- req:
+		default:
+			c.elog.Printf("moderation queue full, dropped a request")
+			c.count("queue_dropped")
+		}
+	}
+}
+
+// moderationLoop makes the Helix calls for queued moderation requests,
+// publishing the results to the reply topic. Twitch no longer supports
+// moderation commands over IRC.
+func (c *Connection) moderationLoop(queue <-chan modRequest, client MQTTClient, stop <-chan struct{}) {
+	h := c.helix()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case req := <-queue:
+			err := c.moderate(h, &req)
+			if err != nil {
+				c.elog.Printf("moderation %s in %s failed: %v", req.Action, req.Channel, err)
+			} else {
+				c.count("moderation_actions")
+			}
+
+			c.replyModeration(client, &req, err)
+		}
+	}
+}
+
+func (c *Connection) moderate(h *helixClient, req *modRequest) error {
+	if req.Channel == "" {
+		return errEmptyChannel
+	}
+
+	switch req.Action {
+	case "ban", "timeout", "unban":
+		if req.User == "" {
+			return errModNoUser
+		}
+	case "delete":
+		if req.Message == "" {
+			return errModNoMessage
+		}
+	default:
+		return fmt.Errorf("%w: %q", errBadModAction, req.Action)
+	}
+
+	if req.Action == "timeout" && req.Duration <= 0 {
+		return errModBadTimeout
+	}
+
+	broadcasterID, err := h.userID(req.Channel)
+	if err != nil {
+		return err
+	}
+
+	moderatorID, err := h.userID(c.Nick)
+	if err != nil {
+		return err
+	}
+
+	if req.Action == "delete" {
+		return h.deleteMessage(broadcasterID, moderatorID, req.Message)
+	}
+
+	userID, err := h.userID(strings.TrimPrefix(req.User, "@"))
+	if err != nil {
+		return err
+	}
+
+	switch req.Action {
+	case "ban":
+		return h.ban(broadcasterID, moderatorID, userID, 0, req.Reason)
+	case "timeout":
+		return h.ban(broadcasterID, moderatorID, userID, req.Duration, req.Reason)
+	default:
+		return h.unban(broadcasterID, moderatorID, userID)
+	}
+}
+
+func (c *Connection) replyModeration(client MQTTClient, req *modRequest, err error) {
+	if c.Moderation.ReplyTopic == "" {
+		return
+	}
+
+	reply := modReply{modRequest: *req, OK: err == nil}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+
+	b, err := json.Marshal(&reply)
+	if err != nil {
+		c.elog.Println(err)
+		return
+	}
+
+	if t := client.Publish(c.Moderation.ReplyTopic, c.Moderation.QOS, false, b); t.Wait() && t.Error() != nil {
+		c.elog.Printf("publish failed: %v", t.Error())
+	}
+}
@@ -0,0 +1,86 @@
+package bridge
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jakebailey/irc"
+)
+
+const (
+	modEventBan     = "ban"
+	modEventTimeout = "timeout"
+	modEventClear   = "clear"
+	modEventDelete  = "delete"
+)
+
+// modEvent is a CLEARCHAT or CLEARMSG, published to the moderation events
+// topic. Type is ban or timeout when a user was removed, clear when the
+// whole chat was cleared, or delete when a single message was deleted.
+type modEvent struct {
+	Type      string     `json:"type"`
+	Channel   string     `json:"channel"`
+	RoomID    string     `json:"room_id,omitempty"`
+	Target    *eventUser `json:"target,omitempty"`
+	Duration  int        `json:"duration,omitempty"`
+	MessageID string     `json:"message_id,omitempty"`
+	Message   string     `json:"message,omitempty"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+func parseModEvent(m *irc.Message) *modEvent {
+	e := &modEvent{
+		Channel: strings.TrimPrefix(messageChannel(m), "#"),
+		RoomID:  tag(m, "room-id"),
+	}
+
+	if ts, err := strconv.ParseInt(tag(m, "tmi-sent-ts"), 10, 64); err == nil {
+		t := time.Unix(0, ts*int64(time.Millisecond)).UTC()
+		e.Timestamp = &t
+	}
+
+	switch m.Command {
+	case "CLEARCHAT":
+		if m.Trailing == "" {
+			e.Type = modEventClear
+			break
+		}
+
+		e.Type = modEventBan
+		e.Target = &eventUser{Login: m.Trailing, ID: tag(m, "target-user-id")}
+
+		if d, err := strconv.Atoi(tag(m, "ban-duration")); err == nil {
+			e.Type = modEventTimeout
+			e.Duration = d
+		}
+
+	case "CLEARMSG":
+		e.Type = modEventDelete
+		e.Target = &eventUser{Login: tag(m, "login")}
+		e.MessageID = tag(m, "target-msg-id")
+		e.Message = m.Trailing
+	}
+
+	return e
+}
+
+// publishModEvent publishes m, a CLEARCHAT or CLEARMSG, as a modEvent to
+// the moderation events topic.
+func (c *Connection) publishModEvent(client MQTTClient, m *irc.Message) {
+	b, err := json.Marshal(parseModEvent(m))
+	if err != nil {
+		c.elog.Println(err)
+		return
+	}
+
+	topic := c.expandTopic(c.Moderation.EventsTopic, m)
+
+	if t := client.Publish(topic, c.Moderation.QOS, false, b); t.Error() != nil {
+		c.elog.Printf("moderation event publish failed: %v", t.Error())
+		c.count("publish_errors")
+	} else {
+		c.count("moderation_events")
+	}
+}
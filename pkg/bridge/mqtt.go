@@ -0,0 +1,271 @@
+package bridge
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	errBadCA          = errors.New("no certificates found in CA bundle")
+	errCertWithoutKey = errors.New("client certificate and key must be given together")
+	errBadTLSVersion  = errors.New("TLS version must be 1.0, 1.1, 1.2, or 1.3")
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// BrokerClient is an MQTT client connected to a broker.
+type BrokerClient interface {
+	MQTTClient
+	IsConnected() bool
+	Disconnect(quiesce uint)
+}
+
+// mqttClientID returns a random client ID, for short-lived clients which
+// must not take over the bridge's session.
+func mqttClientID() string {
+	return fmt.Sprintf("%d%d", time.Now().UnixNano(), rand.Intn(10))
+}
+
+// Broker is an MQTT broker to connect to, with its own credentials and
+// TLS settings. Proxy is a socks5, socks5h, http, or https URL of a proxy
+// to connect through; without it, ALL_PROXY is used, unless NO_PROXY
+// excludes the broker.
+type Broker struct {
+	URL          string
+	Username     string    `yaml:",omitempty"`
+	Password     string    `yaml:",omitempty"`
+	PasswordFile string    `yaml:"password_file,omitempty"`
+	TLS          BrokerTLS `yaml:",omitempty"`
+	Proxy        string    `yaml:",omitempty"`
+}
+
+// BrokerTLS configures TLS for a broker. TLS itself is enabled by using a
+// tls:// or ssl:// broker URL. MinVersion is the lowest TLS version
+// accepted, like "1.2".
+type BrokerTLS struct {
+	CA         string `yaml:",omitempty"`
+	Cert       string `yaml:",omitempty"`
+	Key        string `yaml:",omitempty"`
+	ServerName string `yaml:"server_name,omitempty"`
+	MinVersion string `yaml:"min_version,omitempty"`
+	Insecure   bool   `yaml:",omitempty"`
+}
+
+// validateBrokers checks that every broker has a URL, and any proxy is
+// valid.
+func validateBrokers(brokers []*Broker) error {
+	var errs []error
+	for i, b := range brokers {
+		field := fmt.Sprintf("brokers[%d]", i)
+		if b.URL == "" {
+			errs = append(errs, fieldErr(field+".url", errNoBroker))
+		}
+		if b.Proxy != "" {
+			if _, err := parseProxy(b.Proxy); err != nil {
+				errs = append(errs, fieldErr(field+".proxy", err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Connect connects to the brokers, or the broker given by WithBroker if
+// there are none. With several brokers, the client fails over between them
+// in order until ctx is canceled. If an availability topic is given, an
+// "offline" message is registered as the client's will on that topic.
+func Connect(ctx context.Context, brokers []*Broker, opts ...Option) (BrokerClient, error) {
+	o := newOptions(opts)
+
+	client, err := o.connect(o.clientID, o.availabilityTopic, brokers)
+	if err != nil {
+		return nil, err
+	}
+
+	if f, ok := client.(*failoverClient); ok {
+		go f.run(ctx.Done())
+	}
+
+	return client, nil
+}
+
+// connect connects to the brokers, or the default broker if there are
+// none, failing over between them in order if there are several. If
+// clientID is empty, a random one is used. If willTopic is not empty, an
+// "offline" message is registered as the client's will on that topic.
+func (o *options) connect(clientID, willTopic string, brokers []*Broker) (BrokerClient, error) {
+	if len(brokers) == 0 {
+		if o.broker == nil || o.broker.URL == "" {
+			return nil, errNoBroker
+		}
+		brokers = []*Broker{o.broker}
+	}
+
+	if clientID == "" {
+		clientID = mqttClientID()
+	}
+
+	if len(brokers) > 1 {
+		return o.connectFailover(brokers, clientID, willTopic)
+	}
+
+	return o.connectBroker(brokers[0], clientID, willTopic)
+}
+
+// connectBroker connects to a single broker.
+func (o *options) connectBroker(b *Broker, clientID, willTopic string) (BrokerClient, error) {
+	tlsConfig, err := b.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+
+	if o.mqtt5 {
+		return o.connectMQTT5(b, tlsConfig, clientID, willTopic)
+	}
+
+	// This client can't be given a dialer, so a proxy is reached through a
+	// local forwarder. Without one, it uses ALL_PROXY itself.
+	brokerURL := b.URL
+	var f *proxyForwarder
+	if b.Proxy != "" {
+		u, err := url.Parse(b.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		if f, err = forwardProxy(proxyDialer(b.Proxy), u.Host); err != nil {
+			return nil, err
+		}
+
+		if u.Scheme != "tcp" && u.Scheme != "ws" {
+			if tlsConfig == nil {
+				tlsConfig = &tls.Config{}
+			}
+			if tlsConfig.ServerName == "" {
+				tlsConfig.ServerName = u.Hostname()
+			}
+		}
+
+		u.Host = f.ln.Addr().String()
+		brokerURL = u.String()
+	}
+
+	store, err := o.store(clientID)
+	if err != nil {
+		if f != nil {
+			f.close()
+		}
+		return nil, err
+	}
+
+	cOpts := mqtt.NewClientOptions()
+	cOpts.SetClientID(clientID)
+	cOpts.SetCleanSession(o.cleanSession)
+	if store != nil {
+		cOpts.SetStore(store)
+	}
+	cOpts.AddBroker(brokerURL)
+	if b.Username != "" {
+		cOpts.SetUsername(b.Username)
+		cOpts.SetPassword(b.Password)
+	}
+	if tlsConfig != nil {
+		cOpts.SetTLSConfig(tlsConfig)
+	}
+	if willTopic != "" {
+		cOpts.SetWill(willTopic, availabilityOffline, 1, true)
+	}
+	client := mqtt.NewClient(cOpts)
+
+	if t := client.Connect(); t.Wait() && t.Error() != nil {
+		if f != nil {
+			f.close()
+		}
+		return nil, t.Error()
+	}
+
+	if f != nil {
+		return &forwardedClient{BrokerClient: client, f: f}, nil
+	}
+	return client, nil
+}
+
+// store returns the file store for the client's in-flight messages, or
+// nil to use the default memory store when there is no store directory or
+// the session isn't resumed.
+func (o *options) store(clientID string) (mqtt.Store, error) {
+	if o.storeDir == "" || o.cleanSession {
+		return nil, nil
+	}
+
+	// The store panics if it can't create its directory.
+	dir := filepath.Join(o.storeDir, url.PathEscape(clientID))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	return mqtt.NewFileStore(dir), nil
+}
+
+// config builds the TLS config for the broker connection, returning nil if
+// no TLS settings were given.
+func (opts *BrokerTLS) config() (*tls.Config, error) {
+	if opts.CA == "" && opts.Cert == "" && opts.Key == "" && opts.ServerName == "" && opts.MinVersion == "" && !opts.Insecure {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName:         opts.ServerName,
+		InsecureSkipVerify: opts.Insecure, //nolint:gosec
+	}
+
+	if opts.MinVersion != "" {
+		v, ok := tlsVersions[opts.MinVersion]
+		if !ok {
+			return nil, errBadTLSVersion
+		}
+		config.MinVersion = v
+	}
+
+	if opts.CA != "" {
+		b, err := ioutil.ReadFile(opts.CA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errBadCA
+		}
+		config.RootCAs = pool
+	}
+
+	if (opts.Cert == "") != (opts.Key == "") {
+		return nil, errCertWithoutKey
+	}
+
+	if opts.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.Cert, opts.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
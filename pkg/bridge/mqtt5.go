@@ -0,0 +1,293 @@
+package bridge
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	mqtt5Timeout = 10 * time.Second
+
+	// mqtt5SessionExpiry is how long, in seconds, the broker keeps a
+	// persistent session after the client disconnects.
+	mqtt5SessionExpiry uint32 = 24 * 60 * 60
+)
+
+var errMQTT5Refused = errors.New("MQTT 5 connection refused")
+
+// publishProperties are MQTT 5 properties attached to a publish.
+type publishProperties struct {
+	User   [][2]string
+	Expiry time.Duration
+}
+
+// propertyPublisher is implemented by clients which can publish with MQTT 5
+// properties.
+type propertyPublisher interface {
+	PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props *publishProperties) mqtt.Token
+}
+
+// mqtt5Client adapts a paho.golang MQTT 5 client to the interface of the
+// MQTT 3 client used by the rest of the bridge.
+type mqtt5Client struct {
+	client    *paho.Client
+	router    *paho.StandardRouter
+	connected atomic.Bool
+}
+
+var (
+	_ BrokerClient      = (*mqtt5Client)(nil)
+	_ propertyPublisher = (*mqtt5Client)(nil)
+)
+
+func (o *options) connectMQTT5(b *Broker, tlsConfig *tls.Config, clientID, willTopic string) (*mqtt5Client, error) {
+	u, err := url.Parse(b.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	dial := proxyDialer(b.Proxy, allProxyEnv...)
+	dialCtx, dialCancel := context.WithTimeout(context.Background(), mqtt5Timeout)
+	defer dialCancel()
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		conn, err = dial(dialCtx, "tcp", u.Host)
+	case "tls", "ssl", "tcps", "mqtts":
+		conn, err = dialTLS(dialCtx, dial, u.Host, tlsConfig)
+	default:
+		return nil, fmt.Errorf("unsupported MQTT 5 broker scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &mqtt5Client{router: paho.NewStandardRouter()}
+	client := paho.NewClient(paho.ClientConfig{
+		Conn:   conn,
+		Router: c.router,
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			elog.Printf("MQTT 5 server disconnected: reason code %d", d.ReasonCode)
+			c.connected.Store(false)
+		},
+		OnClientError: func(err error) {
+			elog.Printf("MQTT 5 client error: %v", err)
+			c.connected.Store(false)
+		},
+	})
+	c.client = client
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqtt5Timeout)
+	defer cancel()
+
+	cp := &paho.Connect{
+		ClientID:   clientID,
+		KeepAlive:  30,
+		CleanStart: o.cleanSession,
+	}
+
+	// Unlike MQTT 3, an MQTT 5 session ends with the connection unless it is
+	// given an expiry.
+	if !o.cleanSession {
+		expiry := mqtt5SessionExpiry
+		cp.Properties = &paho.ConnectProperties{SessionExpiryInterval: &expiry}
+	}
+
+	if b.Username != "" {
+		cp.Username, cp.UsernameFlag = b.Username, true
+		cp.Password, cp.PasswordFlag = []byte(b.Password), true
+	}
+
+	if willTopic != "" {
+		cp.WillMessage = &paho.WillMessage{
+			Topic:   willTopic,
+			QoS:     1,
+			Retain:  true,
+			Payload: []byte(availabilityOffline),
+		}
+	}
+
+	ca, err := client.Connect(ctx, cp)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if ca.ReasonCode != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("%w: reason code %d", errMQTT5Refused, ca.ReasonCode)
+	}
+
+	c.connected.Store(true)
+	return c, nil
+}
+
+func (c *mqtt5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return c.PublishWithProperties(topic, qos, retained, payload, nil)
+}
+
+func (c *mqtt5Client) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props *publishProperties) mqtt.Token {
+	var b []byte
+	switch p := payload.(type) {
+	case []byte:
+		b = p
+	case string:
+		b = []byte(p)
+	default:
+		return doneToken(fmt.Errorf("unknown payload type %T", payload))
+	}
+
+	p := &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retained,
+		Payload: b,
+	}
+
+	if props != nil {
+		p.Properties = &paho.PublishProperties{}
+
+		for _, kv := range props.User {
+			p.Properties.User = append(p.Properties.User, paho.UserProperty{Key: kv[0], Value: kv[1]})
+		}
+
+		if props.Expiry > 0 {
+			expiry := uint32(props.Expiry / time.Second)
+			p.Properties.MessageExpiry = &expiry
+		}
+	}
+
+	publish := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), mqtt5Timeout)
+		defer cancel()
+		_, err := c.client.Publish(ctx, p)
+		return err
+	}
+
+	// QOS 0 publishes complete as soon as they are written, so do them
+	// inline to keep them in order.
+	if qos == 0 {
+		return doneToken(publish())
+	}
+
+	return asyncToken(publish)
+}
+
+func (c *mqtt5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.router.RegisterHandler(topic, func(p *paho.Publish) {
+		callback(nil, &mqtt5Message{p: p})
+	})
+
+	return asyncToken(func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), mqtt5Timeout)
+		defer cancel()
+
+		_, err := c.client.Subscribe(ctx, &paho.Subscribe{
+			Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos}},
+		})
+		return err
+	})
+}
+
+func (c *mqtt5Client) Unsubscribe(topics ...string) mqtt.Token {
+	for _, t := range topics {
+		c.router.UnregisterHandler(t)
+	}
+
+	return asyncToken(func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), mqtt5Timeout)
+		defer cancel()
+
+		_, err := c.client.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+		return err
+	})
+}
+
+func (c *mqtt5Client) IsConnected() bool {
+	return c.connected.Load()
+}
+
+func (c *mqtt5Client) Disconnect(quiesce uint) {
+	time.Sleep(time.Duration(quiesce) * time.Millisecond)
+	c.connected.Store(false)
+	if err := c.client.Disconnect(&paho.Disconnect{}); err != nil {
+		elog.Println(err)
+	}
+}
+
+type mqtt5Message struct {
+	p *paho.Publish
+}
+
+var _ mqtt.Message = (*mqtt5Message)(nil)
+
+func (m *mqtt5Message) Duplicate() bool   { return false }
+func (m *mqtt5Message) Qos() byte         { return m.p.QoS }
+func (m *mqtt5Message) Retained() bool    { return m.p.Retain }
+func (m *mqtt5Message) Topic() string     { return m.p.Topic }
+func (m *mqtt5Message) MessageID() uint16 { return m.p.PacketID }
+func (m *mqtt5Message) Payload() []byte   { return m.p.Payload }
+func (m *mqtt5Message) Ack()              {}
+
+// funcToken is an mqtt.Token completed by a function.
+type funcToken struct {
+	done chan struct{}
+	err  error
+}
+
+var _ mqtt.Token = (*funcToken)(nil)
+
+func doneToken(err error) *funcToken {
+	t := &funcToken{done: make(chan struct{}), err: err}
+	close(t.done)
+	return t
+}
+
+func asyncToken(f func() error) *funcToken {
+	t := &funcToken{done: make(chan struct{})}
+	go func() {
+		t.err = f()
+		close(t.done)
+	}()
+	return t
+}
+
+func (t *funcToken) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *funcToken) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *funcToken) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+func (t *funcToken) Done() <-chan struct{} {
+	return t.done
+}
@@ -0,0 +1,93 @@
+package bridge
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// propertyMessage is a publish made with MQTT 5 properties.
+type propertyMessage struct {
+	topic string
+	props *publishProperties
+}
+
+// propertyRecorder publishes to a fake broker, recording the MQTT 5
+// properties of each publish.
+type propertyRecorder struct {
+	*fakeMQTT
+	props chan propertyMessage
+}
+
+var _ propertyPublisher = (*propertyRecorder)(nil)
+
+func (r *propertyRecorder) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props *publishProperties) mqtt.Token {
+	r.props <- propertyMessage{topic: topic, props: props}
+	return r.Publish(topic, qos, retained, payload)
+}
+
+// nextOn returns the properties of the next publish to topic.
+func (r *propertyRecorder) nextOn(topic string, timeout time.Duration) (*publishProperties, error) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case m := <-r.props:
+			if m.topic == topic {
+				return m.props, nil
+			}
+		case <-deadline:
+			return nil, fmt.Errorf("timed out waiting for MQTT publish after %s", timeout)
+		}
+	}
+}
+
+func TestConnectionPublishesUserProperties(t *testing.T) {
+	c := newTestConnection()
+	c.Name = "mqtt5"
+	c.Publish.Expiry = time.Minute
+	c.Publish.Compression = CompressionConfig{Algorithm: compressionGzip, Threshold: 1}
+
+	h, err := newHarness(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.opts = newOptions([]Option{WithMQTT5(true)})
+	rec := &propertyRecorder{fakeMQTT: h.MQTT, props: make(chan propertyMessage, 256)}
+	h.Client = rec
+
+	f, err := h.Start(testTimeout)
+	t.Cleanup(h.Stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Send(chatMessage("alice", "#foo", "hello there")); err != nil {
+		t.Fatal(err)
+	}
+
+	props, err := rec.nextOn("twitch/chat", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if props.Expiry != time.Minute {
+		t.Errorf("expiry %s, want 1m", props.Expiry)
+	}
+
+	want := map[string]string{
+		"channel":          "#foo",
+		"command":          "PRIVMSG",
+		"connection":       "mqtt5",
+		"content-encoding": compressionGzip,
+	}
+	got := make(map[string]string, len(props.User))
+	for _, p := range props.User {
+		got[p[0]] = p[1]
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("user property %s = %q, want %q", k, got[k], v)
+		}
+	}
+}
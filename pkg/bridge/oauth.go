@@ -0,0 +1,153 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// twitchTokenURL is Twitch's OAuth token endpoint.
+const twitchTokenURL = "https://id.twitch.tv/oauth2/token"
+
+const (
+	// tokenRefreshMargin is how long before expiry an access token is
+	// refreshed.
+	tokenRefreshMargin = 5 * time.Minute
+
+	// tokenRetryDelay is how long to wait after a failed refresh of a token
+	// which is still in use.
+	tokenRetryDelay = time.Minute
+)
+
+var errBadOAuth = errors.New("oauth refresh requires a client ID, client secret, and refresh token, and no pass")
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// tokenSource hands out access tokens, refreshing them with a refresh token
+// as they near expiry. Twitch may rotate the refresh token; the new one is
+// kept in memory only.
+type tokenSource struct {
+	clientID     string
+	clientSecret string
+
+	mu      sync.Mutex
+	access  string
+	refresh string
+	expiry  time.Time
+	rotated chan struct{} // closed when the access token is refreshed
+}
+
+func newTokenSource(clientID, clientSecret, refresh string) *tokenSource {
+	return &tokenSource{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		refresh:      refresh,
+		rotated:      make(chan struct{}),
+	}
+}
+
+// pass returns an IRC pass for the current access token, refreshing it
+// first if needed.
+func (t *tokenSource) pass() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.access == "" || time.Until(t.expiry) < tokenRefreshMargin {
+		if err := t.refreshLocked(); err != nil {
+			return "", err
+		}
+	}
+
+	return "oauth:" + t.access, nil
+}
+
+// wait blocks until the access token nears expiry and refreshes it,
+// returning true once the token has rotated, whether refreshed by this
+// call or another. It returns false if done is closed first.
+func (t *tokenSource) wait(done <-chan struct{}) bool {
+	for {
+		t.mu.Lock()
+		d := time.Until(t.expiry) - tokenRefreshMargin
+		rotated := t.rotated
+		t.mu.Unlock()
+
+		timer := time.NewTimer(d)
+		select {
+		case <-done:
+			timer.Stop()
+			return false
+		case <-rotated:
+			timer.Stop()
+			return true
+		case <-timer.C:
+		}
+
+		t.mu.Lock()
+		var err error
+		if t.rotated == rotated {
+			err = t.refreshLocked()
+		}
+		t.mu.Unlock()
+
+		if err == nil {
+			return true
+		}
+
+		// The current token keeps working until it expires, so keep the
+		// session and try again.
+		elog.Printf("refreshing access token: %v", err)
+
+		if !sleep(tokenRetryDelay, done) {
+			return false
+		}
+	}
+}
+
+func (t *tokenSource) refreshLocked() error {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {t.refresh},
+		"client_id":     {t.clientID},
+		"client_secret": {t.clientSecret},
+	}
+
+	resp, err := httpClient.PostForm(twitchTokenURL, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token refresh failed: %s", resp.Status)
+	}
+
+	var body struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+
+	if body.AccessToken == "" {
+		return errors.New("token refresh returned no access token")
+	}
+
+	t.access = body.AccessToken
+	t.expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+
+	if body.RefreshToken != "" {
+		t.refresh = body.RefreshToken
+	}
+
+	close(t.rotated)
+	t.rotated = make(chan struct{})
+
+	return nil
+}
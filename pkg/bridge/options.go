@@ -0,0 +1,119 @@
+package bridge
+
+import "time"
+
+// Build metadata, set at build time with -ldflags "-X ...". Version is
+// reported in Home Assistant discovery and connection status payloads.
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+const (
+	defaultDrainTimeout  = 5 * time.Second
+	defaultFailoverAfter = 10 * time.Second
+)
+
+// options are the settings shared by a Bridge and the MQTT clients it
+// connects, set with Options.
+type options struct {
+	broker            *Broker
+	clientID          string
+	cleanSession      bool
+	storeDir          string
+	mqtt5             bool
+	failoverAfter     time.Duration
+	drainTimeout      time.Duration
+	availabilityTopic string
+	configFormat      string
+	dryRun            bool
+	readOnly          bool
+	writeOnly         bool
+}
+
+// An Option configures a Bridge, or a client connected with Connect.
+type Option func(*options)
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		failoverAfter: defaultFailoverAfter,
+		drainTimeout:  defaultDrainTimeout,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithBroker sets the broker to connect to when no brokers are configured.
+func WithBroker(b *Broker) Option {
+	return func(o *options) { o.broker = b }
+}
+
+// WithClientID sets the MQTT client ID, so the client's session survives
+// restarts. Without it, a random ID is used.
+func WithClientID(id string) Option {
+	return func(o *options) { o.clientID = id }
+}
+
+// WithCleanSession starts a new MQTT session on every connection instead
+// of resuming the last one.
+func WithCleanSession(clean bool) Option {
+	return func(o *options) { o.cleanSession = clean }
+}
+
+// WithStoreDir keeps the in-flight QoS 1 and 2 messages of resumed MQTT
+// sessions in files under dir, one directory per client ID, so they are
+// delivered even if the process restarts. Without it, they are kept in
+// memory. It applies only to MQTT 3.1.1.
+func WithStoreDir(dir string) Option {
+	return func(o *options) { o.storeDir = dir }
+}
+
+// WithMQTT5 connects with MQTT 5, adding user properties to publishes.
+func WithMQTT5(enabled bool) Option {
+	return func(o *options) { o.mqtt5 = enabled }
+}
+
+// WithFailoverAfter sets how long a broker may be unreachable before
+// failing over to the next configured broker (10s by default).
+func WithFailoverAfter(d time.Duration) Option {
+	return func(o *options) { o.failoverAfter = d }
+}
+
+// WithDrainTimeout sets how long connections keep publishing queued
+// messages when stopping (5s by default).
+func WithDrainTimeout(d time.Duration) Option {
+	return func(o *options) { o.drainTimeout = d }
+}
+
+// WithAvailabilityTopic sets a topic to publish the availability of the
+// bridge to, registering an offline will there when connecting.
+func WithAvailabilityTopic(topic string) Option {
+	return func(o *options) { o.availabilityTopic = topic }
+}
+
+// WithDryRun makes every connection log what it would publish and send
+// instead of doing so, as if each had dry_run set.
+func WithDryRun(enabled bool) Option {
+	return func(o *options) { o.dryRun = enabled }
+}
+
+// WithReadOnly stops every connection from writing to IRC, regardless of
+// its mode.
+func WithReadOnly(enabled bool) Option {
+	return func(o *options) { o.readOnly = enabled }
+}
+
+// WithWriteOnly stops every connection from publishing what it reads from
+// IRC, regardless of its mode.
+func WithWriteOnly(enabled bool) Option {
+	return func(o *options) { o.writeOnly = enabled }
+}
+
+// WithConfigFormat sets the format configs are reloaded in, instead of
+// choosing it by extension.
+func WithConfigFormat(format string) Option {
+	return func(o *options) { o.configFormat = format }
+}
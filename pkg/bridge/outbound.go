@@ -0,0 +1,89 @@
+package bridge
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxMessageLength is the most characters Twitch accepts in one message.
+const maxMessageLength = 500
+
+var (
+	errMessageTooLong = errors.New("message is longer than 500 characters")
+	errBadChannelName = errors.New("invalid channel name")
+)
+
+// sanitizeMessage makes text safe to send as a single IRC message, turning
+// line breaks into spaces and dropping other control characters.
+func sanitizeMessage(text string) string {
+	var b strings.Builder
+	b.Grow(len(text))
+
+	space := false
+	for _, r := range text {
+		switch {
+		case r == '\r' || r == '\n':
+			if !space {
+				b.WriteByte(' ')
+			}
+			space = true
+			continue
+		case unicode.IsControl(r) && r != '\t':
+			continue
+		}
+		b.WriteRune(r)
+		space = false
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+// checkChannelName reports whether name, without its #, is usable as an
+// IRC channel parameter.
+func checkChannelName(name string) error {
+	if strings.IndexFunc(name, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r) || unicode.IsControl(r)
+	}) >= 0 {
+		return errBadChannelName
+	}
+	return nil
+}
+
+// splitMessage splits text into parts of at most max characters, breaking
+// at spaces where it can and within words only when a word is too long.
+func splitMessage(text string, max int) []string {
+	var parts []string
+
+	for utf8.RuneCountInString(text) > max {
+		// Byte offset of the rune just past the limit.
+		cut := len(text)
+		n := 0
+		for i := range text {
+			if n == max {
+				cut = i
+				break
+			}
+			n++
+		}
+
+		end, next := cut, cut
+		if text[cut] == ' ' {
+			next = cut + 1
+		} else if i := strings.LastIndexByte(text[:cut], ' '); i > 0 {
+			end, next = i, i+1
+		}
+
+		if part := strings.TrimRight(text[:end], " "); part != "" {
+			parts = append(parts, part)
+		}
+		text = strings.TrimLeft(text[next:], " ")
+	}
+
+	if text != "" {
+		parts = append(parts, text)
+	}
+
+	return parts
+}
@@ -0,0 +1,115 @@
+package bridge
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jakebailey/irc"
+)
+
+// ChannelOverride changes how a connection publishes one channel's
+// messages. Topic (which may be a template) and QOS replace the
+// connection's publish topic and QoS, though routes still apply, Filter
+// further drops the channel's chat messages, and Sample replaces its
+// sample rate.
+type ChannelOverride struct {
+	Topic  string        `yaml:",omitempty"`
+	QOS    *byte         `yaml:",omitempty"`
+	Filter MessageFilter `yaml:",omitempty"`
+	Sample *float64      `yaml:",omitempty"`
+
+	filters messageFilters
+}
+
+var errNilOverride = errors.New("empty channel override")
+
+func (c *Connection) validateOverrides() error {
+	c.overrides = nil
+	if len(c.Publish.Overrides) == 0 {
+		return nil
+	}
+
+	var errs []error
+	c.overrides = make(map[string]*ChannelOverride, len(c.Publish.Overrides))
+
+	for ch, o := range c.Publish.Overrides {
+		if err := c.validateOverride(ch, o); err != nil {
+			errs = append(errs, fieldErr("overrides."+ch, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Connection) validateOverride(ch string, o *ChannelOverride) error {
+	if o == nil {
+		return errNilOverride
+	}
+
+	name := channelName(ch)
+	if name == "" {
+		return errEmptyChannel
+	}
+
+	if o.Topic != "" {
+		if o.Topic == c.Subscribe.Topic {
+			return fieldErr("topic", errBadTopics)
+		}
+		if err := checkTopicTemplate(o.Topic); err != nil {
+			return fieldErr("topic", err)
+		}
+	}
+
+	if o.QOS != nil && *o.QOS > 2 {
+		return fieldErr("qos", errBadQOS)
+	}
+
+	if o.Sample != nil {
+		if *o.Sample < 0 || *o.Sample > 1 {
+			return fieldErr("sample", errBadSampleRate)
+		}
+		if c.sampleRates == nil {
+			c.sampleRates = make(map[string]float64)
+		}
+		c.sampleRates[name] = *o.Sample
+	}
+
+	var err error
+	if o.filters, err = o.Filter.compile("filter"); err != nil {
+		return err
+	}
+
+	c.overrides[name] = o
+	return nil
+}
+
+// override returns the override for the channel, which may have a leading
+// #, or nil if it has none.
+func (c *Connection) override(channel string) *ChannelOverride {
+	return c.overrides[strings.TrimPrefix(channel, "#")]
+}
+
+// overrideTopics reports whether any channel override has a topic.
+func (c *Connection) overrideTopics() bool {
+	for _, o := range c.Publish.Overrides {
+		if o != nil && o.Topic != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// overrideAllows reports whether m passes the filter of its channel's
+// override, if it has one.
+func (c *Connection) overrideAllows(m *irc.Message) bool {
+	o := c.override(messageChannel(m))
+	return o == nil || o.filters.allows(m)
+}
+
+// publishQOS returns the QoS messages in the channel are published with.
+func (c *Connection) publishQOS(channel string) byte {
+	if o := c.override(channel); o != nil && o.QOS != nil {
+		return *o.QOS
+	}
+	return c.Publish.QOS
+}
@@ -0,0 +1,238 @@
+package bridge
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jakebailey/irc"
+)
+
+// parsedMessage is the "parsed" payload format, which decodes Twitch's
+// IRCv3 tags into typed fields.
+type parsedMessage struct {
+	Command     string     `json:"command"`
+	Channel     string     `json:"channel,omitempty"`
+	User        string     `json:"user,omitempty"`
+	Message     string     `json:"message,omitempty"`
+	ID          string     `json:"id,omitempty"`
+	DisplayName string     `json:"display_name,omitempty"`
+	UserID      string     `json:"user_id,omitempty"`
+	RoomID      string     `json:"room_id,omitempty"`
+	Color       string     `json:"color,omitempty"`
+	Badges      []badge    `json:"badges,omitempty"`
+	Emotes      []emote    `json:"emotes,omitempty"`
+	Bits        int        `json:"bits,omitempty"`
+	Cheers      []cheer    `json:"cheers,omitempty"`
+	Mod         bool       `json:"mod"`
+	Subscriber  bool       `json:"subscriber"`
+	VIP         bool       `json:"vip"`
+	Timestamp   *time.Time `json:"timestamp,omitempty"` // Deprecated: repeats SentAt; use that.
+	IsAction    bool       `json:"is_action"`
+
+	// FirstMessage is set on a user's first message in the channel, and
+	// ReturningChatter on the messages of users who have returned to it.
+	FirstMessage     bool `json:"first_msg"`
+	ReturningChatter bool `json:"returning_chatter"`
+
+	// ReceivedAt is when the bridge read the message, and SentAt is when
+	// Twitch says it was sent.
+	ReceivedAt time.Time  `json:"received_at"`
+	SentAt     *time.Time `json:"sent_at,omitempty"`
+
+	// Profile and Stream are filled in from Helix when enrichment is on.
+	Profile *userProfile `json:"profile,omitempty"`
+	Stream  *streamInfo  `json:"stream,omitempty"`
+
+	// ThirdPartyEmotes are filled in when third-party emotes are on.
+	ThirdPartyEmotes []thirdPartyEmote `json:"third_party_emotes,omitempty"`
+
+	// Fields are added by the connection's field scripts.
+	Fields map[string]interface{} `json:"fields,omitempty"`
+
+	// Self is set on messages the bridge sent, if they are tagged.
+	Self bool `json:"self,omitempty"`
+}
+
+type badge struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// emote is one occurrence of an emote in a message. Start and End are the
+// indexes of its first and last characters.
+type emote struct {
+	ID    string    `json:"id"`
+	Name  string    `json:"name,omitempty"`
+	Start int       `json:"start"`
+	End   int       `json:"end"`
+	URLs  emoteURLs `json:"urls"`
+}
+
+// emoteURLs are an emote's image URLs on Twitch's CDN, by scale.
+type emoteURLs struct {
+	X1 string `json:"1x"`
+	X2 string `json:"2x"`
+	X3 string `json:"3x"`
+}
+
+const emoteCDN = "https://static-cdn.jtvnw.net/emoticons/v2/"
+
+func newEmoteURLs(id string) emoteURLs {
+	base := emoteCDN + id + "/default/dark/"
+	return emoteURLs{
+		X1: base + "1.0",
+		X2: base + "2.0",
+		X3: base + "3.0",
+	}
+}
+
+func parseMessage(m *irc.Message) *parsedMessage {
+	p := &parsedMessage{
+		Command:     m.Command,
+		Channel:     strings.TrimPrefix(messageChannel(m), "#"),
+		Message:     m.Trailing,
+		ID:          tag(m, "id"),
+		DisplayName: tag(m, "display-name"),
+		UserID:      tag(m, "user-id"),
+		RoomID:      tag(m, "room-id"),
+		Color:       tag(m, "color"),
+		Badges:      parseBadges(tag(m, "badges")),
+		Emotes:      parseEmotes(tag(m, "emotes")),
+		Mod:         tag(m, "mod") == "1",
+		Subscriber:  tag(m, "subscriber") == "1",
+		VIP:         tag(m, "vip") == "1",
+
+		FirstMessage:     isFirstMessage(m),
+		ReturningChatter: tag(m, "returning-chatter") == "1",
+	}
+
+	if m.Prefix.Name != "" {
+		p.User = m.Prefix.Name
+	}
+
+	if text, ok := unwrapAction(p.Message); ok {
+		p.Message = text
+		p.IsAction = true
+	}
+
+	nameEmotes(p.Emotes, p.Message)
+
+	if bits, err := strconv.Atoi(tag(m, "bits")); err == nil {
+		p.Bits = bits
+		p.Cheers = parseCheers(p.Message, bits)
+	}
+
+	for _, b := range p.Badges {
+		switch b.Name {
+		case "vip":
+			p.VIP = true
+		case "moderator", "broadcaster":
+			p.Mod = true
+		case "subscriber", "founder":
+			p.Subscriber = true
+		}
+	}
+
+	p.SentAt = sentAt(m)
+	p.Timestamp = p.SentAt
+
+	return p
+}
+
+// sentAt returns the time Twitch says m was sent, from its tmi-sent-ts
+// tag, or nil if it has none.
+func sentAt(m *irc.Message) *time.Time {
+	ts, err := strconv.ParseInt(tag(m, "tmi-sent-ts"), 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	t := time.Unix(0, ts*int64(time.Millisecond)).UTC()
+	return &t
+}
+
+// timedMessage is the "json" payload format: the IRC message with the
+// times it was sent and received.
+type timedMessage struct {
+	*irc.Message
+	ReceivedAt time.Time  `json:"received_at"`
+	SentAt     *time.Time `json:"sent_at,omitempty"`
+
+	Fields map[string]interface{} `json:"fields,omitempty"`
+	Self   bool                   `json:"self,omitempty"`
+}
+
+// tag returns the value of the named tag, or an empty string.
+func tag(m *irc.Message, name string) string {
+	return m.Tags[name]
+}
+
+// parseBadges parses a badges tag, like "moderator/1,subscriber/12".
+func parseBadges(s string) []badge {
+	if s == "" {
+		return nil
+	}
+
+	var badges []badge
+	for _, b := range strings.Split(s, ",") {
+		i := strings.IndexByte(b, '/')
+		if i < 0 {
+			badges = append(badges, badge{Name: b})
+			continue
+		}
+		badges = append(badges, badge{Name: b[:i], Version: b[i+1:]})
+	}
+
+	return badges
+}
+
+// parseEmotes parses an emotes tag, like "25:0-4,12-16/1902:6-10", into
+// one entry per occurrence, ordered as in the tag.
+func parseEmotes(s string) []emote {
+	if s == "" {
+		return nil
+	}
+
+	var emotes []emote
+	for _, e := range strings.Split(s, "/") {
+		i := strings.IndexByte(e, ':')
+		if i < 0 {
+			continue
+		}
+
+		id := e[:i]
+		for _, pos := range strings.Split(e[i+1:], ",") {
+			j := strings.IndexByte(pos, '-')
+			if j < 0 {
+				continue
+			}
+
+			start, err1 := strconv.Atoi(pos[:j])
+			end, err2 := strconv.Atoi(pos[j+1:])
+			if err1 != nil || err2 != nil {
+				continue
+			}
+
+			emotes = append(emotes, emote{ID: id, Start: start, End: end, URLs: newEmoteURLs(id)})
+		}
+	}
+
+	return emotes
+}
+
+// nameEmotes fills in each emote's name from the message text. Twitch
+// counts positions in characters rather than bytes.
+func nameEmotes(emotes []emote, text string) {
+	if len(emotes) == 0 {
+		return
+	}
+
+	runes := []rune(text)
+	for i := range emotes {
+		e := &emotes[i]
+		if e.Start >= 0 && e.Start <= e.End && e.End < len(runes) {
+			e.Name = string(runes[e.Start : e.End+1])
+		}
+	}
+}
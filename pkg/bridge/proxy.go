@@ -0,0 +1,304 @@
+package bridge
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+const proxyTimeout = 30 * time.Second
+
+var errBadProxy = errors.New("proxy must be a socks5, socks5h, http, or https URL")
+
+// The environment variables giving the default proxy, in order of
+// preference. IRC, Helix, and EventSub are all TLS on HTTPS-like ports, so
+// use HTTPS_PROXY, while MQTT uses only ALL_PROXY. NO_PROXY is honored for
+// both.
+var (
+	httpsProxyEnv = []string{"HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy"}
+	allProxyEnv   = []string{"ALL_PROXY", "all_proxy"}
+)
+
+// dialContextFunc dials a network address, like net.Dialer.DialContext.
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// parseProxy parses a proxy URL.
+func parseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h", "http", "https":
+	default:
+		return nil, errBadProxy
+	}
+
+	if u.Host == "" {
+		return nil, errBadProxy
+	}
+
+	return u, nil
+}
+
+// envProxy returns the proxy given by the first set of the environment
+// variables keys for a connection to addr, or nil if there is none or
+// NO_PROXY excludes addr.
+func envProxy(addr string, keys ...string) (*url.URL, error) {
+	config := httpproxy.Config{
+		HTTPSProxy: getenvAny(keys...),
+		NoProxy:    getenvAny("NO_PROXY", "no_proxy"),
+	}
+	return config.ProxyFunc()(&url.URL{Scheme: "https", Host: addr})
+}
+
+func getenvAny(keys ...string) string {
+	for _, k := range keys {
+		if v := os.Getenv(k); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// proxyDialer returns a function dialing through the proxy at rawURL, or if
+// it is empty, the proxy given by the environment variables keys, or
+// directly if there is neither.
+func proxyDialer(rawURL string, keys ...string) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var u *url.URL
+		var err error
+		if rawURL != "" {
+			u, err = parseProxy(rawURL)
+		} else {
+			u, err = envProxy(addr, keys...)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return dialProxy(ctx, u, network, addr)
+	}
+}
+
+// proxyDial returns the dial function for the connection's outbound
+// connections to Twitch.
+func (c *Connection) proxyDial() dialContextFunc {
+	return proxyDialer(c.Proxy, httpsProxyEnv...)
+}
+
+// dialProxy dials addr through the proxy u, or directly if u is nil.
+func dialProxy(ctx context.Context, u *url.URL, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+
+	if u == nil {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: pass}
+		}
+
+		sd, err := proxy.SOCKS5("tcp", u.Host, auth, &d)
+		if err != nil {
+			return nil, err
+		}
+
+		if cd, ok := sd.(interface {
+			DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+		}); ok {
+			return cd.DialContext(ctx, network, addr)
+		}
+		return sd.Dial(network, addr)
+
+	default:
+		return dialConnect(ctx, u, addr)
+	}
+}
+
+// dialConnect tunnels to addr through the HTTP proxy u with CONNECT.
+func dialConnect(ctx context.Context, u *url.URL, addr string) (net.Conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(proxyTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// A successful CONNECT has no body, and a failed one is abandoned.
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT failed: %s", resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection some of whose input has already been read
+// into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// dialTLS dials addr with dial and starts TLS over the connection, with
+// the server name taken from addr unless config gives one.
+func dialTLS(ctx context.Context, dial dialContextFunc, addr string, config *tls.Config) (net.Conn, error) {
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+
+	tc := tls.Client(conn, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tc, nil
+}
+
+// proxyForwarder listens locally, tunneling each connection it accepts to
+// addr, for clients which can't be given a dial function.
+type proxyForwarder struct {
+	ln   net.Listener
+	dial dialContextFunc
+	addr string
+}
+
+func forwardProxy(dial dialContextFunc, addr string) (*proxyForwarder, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	f := &proxyForwarder{ln: ln, dial: dial, addr: addr}
+	go f.serve()
+	return f, nil
+}
+
+func (f *proxyForwarder) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.forward(conn)
+	}
+}
+
+func (f *proxyForwarder) forward(conn net.Conn) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), proxyTimeout)
+	up, err := f.dial(ctx, "tcp", f.addr)
+	cancel()
+	if err != nil {
+		elog.Printf("proxy connection failed: %v", err)
+		return
+	}
+	defer up.Close()
+
+	go func() {
+		io.Copy(up, conn)
+		up.Close()
+	}()
+	io.Copy(conn, up)
+}
+
+func (f *proxyForwarder) close() {
+	f.ln.Close()
+}
+
+// forwardedClient is an MQTT client connected through a proxyForwarder,
+// which is closed with it.
+type forwardedClient struct {
+	BrokerClient
+	f *proxyForwarder
+}
+
+func (c *forwardedClient) Disconnect(quiesce uint) {
+	c.BrokerClient.Disconnect(quiesce)
+	c.f.close()
+}
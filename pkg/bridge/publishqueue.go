@@ -0,0 +1,178 @@
+package bridge
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jakebailey/irc"
+)
+
+const (
+	defaultPublishQueue   = 256
+	defaultPublishWorkers = 1
+)
+
+// overflowBlock makes a full publish queue block the IRC read loop until
+// there is room.
+const overflowBlock = "block"
+
+var (
+	errBadPublishQueue  = errors.New("invalid publish queue size, workers, or overflow")
+	errPublishQueueFull = errors.New("publish queue full")
+)
+
+// publishItem is a message read from IRC, with the capabilities of the
+// connection it arrived on and the time it arrived.
+type publishItem struct {
+	m        *irc.Message
+	caps     *capSet
+	received time.Time
+}
+
+// publishQueue decouples reading IRC from publishing to the broker, so a
+// slow broker does not stall reads until Twitch disconnects the client.
+type publishQueue struct {
+	items    chan publishItem
+	overflow string
+
+	// closed is closed once nothing more will be pushed.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *Connection) validatePublishQueue() error {
+	q := &c.Publish.Queue
+
+	if q.Size < 0 || q.Workers < 0 {
+		return errBadPublishQueue
+	}
+
+	switch q.Overflow {
+	case "", overflowBlock, overflowDropNewest, overflowDropOldest:
+	default:
+		return errBadPublishQueue
+	}
+
+	return nil
+}
+
+func (c *Connection) newPublishQueue() *publishQueue {
+	size := c.Publish.Queue.Size
+	if size == 0 {
+		size = defaultPublishQueue
+	}
+
+	overflow := c.Publish.Queue.Overflow
+	if overflow == "" {
+		overflow = overflowDropNewest
+	}
+
+	return &publishQueue{
+		items:    make(chan publishItem, size),
+		overflow: overflow,
+		closed:   make(chan struct{}),
+	}
+}
+
+// close marks the queue as finished, once its producers have stopped, so
+// draining ends when it is empty.
+func (q *publishQueue) close() {
+	q.closeOnce.Do(func() { close(q.closed) })
+}
+
+// push queues a message. It returns errPublishQueueFull if a message was
+// dropped because the queue was full, or errStopped if stop was closed
+// while blocked, leaving the message unqueued.
+func (q *publishQueue) push(it publishItem, stop <-chan struct{}) error {
+	var err error
+
+	for {
+		select {
+		case q.items <- it:
+			return err
+		default:
+		}
+
+		switch q.overflow {
+		case overflowBlock:
+			select {
+			case q.items <- it:
+				return err
+			case <-stop:
+				return errStopped
+			}
+
+		case overflowDropOldest:
+			select {
+			case <-q.items:
+				err = errPublishQueueFull
+			default:
+			}
+
+		default:
+			return errPublishQueueFull
+		}
+	}
+}
+
+func (q *publishQueue) len() int {
+	return len(q.items)
+}
+
+// publishLoops starts the publish workers, which run until stop is closed
+// and then drain the queue, until it is closed and empty, for up to the
+// drain timeout. With more than one worker, messages may be published out
+// of order.
+func (c *Connection) publishLoops(q *publishQueue, client MQTTClient, wg *sync.WaitGroup, g *panicGuard, stop <-chan struct{}) {
+	workers := c.Publish.Queue.Workers
+	if workers == 0 {
+		workers = defaultPublishWorkers
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		g.goSafe(func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					c.drain(q, client)
+					return
+				case it := <-q.items:
+					c.publish(client, it, stop)
+				}
+			}
+		})
+	}
+}
+
+// drain publishes the messages left in the queue once the connection has
+// stopped, including those read while IRC is shutting down, giving up after
+// the drain timeout.
+func (c *Connection) drain(q *publishQueue, client MQTTClient) {
+	timeout := make(chan struct{})
+	t := time.AfterFunc(c.options().drainTimeout, func() { close(timeout) })
+	defer t.Stop()
+
+	for {
+		select {
+		case it := <-q.items:
+			c.publish(client, it, timeout)
+		case <-timeout:
+			if n := q.len(); n > 0 {
+				c.log.Warn().Int("messages", n).Msg("drain timed out, dropping queued messages")
+				c.countN("publish_dropped", int64(n))
+			}
+			return
+		case <-q.closed:
+			// Nothing more is coming, so the queue is drained once empty.
+			select {
+			case it := <-q.items:
+				c.publish(client, it, timeout)
+			default:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package bridge
+
+import (
+	"expvar"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestPublishQueueDrainsUntilClosed(t *testing.T) {
+	c := newTestConnection()
+	h, err := newHarness(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := c.newPublishQueue()
+	stop := make(chan struct{})
+	close(stop)
+
+	var wg sync.WaitGroup
+	g := &panicGuard{c: c, cancel: func() {}}
+	c.publishLoops(q, h.MQTT, &wg, g, stop)
+
+	// A message read after stopping, while the queue is momentarily empty,
+	// is still published.
+	time.Sleep(20 * time.Millisecond)
+	m := chatMessage("alice", "#foo", "late")
+	m.Raw = m.String()
+	q.push(publishItem{m: m, caps: newCapSet(), received: time.Now()}, nil)
+	q.close()
+	wg.Wait()
+
+	p, err := h.MQTT.NextOn("twitch/chat", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(p.payload), "late") {
+		t.Errorf("payload %s does not contain the message", p.payload)
+	}
+}
+
+func TestPublishQueuePushStoppedIsNotFull(t *testing.T) {
+	q := &publishQueue{items: make(chan publishItem, 1), overflow: overflowBlock}
+	if err := q.push(publishItem{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if err := q.push(publishItem{}, stop); err != errStopped {
+		t.Errorf("blocked push after stop returned %v, want %v", err, errStopped)
+	}
+
+	q.overflow = overflowDropNewest
+	if err := q.push(publishItem{}, nil); err != errPublishQueueFull {
+		t.Errorf("push to a full queue returned %v, want %v", err, errPublishQueueFull)
+	}
+}
+
+// slowPublisher takes a millisecond over each publish.
+type slowPublisher struct {
+	*fakeMQTT
+}
+
+func (p slowPublisher) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	time.Sleep(time.Millisecond)
+	return p.fakeMQTT.Publish(topic, qos, retained, payload)
+}
+
+func TestPublishQueueDrainTimeoutCounted(t *testing.T) {
+	c := newTestConnection()
+	c.Name = "drain-timeout"
+	if _, err := newHarness(c); err != nil {
+		t.Fatal(err)
+	}
+	c.opts = newOptions([]Option{WithDrainTimeout(5 * time.Millisecond)})
+
+	dropped := func(m *expvar.Map) int64 {
+		if v, ok := m.Get("publish_dropped").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	connBefore, tenantBefore := dropped(c.metrics), dropped(c.tenant.metrics)
+
+	q := c.newPublishQueue()
+	for i := 0; i < 50; i++ {
+		m := chatMessage("alice", "#foo", "queued")
+		m.Raw = m.String()
+		q.push(publishItem{m: m, caps: newCapSet(), received: time.Now()}, nil)
+	}
+
+	mq := newFakeMQTT()
+	mq.lossy = true
+	c.drain(q, slowPublisher{mq})
+
+	connDropped, tenantDropped := dropped(c.metrics)-connBefore, dropped(c.tenant.metrics)-tenantBefore
+	if connDropped == 0 {
+		t.Error("drain timeout dropped nothing")
+	}
+	if connDropped != tenantDropped {
+		t.Errorf("connection counted %d dropped, tenant %d", connDropped, tenantDropped)
+	}
+}
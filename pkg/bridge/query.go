@@ -0,0 +1,200 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const queryStatus = "status"
+
+var (
+	errNoQueryReply = errors.New("query requires a reply topic")
+	errBadQuery     = errors.New("unknown query")
+)
+
+// queryRequest asks about the connection's state, like {"query":"status"}.
+// ID is optional and echoed in the reply.
+type queryRequest struct {
+	ID    string `json:"id,omitempty"`
+	Query string `json:"query"`
+}
+
+// queryReply is published to the reply topic for each request.
+type queryReply struct {
+	queryRequest
+	Status *statusReply `json:"status,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// statusReply answers the status query.
+type statusReply struct {
+	Name         string        `json:"name,omitempty"`
+	Nick         string        `json:"nick"`
+	Version      string        `json:"version"`
+	Mode         string        `json:"mode"`
+	Uptime       float64       `json:"uptime_seconds"`
+	Connected    bool          `json:"connected"`
+	Channels     []string      `json:"channels"`
+	Shards       []shardStatus `json:"shards"`
+	SendQueue    int           `json:"send_queue"`
+	PublishQueue int           `json:"publish_queue"`
+	RateLimits   rateBudgets   `json:"rate_limits"`
+	Received     int64         `json:"received"`
+	Published    int64         `json:"published"`
+	Sent         int64         `json:"sent"`
+	Reconnects   int64         `json:"reconnects"`
+}
+
+// shardStatus is the state of one of the connection's IRC connections.
+type shardStatus struct {
+	Index     int      `json:"index"`
+	Connected bool     `json:"connected"`
+	Joined    []string `json:"joined"`
+}
+
+// rateBudgets are the messages each of the connection's rate limits
+// allows right now, out of the most they allow at once. Limits which don't
+// apply are left out.
+type rateBudgets struct {
+	Send      *rateBudget `json:"send,omitempty"`
+	Moderator *rateBudget `json:"moderator,omitempty"`
+	Join      *rateBudget `json:"join,omitempty"`
+	Tenant    *rateBudget `json:"tenant,omitempty"`
+}
+
+type rateBudget struct {
+	Available float64 `json:"available"`
+	Max       float64 `json:"max"`
+}
+
+func newRateBudget(l *limiter) *rateBudget {
+	if l == nil {
+		return nil
+	}
+	available, max := l.budget()
+	return &rateBudget{Available: available, Max: max}
+}
+
+func (c *Connection) validateQuery() error {
+	if c.Query.Topic == "" {
+		return nil
+	}
+
+	if c.Query.ReplyTopic == "" {
+		return fieldErr("reply_topic", errNoQueryReply)
+	}
+
+	if c.Query.Topic == c.Query.ReplyTopic {
+		return fieldErr("reply_topic", errBadTopics)
+	}
+
+	return nil
+}
+
+// queryHandler returns an MQTT message handler which queues queries.
+func (c *Connection) queryHandler(queue chan<- queryRequest) mqtt.MessageHandler {
+	return func(_ mqtt.Client, mq mqtt.Message) {
+		var req queryRequest
+
+		if err := json.Unmarshal(mq.Payload(), &req); err != nil {
+			c.elog.Printf("bad payload on %s: %v", mq.Topic(), err)
+			return
+		}
+
+		req.Query = strings.ToLower(strings.TrimSpace(req.Query))
+
+		select {
+		case queue <- req:
+		default:
+			c.elog.Printf("query queue full, dropped a request")
+			c.count("queue_dropped")
+		}
+	}
+}
+
+// queryLoop answers queued queries on the reply topic until stop is
+// closed.
+func (c *Connection) queryLoop(queue <-chan queryRequest, client MQTTClient, sq *sendQueue, pq *publishQueue, stop <-chan struct{}) {
+	start := time.Now()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case req := <-queue:
+			reply := queryReply{queryRequest: req}
+
+			switch req.Query {
+			case queryStatus:
+				reply.Status = c.status(sq, pq, start)
+			default:
+				reply.Error = fmt.Sprintf("%v: %q", errBadQuery, req.Query)
+			}
+
+			c.replyQuery(client, &reply)
+		}
+	}
+}
+
+// status returns the connection's current state.
+func (c *Connection) status(sq *sendQueue, pq *publishQueue, start time.Time) *statusReply {
+	c.mu.Lock()
+	shards := c.shards
+	budgets := rateBudgets{
+		Send:      newRateBudget(c.sendLim),
+		Moderator: newRateBudget(c.modLim),
+		Join:      newRateBudget(c.joinLimiter),
+		Tenant:    newRateBudget(c.tenant.limiter),
+	}
+	c.mu.Unlock()
+
+	st := &statusReply{
+		Name:       c.Name,
+		Nick:       c.Nick,
+		Version:    Version,
+		Mode:       c.Mode,
+		Uptime:     time.Since(start).Seconds(),
+		Connected:  c.isReady(),
+		Channels:   c.channels(),
+		Shards:     make([]shardStatus, 0, len(shards)),
+		RateLimits: budgets,
+		Received:   c.stats.received.Load(),
+		Published:  c.stats.published.Load(),
+		Sent:       c.stats.sent.Load(),
+		Reconnects: c.stats.reconnects.Load(),
+	}
+
+	for _, s := range shards {
+		st.Shards = append(st.Shards, shardStatus{
+			Index:     s.index,
+			Connected: s.isReady(),
+			Joined:    s.channels(),
+		})
+	}
+
+	if sq != nil {
+		st.SendQueue = sq.len()
+	}
+	if pq != nil {
+		st.PublishQueue = pq.len()
+	}
+
+	return st
+}
+
+func (c *Connection) replyQuery(client MQTTClient, reply *queryReply) {
+	b, err := json.Marshal(reply)
+	if err != nil {
+		c.elog.Println(err)
+		return
+	}
+
+	if t := client.Publish(c.Query.ReplyTopic, c.Query.QOS, false, b); t.Wait() && t.Error() != nil {
+		c.elog.Printf("publish failed: %v", t.Error())
+	}
+}
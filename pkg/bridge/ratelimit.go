@@ -0,0 +1,135 @@
+package bridge
+
+import (
+	"sync"
+	"time"
+)
+
+// limiter allows up to max events in any period, keeping the times of the
+// events in the last period. Unlike a token bucket, it never lets a burst
+// push more than max events into a period, which is how Twitch counts.
+type limiter struct {
+	mu     sync.Mutex
+	max    int
+	period time.Duration
+	events []time.Time // oldest first
+}
+
+func newLimiter(max int, period time.Duration) *limiter {
+	return &limiter{
+		max:    max,
+		period: period,
+		events: make([]time.Time, 0, max),
+	}
+}
+
+// prune forgets the events which happened a period or more before now.
+func (l *limiter) prune(now time.Time) {
+	cutoff := now.Add(-l.period)
+	i := 0
+	for i < len(l.events) && !l.events[i].After(cutoff) {
+		i++
+	}
+	l.events = append(l.events[:0], l.events[i:]...)
+}
+
+// Wait blocks until an event may happen, and records it. It returns
+// false if stop was closed first. A nil limiter never blocks.
+func (l *limiter) Wait(stop <-chan struct{}) bool {
+	return l.WaitN(1, stop)
+}
+
+// WaitN is like Wait, but waits until n events may happen together. More
+// than the limiter's max are counted as max, waiting for a whole period.
+func (l *limiter) WaitN(n int, stop <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		d := l.delay(n, now)
+		if d <= 0 {
+			l.record(n, now)
+		}
+		l.mu.Unlock()
+
+		if d <= 0 {
+			return true
+		}
+		if !sleep(d, stop) {
+			return false
+		}
+	}
+}
+
+// waitAll blocks until an event may happen in every one of ls, and then
+// records it in all of them at once, so that no limiter's budget is spent
+// while another holds the event back. Nil limiters are skipped. Callers
+// must pass shared limiters in the same order, so that locking them
+// cannot deadlock.
+func waitAll(stop <-chan struct{}, ls ...*limiter) bool {
+	for {
+		now := time.Now()
+		var d time.Duration
+
+		for _, l := range ls {
+			if l != nil {
+				l.mu.Lock()
+				if ld := l.delay(1, now); ld > d {
+					d = ld
+				}
+			}
+		}
+		for _, l := range ls {
+			if l != nil {
+				if d <= 0 {
+					l.record(1, now)
+				}
+				l.mu.Unlock()
+			}
+		}
+
+		if d <= 0 {
+			return true
+		}
+		if !sleep(d, stop) {
+			return false
+		}
+	}
+}
+
+// delay returns how long until n events may happen, or zero if they may
+// now. l.mu must be held.
+func (l *limiter) delay(n int, now time.Time) time.Duration {
+	if n > l.max {
+		n = l.max
+	}
+
+	l.prune(now)
+	over := len(l.events) + n - l.max
+	if over <= 0 {
+		return 0
+	}
+	return l.events[over-1].Add(l.period).Sub(now)
+}
+
+// record records n events at now. l.mu must be held.
+func (l *limiter) record(n int, now time.Time) {
+	if n > l.max {
+		n = l.max
+	}
+	for i := 0; i < n; i++ {
+		l.events = append(l.events, now)
+	}
+}
+
+// budget returns how many events may happen now, and the most that may
+// happen at once.
+func (l *limiter) budget() (available, max float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(time.Now())
+	return float64(l.max - len(l.events)), float64(l.max)
+}
@@ -0,0 +1,126 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+)
+
+// limiterTimes records the times Wait lets events through for the given
+// duration.
+func limiterTimes(l *limiter, d time.Duration) []time.Time {
+	stop := make(chan struct{})
+	timer := time.AfterFunc(d, func() { close(stop) })
+	defer timer.Stop()
+
+	var times []time.Time
+	for l.Wait(stop) {
+		times = append(times, time.Now())
+	}
+	return times
+}
+
+// checkWindows fails if more than max of times fall within any period.
+func checkWindows(t *testing.T, times []time.Time, max int, period time.Duration) {
+	t.Helper()
+	for i := max; i < len(times); i++ {
+		if d := times[i].Sub(times[i-max]); d < period {
+			t.Fatalf("events %d to %d happened within %s, want at most %d per %s", i-max, i, d, max, period)
+		}
+	}
+}
+
+func TestLimiterNeverExceedsWindow(t *testing.T) {
+	const max = 5
+	const period = 100 * time.Millisecond
+
+	// Times are taken just after Wait returns, so may lag a little.
+	times := limiterTimes(newLimiter(max, period), 350*time.Millisecond)
+	checkWindows(t, times, max, period-period/10)
+
+	// The first window may be used at once, and each after it in turn.
+	if len(times) < 3*max {
+		t.Errorf("%d events in 3.5 periods, want at least %d", len(times), 3*max)
+	}
+	if len(times) > 4*max {
+		t.Errorf("%d events in 3.5 periods, want at most %d", len(times), 4*max)
+	}
+}
+
+func TestLimiterFirstWindow(t *testing.T) {
+	const max = 20
+	const period = time.Second
+
+	times := limiterTimes(newLimiter(max, period), period/2)
+	if len(times) != max {
+		t.Errorf("%d events in the first half period, want %d", len(times), max)
+	}
+}
+
+func TestLimiterBudget(t *testing.T) {
+	l := newLimiter(3, time.Minute)
+	l.Wait(nil)
+
+	available, max := l.budget()
+	if available != 2 || max != 3 {
+		t.Errorf("budget() = %v, %v, want 2, 3", available, max)
+	}
+}
+
+func TestLimiterNil(t *testing.T) {
+	var l *limiter
+	if !l.Wait(nil) {
+		t.Error("nil limiter blocked")
+	}
+}
+
+func TestLimiterWaitN(t *testing.T) {
+	const period = 50 * time.Millisecond
+	l := newLimiter(3, period)
+
+	start := time.Now()
+	l.Wait(nil)
+	l.WaitN(2, nil)
+	if d := time.Since(start); d >= period {
+		t.Fatalf("first window took %s", d)
+	}
+
+	// The next two must wait for the first window to pass.
+	l.WaitN(2, nil)
+	if d := time.Since(start); d < period {
+		t.Errorf("second batch after %s, want at least %s", d, period)
+	}
+}
+
+func TestLimiterWaitNOverMax(t *testing.T) {
+	l := newLimiter(2, time.Minute)
+	if !l.WaitN(3, nil) {
+		t.Fatal("WaitN blocked")
+	}
+	if available, _ := l.budget(); available != 0 {
+		t.Errorf("%v available, want 0", available)
+	}
+}
+
+func TestWaitAllSpendsNothingWhileBlocked(t *testing.T) {
+	conn := newLimiter(2, time.Minute)
+	tenant := newLimiter(1, time.Minute)
+	tenant.Wait(nil)
+
+	stop := make(chan struct{})
+	time.AfterFunc(20*time.Millisecond, func() { close(stop) })
+	if waitAll(stop, conn, tenant) {
+		t.Fatal("waitAll passed a saturated limiter")
+	}
+
+	// The connection's budget is untouched while the tenant held it back.
+	if available, _ := conn.budget(); available != 2 {
+		t.Errorf("connection has %v available, want 2", available)
+	}
+
+	if !waitAll(nil, conn, nil) {
+		t.Fatal("waitAll blocked")
+	}
+	if available, _ := conn.budget(); available != 1 {
+		t.Errorf("connection has %v available, want 1", available)
+	}
+}
@@ -0,0 +1,207 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const defaultReplaySize = 100
+
+var (
+	errBadReplaySize   = errors.New("negative replay size")
+	errNoReplayReply   = errors.New("replay requires a reply topic")
+	errReplayNoPublish = errors.New("replay requires a publish topic")
+)
+
+// replayRequest asks for the last Count messages of a channel, like
+// {"channel":"foo","count":50}. Without a count, every kept message is
+// replayed. ID is optional and echoed in the reply.
+type replayRequest struct {
+	ID      string `json:"id,omitempty"`
+	Channel string `json:"channel"`
+	Count   int    `json:"count,omitempty"`
+}
+
+// replayReply is published to the reply topic for each request. Messages
+// are oldest first, each as it would be published in the publish format
+// with JSON encoding, or as a string in the raw format.
+type replayReply struct {
+	replayRequest
+	Messages []json.RawMessage `json:"messages"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// replayBuffer keeps the last few messages of each channel.
+type replayBuffer struct {
+	size int
+
+	mu       sync.Mutex
+	channels map[string]*replayRing
+}
+
+// replayRing is a ring buffer of a channel's messages.
+type replayRing struct {
+	items []publishItem
+	next  int
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{size: size, channels: make(map[string]*replayRing)}
+}
+
+func (b *replayBuffer) add(channel string, it publishItem) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r := b.channels[channel]
+	if r == nil {
+		r = &replayRing{}
+		b.channels[channel] = r
+	}
+
+	if len(r.items) < b.size {
+		r.items = append(r.items, it)
+		return
+	}
+
+	r.items[r.next] = it
+	r.next = (r.next + 1) % b.size
+}
+
+// last returns up to the last n messages of channel, oldest first, or all
+// of them if n is not positive.
+func (b *replayBuffer) last(channel string, n int) []publishItem {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r := b.channels[channel]
+	if r == nil {
+		return nil
+	}
+
+	items := make([]publishItem, 0, len(r.items))
+	items = append(items, r.items[r.next:]...)
+	items = append(items, r.items[:r.next]...)
+
+	if n > 0 && n < len(items) {
+		items = items[len(items)-n:]
+	}
+	return items
+}
+
+func (c *Connection) validateReplay() error {
+	c.replay = nil
+
+	if c.Replay.Size < 0 {
+		return fieldErr("size", errBadReplaySize)
+	}
+
+	if c.Replay.Topic == "" {
+		return nil
+	}
+
+	if c.Replay.ReplyTopic == "" {
+		return fieldErr("reply_topic", errNoReplayReply)
+	}
+
+	if c.Replay.Topic == c.Replay.ReplyTopic {
+		return fieldErr("reply_topic", errBadTopics)
+	}
+
+	if !c.publishes() {
+		return fieldErr("topic", errReplayNoPublish)
+	}
+
+	if c.Replay.Size == 0 {
+		c.Replay.Size = defaultReplaySize
+	}
+
+	c.replay = newReplayBuffer(c.Replay.Size)
+	return nil
+}
+
+// recordReplay keeps a published chat message for replay.
+func (c *Connection) recordReplay(it publishItem) {
+	if c.replay == nil || !isChat(it.m) {
+		return
+	}
+
+	if ch := messageChannel(it.m); ch != "" {
+		c.replay.add(strings.TrimPrefix(ch, "#"), it)
+	}
+}
+
+// replayHandler returns an MQTT message handler which queues replay
+// requests.
+func (c *Connection) replayHandler(queue chan<- replayRequest) mqtt.MessageHandler {
+	return func(_ mqtt.Client, mq mqtt.Message) {
+		var req replayRequest
+
+		if err := json.Unmarshal(mq.Payload(), &req); err != nil {
+			c.elog.Printf("bad payload on %s: %v", mq.Topic(), err)
+			return
+		}
+
+		req.Channel = channelName(req.Channel)
+
+		select {
+		case queue <- req:
+		default:
+			c.elog.Printf("replay queue full, dropped a request")
+			c.count("queue_dropped")
+		}
+	}
+}
+
+// replayLoop answers queued replay requests on the reply topic.
+func (c *Connection) replayLoop(queue <-chan replayRequest, client MQTTClient, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case req := <-queue:
+			c.replyReplay(client, &req)
+		}
+	}
+}
+
+func (c *Connection) replyReplay(client MQTTClient, req *replayRequest) {
+	reply := replayReply{replayRequest: *req, Messages: []json.RawMessage{}}
+
+	if req.Channel == "" {
+		reply.Error = errEmptyChannel.Error()
+	} else {
+		for _, it := range c.replay.last(req.Channel, req.Count) {
+			b, err := c.payload(c.Publish.Format, encodingJSON, it, nil, false)
+			if err != nil {
+				c.elog.Println(err)
+				continue
+			}
+
+			// Raw lines aren't JSON.
+			if c.Publish.Format == formatRaw || !it.caps.has(capTags) {
+				if b, err = json.Marshal(string(b)); err != nil {
+					c.elog.Println(err)
+					continue
+				}
+			}
+
+			reply.Messages = append(reply.Messages, b)
+		}
+		c.count("replays")
+	}
+
+	b, err := json.Marshal(&reply)
+	if err != nil {
+		c.elog.Println(err)
+		return
+	}
+
+	if t := client.Publish(c.Replay.ReplyTopic, c.Replay.QOS, false, b); t.Wait() && t.Error() != nil {
+		c.elog.Printf("publish failed: %v", t.Error())
+	}
+}
@@ -0,0 +1,141 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	errBadRoomSetting = errors.New("unknown room setting")
+	errBadRoomValue   = errors.New("room setting value must be a boolean or non-negative number")
+)
+
+// roomSetting is a request to change a room setting, like
+// {"channel":"foo","setting":"slow","value":30}. Value is a boolean, or a
+// number for settings with a duration (slow mode in seconds, followers-only
+// mode in minutes), where 0 turns slow mode off.
+type roomSetting struct {
+	Channel string
+	Setting string
+	Value   json.RawMessage
+}
+
+// roomSettingFields maps settings, with dashes and underscores removed, to
+// their Helix chat settings field and duration field.
+var roomSettingFields = map[string][2]string{
+	"slow":            {"slow_mode", "slow_mode_wait_time"},
+	"followers":       {"follower_mode", "follower_mode_duration"},
+	"followersonly":   {"follower_mode", "follower_mode_duration"},
+	"emoteonly":       {"emote_mode", ""},
+	"emotes":          {"emote_mode", ""},
+	"subonly":         {"subscriber_mode", ""},
+	"subscribers":     {"subscriber_mode", ""},
+	"subscribersonly": {"subscriber_mode", ""},
+	"unique":          {"unique_chat_mode", ""},
+	"uniquechat":      {"unique_chat_mode", ""},
+	"r9k":             {"unique_chat_mode", ""},
+}
+
+func (c *Connection) validateRoomSettings() error {
+	if c.RoomSettings.Topic == "" {
+		return nil
+	}
+
+	if err := c.checkHelix(); err != nil {
+		return fieldErr("topic", err)
+	}
+
+	return nil
+}
+
+// chatSettings converts the request to Helix chat settings.
+func (s *roomSetting) chatSettings() (map[string]interface{}, error) {
+	name := strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(s.Setting))
+
+	fields, ok := roomSettingFields[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", errBadRoomSetting, s.Setting)
+	}
+
+	var on bool
+	if err := json.Unmarshal(s.Value, &on); err == nil {
+		return map[string]interface{}{fields[0]: on}, nil
+	}
+
+	var n int
+	if err := json.Unmarshal(s.Value, &n); err != nil || n < 0 || fields[1] == "" {
+		return nil, errBadRoomValue
+	}
+
+	if name == "slow" && n == 0 {
+		return map[string]interface{}{fields[0]: false}, nil
+	}
+
+	return map[string]interface{}{fields[0]: true, fields[1]: n}, nil
+}
+
+// roomSettingsHandler returns an MQTT message handler which queues room
+// setting changes.
+func (c *Connection) roomSettingsHandler(queue chan<- roomSetting) mqtt.MessageHandler {
+	return func(_ mqtt.Client, mq mqtt.Message) {
+		var s roomSetting
+
+		if err := json.Unmarshal(mq.Payload(), &s); err != nil {
+			c.elog.Printf("bad payload on %s: %v", mq.Topic(), err)
+			return
+		}
+
+		s.Channel = channelName(s.Channel)
+		if s.Channel == "" {
+			c.elog.Printf("empty channel")
+			return
+		}
+
+		select {
+		case queue <- s:
+		default:
+			c.elog.Printf("room settings queue full, dropped a request")
+			c.count("queue_dropped")
+		}
+	}
+}
+
+// roomSettingsLoop applies queued room setting changes through the Helix
+// API.
+func (c *Connection) roomSettingsLoop(queue <-chan roomSetting, stop <-chan struct{}) {
+	h := c.helix()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case s := <-queue:
+			if err := c.applyRoomSetting(h, &s); err != nil {
+				c.elog.Printf("setting %s in %s failed: %v", s.Setting, s.Channel, err)
+			}
+		}
+	}
+}
+
+func (c *Connection) applyRoomSetting(h *helixClient, s *roomSetting) error {
+	settings, err := s.chatSettings()
+	if err != nil {
+		return err
+	}
+
+	broadcasterID, err := h.userID(s.Channel)
+	if err != nil {
+		return err
+	}
+
+	moderatorID, err := h.userID(c.Nick)
+	if err != nil {
+		return err
+	}
+
+	return h.updateChatSettings(broadcasterID, moderatorID, settings)
+}
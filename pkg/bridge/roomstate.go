@@ -0,0 +1,90 @@
+package bridge
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jakebailey/irc"
+)
+
+// roomState is a channel's chat settings as last reported by ROOMSTATE.
+// FollowersOnly is the required follow age in minutes, or -1 when
+// followers-only mode is off. Slow is the delay between messages in
+// seconds, or 0 when slow mode is off.
+type roomState struct {
+	Channel       string `json:"channel"`
+	RoomID        string `json:"room_id,omitempty"`
+	EmoteOnly     bool   `json:"emote_only"`
+	FollowersOnly int    `json:"followers_only"`
+	R9K           bool   `json:"r9k"`
+	Slow          int    `json:"slow"`
+	SubsOnly      bool   `json:"subs_only"`
+}
+
+// roomStates merges ROOMSTATE updates, which only carry the settings that
+// changed after the first one sent on join.
+type roomStates struct {
+	mu     sync.Mutex
+	states map[string]*roomState
+}
+
+func (c *Connection) validateRoomState() error {
+	if strings.ContainsAny(c.RoomState.Topic, "+#") {
+		return fieldErr("topic", errBadStateTopic)
+	}
+	return nil
+}
+
+// update applies m to its channel's state, returning a copy of the state
+// and whether it changed.
+func (r *roomStates) update(m *irc.Message) (roomState, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	channel := messageChannel(m)
+
+	if r.states == nil {
+		r.states = make(map[string]*roomState)
+	}
+
+	st := r.states[channel]
+	if st == nil {
+		st = &roomState{Channel: channel, FollowersOnly: -1}
+		r.states[channel] = st
+	}
+
+	old := *st
+
+	if v, ok := m.Tags["room-id"]; ok {
+		st.RoomID = v
+	}
+	if v, ok := m.Tags["emote-only"]; ok {
+		st.EmoteOnly = v == "1"
+	}
+	if v, ok := m.Tags["followers-only"]; ok {
+		if n, err := strconv.Atoi(v); err == nil {
+			st.FollowersOnly = n
+		}
+	}
+	if v, ok := m.Tags["r9k"]; ok {
+		st.R9K = v == "1"
+	}
+	if v, ok := m.Tags["slow"]; ok {
+		if n, err := strconv.Atoi(v); err == nil {
+			st.Slow = n
+		}
+	}
+	if v, ok := m.Tags["subs-only"]; ok {
+		st.SubsOnly = v == "1"
+	}
+
+	return *st, *st != old
+}
+
+// publishRoomState publishes the channel's room state, retained, to
+// RoomState.Topic/<channel>.
+func (c *Connection) publishRoomState(client MQTTClient, st roomState) {
+	topic := c.RoomState.Topic + "/" + strings.TrimPrefix(st.Channel, "#")
+	c.publishJSON(client, "room state", topic, c.RoomState.QOS, true, &st)
+}
@@ -0,0 +1,52 @@
+package bridge
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+
+	"github.com/jakebailey/irc"
+)
+
+var errBadSampleRate = errors.New("sample rate must be between 0 and 1")
+
+func (c *Connection) validateSample() error {
+	sp := &c.Publish.Sample
+
+	if sp.Rate < 0 || sp.Rate > 1 {
+		return fieldErr("rate", errBadSampleRate)
+	}
+
+	c.sampleRates = nil
+	if len(sp.Channels) == 0 {
+		return nil
+	}
+
+	c.sampleRates = make(map[string]float64, len(sp.Channels))
+	for ch, rate := range sp.Channels {
+		if rate < 0 || rate > 1 {
+			return fieldErr("channels."+ch, errBadSampleRate)
+		}
+		c.sampleRates[channelName(ch)] = rate
+	}
+
+	return nil
+}
+
+// sampled reports whether m is published under the connection's sample
+// rates, choosing chat messages at random.
+func (c *Connection) sampled(m *irc.Message) bool {
+	if m.Command != "PRIVMSG" {
+		return true
+	}
+
+	rate, ok := c.sampleRates[strings.TrimPrefix(messageChannel(m), "#")]
+	if !ok {
+		rate = c.Publish.Sample.Rate
+		if rate == 0 {
+			return true
+		}
+	}
+
+	return rand.Float64() < rate
+}
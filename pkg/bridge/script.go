@@ -0,0 +1,518 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jakebailey/irc"
+)
+
+// Scripts are expressions in Go syntax, evaluated against each message.
+// Numbers are float64s; tags is a map of the message's tags.
+var scriptVars = map[string]bool{
+	"bits":              true,
+	"channel":           true,
+	"command":           true,
+	"display_name":      true,
+	"first_msg":         true,
+	"is_action":         true,
+	"message":           true,
+	"mod":               true,
+	"nick":              true,
+	"returning_chatter": true,
+	"room_id":           true,
+	"subscriber":        true,
+	"tags":              true,
+	"topic":             true,
+	"user":              true,
+	"user_id":           true,
+	"vip":               true,
+}
+
+// scriptFuncs are the functions scripts may call, with their arity, or -1
+// for variadic functions.
+var scriptFuncs = map[string]int{
+	"cond":      3,
+	"contains":  2,
+	"hasPrefix": 2,
+	"hasSuffix": 2,
+	"len":       1,
+	"lower":     1,
+	"matches":   2,
+	"oneOf":     -1,
+	"replace":   3,
+	"str":       1,
+	"trim":      1,
+	"upper":     1,
+}
+
+var (
+	errScriptSyntax   = errors.New("unsupported expression")
+	errScriptIdent    = errors.New("unknown variable")
+	errScriptFunc     = errors.New("unknown function or wrong number of arguments")
+	errScriptType     = errors.New("mismatched types")
+	errScriptTopic    = errors.New("topic script did not return a valid topic")
+	errScriptNotOwned = errors.New("topic script returned a topic outside the tenant's prefix")
+)
+
+// script is a compiled expression.
+type script struct {
+	src  string
+	expr ast.Expr
+}
+
+// scriptEnv is the variables a script is evaluated with.
+type scriptEnv map[string]interface{}
+
+func compileScript(src string) (*script, error) {
+	expr, err := parser.ParseExpr(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkScript(expr); err != nil {
+		return nil, err
+	}
+
+	return &script{src: src, expr: expr}, nil
+}
+
+// checkScript checks that e uses only the expressions, variables, and
+// functions scripts support.
+func checkScript(e ast.Expr) error {
+	switch e := e.(type) {
+	case *ast.ParenExpr:
+		return checkScript(e.X)
+
+	case *ast.UnaryExpr:
+		return checkScript(e.X)
+
+	case *ast.BinaryExpr:
+		if err := checkScript(e.X); err != nil {
+			return err
+		}
+		return checkScript(e.Y)
+
+	case *ast.IndexExpr:
+		if err := checkScript(e.X); err != nil {
+			return err
+		}
+		return checkScript(e.Index)
+
+	case *ast.CallExpr:
+		// The function is named by an identifier, which is not a variable.
+		id, ok := e.Fun.(*ast.Ident)
+		if !ok {
+			return errScriptSyntax
+		}
+		arity, ok := scriptFuncs[id.Name]
+		if !ok || (arity >= 0 && len(e.Args) != arity) || (arity < 0 && len(e.Args) < 1) || e.Ellipsis.IsValid() {
+			return fmt.Errorf("%w: %s", errScriptFunc, id.Name)
+		}
+		for _, arg := range e.Args {
+			if err := checkScript(arg); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case *ast.BasicLit:
+		if e.Kind == token.CHAR || e.Kind == token.IMAG {
+			return errScriptSyntax
+		}
+		return nil
+
+	case *ast.Ident:
+		if e.Name == "true" || e.Name == "false" || scriptVars[e.Name] {
+			return nil
+		}
+		return fmt.Errorf("%w: %s", errScriptIdent, e.Name)
+
+	default:
+		return errScriptSyntax
+	}
+}
+
+func (s *script) eval(env scriptEnv) (interface{}, error) {
+	return evalScript(s.expr, env)
+}
+
+// evalBool evaluates the script, which must return a bool.
+func (s *script) evalBool(env scriptEnv) (bool, error) {
+	v, err := s.eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, errScriptType
+	}
+	return b, nil
+}
+
+func evalScript(e ast.Expr, env scriptEnv) (interface{}, error) {
+	switch e := e.(type) {
+	case *ast.ParenExpr:
+		return evalScript(e.X, env)
+
+	case *ast.BasicLit:
+		switch e.Kind {
+		case token.STRING:
+			return strconv.Unquote(e.Value)
+		default:
+			return strconv.ParseFloat(e.Value, 64)
+		}
+
+	case *ast.Ident:
+		switch e.Name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return env[e.Name], nil
+
+	case *ast.IndexExpr:
+		x, err := evalScript(e.X, env)
+		if err != nil {
+			return nil, err
+		}
+		key, err := evalScript(e.Index, env)
+		if err != nil {
+			return nil, err
+		}
+		m, ok1 := x.(map[string]string)
+		k, ok2 := key.(string)
+		if !ok1 || !ok2 {
+			return nil, errScriptType
+		}
+		return m[k], nil
+
+	case *ast.UnaryExpr:
+		x, err := evalScript(e.X, env)
+		if err != nil {
+			return nil, err
+		}
+		switch e.Op {
+		case token.NOT:
+			if b, ok := x.(bool); ok {
+				return !b, nil
+			}
+		case token.SUB:
+			if f, ok := x.(float64); ok {
+				return -f, nil
+			}
+		}
+		return nil, errScriptType
+
+	case *ast.BinaryExpr:
+		return evalBinary(e, env)
+
+	case *ast.CallExpr:
+		args := make([]interface{}, len(e.Args))
+		for i, arg := range e.Args {
+			v, err := evalScript(arg, env)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = v
+		}
+		return callScript(e.Fun.(*ast.Ident).Name, args)
+	}
+
+	return nil, errScriptSyntax
+}
+
+func evalBinary(e *ast.BinaryExpr, env scriptEnv) (interface{}, error) {
+	x, err := evalScript(e.X, env)
+	if err != nil {
+		return nil, err
+	}
+
+	// && and || short circuit.
+	if e.Op == token.LAND || e.Op == token.LOR {
+		b, ok := x.(bool)
+		if !ok {
+			return nil, errScriptType
+		}
+		if (e.Op == token.LAND) != b {
+			return b, nil
+		}
+		y, err := evalScript(e.Y, env)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := y.(bool); !ok {
+			return nil, errScriptType
+		}
+		return y, nil
+	}
+
+	y, err := evalScript(e.Y, env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.Op {
+	case token.EQL:
+		return x == y, nil
+	case token.NEQ:
+		return x != y, nil
+	}
+
+	switch x := x.(type) {
+	case string:
+		y, ok := y.(string)
+		if !ok {
+			return nil, errScriptType
+		}
+		switch e.Op {
+		case token.ADD:
+			return x + y, nil
+		case token.LSS:
+			return x < y, nil
+		case token.LEQ:
+			return x <= y, nil
+		case token.GTR:
+			return x > y, nil
+		case token.GEQ:
+			return x >= y, nil
+		}
+
+	case float64:
+		y, ok := y.(float64)
+		if !ok {
+			return nil, errScriptType
+		}
+		switch e.Op {
+		case token.ADD:
+			return x + y, nil
+		case token.SUB:
+			return x - y, nil
+		case token.MUL:
+			return x * y, nil
+		case token.QUO:
+			return x / y, nil
+		case token.LSS:
+			return x < y, nil
+		case token.LEQ:
+			return x <= y, nil
+		case token.GTR:
+			return x > y, nil
+		case token.GEQ:
+			return x >= y, nil
+		}
+	}
+
+	return nil, errScriptType
+}
+
+// scriptRegexps caches the patterns passed to matches.
+var scriptRegexps sync.Map
+
+func callScript(name string, args []interface{}) (interface{}, error) {
+	if name == "cond" {
+		b, ok := args[0].(bool)
+		if !ok {
+			return nil, errScriptType
+		}
+		if b {
+			return args[1], nil
+		}
+		return args[2], nil
+	}
+
+	if name == "oneOf" {
+		for _, a := range args[1:] {
+			if a == args[0] {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	if name == "str" {
+		switch v := args[0].(type) {
+		case string:
+			return v, nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		default:
+			return fmt.Sprint(v), nil
+		}
+	}
+
+	strs := make([]string, len(args))
+	for i, a := range args {
+		s, ok := a.(string)
+		if !ok {
+			return nil, errScriptType
+		}
+		strs[i] = s
+	}
+
+	switch name {
+	case "contains":
+		return strings.Contains(strs[0], strs[1]), nil
+	case "hasPrefix":
+		return strings.HasPrefix(strs[0], strs[1]), nil
+	case "hasSuffix":
+		return strings.HasSuffix(strs[0], strs[1]), nil
+	case "len":
+		return float64(len([]rune(strs[0]))), nil
+	case "lower":
+		return strings.ToLower(strs[0]), nil
+	case "upper":
+		return strings.ToUpper(strs[0]), nil
+	case "trim":
+		return strings.TrimSpace(strs[0]), nil
+	case "replace":
+		return strings.ReplaceAll(strs[0], strs[1], strs[2]), nil
+	case "matches":
+		var re *regexp.Regexp
+		if v, ok := scriptRegexps.Load(strs[1]); ok {
+			re = v.(*regexp.Regexp)
+		} else {
+			var err error
+			if re, err = regexp.Compile(strs[1]); err != nil {
+				return nil, err
+			}
+			scriptRegexps.Store(strs[1], re)
+		}
+		return re.MatchString(strs[0]), nil
+	}
+
+	return nil, errScriptFunc
+}
+
+// connScripts are a connection's compiled publish scripts.
+type connScripts struct {
+	drop   *script
+	topic  *script
+	fields map[string]*script
+	names  []string // of fields, sorted
+}
+
+func (c *Connection) validateScript() error {
+	sc := &c.Publish.Script
+	c.scripts = nil
+
+	if sc.Drop == "" && sc.Topic == "" && len(sc.Fields) == 0 {
+		return nil
+	}
+
+	s := &connScripts{}
+
+	var err error
+	if sc.Drop != "" {
+		if s.drop, err = compileScript(sc.Drop); err != nil {
+			return fieldErr("drop", err)
+		}
+	}
+
+	if sc.Topic != "" {
+		if s.topic, err = compileScript(sc.Topic); err != nil {
+			return fieldErr("topic", err)
+		}
+	}
+
+	if len(sc.Fields) > 0 {
+		s.fields = make(map[string]*script, len(sc.Fields))
+		for name, src := range sc.Fields {
+			if s.fields[name], err = compileScript(src); err != nil {
+				return fieldErr("fields."+name, err)
+			}
+			s.names = append(s.names, name)
+		}
+		sort.Strings(s.names)
+	}
+
+	c.scripts = s
+	return nil
+}
+
+// scriptEnv returns the variables scripts see for m, to be published to
+// topic.
+func (c *Connection) scriptEnv(m *irc.Message, topic string) scriptEnv {
+	p := parseMessage(m)
+	return scriptEnv{
+		"bits":              float64(p.Bits),
+		"channel":           p.Channel,
+		"command":           p.Command,
+		"display_name":      p.DisplayName,
+		"first_msg":         p.FirstMessage,
+		"is_action":         p.IsAction,
+		"message":           p.Message,
+		"mod":               p.Mod,
+		"nick":              c.Nick,
+		"returning_chatter": p.ReturningChatter,
+		"room_id":           p.RoomID,
+		"subscriber":        p.Subscriber,
+		"tags":              m.Tags,
+		"topic":             topic,
+		"user":              p.User,
+		"user_id":           p.UserID,
+		"vip":               p.VIP,
+	}
+}
+
+// runScripts evaluates the connection's scripts for m, returning the topic
+// to publish it to and any derived fields, or false if it should be
+// dropped. Scripts which fail are logged and otherwise ignored.
+func (c *Connection) runScripts(m *irc.Message, topic string) (string, map[string]interface{}, bool) {
+	s := c.scripts
+	if s == nil {
+		return topic, nil, true
+	}
+
+	env := c.scriptEnv(m, topic)
+
+	if s.drop != nil {
+		drop, err := s.drop.evalBool(env)
+		if err != nil {
+			c.elog.Printf("drop script: %v", err)
+		} else if drop {
+			c.count("script_dropped")
+			return "", nil, false
+		}
+	}
+
+	if s.topic != nil && topic != "" {
+		v, err := s.topic.eval(env)
+		t, ok := v.(string)
+		switch {
+		case err != nil:
+			c.elog.Printf("topic script: %v", err)
+		case !ok || t == "" || strings.ContainsAny(t, "+#"):
+			c.elog.Printf("topic script: %v", errScriptTopic)
+		case !c.tenant.owns(t):
+			c.elog.Printf("topic script: %v", errScriptNotOwned)
+		default:
+			topic = t
+			env["topic"] = t
+		}
+	}
+
+	var fields map[string]interface{}
+	if len(s.names) > 0 {
+		fields = make(map[string]interface{}, len(s.names))
+		for _, name := range s.names {
+			v, err := s.fields[name].eval(env)
+			if err != nil {
+				c.elog.Printf("field script %s: %v", name, err)
+				continue
+			}
+			fields[name] = v
+		}
+	}
+
+	return topic, fields, true
+}
@@ -0,0 +1,195 @@
+package bridge
+
+import (
+	"errors"
+	"testing"
+)
+
+var testScriptEnv = scriptEnv{
+	"bits":         float64(100),
+	"channel":      "foo",
+	"command":      "PRIVMSG",
+	"display_name": "Alice",
+	"message":      "Hello World",
+	"mod":          true,
+	"subscriber":   false,
+	"tags":         map[string]string{"color": "#FF0000"},
+	"user":         "alice",
+}
+
+func TestScriptEval(t *testing.T) {
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		// Literals and variables.
+		{`"hi"`, "hi"},
+		{`42`, float64(42)},
+		{`1.5`, 1.5},
+		{`true`, true},
+		{`false`, false},
+		{`user`, "alice"},
+		{`bits`, float64(100)},
+		{`tags["color"]`, "#FF0000"},
+		{`tags["missing"]`, ""},
+		{`(user)`, "alice"},
+
+		// Operators.
+		{`1 + 2 * 3`, float64(7)},
+		{`(1 + 2) * 3`, float64(9)},
+		{`10 / 4`, 2.5},
+		{`10 - 4`, float64(6)},
+		{`-bits`, float64(-100)},
+		{`"a" + "b"`, "ab"},
+		{`bits > 50`, true},
+		{`bits <= 50`, false},
+		{`bits >= 100`, true},
+		{`bits < 100`, false},
+		{`"a" < "b"`, true},
+		{`user == "alice"`, true},
+		{`user != "alice"`, false},
+		{`bits == "100"`, false},
+		{`!mod`, false},
+		{`mod && !subscriber`, true},
+		{`subscriber || mod`, true},
+		{`subscriber && mod`, false},
+
+		// && and || short circuit, so the right side isn't evaluated.
+		{`false && tags["x"] + 1`, false},
+		{`true || tags["x"] + 1`, true},
+
+		// Calls.
+		{`contains(message, "World")`, true},
+		{`contains(lower(message), "world")`, true},
+		{`hasPrefix(message, "Hello")`, true},
+		{`hasSuffix(message, "Hello")`, false},
+		{`lower(display_name)`, "alice"},
+		{`upper(user)`, "ALICE"},
+		{`trim("  x  ")`, "x"},
+		{`replace(message, "World", "there")`, "Hello there"},
+		{`len("héllo")`, float64(5)},
+		{`len(trim(upper(" ab ")))`, float64(2)},
+		{`matches(message, "^H.*d$")`, true},
+		{`oneOf(channel, "bar", "foo")`, true},
+		{`oneOf(channel, "bar")`, false},
+		{`cond(mod, "mod", "user")`, "mod"},
+		{`cond(subscriber, "sub", lower(user))`, "alice"},
+		{`str(bits)`, "100"},
+		{`str(1.5)`, "1.5"},
+		{`str(mod)`, "true"},
+		{`str(user)`, "alice"},
+		{`"channel/" + channel + "/" + str(bits)`, "channel/foo/100"},
+	}
+
+	for _, test := range tests {
+		s, err := compileScript(test.src)
+		if err != nil {
+			t.Errorf("compileScript(%s): %v", test.src, err)
+			continue
+		}
+
+		got, err := s.eval(testScriptEnv)
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+			continue
+		}
+
+		if got != test.want {
+			t.Errorf("%s = %#v, want %#v", test.src, got, test.want)
+		}
+	}
+}
+
+func TestScriptCompileErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want error
+	}{
+		{`unknown`, errScriptIdent},
+		{`contains(unknown, "x")`, errScriptIdent},
+		{`lower(upper(unknown))`, errScriptIdent},
+		{`user == nope`, errScriptIdent},
+		{`tags[nope]`, errScriptIdent},
+		{`frobnicate(user)`, errScriptFunc},
+		{`contains(user)`, errScriptFunc},
+		{`contains(lower(user, user), "x")`, errScriptFunc},
+		{`oneOf()`, errScriptFunc},
+		{`lower(user...)`, errScriptFunc},
+		{`strings.ToLower(user)`, errScriptSyntax},
+		{`'x'`, errScriptSyntax},
+		{`1i`, errScriptSyntax},
+		{`user.name`, errScriptSyntax},
+		{`func() {}`, errScriptSyntax},
+		{`tags["a":"b"]`, errScriptSyntax},
+		{`contains(user, 'x')`, errScriptSyntax},
+	}
+
+	for _, test := range tests {
+		_, err := compileScript(test.src)
+		if !errors.Is(err, test.want) {
+			t.Errorf("compileScript(%s) = %v, want %v", test.src, err, test.want)
+		}
+	}
+
+	if _, err := compileScript(`user ==`); err == nil {
+		t.Error("compileScript of a parse error succeeded")
+	}
+}
+
+func TestScriptTypeErrors(t *testing.T) {
+	tests := []string{
+		`user + 1`,
+		`bits + "x"`,
+		`!user`,
+		`-user`,
+		`user && mod`,
+		`mod && user`,
+		`user < 1`,
+		`mod < true`,
+		`bits % 2`,
+		`user[0]`,
+		`tags[1]`,
+		`lower(bits)`,
+		`contains(user, mod)`,
+		`cond(user, 1, 2)`,
+	}
+
+	for _, src := range tests {
+		s, err := compileScript(src)
+		if err != nil {
+			t.Errorf("compileScript(%s): %v", src, err)
+			continue
+		}
+		if _, err := s.eval(testScriptEnv); !errors.Is(err, errScriptType) {
+			t.Errorf("%s: got error %v, want %v", src, err, errScriptType)
+		}
+	}
+}
+
+func TestScriptEvalBool(t *testing.T) {
+	s, err := compileScript(`user`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.evalBool(testScriptEnv); !errors.Is(err, errScriptType) {
+		t.Errorf("evalBool of a string: got error %v, want %v", err, errScriptType)
+	}
+
+	s, err = compileScript(`mod && bits > 10`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := s.evalBool(testScriptEnv); err != nil || !b {
+		t.Errorf("evalBool = %v, %v, want true", b, err)
+	}
+}
+
+func TestScriptMatchesBadPattern(t *testing.T) {
+	s, err := compileScript(`matches(user, "(")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.eval(testScriptEnv); err == nil {
+		t.Error("matches with an invalid pattern succeeded")
+	}
+}
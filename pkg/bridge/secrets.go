@@ -0,0 +1,175 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+var (
+	errSecretConflict = errors.New("value and file are both set")
+	errUndefinedEnv   = errors.New("undefined environment variable")
+)
+
+var envRefRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${NAME} references in the string fields of the
+// decoded config v, a pointer, with the named environment variables. Only
+// decoded strings are expanded, so a value can't change the structure of
+// the config, and references in comments are ignored. Unlike os.Expand,
+// bare $NAME is left alone, and undefined variables are an error rather
+// than silently empty.
+func expandEnv(v interface{}) error {
+	return expandEnvValue(reflect.ValueOf(v))
+}
+
+func expandEnvValue(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return nil
+		}
+		return expandEnvValue(v.Elem())
+
+	case reflect.Interface:
+		if v.IsNil() || !v.CanSet() {
+			return nil
+		}
+		e := reflect.New(v.Elem().Type()).Elem()
+		e.Set(v.Elem())
+		if err := expandEnvValue(e); err != nil {
+			return err
+		}
+		v.Set(e)
+
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.CanSet() {
+				if err := expandEnvValue(f); err != nil {
+					return err
+				}
+			}
+		}
+
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandEnvValue(v.Index(i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		// Map values can't be set in place, so are expanded in a copy.
+		iter := v.MapRange()
+		for iter.Next() {
+			e := reflect.New(iter.Value().Type()).Elem()
+			e.Set(iter.Value())
+			if err := expandEnvValue(e); err != nil {
+				return err
+			}
+			v.SetMapIndex(iter.Key(), e)
+		}
+
+	case reflect.String:
+		s, err := expandEnvString(v.String())
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	}
+
+	return nil
+}
+
+func expandEnvString(s string) (string, error) {
+	var err error
+
+	s = envRefRe.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envRefRe.FindStringSubmatch(ref)[1]
+
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("%w: %s", errUndefinedEnv, name)
+			}
+			return ref
+		}
+
+		return v
+	})
+
+	return s, err
+}
+
+// resolveSecrets reads secrets kept in separate files into the config.
+// Relative paths are relative to dir.
+func (c *Config) resolveSecrets(dir string) error {
+	for i, b := range c.Brokers {
+		if err := resolveSecret(dir, "password_file", &b.Password, b.PasswordFile); err != nil {
+			return fieldErr(fmt.Sprintf("brokers[%d]", i), err)
+		}
+	}
+
+	for i, conn := range c.Connections {
+		if err := conn.resolveSecrets(dir); err != nil {
+			return fieldErr(fmt.Sprintf("connections[%d]", i), err)
+		}
+	}
+	return nil
+}
+
+func (c *Connection) resolveSecrets(dir string) error {
+	secrets := []struct {
+		field string
+		value *string
+		path  string
+	}{
+		{"nick_file", &c.Nick, c.NickFile},
+		{"pass_file", &c.Pass, c.PassFile},
+		{"oauth.client_secret_file", &c.OAuth.ClientSecret, c.OAuth.ClientSecretFile},
+		{"oauth.refresh_token_file", &c.OAuth.RefreshToken, c.OAuth.RefreshTokenFile},
+	}
+
+	for _, s := range secrets {
+		if err := resolveSecret(dir, s.field, s.value, s.path); err != nil {
+			return err
+		}
+	}
+
+	for i, b := range c.Brokers {
+		if err := resolveSecret(dir, fmt.Sprintf("brokers[%d].password_file", i), &b.Password, b.PasswordFile); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolveSecret reads the file at path, if set, into value, which must not
+// also be set.
+func resolveSecret(dir, field string, value *string, path string) error {
+	if path == "" {
+		return nil
+	}
+
+	if *value != "" {
+		return fieldErr(field, errSecretConflict)
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fieldErr(field, err)
+	}
+
+	*value = strings.TrimSpace(string(b))
+	return nil
+}
@@ -0,0 +1,77 @@
+package bridge
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigExpandsEnv(t *testing.T) {
+	t.Setenv("TWITCHMQTT_TEST_PASS", "oauth:abc\"\ndef: ghi")
+	t.Setenv("TWITCHMQTT_TEST_CHANNEL", "foo")
+
+	tests := []struct {
+		name, content string
+	}{
+		{"config.yaml", `
+# Neither ${TWITCHMQTT_TEST_UNDEFINED} in a comment nor a bare $HOME is expanded.
+connections:
+- nick: bot
+  pass: ${TWITCHMQTT_TEST_PASS}
+  publish:
+    topic: twitch/$HOME/${TWITCHMQTT_TEST_CHANNEL}
+    channels: ["${TWITCHMQTT_TEST_CHANNEL}"]
+`},
+		{"config.json", `{
+  "connections": [{
+    "nick": "bot",
+    "pass": "${TWITCHMQTT_TEST_PASS}",
+    "publish": {
+      "topic": "twitch/$HOME/${TWITCHMQTT_TEST_CHANNEL}",
+      "channels": ["${TWITCHMQTT_TEST_CHANNEL}"]
+    }
+  }]
+}`},
+	}
+
+	for _, test := range tests {
+		config, err := LoadConfig(writeConfig(t, test.name, test.content))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		c := config.Connections[0]
+		if c.Pass != "oauth:abc\"\ndef: ghi" {
+			t.Errorf("%s: pass = %q", test.name, c.Pass)
+		}
+		if c.Publish.Topic != "twitch/$HOME/foo" {
+			t.Errorf("%s: topic = %q", test.name, c.Publish.Topic)
+		}
+		if len(c.Publish.Channels) != 1 || c.Publish.Channels[0] != "#foo" {
+			t.Errorf("%s: channels = %q", test.name, c.Publish.Channels)
+		}
+	}
+}
+
+func TestLoadConfigUndefinedEnv(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+connections:
+- nick: bot
+  pass: ${TWITCHMQTT_TEST_UNDEFINED}
+`)
+
+	if _, err := LoadConfig(path); !errors.Is(err, errUndefinedEnv) {
+		t.Errorf("got error %v, want %v", err, errUndefinedEnv)
+	}
+}
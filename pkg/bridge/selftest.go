@@ -0,0 +1,276 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jakebailey/irc"
+)
+
+const selfTestUser = "selftest"
+
+var (
+	errSelfTestNotPublished = errors.New("chat read from IRC was not published")
+	errSelfTestNotSent      = errors.New("message from the subscribe topic was not sent to IRC")
+	errSelfTestNoSubscriber = errors.New("nothing subscribed to the subscribe topic")
+	errSelfTestNotDialed    = errors.New("connection did not dial IRC")
+)
+
+// SelfTest runs each of the config's connections, which must already be
+// validated, against an in-memory IRC server and MQTT broker, checking
+// that chat read from IRC is published and that messages on the subscribe
+// topic are sent, as far as each connection does either. Nothing connects
+// to Twitch or a broker, and the config is left as it is. Each check is
+// logged, and the errors of those which failed are returned.
+func SelfTest(config *Config, timeout time.Duration) error {
+	sandbox, err := config.selfTestCopy()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i, c := range sandbox.Connections {
+		if err := c.selfTest(timeout); err != nil {
+			errs = append(errs, fieldErr(fmt.Sprintf("connections[%d]", i), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// selfTestCopy returns a validated copy of the config whose connections
+// keep off Twitch and everything else outside the self-test: they refresh
+// no tokens, make no Helix, third party emote, or EventSub calls, use no
+// proxy, and run a single shard.
+func (c *Config) selfTestCopy() (*Config, error) {
+	sandbox, err := c.clone()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, conn := range sandbox.Connections {
+		if conn.OAuth != (OAuthConfig{}) {
+			if conn.ClientID == "" {
+				conn.ClientID = conn.OAuth.ClientID
+			}
+			conn.OAuth = OAuthConfig{}
+			conn.Pass = "oauth:" + selfTestUser
+		}
+		conn.Proxy = ""
+		conn.Publish.Enrich.Enabled = false
+		conn.Publish.ThirdPartyEmotes.Enabled = false
+		conn.EventSub.Topic = ""
+		conn.Moderation.Topic = ""
+		conn.RoomSettings.Topic = ""
+		conn.Whisper.SendTopic = ""
+		conn.Shard.Channels = 0
+
+		// Validation already routed whispers to their topic.
+		conn.Whisper.Topic = ""
+	}
+
+	if err := sandbox.Validate(); err != nil {
+		return nil, err
+	}
+	return sandbox, nil
+}
+
+func (c *Connection) selfTest(timeout time.Duration) error {
+	dialer := newFakeDialer()
+	c.dial = dialer.dial
+
+	mq := newFakeMQTT()
+	mq.lossy = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.run(ctx, mq)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	var f *fakeIRC
+	select {
+	case f = <-dialer.Conns:
+	case <-time.After(timeout):
+		return fieldErr("connect", errSelfTestNotDialed)
+	}
+
+	sent := make(chan *irc.Message, 16)
+	go serveSelfTest(f, sent)
+
+	channel := "#" + selfTestUser
+	if len(c.Publish.Channels) > 0 {
+		channel = "#" + strings.TrimPrefix(c.Publish.Channels[0], "#")
+	}
+
+	var errs []error
+	check := func(step, skipped string, run func() error) {
+		if skipped != "" {
+			c.log.Info().Str("check", step).Str("reason", skipped).Msg("self-test skipped")
+			return
+		}
+		if err := run(); err != nil {
+			c.log.Error().Err(err).Str("check", step).Msg("self-test failed")
+			errs = append(errs, fieldErr(step, err))
+			return
+		}
+		c.log.Info().Str("check", step).Msg("self-test passed")
+	}
+
+	readSkipped := ""
+	switch {
+	case !c.publishes() || !c.canRead():
+		readSkipped = "connection does not publish"
+	case len(c.Publish.Channels) == 0:
+		readSkipped = "no channels to read"
+	}
+	check("read", readSkipped, func() error {
+		return c.selfTestRead(mq, f, channel, timeout)
+	})
+
+	writeSkipped := ""
+	switch {
+	case c.Subscribe.Topic == "" || !c.canWrite():
+		writeSkipped = "connection does not send"
+	case c.Subscribe.Transport == transportHelix:
+		writeSkipped = "messages are sent through Helix"
+	}
+	check("write", writeSkipped, func() error {
+		return c.selfTestWrite(mq, sent, channel, timeout)
+	})
+
+	return errors.Join(errs...)
+}
+
+// serveSelfTest plays the part of the IRC server, confirming joins and
+// answering pings, and passes on the chat messages the bridge sends.
+func serveSelfTest(f *fakeIRC, sent chan<- *irc.Message) {
+	nick := ""
+
+	for {
+		var m *irc.Message
+		select {
+		case l := <-f.out:
+			m = l.m
+		case <-f.closed:
+			return
+		}
+
+		switch m.Command {
+		case "NICK":
+			nick = m.Params[0]
+		case "JOIN":
+			for _, ch := range strings.Split(m.Params[0], ",") {
+				f.Send(&irc.Message{
+					Prefix:  irc.Prefix{Name: nick, User: nick, Host: nick + ".tmi.twitch.tv"},
+					Command: "JOIN",
+					Params:  []string{ch},
+				})
+			}
+		case "PING":
+			f.Send(&irc.Message{Command: "PONG", Params: m.Params, Trailing: m.Trailing})
+		case "PRIVMSG":
+			select {
+			case sent <- m:
+			default:
+			}
+		}
+	}
+}
+
+// selfTestText returns a chat message which can be told apart from any
+// other.
+func selfTestText() string {
+	return fmt.Sprintf("twitchmqtt self-test %d", rand.Int63())
+}
+
+// selfTestRead sends a chat message from the fake server and waits for it
+// to be published.
+func (c *Connection) selfTestRead(mq *fakeMQTT, f *fakeIRC, channel string, timeout time.Duration) error {
+	text := selfTestText()
+	now := time.Now()
+
+	err := f.Send(&irc.Message{
+		Tags: map[string]string{
+			"id":           strconv.FormatInt(now.UnixNano(), 36),
+			"display-name": selfTestUser,
+			"user-id":      "1",
+			"tmi-sent-ts":  strconv.FormatInt(now.UnixMilli(), 10),
+		},
+		Prefix:   irc.Prefix{Name: selfTestUser, User: selfTestUser, Host: selfTestUser + ".tmi.twitch.tv"},
+		Command:  "PRIVMSG",
+		Params:   []string{channel},
+		Trailing: text,
+	})
+	if err != nil {
+		return err
+	}
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case m := <-mq.published:
+			payload, err := uncompress(m.payload)
+			if err != nil {
+				return err
+			}
+			if strings.Contains(string(payload), text) {
+				c.log.Debug().Str("topic", m.topic).Msg("self-test message published")
+				return nil
+			}
+		case <-deadline:
+			return errSelfTestNotPublished
+		}
+	}
+}
+
+// selfTestWrite delivers a message to the subscribe topic and waits for it
+// to be sent to the fake server.
+func (c *Connection) selfTestWrite(mq *fakeMQTT, sent <-chan *irc.Message, channel string, timeout time.Duration) error {
+	text := selfTestText()
+
+	payload := []byte(text)
+	if !c.channelFromTopic() {
+		var err error
+		payload, err = json.Marshal(map[string]string{"channel": channel, "message": text})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Make a topic the subscription matches, with the channel in place of
+	// any wildcards.
+	levels := strings.Split(c.Subscribe.Topic, "/")
+	for i, l := range levels {
+		if l == "+" || l == "#" {
+			levels[i] = strings.TrimPrefix(channel, "#")
+		}
+	}
+	topic := strings.Join(levels, "/")
+
+	if mq.Deliver(topic, payload) == 0 {
+		return errSelfTestNoSubscriber
+	}
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case m := <-sent:
+			if strings.Contains(m.Trailing, text) {
+				return nil
+			}
+		case <-deadline:
+			return errSelfTestNotSent
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package bridge
+
+import (
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestSelfTestLeavesConfig(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+connections:
+- nick: bot
+  proxy: socks5://localhost:1080
+  oauth:
+    client_id: id
+    client_secret: secret
+    refresh_token: token
+  publish:
+    topic: twitch/chat
+    format: parsed
+    channels: [foo]
+    enrich:
+      enabled: true
+    third_party_emotes:
+      enabled: true
+  subscribe:
+    topic: twitch/send
+  whisper:
+    topic: twitch/whispers
+    send_topic: twitch/whisper
+  moderation:
+    topic: twitch/mod
+    reply_topic: twitch/mod/reply
+  room_settings:
+    topic: twitch/settings
+  eventsub:
+    topic: twitch/eventsub
+    types: [stream.online]
+  shard:
+    channels: 1
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SelfTest(config, testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Errorf("config changed from\n%s\nto\n%s", before, after)
+	}
+
+	c := config.Connections[0]
+	if c.token == nil {
+		t.Error("token source was removed")
+	}
+	if c.dial != nil {
+		t.Error("dialer was replaced")
+	}
+
+	sandbox, err := config.selfTestCopy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sandbox.Connections[0]
+	if s.token != nil || s.enricher != nil || s.emoteSets != nil || s.Proxy != "" {
+		t.Error("self-test copy calls out to Twitch")
+	}
+	if s.EventSub.Topic != "" || s.Moderation.Topic != "" || s.RoomSettings.Topic != "" || s.Whisper.SendTopic != "" {
+		t.Error("self-test copy makes Helix calls")
+	}
+	if s.Publish.Routes["WHISPER"] != "twitch/whispers" {
+		t.Errorf("self-test copy routes whispers to %q", s.Publish.Routes["WHISPER"])
+	}
+}
@@ -0,0 +1,507 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jakebailey/irc"
+)
+
+const defaultSendQueue = 32
+
+// commandPriority is the default send priority of chat commands, so that
+// moderation like /timeout isn't stuck behind queued chat.
+const commandPriority = 1
+
+const (
+	overflowDropNewest = "drop-newest"
+	overflowDropOldest = "drop-oldest"
+)
+
+var (
+	errBadRateLimit = errors.New("invalid rate limit")
+	errBadOverflow  = errors.New("overflow must be drop-newest or drop-oldest")
+)
+
+// Twitch's chat limits, in messages per 30 seconds, by account class.
+var rateLimitClasses = map[string]int{
+	"regular":  20,
+	"known":    50,
+	"verified": 7500,
+}
+
+const rateLimitPeriod = 30 * time.Second
+
+// RateLimit is a connection's outbound message limit.
+type RateLimit struct {
+	Class    string        `yaml:",omitempty"`
+	Messages int           `yaml:",omitempty"`
+	Period   time.Duration `yaml:",omitempty"`
+	Queue    int           `yaml:",omitempty"`
+	Overflow string        `yaml:",omitempty"`
+}
+
+func (c *Connection) validateRateLimit() error {
+	rl := &c.RateLimit
+
+	if rl.Class != "" {
+		if _, ok := rateLimitClasses[rl.Class]; !ok {
+			return errBadRateLimit
+		}
+	}
+
+	if rl.Messages < 0 || rl.Period < 0 || rl.Queue < 0 {
+		return errBadRateLimit
+	}
+
+	if (rl.Messages == 0) != (rl.Period == 0) {
+		return errBadRateLimit
+	}
+
+	switch rl.Overflow {
+	case "", overflowDropNewest, overflowDropOldest:
+	default:
+		return errBadOverflow
+	}
+
+	return nil
+}
+
+// newLimiter returns the connection's outbound rate limiter. Explicit
+// limits take precedence over the account class, which defaults to
+// regular.
+func (c *Connection) newLimiter() *limiter {
+	if c.RateLimit.Messages > 0 {
+		return newLimiter(c.RateLimit.Messages, c.RateLimit.Period)
+	}
+
+	class := c.RateLimit.Class
+	if class == "" {
+		class = "regular"
+	}
+
+	return newLimiter(rateLimitClasses[class], rateLimitPeriod)
+}
+
+func (c *Connection) newSendQueue() *sendQueue {
+	size := c.RateLimit.Queue
+	if size == 0 {
+		size = defaultSendQueue
+	}
+
+	overflow := c.RateLimit.Overflow
+	if overflow == "" {
+		overflow = overflowDropNewest
+	}
+
+	return &sendQueue{
+		max:      size,
+		overflow: overflow,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// sendItem is a message waiting to be sent, with its priority and the QOS
+// and retain flag to publish its delivery result with.
+type sendItem struct {
+	m        *irc.Message
+	priority int
+	qos      byte
+	retain   bool
+
+	// action, if set, is an announcement or shoutout made through Helix,
+	// for which m stands in.
+	action *helixAction
+
+	// notBefore, if set, is when the message may next be sent. Until then
+	// it is passed over for later messages.
+	notBefore time.Time
+}
+
+// sendQueue is a bounded queue of messages waiting to be sent, in order of
+// priority and then arrival.
+type sendQueue struct {
+	mu       sync.Mutex
+	items    []sendItem
+	max      int
+	overflow string
+	notify   chan struct{}
+}
+
+// push adds it to the queue, returning false if a message was dropped
+// because the queue was full. Only messages of the lowest priority, which
+// may be it, are dropped.
+func (q *sendQueue) push(it sendItem) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ok := true
+	if len(q.items) >= q.max {
+		ok = false
+
+		lowest := q.items[len(q.items)-1].priority
+		if it.priority < lowest || (it.priority == lowest && q.overflow != overflowDropOldest) {
+			return false
+		}
+
+		drop := len(q.items) - 1
+		if q.overflow == overflowDropOldest {
+			for drop > 0 && q.items[drop-1].priority == lowest {
+				drop--
+			}
+		}
+		q.items = append(q.items[:drop], q.items[drop+1:]...)
+	}
+
+	q.insert(it)
+	return ok
+}
+
+// deferUntil puts it back on the queue to be sent no sooner than at. It was
+// already accepted, so it is never dropped for being over the limit.
+func (q *sendQueue) deferUntil(it sendItem, at time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	it.notBefore = at
+	q.insert(it)
+}
+
+// insert adds it after every item of the same or higher priority, and wakes
+// pop. q.mu must be held.
+func (q *sendQueue) insert(it sendItem) {
+	i := len(q.items)
+	for i > 0 && q.items[i-1].priority < it.priority {
+		i--
+	}
+	q.items = append(q.items, sendItem{})
+	copy(q.items[i+1:], q.items[i:])
+	q.items[i] = it
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *sendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// pop waits for a message which may be sent now, returning false if stop
+// was closed first.
+func (q *sendQueue) pop(stop <-chan struct{}) (sendItem, bool) {
+	for {
+		now := time.Now()
+		var next time.Time
+
+		q.mu.Lock()
+		for i, it := range q.items {
+			if it.notBefore.After(now) {
+				if next.IsZero() || it.notBefore.Before(next) {
+					next = it.notBefore
+				}
+				continue
+			}
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			q.mu.Unlock()
+			return it, true
+		}
+		q.mu.Unlock()
+
+		var due <-chan time.Time
+		var t *time.Timer
+		if !next.IsZero() {
+			t = time.NewTimer(next.Sub(now))
+			due = t.C
+		}
+
+		select {
+		case <-q.notify:
+		case <-due:
+		case <-stop:
+			return sendItem{}, false
+		}
+
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
+
+// sendLoop sends queued messages over conn, or through Helix, as fast as
+// the connection's and tenant's rate limits allow.
+func (c *Connection) sendLoop(queue *sendQueue, conn *sharedConn, client MQTTClient, stop <-chan struct{}) {
+	lim, modLim := c.newLimiter(), c.newModLimiter()
+	dups := c.newDuplicates()
+
+	c.mu.Lock()
+	c.sendLim, c.modLim = lim, modLim
+	c.mu.Unlock()
+
+	var h *helixClient
+	if c.Subscribe.Transport == transportHelix {
+		h = c.helix()
+	}
+
+	// Announcements and shoutouts go through Helix regardless of the
+	// transport.
+	ah := h
+
+	for {
+		it, ok := queue.pop(stop)
+		if !ok {
+			return
+		}
+		m := it.m
+
+		text := m.Trailing
+		if it.action != nil {
+			text = it.action.Message
+		} else if t, ok := unwrapAction(text); ok {
+			text = t
+		}
+		if c.blocked(client, messageChannel(m), "", text) {
+			continue
+		}
+
+		if dups != nil && it.action == nil {
+			wait, ok := dups.check(m)
+			if !ok {
+				c.log.Debug().Str("channel", messageChannel(m)).Msg("skipping duplicate message")
+				c.count("send_duplicate")
+				continue
+			}
+			if wait > 0 {
+				// Let other messages go ahead rather than holding up the
+				// whole queue.
+				queue.deferUntil(it, time.Now().Add(wait))
+				continue
+			}
+		}
+
+		// Twitch allows more messages in channels the account moderates.
+		l := lim
+		if modLim != nil && c.users.moderates(messageChannel(m)) {
+			l = modLim
+		}
+
+		if !waitAll(stop, l, c.tenant.limiter) {
+			return
+		}
+
+		if c.dryRun() {
+			c.log.Info().Str("raw", m.String()).Msg("dry run: not sending")
+			c.count("dry_run")
+			continue
+		}
+
+		c.log.Debug().Str("raw", m.String()).Msg("sending")
+
+		var err error
+		switch {
+		case it.action != nil:
+			if ah == nil {
+				ah = c.helix()
+			}
+			err = c.sendAction(ah, client, it)
+		case h != nil:
+			err = c.sendHelix(h, client, it)
+		default:
+			tagNonce(m)
+			err = conn.Encode(m)
+		}
+
+		if err != nil {
+			c.elog.Printf("send failed: %v", err)
+			continue
+		}
+
+		if dups != nil && it.action == nil {
+			dups.sent(m)
+		}
+
+		c.count("sent")
+		c.stats.sent.Add(1)
+	}
+}
+
+// isChatCommand reports whether text is a chat command, like /timeout.
+func isChatCommand(text string) bool {
+	return strings.HasPrefix(text, "/") || strings.HasPrefix(text, ".")
+}
+
+// channelFromTopic reports whether the subscribe topic ends in a single
+// level wildcard, in which case that level of each message's topic is its
+// channel and the payload is the plain text to send.
+func (c *Connection) channelFromTopic() bool {
+	topic := c.Subscribe.Topic
+	return topic == "+" || strings.HasSuffix(topic, "/+")
+}
+
+// sendHandler returns an MQTT message handler which queues chat messages
+// to be sent.
+func (c *Connection) sendHandler(queue *sendQueue) mqtt.MessageHandler {
+	return func(_ mqtt.Client, mq mqtt.Message) {
+		var msg struct {
+			// Type is "message" (the default), or "announce" or
+			// "shoutout", which are made through Helix. Announcements
+			// are highlighted in Color, and shoutouts are for Target.
+			Type    string
+			Channel string
+			Message string
+			Color   string
+			Target  string
+
+			// ReplyParentMsgID, if set, sends the message as a reply.
+			ReplyParentMsgID string `json:"reply_parent_msg_id"`
+
+			// Action sends the message as a /me action.
+			Action bool
+
+			// QOS and Retain, if set, override how the message's delivery
+			// result is published.
+			QOS    *byte `json:"qos"`
+			Retain *bool `json:"retain"`
+
+			// Priority, if set, overrides the message's priority in the
+			// send queue, which is 0 for chat and 1 for commands. Higher
+			// priority messages are sent first.
+			Priority *int `json:"priority"`
+		}
+
+		if c.channelFromTopic() {
+			topic := mq.Topic()
+			msg.Channel = topic[strings.LastIndexByte(topic, '/')+1:]
+			msg.Message = strings.TrimRight(string(mq.Payload()), "\r\n")
+		} else if err := json.Unmarshal(mq.Payload(), &msg); err != nil {
+			c.elog.Printf("bad payload on %s: %v", mq.Topic(), err)
+			return
+		}
+
+		msg.Channel = normalizeChannel(msg.Channel)
+		if msg.Channel == "" {
+			c.elog.Printf("empty channel")
+			return
+		}
+
+		if err := checkChannelName(msg.Channel[1:]); err != nil {
+			c.elog.Printf("bad payload on %s: %v", mq.Topic(), err)
+			return
+		}
+
+		if msg.Type != "" && msg.Type != payloadMessage {
+			c.queueAction(queue, mq.Topic(), msg.Type, msg.Channel, msg.Message, msg.Color, msg.Target, msg.QOS, msg.Retain)
+			return
+		}
+
+		msg.Message = sanitizeMessage(msg.Message)
+
+		if msg.Message == "" {
+			c.elog.Printf("empty message")
+			return
+		}
+
+		parts := []string{msg.Message}
+		if utf8.RuneCountInString(msg.Message) > maxMessageLength {
+			if !c.Subscribe.Split {
+				c.elog.Printf("bad payload on %s: %v", mq.Topic(), errMessageTooLong)
+				c.count("send_rejected")
+				return
+			}
+			parts = splitMessage(msg.Message, maxMessageLength)
+		}
+
+		qos, retain := c.Subscribe.QOS, false
+
+		if msg.QOS != nil {
+			if *msg.QOS > 2 {
+				c.elog.Printf("bad payload on %s: %v", mq.Topic(), errBadQOS)
+				return
+			}
+			qos = *msg.QOS
+		}
+
+		if msg.Retain != nil {
+			retain = *msg.Retain
+		}
+
+		priority := 0
+		if isChatCommand(msg.Message) {
+			priority = commandPriority
+		}
+		if msg.Priority != nil {
+			priority = *msg.Priority
+		}
+
+		if !c.canWrite() {
+			return
+		}
+
+		for i, text := range parts {
+			if msg.Action {
+				text = wrapAction(text)
+			}
+
+			m := &irc.Message{
+				Command:  "PRIVMSG",
+				Params:   []string{msg.Channel},
+				Trailing: text,
+			}
+
+			// Only the first part of a split message is the reply.
+			if msg.ReplyParentMsgID != "" && i == 0 {
+				m.Tags = map[string]string{"reply-parent-msg-id": msg.ReplyParentMsgID}
+			}
+
+			if !c.runMiddleware(Outbound, m) {
+				continue
+			}
+
+			if !queue.push(sendItem{m: m, priority: priority, qos: qos, retain: retain}) {
+				c.elog.Printf("send queue full, dropped a message")
+				c.count("queue_dropped")
+			}
+		}
+	}
+}
+
+// queueAction queues an announcement or shoutout from the subscribe topic.
+func (c *Connection) queueAction(queue *sendQueue, topic, typ, channel, message, color, target string, qos *byte, retain *bool) {
+	a, m, err := newHelixAction(typ, channel, message, color, target)
+	if err != nil {
+		c.elog.Printf("bad payload on %s: %v", topic, err)
+		c.count("send_rejected")
+		return
+	}
+
+	it := sendItem{m: m, priority: commandPriority, qos: c.Subscribe.QOS, action: a}
+
+	if qos != nil {
+		if *qos > 2 {
+			c.elog.Printf("bad payload on %s: %v", topic, errBadQOS)
+			return
+		}
+		it.qos = *qos
+	}
+
+	if retain != nil {
+		it.retain = *retain
+	}
+
+	if !c.canWrite() {
+		return
+	}
+
+	if !queue.push(it) {
+		c.elog.Printf("send queue full, dropped a message")
+		c.count("queue_dropped")
+	}
+}
@@ -0,0 +1,72 @@
+package bridge
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakebailey/irc"
+)
+
+func TestSendQueueDeferred(t *testing.T) {
+	q := &sendQueue{max: 4, notify: make(chan struct{}, 1)}
+
+	first := sendItem{m: &irc.Message{Trailing: "first"}}
+	q.push(first)
+	q.push(sendItem{m: &irc.Message{Trailing: "second"}})
+
+	it, _ := q.pop(nil)
+	start := time.Now()
+	q.deferUntil(it, start.Add(50*time.Millisecond))
+
+	// A deferred message must not hold up those behind it.
+	if it, _ := q.pop(nil); it.m.Trailing != "second" {
+		t.Fatalf("popped %q, want second", it.m.Trailing)
+	}
+	if d := time.Since(start); d >= 50*time.Millisecond {
+		t.Errorf("second message waited %s", d)
+	}
+
+	it, _ = q.pop(nil)
+	if it.m.Trailing != "first" {
+		t.Fatalf("popped %q, want first", it.m.Trailing)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("deferred message popped after %s, want at least 50ms", d)
+	}
+}
+
+func TestDuplicatesSuffixLength(t *testing.T) {
+	d := &duplicates{strategy: duplicatesSuffix, last: map[string]sentMessage{}}
+
+	short := &irc.Message{Command: "PRIVMSG", Params: []string{"#foo"}, Trailing: "hi"}
+	d.sent(short)
+	if wait, ok := d.check(short); wait != 0 || !ok || short.Trailing != "hi"+duplicateSuffix {
+		t.Errorf("check = %s, %v, %q, want suffixed", wait, ok, short.Trailing)
+	}
+
+	// A message at the limit would be too long with the suffix, so waits.
+	text := strings.Repeat("a", maxMessageLength)
+	long := &irc.Message{Command: "PRIVMSG", Params: []string{"#foo"}, Trailing: text}
+	d.sent(long)
+	if wait, ok := d.check(long); wait <= 0 || !ok || long.Trailing != text {
+		t.Errorf("check = %s, %v, %d characters, want delayed", wait, ok, len(long.Trailing))
+	}
+}
+
+func TestNormalizeChannel(t *testing.T) {
+	tests := map[string]string{
+		"Foo":    "#foo",
+		"#Foo":   "#foo",
+		" #bar ": "#bar",
+		"#":      "",
+		" # ":    "",
+		"":       "",
+	}
+
+	for in, want := range tests {
+		if got := normalizeChannel(in); got != want {
+			t.Errorf("normalizeChannel(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
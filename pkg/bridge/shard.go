@@ -0,0 +1,310 @@
+package bridge
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errBadShard = errors.New("negative channels per shard")
+
+// shard is one of a connection's IRC connections. Connections without
+// sharding have a single shard in every channel. Each channel is assigned
+// to one shard, which keeps it across reconnects unless the shards are
+// rebalanced.
+type shard struct {
+	index int
+	conn  *sharedConn
+
+	mu       sync.Mutex
+	assigned map[string]bool
+	joined   map[string]bool
+	ready    bool // connected and joined to its assigned channels
+
+	read atomic.Int64 // unix nanoseconds of the last message read
+}
+
+func newShard(index int) *shard {
+	return &shard{
+		index:    index,
+		conn:     &sharedConn{},
+		assigned: make(map[string]bool),
+		joined:   make(map[string]bool),
+	}
+}
+
+// reset forgets the channels the shard has joined when its IRC connection
+// is lost. Its assigned channels are joined again when it reconnects.
+func (s *shard) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.joined = make(map[string]bool)
+	s.ready = false
+}
+
+func (s *shard) assign(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.assigned[channel] = true
+}
+
+func (s *shard) unassign(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.assigned, channel)
+}
+
+func (s *shard) isAssigned(channel string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.assigned[channel]
+}
+
+// assignedChannels returns the channels assigned to the shard, sorted.
+func (s *shard) assignedChannels() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channels := make([]string, 0, len(s.assigned))
+	for ch := range s.assigned {
+		channels = append(channels, ch)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+func (s *shard) setJoined(channel string, joined bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if joined {
+		s.joined[channel] = true
+	} else {
+		delete(s.joined, channel)
+	}
+}
+
+func (s *shard) hasJoined(channel string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.joined[channel]
+}
+
+// channels returns the channels the shard has joined.
+func (s *shard) channels() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channels := make([]string, 0, len(s.joined))
+	for ch := range s.joined {
+		channels = append(channels, ch)
+	}
+	return channels
+}
+
+// touch records that a message was just read from the shard.
+func (s *shard) touch() {
+	s.read.Store(time.Now().UnixNano())
+}
+
+func (s *shard) lastRead() time.Time {
+	return time.Unix(0, s.read.Load())
+}
+
+// load returns the number of channels assigned to the shard.
+func (s *shard) load() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.assigned)
+}
+
+func (s *shard) setReady() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ready = true
+}
+
+func (s *shard) isReady() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ready
+}
+
+func (c *Connection) validateShard() error {
+	if c.Shard.Channels < 0 {
+		return errBadShard
+	}
+	return nil
+}
+
+// newShards creates enough shards for the connection's channels, and
+// assigns the channels to them evenly, in order.
+func (c *Connection) newShards() []*shard {
+	channels := c.channels()
+
+	n := 1
+	per := c.Shard.Channels
+	if per > 0 && len(channels) > per {
+		n = (len(channels) + per - 1) / per
+	}
+
+	shards := make([]*shard, n)
+	rest := channels
+	for i := range shards {
+		shards[i] = newShard(i)
+
+		size := len(channels) / n
+		if i < len(channels)%n {
+			size++
+		}
+		for _, ch := range rest[:size] {
+			shards[i].assign(ch)
+		}
+		rest = rest[size:]
+	}
+
+	return shards
+}
+
+// assignShard assigns channel to the shard with the fewest channels and
+// returns it, starting a new shard if every shard is full. It returns the
+// shard channel is already assigned to, if any, or nil if the connection
+// is not running.
+func (c *Connection) assignShard(channel string) *shard {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var best *shard
+	bestLoad := 0
+
+	for _, s := range c.shards {
+		if s.isAssigned(channel) {
+			return s
+		}
+		if load := s.load(); best == nil || load < bestLoad {
+			best, bestLoad = s, load
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	if per := c.Shard.Channels; per > 0 && bestLoad >= per && c.startShard != nil {
+		best = newShard(len(c.shards))
+		c.shards = append(c.shards, best)
+		best.assign(channel)
+		c.log.Info().Int("shard", best.index).Msg("adding shard")
+		c.startShard(best)
+		return best
+	}
+
+	best.assign(channel)
+	return best
+}
+
+// shardMove is a channel moved between shards by rebalance.
+type shardMove struct {
+	channel  string
+	from, to *shard
+}
+
+// rebalance evens out the channels of the running connection's shards
+// around s, after s reconnects or a part leaves it with fewer channels.
+// Channels are moved to s from shards with at least two more than it, or
+// from s to shards with at least two fewer, parting them on their old
+// shard and joining them on their new one, so channels don't pile up on
+// the shards which stayed connected or which parts left alone.
+func (c *Connection) rebalance(s *shard) {
+	var moves []shardMove
+
+	c.mu.Lock()
+	for {
+		var most, least *shard
+		for _, o := range c.shards {
+			if o == s {
+				continue
+			}
+			if most == nil || o.load() > most.load() {
+				most = o
+			}
+			if least == nil || o.load() < least.load() {
+				least = o
+			}
+		}
+
+		if most != nil && most.load() > s.load()+1 {
+			moves = append(moves, moveLastChannel(most, s))
+		} else if least != nil && least.load()+1 < s.load() {
+			moves = append(moves, moveLastChannel(s, least))
+		} else {
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	for _, m := range moves {
+		c.log.Info().Str("channel", m.channel).Int("from", m.from.index).Int("shard", m.to.index).Msg("moving channel")
+
+		if m.from.hasJoined(m.channel) {
+			if err := part(m.from.conn, m.channel); err != nil && err != errNotConnected {
+				c.elog.Printf("part failed: %v", err)
+			}
+			m.from.setJoined(m.channel, false)
+		}
+
+		c.joinOnShard(m.to, m.channel)
+	}
+}
+
+// moveLastChannel moves the last of from's channels to to.
+func moveLastChannel(from, to *shard) shardMove {
+	channels := from.assignedChannels()
+	ch := channels[len(channels)-1]
+	from.unassign(ch)
+	to.assign(ch)
+	return shardMove{channel: ch, from: from, to: to}
+}
+
+// channelShard returns the shard channel is assigned to, or nil if it is
+// not assigned to one.
+func (c *Connection) channelShard(channel string) *shard {
+	c.mu.Lock()
+	shards := c.shards
+	c.mu.Unlock()
+
+	for _, s := range shards {
+		if s.isAssigned(channel) {
+			return s
+		}
+	}
+	return nil
+}
+
+// runningShards returns the shards of the running connection.
+func (c *Connection) runningShards() []*shard {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*shard(nil), c.shards...)
+}
+
+// isReady reports whether every shard is connected and joined.
+func (c *Connection) isReady() bool {
+	c.mu.Lock()
+	shards := c.shards
+	c.mu.Unlock()
+
+	if len(shards) == 0 {
+		return false
+	}
+
+	for _, s := range shards {
+		if !s.isReady() {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,191 @@
+package bridge
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jakebailey/irc"
+)
+
+// shardConns waits for n shards to connect, returning their connections by
+// the channels they first join.
+func shardConns(t *testing.T, h *harness, first *fakeIRC, n int) map[string]*fakeIRC {
+	t.Helper()
+
+	conns := map[string]*fakeIRC{}
+	for i := 0; i < n; i++ {
+		f := first
+		if i > 0 {
+			var err error
+			if f, err = h.NextConn(testTimeout); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		m, err := f.NextCommand("JOIN", testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[m.Params[0]] = f
+	}
+	return conns
+}
+
+func TestShardsKeepChannelsAcrossReconnects(t *testing.T) {
+	c := newTestConnection()
+	c.Publish.Channels = []string{"a", "b", "c"}
+	c.Shard.Channels = 2
+
+	h, f := startHarness(t, c)
+	conns := shardConns(t, h, f, 2)
+
+	first, second := conns["#a,#b"], conns["#c"]
+	if first == nil || second == nil {
+		t.Fatalf("shards joined %v, want #a,#b and #c", conns)
+	}
+
+	// Parting a channel from the first shard must not move the second
+	// shard's channels, and the new channel goes to the emptier shard.
+	c.partChannel("#a")
+	if _, err := first.NextCommand("PART", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	c.joinChannel("#d")
+	m, err := first.NextCommand("JOIN", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Params[0] != "#d" {
+		t.Errorf("first shard joined %v, want #d", m.Params)
+	}
+
+	// Each shard rejoins its own channels when it reconnects.
+	if err := second.Send(&irc.Message{Command: "RECONNECT"}); err != nil {
+		t.Fatal(err)
+	}
+
+	f2, err := h.NextConn(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = f2.NextCommand("JOIN", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Params[0] != "#c" {
+		t.Errorf("reconnected shard joined %v, want #c", m.Params)
+	}
+
+	if err := first.Send(&irc.Message{Command: "RECONNECT"}); err != nil {
+		t.Fatal(err)
+	}
+
+	f1, err := h.NextConn(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = f1.NextCommand("JOIN", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Params[0] != "#b,#d" {
+		t.Errorf("reconnected shard joined %v, want #b,#d", m.Params)
+	}
+}
+
+func TestShardAddedWhenFull(t *testing.T) {
+	c := newTestConnection()
+	c.Publish.Channels = []string{"a"}
+	c.Shard.Channels = 1
+
+	h, f := startHarness(t, c)
+	if _, err := f.NextCommand("JOIN", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	c.joinChannel("#b")
+
+	f2, err := h.NextConn(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := f2.NextCommand("JOIN", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Params[0] != "#b" {
+		t.Errorf("new shard joined %v, want #b", m.Params)
+	}
+
+	if got := len(c.runningShards()); got != 2 {
+		t.Errorf("%d shards, want 2", got)
+	}
+}
+
+func TestShardsRebalancedAfterPart(t *testing.T) {
+	c := newTestConnection()
+	c.Publish.Channels = []string{"a", "b", "c"}
+	c.Shard.Channels = 2
+
+	h, f := startHarness(t, c)
+	conns := shardConns(t, h, f, 2)
+
+	first, second := conns["#a,#b"], conns["#c"]
+	if first == nil || second == nil {
+		t.Fatalf("shards joined %v, want #a,#b and #c", conns)
+	}
+
+	// Parting the second shard's only channel leaves it two behind the
+	// first, which hands over one of its own.
+	c.partChannel("#c")
+	if _, err := second.NextCommand("PART", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := first.NextCommand("PART", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Params[0] != "#b" {
+		t.Errorf("first shard parted %v, want #b", m.Params)
+	}
+
+	m, err = second.NextCommand("JOIN", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Params[0] != "#b" {
+		t.Errorf("second shard joined %v, want #b", m.Params)
+	}
+}
+
+func TestShardsRebalancedOnReconnect(t *testing.T) {
+	c := newTestConnection()
+	c.Publish.Channels = []string{"a", "b", "c", "d", "e"}
+	c.Shard.Channels = 3
+	if _, err := newHarness(c); err != nil {
+		t.Fatal(err)
+	}
+
+	shards := c.newShards()
+	if got := []int{shards[0].load(), shards[1].load()}; got[0] != 3 || got[1] != 2 {
+		t.Fatalf("shards have %v channels, want [3 2]", got)
+	}
+	c.shards = shards
+
+	// Channels joined while the second shard was away went to the first.
+	shards[1].unassign("#d")
+	shards[1].unassign("#e")
+	shards[0].assign("#d")
+	shards[0].assign("#e")
+
+	c.rebalance(shards[1])
+
+	if got := shards[0].assignedChannels(); strings.Join(got, ",") != "#a,#b,#c" {
+		t.Errorf("first shard has %v, want #a,#b,#c", got)
+	}
+	if got := shards[1].assignedChannels(); strings.Join(got, ",") != "#d,#e" {
+		t.Errorf("reconnected shard has %v, want #d,#e", got)
+	}
+}
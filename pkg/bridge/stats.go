@@ -0,0 +1,116 @@
+package bridge
+
+import (
+	"errors"
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+const defaultStatsInterval = time.Minute
+
+var errBadStatsInterval = errors.New("negative stats interval")
+
+var connectionMetrics = expvar.NewMap("connections")
+
+// namedMetrics returns the metrics of the connection with the given name,
+// which are kept across reloads, or nil if it has none.
+func namedMetrics(name string) *expvar.Map {
+	if name == "" {
+		return nil
+	}
+	if m, ok := connectionMetrics.Get(name).(*expvar.Map); ok {
+		return m
+	}
+	m := new(expvar.Map).Init()
+	connectionMetrics.Set(name, m)
+	return m
+}
+
+// count adds one to the named metric of the connection's tenant, and of
+// the connection itself if it is named.
+func (c *Connection) count(name string) {
+	c.countN(name, 1)
+}
+
+// countN is like count, but adds n.
+func (c *Connection) countN(name string, n int64) {
+	c.tenant.metrics.Add(name, n)
+	if c.metrics != nil {
+		c.metrics.Add(name, n)
+	}
+}
+
+// connStats counts a connection's activity since it started running.
+type connStats struct {
+	received   atomic.Int64
+	published  atomic.Int64
+	sent       atomic.Int64
+	reconnects atomic.Int64
+}
+
+// statsDocument is published to the stats topic.
+type statsDocument struct {
+	Name         string    `json:"name,omitempty"`
+	Time         time.Time `json:"time"`
+	Uptime       float64   `json:"uptime_seconds"`
+	Connected    bool      `json:"connected"`
+	Channels     []string  `json:"channels"`
+	Received     int64     `json:"received"`
+	Published    int64     `json:"published"`
+	Sent         int64     `json:"sent"`
+	Reconnects   int64     `json:"reconnects"`
+	SendQueue    int       `json:"send_queue"`
+	PublishQueue int       `json:"publish_queue"`
+}
+
+func (c *Connection) validateStats() error {
+	if c.Stats.Interval < 0 {
+		return fieldErr("interval", errBadStatsInterval)
+	}
+
+	if c.Stats.Interval == 0 {
+		c.Stats.Interval = defaultStatsInterval
+	}
+
+	return nil
+}
+
+// statsLoop publishes the connection's stats every interval until stop is
+// closed.
+func (c *Connection) statsLoop(client MQTTClient, queue *sendQueue, pq *publishQueue, stop <-chan struct{}) {
+	start := time.Now()
+
+	ticker := time.NewTicker(c.Stats.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			c.publishStats(client, queue, pq, start, now)
+		}
+	}
+}
+
+func (c *Connection) publishStats(client MQTTClient, queue *sendQueue, pq *publishQueue, start, now time.Time) {
+	pqLen := 0
+	if pq != nil {
+		pqLen = pq.len()
+	}
+
+	c.publishJSON(client, "stats", c.Stats.Topic, c.Stats.QOS, true, &statsDocument{
+		Name:         c.Name,
+		Time:         now.UTC(),
+		Uptime:       now.Sub(start).Seconds(),
+		Connected:    c.isReady(),
+		Channels:     c.channels(),
+		Received:     c.stats.received.Load(),
+		Published:    c.stats.published.Load(),
+		Sent:         c.stats.sent.Load(),
+		Reconnects:   c.stats.reconnects.Load(),
+		SendQueue:    queue.len(),
+		PublishQueue: pqLen,
+	})
+}
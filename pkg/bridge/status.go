@@ -0,0 +1,70 @@
+package bridge
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type connectionStatus struct {
+	Name         string   `json:"name,omitempty"`
+	Version      string   `json:"version"`
+	Capabilities []string `json:"capabilities"`
+	Degraded     bool     `json:"degraded"`
+}
+
+// publishStatus publishes the connection's current status, retained, to
+// its status topic, if one is configured.
+func (c *Connection) publishStatus(client MQTTClient, caps *capSet) {
+	if c.Status.Topic == "" {
+		return
+	}
+
+	c.publishJSON(client, "status", c.Status.Topic, c.Status.QOS, true, &connectionStatus{
+		Name:         c.Name,
+		Version:      Version,
+		Capabilities: caps.list(),
+		Degraded:     caps.degraded(),
+	})
+}
+
+// publishTimeout is how long to wait for the broker to take a status or
+// state publish before giving up on it.
+const publishTimeout = 5 * time.Second
+
+// publishJSON publishes v, encoded as JSON, to topic, and waits for the
+// broker to take it in the background, so the IRC read loop isn't held up
+// by a slow broker. Failures are logged as failed publishes of what.
+func (c *Connection) publishJSON(client MQTTClient, what, topic string, qos byte, retain bool, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		c.elog.Println(err)
+		return
+	}
+
+	t := client.Publish(topic, qos, retain, b)
+	go func() {
+		if !t.WaitTimeout(publishTimeout) {
+			c.elog.Printf("%s publish failed: %v", what, errConfirmTimeout)
+		} else if err := t.Error(); err != nil {
+			c.elog.Printf("%s publish failed: %v", what, err)
+		}
+	}()
+}
+
+const (
+	availabilityOnline  = "online"
+	availabilityOffline = "offline"
+)
+
+// publishAvailability publishes a retained online or offline message.
+func publishAvailability(client MQTTClient, topic string, qos byte, online bool) {
+	payload := availabilityOffline
+	if online {
+		payload = availabilityOnline
+	}
+
+	t := client.Publish(topic, qos, true, payload)
+	if t.WaitTimeout(publishTimeout) && t.Error() != nil {
+		elog.Printf("availability publish failed: %v", t.Error())
+	}
+}
@@ -0,0 +1,215 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+	restartNever     = "never"
+
+	defaultRestartWindow = 10 * time.Minute
+)
+
+var (
+	errBadRestartPolicy = errors.New("restart policy must be on-failure, always, or never")
+	errBadRestart       = errors.New("negative restart limit")
+	errPanic            = errors.New("connection panicked")
+)
+
+// The events published to the status events topic as the connection is
+// supervised.
+const (
+	restartEventRestarting = "restarting"
+	restartEventStopped    = "stopped"
+)
+
+// restartEventsSuffix is appended to the status topic to publish events.
+const restartEventsSuffix = "/events"
+
+type restartEvent struct {
+	Name     string  `json:"name,omitempty"`
+	Event    string  `json:"event"`
+	Error    string  `json:"error,omitempty"`
+	Restarts int     `json:"restarts"`
+	Delay    float64 `json:"delay_seconds,omitempty"`
+}
+
+func (c *Connection) validateRestart() error {
+	switch c.Restart.Policy {
+	case "":
+		c.Restart.Policy = restartOnFailure
+	case restartOnFailure, restartAlways, restartNever:
+	default:
+		return fieldErr("policy", errBadRestartPolicy)
+	}
+
+	if c.Restart.MaxRestarts < 0 {
+		return fieldErr("max_restarts", errBadRestart)
+	}
+
+	if c.Restart.Window < 0 {
+		return fieldErr("window", errBadRestart)
+	}
+
+	if c.Restart.Window == 0 {
+		c.Restart.Window = defaultRestartWindow
+	}
+
+	return nil
+}
+
+// supervise runs c until ctx is canceled, restarting it with a backoff as
+// its restart policy allows, so that one failed connection doesn't stop
+// the others.
+func (c *Connection) supervise(ctx context.Context, client MQTTClient) {
+	retry := newBackoff(c.Reconnect.MinDelay, c.Reconnect.MaxDelay)
+	var restarts []time.Time
+	total := 0
+
+	for {
+		start := time.Now()
+		err := c.runRecovered(ctx, client)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == nil && c.Restart.Policy != restartAlways {
+			return
+		}
+
+		if c.Restart.Policy == restartNever {
+			c.log.Error().Err(err).Msg("connection failed, not restarting")
+			c.publishRestart(client, restartEventStopped, err, total, 0)
+			return
+		}
+
+		// Forget restarts which have left the window.
+		now := time.Now()
+		for len(restarts) > 0 && now.Sub(restarts[0]) >= c.Restart.Window {
+			restarts = restarts[1:]
+		}
+
+		if max := c.Restart.MaxRestarts; max > 0 && len(restarts) >= max {
+			c.log.Error().Err(err).Int("restarts", len(restarts)).Dur("window", c.Restart.Window).Msg("connection restarted too often, stopping")
+			c.publishRestart(client, restartEventStopped, err, total, 0)
+			return
+		}
+
+		restarts = append(restarts, now)
+		total++
+		c.count("restarts")
+
+		if time.Since(start) >= stableSession {
+			retry.reset()
+		}
+
+		d := retry.next()
+		if err != nil {
+			c.log.Error().Err(err).Dur("delay", d).Msg("connection failed, restarting")
+		} else {
+			c.log.Warn().Dur("delay", d).Msg("connection stopped, restarting")
+		}
+		c.publishRestart(client, restartEventRestarting, err, total, d)
+
+		if !sleep(d, ctx.Done()) {
+			return
+		}
+	}
+}
+
+// runRecovered runs c, returning a panic in run as an error.
+func (c *Connection) runRecovered(ctx context.Context, client MQTTClient) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = c.panicked(v)
+		}
+	}()
+	return c.run(ctx, client)
+}
+
+// panicked logs the recovered panic v and returns it as an error.
+func (c *Connection) panicked(v interface{}) error {
+	c.log.Error().Str("panic", fmt.Sprint(v)).Str("stack", string(debug.Stack())).Msg("recovered panic")
+	return fmt.Errorf("%w: %v", errPanic, v)
+}
+
+// publishRestart publishes a supervision event to the events subtopic of
+// the status topic, if one is configured. Unlike the status itself, events
+// aren't retained, so are kept apart from it.
+func (c *Connection) publishRestart(client MQTTClient, event string, err error, restarts int, delay time.Duration) {
+	if c.Status.Topic == "" {
+		return
+	}
+
+	e := restartEvent{
+		Name:     c.Name,
+		Event:    event,
+		Restarts: restarts,
+		Delay:    delay.Seconds(),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	c.publishJSON(client, "restart event", c.Status.Topic+restartEventsSuffix, c.Status.QOS, false, &e)
+}
+
+// panicGuard stops a run of the connection when one of its goroutines
+// panics, keeping the first panic as the run's error.
+type panicGuard struct {
+	c      *Connection
+	cancel context.CancelFunc
+
+	mu  sync.Mutex
+	err error
+}
+
+// recover recovers a panic in the calling goroutine, so must be deferred.
+func (g *panicGuard) recover() {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	err := g.c.panicked(v)
+
+	g.mu.Lock()
+	if g.err == nil {
+		g.err = err
+	}
+	g.mu.Unlock()
+
+	g.cancel()
+}
+
+// goSafe runs f in a goroutine which recovers panics.
+func (g *panicGuard) goSafe(f func()) {
+	go func() {
+		defer g.recover()
+		f()
+	}()
+}
+
+// handler wraps h to recover panics, which would otherwise crash the MQTT
+// client's goroutine.
+func (g *panicGuard) handler(h mqtt.MessageHandler) mqtt.MessageHandler {
+	return func(client mqtt.Client, m mqtt.Message) {
+		defer g.recover()
+		h(client, m)
+	}
+}
+
+func (g *panicGuard) error() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
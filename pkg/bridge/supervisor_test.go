@@ -0,0 +1,72 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+)
+
+func TestPanicGuardHandler(t *testing.T) {
+	c := newTestConnection()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	g := &panicGuard{c: c, cancel: cancel}
+
+	h := g.handler(func(mqtt.Client, mqtt.Message) { panic("boom") })
+	h(nil, nil)
+
+	if !errors.Is(g.error(), errPanic) {
+		t.Errorf("got error %v, want %v", g.error(), errPanic)
+	}
+	if ctx.Err() == nil {
+		t.Error("panic did not stop the run")
+	}
+}
+
+// slowBroker acknowledges publishes with an error after a delay.
+type slowBroker struct {
+	*fakeMQTT
+}
+
+func (slowBroker) Publish(string, byte, bool, interface{}) mqtt.Token {
+	return asyncToken(func() error {
+		time.Sleep(10 * time.Millisecond)
+		return errors.New("not authorized")
+	})
+}
+
+// lineWriter passes on each line written to it.
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestPublishRestartWaitsForBroker(t *testing.T) {
+	c := newTestConnection()
+	c.Status.Topic = "twitch/status"
+
+	lines := make(lineWriter, 1)
+	l := zerolog.New(lines)
+	c.elog = &errorLog{
+		errorCounts: &errorCounts{window: time.Minute, entries: make(map[errorKey]int)},
+		log:         &l,
+	}
+
+	c.publishRestart(slowBroker{newFakeMQTT()}, "restarting", nil, 1, time.Second)
+
+	select {
+	case line := <-lines:
+		if !strings.Contains(line, "restart event publish failed: not authorized") {
+			t.Errorf("logged %q", line)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("failed publish was not logged")
+	}
+}
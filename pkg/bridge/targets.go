@@ -0,0 +1,92 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jakebailey/irc"
+)
+
+var errNoTargetTopic = errors.New("publish target without a topic")
+
+// PublishTarget is a further topic a connection publishes messages to.
+// Topic may be a template, like Publish.Topic. Commands, ExcludeCommands,
+// and Filter select the messages published to it, as they do for the
+// connection.
+type PublishTarget struct {
+	Topic    string
+	QOS      byte   `yaml:",omitempty"`
+	Retain   bool   `yaml:",omitempty"`
+	Format   string `yaml:",omitempty"`
+	Encoding string `yaml:",omitempty"`
+
+	Commands        []string      `yaml:",omitempty"`
+	ExcludeCommands []string      `yaml:"exclude_commands,omitempty"`
+	Filter          MessageFilter `yaml:",omitempty"`
+
+	commands        map[string]bool
+	excludeCommands map[string]bool
+	filters         messageFilters
+}
+
+func (c *Connection) validateTargets() error {
+	var errs []error
+
+	for i, t := range c.Publish.Targets {
+		if err := t.validate(c.Subscribe.Topic); err != nil {
+			errs = append(errs, fieldErr(fmt.Sprintf("publish.targets[%d]", i), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (t *PublishTarget) validate(subscribeTopic string) error {
+	if t.Topic == "" {
+		return fieldErr("topic", errNoTargetTopic)
+	}
+
+	if t.Topic == subscribeTopic {
+		return fieldErr("topic", errBadTopics)
+	}
+
+	if err := checkTopicTemplate(t.Topic); err != nil {
+		return fieldErr("topic", err)
+	}
+
+	if t.QOS > 2 {
+		return fieldErr("qos", errBadQOS)
+	}
+
+	switch t.Format {
+	case "", formatJSON, formatParsed, formatRaw:
+	default:
+		return fieldErr("format", errBadFormat)
+	}
+
+	switch t.Encoding {
+	case "", encodingJSON, encodingMsgpack, encodingProtobuf:
+	default:
+		return fieldErr("encoding", errBadEncoding)
+	}
+
+	t.commands = upperSet(t.Commands)
+	t.excludeCommands = upperSet(t.ExcludeCommands)
+
+	var err error
+	t.filters, err = t.Filter.compile("filter")
+	return err
+}
+
+// filter reports whether m should be published to the target.
+func (t *PublishTarget) filter(m *irc.Message) bool {
+	if t.commands != nil && !t.commands[m.Command] {
+		return false
+	}
+
+	if t.excludeCommands[m.Command] {
+		return false
+	}
+
+	return !isChat(m) || t.filters.allows(m)
+}
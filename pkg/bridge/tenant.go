@@ -0,0 +1,203 @@
+package bridge
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const defaultTenantName = "default"
+
+var (
+	errEmptyTenantName     = errors.New("empty tenant name")
+	errDuplicateTenant     = errors.New("duplicate tenant name")
+	errBadTenantPrefix     = errors.New("tenant topic prefix is empty or contains wildcards")
+	errOverlappingTenants  = errors.New("tenant topic prefixes overlap")
+	errBadTenantRateLimit  = errors.New("tenant rate limit requires a positive message count and period")
+	errUnknownTenant       = errors.New("unknown tenant")
+	errTopicOutsideTenant  = errors.New("topic is outside of the tenant's topic prefix")
+	errTopicInOtherTenant  = errors.New("topic overlaps another tenant's topic prefix")
+	errControlInsideTopics = errors.New("topic overlaps the tenant's control topics")
+)
+
+var tenantMetrics = expvar.NewMap("tenants")
+
+// Tenant is a namespace shared by one or more connections. All of a
+// tenant's topics live under its prefix, and its outbound messages share
+// a single rate limit.
+type Tenant struct {
+	Name        string
+	TopicPrefix string `yaml:"topic_prefix"`
+
+	RateLimit TenantRateLimit `yaml:"rate_limit"`
+
+	key     string // identifies the tenant's settings across reloads
+	limiter *limiter
+	metrics *expvar.Map
+}
+
+// TenantRateLimit limits a tenant's outbound messages to Messages per
+// Period.
+type TenantRateLimit struct {
+	Messages int
+	Period   time.Duration
+}
+
+func (t *Tenant) validate() error {
+	if t.Name == "" {
+		return fieldErr("name", errEmptyTenantName)
+	}
+
+	if t.TopicPrefix == "" || strings.ContainsAny(t.TopicPrefix, "+#") {
+		return fieldErr("topic_prefix", errBadTenantPrefix)
+	}
+
+	t.TopicPrefix = strings.TrimSuffix(t.TopicPrefix, "/")
+
+	if t.RateLimit.Messages != 0 || t.RateLimit.Period != 0 {
+		if t.RateLimit.Messages <= 0 || t.RateLimit.Period <= 0 {
+			return fieldErr("rate_limit", errBadTenantRateLimit)
+		}
+	}
+
+	key, err := t.reloadKey()
+	if err != nil {
+		return err
+	}
+	t.key = key
+	return nil
+}
+
+func (t *Tenant) init() {
+	if t.RateLimit.Messages > 0 {
+		t.limiter = newLimiter(t.RateLimit.Messages, t.RateLimit.Period)
+	}
+
+	// Keep counting into the same metrics when the config is reloaded.
+	if m, ok := tenantMetrics.Get(t.Name).(*expvar.Map); ok {
+		t.metrics = m
+	} else {
+		t.metrics = new(expvar.Map).Init()
+		tenantMetrics.Set(t.Name, t.metrics)
+	}
+}
+
+// reloadKey identifies the tenant's settings across reloads.
+func (t *Tenant) reloadKey() (string, error) {
+	b, err := yaml.Marshal(t)
+	return string(b), err
+}
+
+// controlTopic returns the topic for the named control function, which is
+// kept under the tenant's prefix so tenants cannot control each other.
+func (t *Tenant) controlTopic(name string) string {
+	if t.TopicPrefix == "" {
+		return "control/" + name
+	}
+	return t.TopicPrefix + "/control/" + name
+}
+
+// owns reports whether topic (which may be a filter) is within the tenant's
+// namespace. The built-in default tenant has no prefix and owns everything
+// not owned by another tenant, which is checked separately.
+func (t *Tenant) owns(topic string) bool {
+	if t.TopicPrefix == "" {
+		return true
+	}
+	return strings.HasPrefix(topic, t.TopicPrefix+"/")
+}
+
+// tenants validates the configured tenants and returns them by name,
+// including the built-in default tenant if it was not configured.
+func (c *Config) tenants() (map[string]*Tenant, error) {
+	tenants := make(map[string]*Tenant, len(c.Tenants)+1)
+
+	for i, t := range c.Tenants {
+		field := fmt.Sprintf("tenants[%d]", i)
+
+		if err := t.validate(); err != nil {
+			return nil, fieldErr(field, err)
+		}
+
+		if _, ok := tenants[t.Name]; ok {
+			return nil, fieldErr(field+".name", errDuplicateTenant)
+		}
+
+		for _, other := range c.Tenants[:i] {
+			if topicsOverlap(t.TopicPrefix+"/#", other.TopicPrefix+"/#") {
+				return nil, fieldErr(field+".topic_prefix", errOverlappingTenants)
+			}
+		}
+
+		tenants[t.Name] = t
+	}
+
+	if _, ok := tenants[defaultTenantName]; !ok {
+		tenants[defaultTenantName] = &Tenant{Name: defaultTenantName}
+	}
+
+	return tenants, nil
+}
+
+// checkTopic verifies that topic belongs to t and does not reach into any
+// other tenant's namespace or t's own control topics.
+func (t *Tenant) checkTopic(tenants map[string]*Tenant, topic string) error {
+	if topic == "" {
+		return nil
+	}
+
+	if !t.owns(topic) {
+		return errTopicOutsideTenant
+	}
+
+	for _, other := range tenants {
+		if other == t || other.TopicPrefix == "" {
+			continue
+		}
+
+		if topicsOverlap(topic, other.TopicPrefix+"/#") {
+			return errTopicInOtherTenant
+		}
+	}
+
+	if topicsOverlap(topic, t.controlTopic("#")) {
+		return errControlInsideTopics
+	}
+
+	return nil
+}
+
+// topicsOverlap reports whether there is any topic matched by both of the
+// given MQTT topic filters.
+func topicsOverlap(a, b string) bool {
+	as := strings.Split(a, "/")
+	bs := strings.Split(b, "/")
+
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == "#" || bs[i] == "#" {
+			return true
+		}
+
+		if as[i] != bs[i] && as[i] != "+" && bs[i] != "+" {
+			return false
+		}
+	}
+
+	if len(as) == len(bs) {
+		return true
+	}
+
+	// A trailing "#" also matches its parent level.
+	if len(as) == len(bs)+1 {
+		return as[len(as)-1] == "#"
+	}
+	if len(bs) == len(as)+1 {
+		return bs[len(bs)-1] == "#"
+	}
+
+	return false
+}
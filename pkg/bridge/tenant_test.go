@@ -0,0 +1,124 @@
+package bridge
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTopicsOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"acme/chat", "acme/chat", true},
+		{"acme/chat", "acme/send", false},
+		{"acme/+", "acme/chat", true},
+		{"acme/#", "acme", true},
+		{"acme/#", "acmecorp/chat", false},
+		{"+/chat", "acme/#", true},
+		{"acme/chat/x", "acme/chat", false},
+		{"#", "anything/at/all", true},
+	}
+
+	for _, test := range tests {
+		if got := topicsOverlap(test.a, test.b); got != test.want {
+			t.Errorf("topicsOverlap(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+		if got := topicsOverlap(test.b, test.a); got != test.want {
+			t.Errorf("topicsOverlap(%q, %q) = %v, want %v", test.b, test.a, got, test.want)
+		}
+	}
+}
+
+func TestValidateTenantTopics(t *testing.T) {
+	tests := []struct {
+		name   string
+		tenant string
+		topic  string
+		want   error
+	}{
+		{name: "inside", tenant: "acme", topic: "acme/chat"},
+		{name: "outside", tenant: "acme", topic: "globex/chat", want: errTopicOutsideTenant},
+		{name: "other tenant", topic: "globex/chat", want: errTopicInOtherTenant},
+		{name: "wildcard into other tenant", topic: "+/chat", want: errTopicInOtherTenant},
+		{name: "control", tenant: "acme", topic: "acme/control/bot", want: errControlInsideTopics},
+		{name: "unknown tenant", tenant: "initech", topic: "initech/chat", want: errUnknownTenant},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Connection{Nick: "bot", Pass: "oauth:abc", Tenant: test.tenant}
+			c.Publish.Topic = test.topic
+
+			config := &Config{
+				Tenants: []*Tenant{
+					{Name: "acme", TopicPrefix: "acme"},
+					{Name: "globex", TopicPrefix: "globex"},
+				},
+				Connections: []*Connection{c},
+			}
+
+			err := config.Validate()
+			if test.want == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, errInvalidConfig) || !strings.Contains(err.Error(), test.want.Error()) {
+				t.Errorf("got error %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateOverlappingTenants(t *testing.T) {
+	config := &Config{
+		Tenants: []*Tenant{
+			{Name: "acme", TopicPrefix: "acme"},
+			{Name: "acme-eu", TopicPrefix: "acme/eu"},
+		},
+	}
+
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), errOverlappingTenants.Error()) {
+		t.Errorf("got error %v, want %v", err, errOverlappingTenants)
+	}
+}
+
+func TestTenantControlIsolated(t *testing.T) {
+	c := newTestConnection()
+	c.Tenant = "acme"
+	c.Publish.Topic = "acme/chat"
+	c.Subscribe.Topic = "acme/send"
+	c.Control.Topic = "bot"
+
+	h, err := newHarness(c, &Tenant{Name: "acme", TopicPrefix: "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := h.Start(testTimeout)
+	t.Cleanup(h.Stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.NextCommand("JOIN", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	join := []byte(`{"action":"join","channel":"bar"}`)
+	if err := h.MQTT.DeliverWhenSubscribed("acme/control/bot", join, testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the tenant's own control topic reaches the connection.
+	if n := h.MQTT.Deliver("control/bot", []byte(`{"action":"part","channel":"bar"}`)); n != 0 {
+		t.Errorf("default tenant's control topic reached %d subscriptions", n)
+	}
+
+	if !c.hasChannel("#bar") {
+		t.Errorf("channels %v, want #bar joined", c.channels())
+	}
+}
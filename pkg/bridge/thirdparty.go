@@ -0,0 +1,313 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	providerBTTV    = "bttv"
+	providerFFZ     = "ffz"
+	provider7TV     = "7tv"
+	defaultEmoteTTL = time.Hour
+
+	// emoteRetryTTL is how long a failed emote set fetch is remembered as
+	// empty, so an outage isn't retried for every message.
+	emoteRetryTTL = time.Minute
+)
+
+var (
+	errBadEmoteProvider = errors.New("emote providers must be bttv, ffz, or 7tv")
+	errBadEmoteTTL      = errors.New("negative emote cache TTL")
+)
+
+// thirdPartyEmote is an occurrence in a message of an emote from BTTV, FFZ,
+// or 7TV. Start and End are character indexes, as for Twitch emotes.
+type thirdPartyEmote struct {
+	Provider string    `json:"provider"`
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Start    int       `json:"start"`
+	End      int       `json:"end"`
+	URLs     emoteURLs `json:"urls"`
+}
+
+// emoteSet maps emote names to emotes of a single provider.
+type emoteSet map[string]thirdPartyEmote
+
+type emoteSetEntry struct {
+	set     emoteSet
+	expires time.Time
+}
+
+// emoteSets fetches and caches third-party emote sets, globally and per
+// channel.
+type emoteSets struct {
+	providers []string
+	ttl       time.Duration
+
+	mu   sync.Mutex
+	sets map[string]emoteSetEntry
+}
+
+func (c *Connection) validateThirdPartyEmotes() error {
+	e := &c.Publish.ThirdPartyEmotes
+	if !e.Enabled {
+		return nil
+	}
+
+	if c.Publish.Format != formatParsed {
+		return errEnrichFormat
+	}
+
+	if e.TTL < 0 {
+		return errBadEmoteTTL
+	}
+
+	if e.TTL == 0 {
+		e.TTL = defaultEmoteTTL
+	}
+
+	providers := e.Providers
+	if len(providers) == 0 {
+		providers = []string{provider7TV, providerBTTV, providerFFZ}
+	}
+
+	for i, p := range providers {
+		switch p {
+		case providerBTTV, providerFFZ, provider7TV:
+		default:
+			return fieldErr(fmt.Sprintf("providers[%d]", i), errBadEmoteProvider)
+		}
+	}
+
+	c.emoteSets = &emoteSets{
+		providers: providers,
+		ttl:       e.TTL,
+		sets:      make(map[string]emoteSetEntry),
+	}
+
+	return nil
+}
+
+// set returns the provider's emote set for the channel with the given room
+// ID, or its global set if roomID is empty.
+func (s *emoteSets) set(provider, roomID string) (emoteSet, error) {
+	key := provider + ":" + roomID
+	now := time.Now()
+
+	s.mu.Lock()
+	entry, ok := s.sets[key]
+	s.mu.Unlock()
+
+	if ok && now.Before(entry.expires) {
+		return entry.set, nil
+	}
+
+	set, err := fetchEmoteSet(provider, roomID)
+
+	ttl := s.ttl
+	if err != nil {
+		ttl = emoteRetryTTL
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, old := range s.sets {
+		if now.After(old.expires) {
+			delete(s.sets, k)
+		}
+	}
+	s.sets[key] = emoteSetEntry{set: set, expires: now.Add(ttl)}
+
+	return set, err
+}
+
+// find annotates the words of text which are third-party emotes in the
+// channel or globally, skipping those which are already Twitch emotes.
+// Providers earlier in the list take precedence.
+func (s *emoteSets) find(text, roomID string, twitch []emote) ([]thirdPartyEmote, error) {
+	var sets []emoteSet
+	var errs []error
+
+	rooms := []string{""}
+	if roomID != "" {
+		rooms = []string{roomID, ""}
+	}
+
+	// Channel emotes shadow global ones of the same name.
+	for _, room := range rooms {
+		for _, p := range s.providers {
+			set, err := s.set(p, room)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			if len(set) > 0 {
+				sets = append(sets, set)
+			}
+		}
+	}
+
+	if len(sets) == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	twitchAt := make(map[int]bool, len(twitch))
+	for _, e := range twitch {
+		twitchAt[e.Start] = true
+	}
+
+	var found []thirdPartyEmote
+
+	pos := 0
+	for _, word := range strings.Split(text, " ") {
+		n := len([]rune(word))
+
+		if n > 0 && !twitchAt[pos] {
+			for _, set := range sets {
+				if e, ok := set[word]; ok {
+					e.Start, e.End = pos, pos+n-1
+					found = append(found, e)
+					break
+				}
+			}
+		}
+
+		pos += n + 1
+	}
+
+	return found, errors.Join(errs...)
+}
+
+// fetchEmoteSet fetches an emote set from the provider's API. Channels
+// without any of the provider's emotes have an empty set.
+func fetchEmoteSet(provider, roomID string) (emoteSet, error) {
+	set := make(emoteSet)
+
+	add := func(id, name string, urls emoteURLs) {
+		if id != "" && name != "" {
+			set[name] = thirdPartyEmote{Provider: provider, ID: id, Name: name, URLs: urls}
+		}
+	}
+
+	switch provider {
+	case providerBTTV:
+		type bttvEmote struct {
+			ID   string
+			Code string
+		}
+
+		var emotes []bttvEmote
+		if roomID == "" {
+			if err := getJSON("https://api.betterttv.net/3/cached/emotes/global", &emotes); err != nil {
+				return nil, err
+			}
+		} else {
+			var user struct {
+				ChannelEmotes []bttvEmote
+				SharedEmotes  []bttvEmote
+			}
+			if err := getJSON("https://api.betterttv.net/3/cached/users/twitch/"+roomID, &user); err != nil {
+				return nil, err
+			}
+			emotes = append(user.ChannelEmotes, user.SharedEmotes...)
+		}
+
+		for _, e := range emotes {
+			base := "https://cdn.betterttv.net/emote/" + e.ID + "/"
+			add(e.ID, e.Code, emoteURLs{X1: base + "1x", X2: base + "2x", X3: base + "3x"})
+		}
+
+	case providerFFZ:
+		u := "https://api.betterttv.net/3/cached/frankerfacez/emotes/global"
+		if roomID != "" {
+			u = "https://api.betterttv.net/3/cached/frankerfacez/users/twitch/" + roomID
+		}
+
+		var emotes []struct {
+			ID     json.Number
+			Code   string
+			Images map[string]string
+		}
+		if err := getJSON(u, &emotes); err != nil {
+			return nil, err
+		}
+
+		for _, e := range emotes {
+			add(e.ID.String(), e.Code, emoteURLs{X1: e.Images["1x"], X2: e.Images["2x"], X3: e.Images["4x"]})
+		}
+
+	case provider7TV:
+		type sevenTVSet struct {
+			Emotes []struct {
+				ID   string
+				Name string
+			}
+		}
+
+		var es sevenTVSet
+		if roomID == "" {
+			if err := getJSON("https://7tv.io/v3/emote-sets/global", &es); err != nil {
+				return nil, err
+			}
+		} else {
+			var user struct {
+				EmoteSet *sevenTVSet `json:"emote_set"`
+			}
+			if err := getJSON("https://7tv.io/v3/users/twitch/"+roomID, &user); err != nil {
+				return nil, err
+			}
+			if user.EmoteSet != nil {
+				es = *user.EmoteSet
+			}
+		}
+
+		for _, e := range es.Emotes {
+			base := "https://cdn.7tv.app/emote/" + e.ID + "/"
+			add(e.ID, e.Name, emoteURLs{X1: base + "1x.webp", X2: base + "2x.webp", X3: base + "3x.webp"})
+		}
+	}
+
+	return set, nil
+}
+
+// getJSON fetches u and decodes its JSON body into out. A 404 leaves out
+// untouched, as the emote APIs return it for unknown channels.
+func getJSON(u string, out interface{}) error {
+	resp, err := httpClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// addThirdPartyEmotes annotates p with the third-party emotes in its
+// message. Lookup failures are logged and leave the failed sets out.
+func (c *Connection) addThirdPartyEmotes(p *parsedMessage) {
+	s := c.emoteSets
+	if s == nil || p.Message == "" {
+		return
+	}
+
+	emotes, err := s.find(p.Message, p.RoomID, p.Emotes)
+	if err != nil {
+		c.elog.Printf("fetching emotes: %v", err)
+	}
+	p.ThirdPartyEmotes = emotes
+}
@@ -0,0 +1,91 @@
+package bridge
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/jakebailey/irc"
+)
+
+var errBadTopicTemplate = errors.New("unknown placeholder in topic")
+
+var topicPlaceholderRe = regexp.MustCompile(`\{([^{}/]*)\}`)
+
+var topicPlaceholders = map[string]bool{
+	"channel":    true,
+	"command":    true,
+	"connection": true,
+	"event":      true,
+	"nick":       true,
+	"user":       true,
+}
+
+// checkTopicTemplate verifies that all placeholders in topic are known.
+func checkTopicTemplate(topic string) error {
+	for _, match := range topicPlaceholderRe.FindAllStringSubmatch(topic, -1) {
+		if !topicPlaceholders[match[1]] {
+			return errBadTopicTemplate
+		}
+	}
+	return nil
+}
+
+// topicTemplateFilter returns an MQTT topic filter which matches every
+// expansion of the template, for checking it against tenant namespaces.
+func topicTemplateFilter(topic string) string {
+	if !strings.Contains(topic, "{") {
+		return topic
+	}
+
+	levels := strings.Split(topic, "/")
+	for i, l := range levels {
+		if topicPlaceholderRe.MatchString(l) {
+			levels[i] = "+"
+		}
+	}
+
+	return strings.Join(levels, "/")
+}
+
+// expandTopic replaces the placeholders in topic with values from m.
+func (c *Connection) expandTopic(topic string, m *irc.Message) string {
+	if !strings.Contains(topic, "{") {
+		return topic
+	}
+
+	user := m.Prefix.Name
+
+	return strings.NewReplacer(
+		"{channel}", topicLevel(strings.TrimPrefix(messageChannel(m), "#")),
+		"{command}", topicLevel(m.Command),
+		"{connection}", topicLevel(c.name()),
+		"{event}", topicLevel(m.Tags["msg-id"]),
+		"{nick}", topicLevel(c.Nick),
+		"{user}", topicLevel(user),
+	).Replace(topic)
+}
+
+// topicLevel makes s safe to use as a single topic level. Empty values are
+// replaced with an underscore so that levels are never empty.
+func topicLevel(s string) string {
+	if s == "" {
+		return "_"
+	}
+
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '+', '#', 0:
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// name returns the connection's name, or its nick if it has none.
+func (c *Connection) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Nick
+}
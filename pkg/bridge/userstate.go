@@ -0,0 +1,113 @@
+package bridge
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/jakebailey/irc"
+)
+
+// modRateLimit is Twitch's chat limit, in messages per 30 seconds, in
+// channels where the account is the broadcaster or a moderator.
+const modRateLimit = 100
+
+// userState is the connection's own standing in a channel, as last
+// reported by USERSTATE.
+type userState struct {
+	Channel     string  `json:"channel"`
+	DisplayName string  `json:"display_name,omitempty"`
+	Color       string  `json:"color,omitempty"`
+	Badges      []badge `json:"badges,omitempty"`
+	Broadcaster bool    `json:"broadcaster"`
+	Mod         bool    `json:"mod"`
+	VIP         bool    `json:"vip"`
+	Subscriber  bool    `json:"subscriber"`
+}
+
+// userStates tracks the connection's USERSTATE in each channel.
+type userStates struct {
+	mu     sync.Mutex
+	states map[string]userState
+}
+
+func (c *Connection) validateUserState() error {
+	if strings.ContainsAny(c.UserState.Topic, "+#") {
+		return fieldErr("topic", errBadStateTopic)
+	}
+	return nil
+}
+
+// update records m's state for its channel, returning the state and
+// whether it changed.
+func (u *userStates) update(m *irc.Message) (userState, bool) {
+	st := userState{
+		Channel:     messageChannel(m),
+		DisplayName: tag(m, "display-name"),
+		Color:       tag(m, "color"),
+		Badges:      parseBadges(tag(m, "badges")),
+		Mod:         tag(m, "mod") == "1",
+	}
+
+	for _, b := range st.Badges {
+		switch b.Name {
+		case "broadcaster":
+			st.Broadcaster = true
+		case "moderator":
+			st.Mod = true
+		case "vip":
+			st.VIP = true
+		case "subscriber", "founder":
+			st.Subscriber = true
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.states == nil {
+		u.states = make(map[string]userState)
+	}
+
+	old, ok := u.states[st.Channel]
+	u.states[st.Channel] = st
+
+	return st, !ok || !reflect.DeepEqual(old, st)
+}
+
+// moderates reports whether the connection is the broadcaster or a
+// moderator in channel.
+func (u *userStates) moderates(channel string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	st := u.states[channel]
+	return st.Broadcaster || st.Mod
+}
+
+// publishUserState publishes the connection's state in a channel,
+// retained, to UserState.Topic/<channel>.
+func (c *Connection) publishUserState(client MQTTClient, st userState) {
+	topic := c.UserState.Topic + "/" + strings.TrimPrefix(st.Channel, "#")
+	c.publishJSON(client, "user state", topic, c.UserState.QOS, true, &st)
+}
+
+// newModLimiter returns the outbound rate limiter for channels the
+// connection moderates, or nil if the connection's limit is already at
+// least as high, or set explicitly.
+func (c *Connection) newModLimiter() *limiter {
+	if c.RateLimit.Messages > 0 {
+		return nil
+	}
+
+	class := c.RateLimit.Class
+	if class == "" {
+		class = "regular"
+	}
+
+	if rateLimitClasses[class] >= modRateLimit {
+		return nil
+	}
+
+	return newLimiter(modRateLimit, rateLimitPeriod)
+}
@@ -0,0 +1,103 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var errWhisperRoute = errors.New("whisper topic conflicts with a WHISPER route")
+
+// whisper is an outgoing whisper.
+type whisper struct {
+	User    string
+	Message string
+}
+
+// validateWhisper checks the whisper settings, routing incoming whispers
+// to the whisper topic.
+func (c *Connection) validateWhisper() error {
+	if topic := c.Whisper.Topic; topic != "" {
+		for cmd := range c.Publish.Routes {
+			if strings.EqualFold(cmd, "WHISPER") {
+				return fieldErr("topic", errWhisperRoute)
+			}
+		}
+
+		if c.Publish.Routes == nil {
+			c.Publish.Routes = make(map[string]string)
+		}
+		c.Publish.Routes["WHISPER"] = topic
+	}
+
+	if c.Whisper.SendTopic != "" {
+		if err := c.checkHelix(); err != nil {
+			return fieldErr("send_topic", err)
+		}
+	}
+
+	return nil
+}
+
+// whisperHandler returns an MQTT message handler which queues whispers
+// like {"user":"foo","message":"hi"}.
+func (c *Connection) whisperHandler(queue chan<- whisper) mqtt.MessageHandler {
+	return func(_ mqtt.Client, mq mqtt.Message) {
+		var w whisper
+
+		if err := json.Unmarshal(mq.Payload(), &w); err != nil {
+			c.elog.Printf("bad payload on %s: %v", mq.Topic(), err)
+			return
+		}
+
+		w.User = strings.TrimPrefix(strings.TrimSpace(w.User), "@")
+
+		if w.User == "" {
+			c.elog.Printf("empty whisper user")
+			return
+		}
+
+		if w.Message == "" {
+			c.elog.Printf("empty message")
+			return
+		}
+
+		select {
+		case queue <- w:
+		default:
+			c.elog.Printf("whisper queue full, dropped a whisper")
+			c.count("queue_dropped")
+		}
+	}
+}
+
+// whisperLoop sends queued whispers through the Helix API, as IRC no
+// longer delivers them.
+func (c *Connection) whisperLoop(queue <-chan whisper, client MQTTClient, stop <-chan struct{}) {
+	h := c.helix()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case w := <-queue:
+			if c.blocked(client, "", w.User, w.Message) {
+				continue
+			}
+
+			if !c.tenant.limiter.Wait(stop) {
+				return
+			}
+
+			if err := h.whisper(c.Nick, w.User, w.Message); err != nil {
+				c.elog.Printf("whisper to %s failed: %v", w.User, err)
+				continue
+			}
+
+			c.log.Debug().Str("user", w.User).Msg("whispered")
+			c.count("whispers_sent")
+		}
+	}
+}
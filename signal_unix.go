@@ -0,0 +1,16 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	// shutdownSignals stop the bridge gracefully.
+	shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+	// reloadSignals reload the config.
+	reloadSignals = []os.Signal{syscall.SIGHUP}
+)
@@ -0,0 +1,13 @@
+package main
+
+import "os"
+
+var (
+	// shutdownSignals stop the bridge gracefully. Windows only delivers
+	// Ctrl+C and Ctrl+Break, both as os.Interrupt.
+	shutdownSignals = []os.Signal{os.Interrupt}
+
+	// reloadSignals reload the config. Windows has no SIGHUP, so the config
+	// can only be reloaded with --watch-config.
+	reloadSignals []os.Signal
+)
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jakebailey/twitchmqtt/pkg/bridge"
+)
+
+// sdNotify sends a state change, like "READY=1", to systemd when running
+// as a Type=notify service, and otherwise does nothing.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// Abstract sockets are given with a leading @.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often to ping systemd's watchdog, half its
+// timeout, or zero if the watchdog is not enabled for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// notifySystemd reports the bridge ready to systemd once the broker and
+// every connection are, then pings the watchdog until stop is closed. The
+// watchdog is only pinged while the bridge responds and is ready, so
+// systemd restarts it if it hangs or stays disconnected; meanwhile, what
+// isn't ready is reported as the service's status.
+func notifySystemd(client bridge.BrokerClient, b *bridge.Bridge, stop <-chan struct{}) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	ready := time.NewTicker(time.Second)
+	defer ready.Stop()
+
+	var watchdog <-chan time.Time
+	if d := watchdogInterval(); d > 0 {
+		t := time.NewTicker(d)
+		defer t.Stop()
+		watchdog = t.C
+	}
+
+	var lastStatus string
+
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-ready.C:
+			if len(notReady(client, b)) > 0 {
+				continue
+			}
+			if err := sdNotify("READY=1"); err != nil {
+				logger.Error().Err(err).Msg("notifying systemd")
+			}
+			ready.Stop()
+
+		case <-watchdog:
+			problems := notReady(client, b)
+
+			status := "ready"
+			if len(problems) > 0 {
+				status = strings.Join(problems, ", ")
+			}
+			if status != lastStatus {
+				if err := sdNotify("STATUS=" + status); err != nil {
+					logger.Error().Err(err).Msg("notifying systemd")
+				}
+				lastStatus = status
+			}
+
+			if len(problems) > 0 {
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				logger.Error().Err(err).Msg("pinging systemd watchdog")
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long to wait for writes to the config to settle
+// before reloading it.
+const watchDebounce = 500 * time.Millisecond
+
+// watchConfig watches the config at path, sending on the returned channel
+// when it may have changed. The directory is watched rather than the file
+// itself so that files replaced by renames or symlink swaps (as done by
+// editors and Kubernetes configmaps) keep being watched.
+func watchConfig(path string, stop <-chan struct{}) (<-chan struct{}, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	path = filepath.Clean(path)
+
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	changed := make(chan struct{}, 1)
+
+	go func() {
+		defer w.Close()
+
+		var timer <-chan time.Time
+		target, _ := filepath.EvalSymlinks(path)
+
+		for {
+			select {
+			case <-stop:
+				return
+
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+
+				// A configmap update swaps a symlink, so the file's name
+				// is never in an event, but its target changes.
+				next, _ := filepath.EvalSymlinks(path)
+				if filepath.Clean(ev.Name) != path && next == target {
+					continue
+				}
+				target = next
+
+				timer = time.After(watchDebounce)
+
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				logger.Error().Err(err).Msg("config watch")
+
+			case <-timer:
+				timer = nil
+
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return changed, nil
+}